@@ -2,71 +2,184 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	CmdKeys = "keys"
-	CmdPul  = "pull"
-	CmdPush = "push"
+	CmdKeys    = "keys"
+	CmdPul     = "pull"
+	CmdPush    = "push"
+	CmdGet     = "get"
+	CmdSet     = "set"
+	CmdDel     = "del"
+	CmdScan    = "scan"
+	CmdTTL     = "ttl"
+	CmdExpire  = "expire"
+	CmdConnect = "connect"
+	CmdCluster = "cluster"
 )
 
-var commands = []string{CmdKeys, CmdPul, CmdPush}
+var commands = []string{CmdKeys, CmdPul, CmdPush, CmdGet, CmdSet, CmdDel,
+	CmdScan, CmdTTL, CmdExpire, CmdConnect, CmdCluster}
+
+// KeyCommands take a key as the first argument
+var KeyCommands = []string{CmdGet, CmdSet, CmdDel, CmdTTL, CmdExpire}
+
+// Timeout of each command
+var Timeout = 3 * time.Second
+
+// ErrExit is returned by Run for exit and quit
+var ErrExit = errors.New("exit")
 
 type Command interface {
 	Execute(args ...string) (string, error)
 }
 
 func NewCommand(cmd string) (Command, error) {
+	base := baseCommand{client: GetEvolvestClient()}
 	switch cmd {
 	case CmdKeys:
-		return &KeysCommand{baseCommand{
-			client: GetEvolvestClient(),
-		}}, nil
-
+		return &KeysCommand{base}, nil
 	case CmdPul:
-		return &PullCommand{baseCommand{
-			client: GetEvolvestClient(),
-		}}, nil
+		return &PullCommand{base}, nil
 	case CmdPush:
-		return &PushCommand{baseCommand{
-			client: GetEvolvestClient(),
-		}}, nil
+		return &PushCommand{base}, nil
+	case CmdGet:
+		return &GetCommand{base}, nil
+	case CmdSet:
+		return &SetCommand{base}, nil
+	case CmdDel:
+		return &DelCommand{base}, nil
+	case CmdScan:
+		return &ScanCommand{base}, nil
+	case CmdTTL:
+		return &TTLCommand{base}, nil
+	case CmdExpire:
+		return &ExpireCommand{base}, nil
+	case CmdConnect:
+		return &ConnectCommand{base}, nil
+	case CmdCluster:
+		return &ClusterCommand{base}, nil
 	}
 
 	return nil, fmt.Errorf("cmd %s not support", cmd)
 
 }
 
-func ParseCommand(line string) (func(), error) {
-	worlds := strings.Fields(line)
-	cmd := worlds[0]
+// Run executes a command line, returns ErrExit for exit and quit
+func Run(line string) (string, error) {
+	words, err := SplitArgs(line)
+	if err != nil {
+		return "", err
+	}
+	if len(words) == 0 {
+		return "", nil
+	}
+	cmd := strings.ToLower(words[0])
+	if contains([]string{"exit", "quit"}, cmd) {
+		return "", ErrExit
+	}
+	if !contains(commands, cmd) {
+		return "", fmt.Errorf("command '%s' is not supported", words[0])
+	}
+	c, err := NewCommand(cmd)
+	if err != nil {
+		return "", err
+	}
+	return c.Execute(words[1:]...)
+}
 
-	if contains(commands, cmd) {
-		c, err := NewCommand(worlds[0])
-		if err != nil {
-			return nil, err
+func ParseCommand(line string) (func(), error) {
+	words, err := SplitArgs(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return func() {}, nil
+	}
+	cmd := strings.ToLower(words[0])
+	if !contains(commands, cmd) && !contains([]string{"exit", "quit"}, cmd) {
+		return nil, fmt.Errorf("command '%s' is not supported", words[0])
+	}
+	return func() {
+		ret, err := Run(line)
+		if err == ErrExit {
+			fmt.Println("Bye!")
+			os.Exit(0)
+		} else if err != nil {
+			fmt.Printf("err: %s\n", err.Error())
+			return
 		}
-		return func() {
+		fmt.Println(ret)
+	}, nil
+}
 
-			if ret, err := c.Execute(worlds[1:]...); err != nil {
-				fmt.Printf("err: %s\n", err.Error())
-				return
-			} else {
-				fmt.Println(ret)
+// SplitArgs splits the line by spaces, the words can be quoted by
+// double quotes with escapes like "a \"b\"\n", or single quotes
+func SplitArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
 			}
-		}, nil
-	} else if contains([]string{"exit", "quit"}, cmd) {
-		return func() {
-			fmt.Println("Bye!")
-			os.Exit(1)
-		}, nil
+		case c == '"':
+			inWord = true
+			closed := false
+			for i++; i < len(line); i++ {
+				if line[i] == '"' {
+					closed = true
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						word.WriteByte('\n')
+					case 't':
+						word.WriteByte('\t')
+					case 'r':
+						word.WriteByte('\r')
+					default:
+						word.WriteByte(line[i])
+					}
+					continue
+				}
+				word.WriteByte(line[i])
+			}
+			if !closed {
+				return nil, errors.New("unbalanced quotes")
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unbalanced quotes")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
 	}
-
-	return nil, fmt.Errorf("command '%s' is not supported", cmd)
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
 }
 
 func contains(array []string, e string) bool {
@@ -82,6 +195,10 @@ type baseCommand struct {
 	client *EvolvestClient
 }
 
+func (c *baseCommand) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), Timeout)
+}
+
 type KeysCommand struct {
 	baseCommand
 }
@@ -95,7 +212,7 @@ func (c *KeysCommand) Execute(args ...string) (string, error) {
 	} else {
 		return "", fmt.Errorf("wrong format, have multiple keys")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
 	return c.client.Keys(ctx, pattern)
 }
@@ -104,28 +221,206 @@ type PullCommand struct {
 	baseCommand
 }
 
+// Execute pulls all data, the output format can be given as json or table
 func (c *PullCommand) Execute(args ...string) (string, error) {
-	if len(args) != 0 {
-		return "", fmt.Errorf("wrong format, no required parameters")
+	if len(args) > 1 {
+		return "", fmt.Errorf("wrong format, usage: pull [json|table]")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
-	return c.client.Pull(ctx)
+	vals, err := c.client.admin.Pull(ctx)
+	if err != nil {
+		return "", err
+	}
+	format := c.client.Format
+	if len(args) == 1 {
+		format = args[0]
+	}
+	return formatValues(vals, format)
 }
 
 type PushCommand struct {
 	baseCommand
 }
 
+// Execute pushes "set <key> <val>", "del <key>", "expire <key> <unix millis>",
+// or the raw request "txid flag action key [base64 val]"
 func (c *PushCommand) Execute(args ...string) (string, error) {
-	if len(args) < 4 {
+	ctx, cancel := c.context()
+	defer cancel()
+	if len(args) >= 4 {
+		if _, err := strconv.ParseInt(args[0], 10, 64); err == nil {
+			return c.client.Push(ctx, strings.Join(args, " "))
+		}
+	}
+	if len(args) < 2 {
 		return "", fmt.Errorf("wrong format, missing required parameters")
 	}
-	text := fmt.Sprintf("%s %s %s %s %s",
-		args[0], args[1], args[2], args[3], args[4])
+	req := &common.TxRequest{
+		TxId:   utils.GenerateId(),
+		Flag:   common.FlagSync,
+		Action: strings.ToLower(args[0]),
+		Key:    args[1],
+	}
+	switch req.Action {
+	case common.SET, common.EXPIRE:
+		if len(args) != 3 {
+			return "", fmt.Errorf("wrong format, usage: push %s <key> <val>", req.Action)
+		}
+		req.Val = []byte(args[2])
+	case common.DEL:
+		if len(args) != 2 {
+			return "", fmt.Errorf("wrong format, usage: push del <key>")
+		}
+	default:
+		return "", fmt.Errorf("action %s not support", args[0])
+	}
+	return c.client.PushRequest(ctx, req)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+type GetCommand struct {
+	baseCommand
+}
+
+func (c *GetCommand) Execute(args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("wrong format, usage: get <key>")
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.client.Get(ctx, args[0])
+}
+
+type SetCommand struct {
+	baseCommand
+}
+
+// Execute sets the value, expiring after seconds if "ex <seconds>" given
+func (c *SetCommand) Execute(args ...string) (string, error) {
+	var ttl time.Duration
+	switch {
+	case len(args) == 2:
+	case len(args) == 4 && strings.ToLower(args[2]) == "ex":
+		secs, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || secs <= 0 {
+			return "", fmt.Errorf("invalid expire seconds '%s'", args[3])
+		}
+		ttl = time.Duration(secs) * time.Second
+	default:
+		return "", fmt.Errorf("wrong format, usage: set <key> <val> [ex <seconds>]")
+	}
+	ctx, cancel := c.context()
 	defer cancel()
-	return c.client.Push(ctx, text)
+	return c.client.Set(ctx, args[0], args[1], ttl)
+}
+
+type DelCommand struct {
+	baseCommand
+}
+
+func (c *DelCommand) Execute(args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("wrong format, usage: del <key> [key ...]")
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.client.Del(ctx, args...)
+}
+
+type ScanCommand struct {
+	baseCommand
+}
+
+// Execute lists the keys matching the glob pattern, 1000 at most by default
+func (c *ScanCommand) Execute(args ...string) (string, error) {
+	match, limit := "*", 1000
+	if len(args) > 2 {
+		return "", fmt.Errorf("wrong format, usage: scan [pattern] [limit]")
+	}
+	if len(args) > 0 {
+		match = args[0]
+	}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid limit '%s'", args[1])
+		}
+		limit = n
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	keys, err := c.client.Scan(ctx, match, limit)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "(empty)", nil
+	}
+	return strings.Join(keys, "\n"), nil
+}
+
+type TTLCommand struct {
+	baseCommand
+}
+
+func (c *TTLCommand) Execute(args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("wrong format, usage: ttl <key>")
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.client.TTL(ctx, args[0])
+}
+
+type ExpireCommand struct {
+	baseCommand
+}
+
+func (c *ExpireCommand) Execute(args ...string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("wrong format, usage: expire <key> <seconds>")
+	}
+	secs, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid expire seconds '%s'", args[1])
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.client.Expire(ctx, args[0], time.Duration(secs)*time.Second)
+}
+
+type ConnectCommand struct {
+	baseCommand
+}
+
+// Execute switches to another node by its server address, and the sync
+// address if given
+func (c *ConnectCommand) Execute(args ...string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", fmt.Errorf("wrong format, usage: connect <addr> [sync addr]")
+	}
+	syncAddr := ""
+	if len(args) == 2 {
+		syncAddr = args[1]
+	}
+	return c.client.Connect(args[0], syncAddr)
+}
+
+type ClusterCommand struct {
+	baseCommand
+}
+
+// Execute runs "status" comparing all nodes, or "diff <node> <node>"
+// listing the differing keys of two nodes
+func (c *ClusterCommand) Execute(args ...string) (string, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		return c.client.ClusterStatus(ctx)
+	case len(args) == 3 && args[0] == "diff":
+		return c.client.ClusterDiff(ctx, args[1], args[2])
+	}
+	return "", fmt.Errorf("wrong format, usage: cluster status | cluster diff <node> <node>")
 }
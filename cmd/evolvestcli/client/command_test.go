@@ -0,0 +1,66 @@
+package client
+
+import (
+	"github.com/edditen/evolvest/pkg/store"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"words", "  set a  b ", []string{"set", "a", "b"}, false},
+		{"empty", "", []string{}, false},
+		{"double quotes", `set a "hello world"`, []string{"set", "a", "hello world"}, false},
+		{"escapes", `set a "x\"y\n"`, []string{"set", "a", "x\"y\n"}, false},
+		{"single quotes", `set a 'x\n y'`, []string{"set", "a", `x\n y`}, false},
+		{"empty quotes", `set a ""`, []string{"set", "a", ""}, false},
+		{"joined", `a"b c"d`, []string{"ab cd"}, false},
+		{"unbalanced", `set a "b`, nil, true},
+		{"unbalanced single", `set a 'b`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitArgs(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SplitArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatValues(t *testing.T) {
+	vals := map[string]store.DataItem{
+		"b": {Val: []byte("2"), Ver: 2},
+		"a": {Val: []byte("x y"), Ver: 1},
+	}
+	out, err := formatValues(vals, FormatTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], `a    "x y"`) ||
+		!strings.HasPrefix(lines[2], "b") || lines[3] != "(2 keys)" {
+		t.Errorf("formatValues(table) = \n%s", out)
+	}
+
+	out, err = formatValues(vals, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"val": "x y"`) {
+		t.Errorf("formatValues(json) = %s", out)
+	}
+
+	if _, err = formatValues(vals, "xml"); err == nil {
+		t.Error("formatValues() unknown format, want error")
+	}
+}
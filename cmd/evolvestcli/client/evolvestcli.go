@@ -2,9 +2,17 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/edditen/evolvest/api/pb/evolvest"
-	"google.golang.org/grpc"
+	eclient "github.com/edditen/evolvest/pkg/client"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/store"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -18,62 +26,382 @@ func GetEvolvestClient() *EvolvestClient {
 	return evolvestClient
 }
 
+// EvolvestClient runs the admin commands on the sync port, and the data
+// commands on the server port of the connected node
 type EvolvestClient struct {
-	//conn   *grpc.ClientConn
-	client evolvest.EvolvestServiceClient
+	admin     *eclient.AdminClient
+	data      *eclient.Client
+	adminOpts eclient.AdminOptions
+	dataOpts  eclient.Options
+	addr      string
+	// Format of pull output, json or table
+	Format string
 }
 
 func NewEvolvestClient() *EvolvestClient {
-	return &EvolvestClient{}
+	return &EvolvestClient{Format: FormatJSON}
 }
 
 func StartClient(addr string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	fmt.Printf("connecting to %s\n", addr)
-	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure())
+	return dial(addr, eclient.AdminOptions{})
+}
+
+// StartSecureClient connects to the sync port with mutual TLS if conf
+// is not nil, and sends the operator token if not empty
+func StartSecureClient(addr string, conf *tls.Config, token string) error {
+	return dial(addr, eclient.AdminOptions{TLS: conf, Token: token})
+}
+
+func dial(addr string, opts eclient.AdminOptions) error {
+	fmt.Fprintf(os.Stderr, "connecting to %s\n", addr)
+	admin, err := eclient.NewAdminClient(addr, opts)
 	if err != nil {
 		return err
 	}
-	evolvestClient.client = evolvest.NewEvolvestServiceClient(conn)
+	if evolvestClient.admin != nil {
+		evolvestClient.admin.Close()
+	}
+	evolvestClient.admin = admin
+	evolvestClient.adminOpts = opts
 	return nil
 }
 
-func (e *EvolvestClient) Keys(ctx context.Context, pattern string) (keys string, err error) {
-	req := &evolvest.KeysRequest{Pattern: pattern}
+// StartDataClient connects to the server port for the data commands,
+// the connection is made lazily
+func StartDataClient(addr string, opts eclient.Options) error {
+	if strings.HasPrefix(addr, "/") {
+		opts.Network = "unix"
+	}
+	opts.Addrs = []string{addr}
+	data, err := eclient.New(opts)
+	if err != nil {
+		return err
+	}
+	if evolvestClient.data != nil {
+		evolvestClient.data.Close()
+	}
+	evolvestClient.data = data
+	evolvestClient.dataOpts = opts
+	evolvestClient.addr = addr
+	return nil
+}
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	resp, err := e.client.Keys(ctx, req)
+// Connect switches to another node, the sync port is kept if syncAddr
+// is empty
+func (e *EvolvestClient) Connect(addr, syncAddr string) (string, error) {
+	if err := StartDataClient(addr, e.dataOpts); err != nil {
+		return "", err
+	}
+	if syncAddr != "" {
+		if err := dial(syncAddr, e.adminOpts); err != nil {
+			return "", err
+		}
+	}
+	return "ok", nil
+}
+
+// Addr returns the server address connected
+func (e *EvolvestClient) Addr() string {
+	return e.addr
+}
+
+func (e *EvolvestClient) Keys(ctx context.Context, pattern string) (keys string, err error) {
+	ks, err := e.admin.Keys(ctx, pattern)
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%v", resp.GetKeys()), nil
+	return fmt.Sprintf("%v", ks), nil
+}
+
+const (
+	FormatJSON  = "json"
+	FormatTable = "table"
+)
 
+// item is the readable form of store.DataItem
+type item struct {
+	Val string `json:"val"`
+	Ver int64  `json:"ver"`
+	Exp int64  `json:"exp,omitempty"`
 }
 
 func (e *EvolvestClient) Pull(ctx context.Context) (values string, err error) {
-	req := &evolvest.PullRequest{}
-
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	resp, err := e.client.Pull(ctx, req)
+	vals, err := e.admin.Pull(ctx)
 	if err != nil {
 		return "", err
 	}
-	return string(resp.Values), nil
+	return formatValues(vals, e.Format)
 }
 
-func (e *EvolvestClient) Push(ctx context.Context, txCmd string) (ok string, err error) {
-	req := &evolvest.PushRequest{
-		TxCmds: []string{txCmd},
+// formatValues prints the values as indented json or a table sorted by key
+func formatValues(vals map[string]store.DataItem, format string) (string, error) {
+	for k, v := range vals {
+		// the compressed ones are printed as is if corrupted
+		if b, err := v.Value(); err == nil {
+			v.Val = b
+			vals[k] = v
+		}
 	}
+	switch format {
+	case FormatJSON:
+		items := make(map[string]item, len(vals))
+		for k, v := range vals {
+			items[k] = item{Val: string(v.Val), Ver: v.Ver, Exp: v.Exp}
+		}
+		data, err := json.MarshalIndent(items, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case FormatTable:
+		keys := make([]string, 0, len(vals))
+		for k := range vals {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tVERSION\tEXPIRE")
+		for _, k := range keys {
+			v := vals[k]
+			exp := "-"
+			if v.Exp > 0 {
+				exp = time.Unix(0, v.Exp*int64(time.Millisecond)).Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%q\t%d\t%s\n", k, v.Val, v.Ver, exp)
+		}
+		w.Flush()
+		return fmt.Sprintf("%s(%d keys)", b.String(), len(keys)), nil
+	}
+	return "", fmt.Errorf("unknown format '%s'", format)
+}
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	_, err = e.client.Push(ctx, req)
+// Push sends a request in format "txid flag action key [base64 val]"
+func (e *EvolvestClient) Push(ctx context.Context, txCmd string) (ok string, err error) {
+	req, err := store.ParseTx(txCmd)
 	if err != nil {
 		return "", err
 	}
+	return e.PushRequest(ctx, req)
+}
+
+// PushRequest sends the request to the node as a peer
+func (e *EvolvestClient) PushRequest(ctx context.Context, req *common.TxRequest) (ok string, err error) {
+	if err = e.admin.Push(ctx, req); err != nil {
+		return "", err
+	}
 	return "ok", nil
 }
+
+func (e *EvolvestClient) dataClient() (*eclient.Client, error) {
+	if e.data == nil {
+		return nil, errors.New("not connected to server port, use `connect <addr>`")
+	}
+	return e.data, nil
+}
+
+func (e *EvolvestClient) Get(ctx context.Context, key string) (string, error) {
+	c, err := e.dataClient()
+	if err != nil {
+		return "", err
+	}
+	val, err := c.Get(ctx, key)
+	if err == eclient.ErrNil {
+		return "(nil)", nil
+	} else if err != nil {
+		return "", err
+	}
+	return string(val), nil
+}
+
+// Set sets the value, which expires after ttl if ttl is positive
+func (e *EvolvestClient) Set(ctx context.Context, key, val string, ttl time.Duration) (string, error) {
+	c, err := e.dataClient()
+	if err != nil {
+		return "", err
+	}
+	if ttl > 0 {
+		err = c.SetEX(ctx, key, val, ttl)
+	} else {
+		err = c.Set(ctx, key, val)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "OK", nil
+}
+
+func (e *EvolvestClient) Del(ctx context.Context, keys ...string) (string, error) {
+	c, err := e.dataClient()
+	if err != nil {
+		return "", err
+	}
+	n, err := c.Del(ctx, keys...)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(integer) %d", n), nil
+}
+
+func (e *EvolvestClient) Expire(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	c, err := e.dataClient()
+	if err != nil {
+		return "", err
+	}
+	ok, err := c.Expire(ctx, key, ttl)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "(integer) 0", nil
+	}
+	return "(integer) 1", nil
+}
+
+// TTL returns the remaining seconds, -1 if key has no expiry and -2
+// if not exists
+func (e *EvolvestClient) TTL(ctx context.Context, key string) (string, error) {
+	c, err := e.dataClient()
+	if err != nil {
+		return "", err
+	}
+	ttl, err := c.TTL(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if ttl < 0 {
+		return fmt.Sprintf("(integer) %d", ttl), nil
+	}
+	return fmt.Sprintf("(integer) %d", (ttl+500*time.Millisecond)/time.Second), nil
+}
+
+// errScanLimit stops scanning when enough keys are found
+var errScanLimit = errors.New("scan limit reached")
+
+// Scan returns at most limit keys matching the glob pattern
+func (e *EvolvestClient) Scan(ctx context.Context, match string, limit int) ([]string, error) {
+	c, err := e.dataClient()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	err = c.Scan(ctx, match, 100, func(key string) error {
+		keys = append(keys, key)
+		if limit > 0 && len(keys) >= limit {
+			return errScanLimit
+		}
+		return nil
+	})
+	if err != nil && err != errScanLimit {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ClusterStatus queries all nodes of the cluster
+func (e *EvolvestClient) ClusterStatus(ctx context.Context) (string, error) {
+	statuses, err := e.admin.Status(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	return formatStatus(statuses), nil
+}
+
+// formatStatus prints a row for each node, the divergent and unreachable
+// nodes are marked with * in the first column
+func formatStatus(statuses []store.NodeStatus) string {
+	divergent := store.Divergent(statuses)
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, " \tADDR\tNODE\tROLE\tKEYS\tLAST TX\tPENDING\tLAG\tDIGESTS\tSTATE")
+	marked := 0
+	for _, st := range statuses {
+		mark, state := " ", "ok"
+		if st.Error != "" {
+			mark, state = "*", "unreachable: "+st.Error
+		} else if groups, ok := divergent[st.Addr]; ok {
+			mark, state = "*", "divergent: "+strings.Join(groups, ",")
+		}
+		if mark != " " {
+			marked++
+		}
+
+		var pending int64
+		var lag float64
+		for _, peer := range st.Peers {
+			pending += peer.Pending
+			if peer.LagSeconds > lag {
+				lag = peer.LagSeconds
+			}
+		}
+		groups := make([]string, 0, len(st.Digests))
+		for g := range st.Digests {
+			groups = append(groups, g)
+		}
+		sort.Strings(groups)
+		digests := make([]string, 0, len(groups))
+		for _, g := range groups {
+			digest := st.Digests[g][:8]
+			if g != store.DigestAll {
+				digest = g + "=" + digest
+			}
+			digests = append(digests, digest)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%.1fs\t%s\t%s\n", mark, st.Addr, st.NodeId,
+			st.Role, st.Keys, st.LastTxId, pending, lag, strings.Join(digests, " "), state)
+	}
+	w.Flush()
+	if marked > 0 {
+		return fmt.Sprintf("%s(%d of %d nodes need attention)", b.String(), marked, len(statuses))
+	}
+	return fmt.Sprintf("%s(%d nodes consistent)", b.String(), len(statuses))
+}
+
+// ClusterDiff lists the keys differing between two nodes, which are given
+// by sync address or node id
+func (e *EvolvestClient) ClusterDiff(ctx context.Context, nodeA, nodeB string) (string, error) {
+	statuses, err := e.admin.Status(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	addrs := []string{nodeA, nodeB}
+	vals := make([]map[string]store.DataItem, 2)
+	for i, node := range addrs {
+		for _, st := range statuses {
+			if st.NodeId == node && st.NodeId != "" {
+				addrs[i] = st.Addr
+			}
+		}
+		admin, err := eclient.NewAdminClient(addrs[i], e.adminOpts)
+		if err != nil {
+			return "", err
+		}
+		vals[i], err = admin.Pull(ctx)
+		admin.Close()
+		if err != nil {
+			return "", fmt.Errorf("pull from %s error, %v", addrs[i], err)
+		}
+	}
+	return formatDiff(addrs[0], addrs[1], store.DiffValues(vals[0], vals[1])), nil
+}
+
+func formatDiff(addrA, addrB string, diffs []store.KeyDiff) string {
+	if len(diffs) == 0 {
+		return "(identical)"
+	}
+	version := func(ver int64) string {
+		if ver == 0 {
+			return "-"
+		}
+		return fmt.Sprint(ver)
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "KEY\t%s\t%s\n", addrA, addrB)
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Key, version(d.VerA), version(d.VerB))
+	}
+	w.Flush()
+	return fmt.Sprintf("%s(%d keys differ)", b.String(), len(diffs))
+}
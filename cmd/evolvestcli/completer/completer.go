@@ -1,27 +1,124 @@
 package completer
 
 import (
+	"context"
 	"fmt"
 	"github.com/c-bata/go-prompt"
 	"github.com/edditen/evolvest/cmd/evolvestcli/client"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// keysLimit is the max count of keys suggested
+	keysLimit = 50
+	// keysTTL is how long the keys of a prefix are cached
+	keysTTL      = 3 * time.Second
+	keysTimeout  = 300 * time.Millisecond
+	keysCacheMax = 100
+)
+
+var suggests = []prompt.Suggest{
+	{Text: "get", Description: "<key> 'Get value of key'"},
+	{Text: "set", Description: "<key> <val> [ex <seconds>] 'Set value of key'"},
+	{Text: "del", Description: "<key> [key ...] 'Delete keys'"},
+	{Text: "scan", Description: "[pattern] [limit] 'Keys of glob pattern'"},
+	{Text: "ttl", Description: "<key> 'Seconds to live of key'"},
+	{Text: "expire", Description: "<key> <seconds> 'Set seconds to live of key'"},
+	{Text: "keys", Description: "<pattern> 'Keys of regular expression on sync port'"},
+	{Text: "pull", Description: "[json|table] 'Pull values'"},
+	{Text: "push", Description: "set|del|expire <key> [val] 'Push Command'"},
+	{Text: "cluster", Description: "status | diff <node> <node> 'Compare nodes of cluster'"},
+	{Text: "connect", Description: "<addr> [sync addr] 'Switch to another node'"},
+	{Text: "exit", Description: "Exit the prompt"},
+}
+
+type cachedKeys struct {
+	keys    []string
+	fetched time.Time
+}
+
+// Completer suggests the commands, and the keys fetched from the server
+// for the commands taking a key
 type Completer struct {
+	mu    sync.Mutex
+	cache map[string]cachedKeys
+	addr  string
 }
 
 func NewCompleter() *Completer {
-	return &Completer{}
+	return &Completer{cache: make(map[string]cachedKeys)}
 }
 
 func (c *Completer) Complete(d prompt.Document) []prompt.Suggest {
-	s := []prompt.Suggest{
-		{Text: "keys", Description: "<pattern> 'Keys of pattern'"},
-		{Text: "pull", Description: "'Pull values'"},
-		{Text: "push", Description: "<txid> <flag> <cmd> <key> [val] 'Push Command'"},
-		{Text: "exit", Description: "Exit the prompt"},
+	words := strings.Fields(d.TextBeforeCursor())
+	word := d.GetWordBeforeCursor()
+	if len(words) == 0 || (len(words) == 1 && word != "") {
+		return prompt.FilterHasPrefix(suggests, word, true)
+	}
+	// the key is the second word, or any word of del
+	cmd := strings.ToLower(words[0])
+	n := len(words)
+	if word == "" {
+		n++
+	}
+	if n == 2 && contains(client.KeyCommands, cmd) || n >= 2 && cmd == client.CmdDel {
+		s := make([]prompt.Suggest, 0)
+		for _, key := range c.keys(word) {
+			s = append(s, prompt.Suggest{Text: key})
+		}
+		return s
+	}
+	return []prompt.Suggest{}
+}
+
+// keys returns the keys with prefix, which are cached for a while
+func (c *Completer) keys(prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cli := client.GetEvolvestClient()
+	if c.addr != cli.Addr() {
+		// switched to another node
+		c.addr = cli.Addr()
+		c.cache = make(map[string]cachedKeys)
+	}
+	if cached, ok := c.cache[prefix]; ok && time.Since(cached.fetched) < keysTTL {
+		return cached.keys
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), keysTimeout)
+	defer cancel()
+	keys, err := cli.Scan(ctx, escapeGlob(prefix)+"*", keysLimit)
+	if err != nil {
+		return nil
+	}
+	if len(c.cache) >= keysCacheMax {
+		c.cache = make(map[string]cachedKeys)
+	}
+	c.cache[prefix] = cachedKeys{keys: keys, fetched: time.Now()}
+	return keys
+}
+
+// escapeGlob escapes the special characters of glob pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func contains(array []string, e string) bool {
+	for _, item := range array {
+		if item == e {
+			return true
+		}
 	}
-	return prompt.FilterHasPrefix(s, d.GetWordBeforeCursor(), true)
+	return false
 }
 
 func Executor(s string) {
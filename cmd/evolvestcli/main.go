@@ -1,19 +1,60 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/c-bata/go-prompt"
-	"github.com/c-bata/go-prompt/completer"
 	"github.com/edditen/evolvest/cmd/evolvestcli/client"
 	ecli "github.com/edditen/evolvest/cmd/evolvestcli/completer"
+	eclient "github.com/edditen/evolvest/pkg/client"
+	"github.com/edditen/evolvest/pkg/common/config"
 	"log"
+	"os"
+	"strings"
 )
 
+type args struct {
+	addr       string
+	serverAddr string
+	tlsConf    *config.TLSConfig
+	token      string
+	user       string
+	password   string
+	cluster    bool
+	command    string
+	format     string
+}
+
 func main() {
-	addr := parseArgs()
+	a := parseArgs()
 
-	startRpc(addr)
+	client.GetEvolvestClient().Format = a.format
+	conf := loadTLS(a.tlsConf)
+	if err := client.StartSecureClient(a.addr, conf, a.token); err != nil {
+		log.Fatalf("connect '%s' error, %v\n", a.addr, err)
+	}
+	err := client.StartDataClient(a.serverAddr, eclient.Options{
+		Username: a.user,
+		Password: a.password,
+		TLS:      conf,
+		Cluster:  a.cluster,
+	})
+	if err != nil {
+		log.Fatalf("connect '%s' error, %v\n", a.serverAddr, err)
+	}
+
+	if a.command != "" {
+		if !execute(a.command) {
+			os.Exit(1)
+		}
+		return
+	}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		runScript()
+		return
+	}
 
 	c := ecli.NewCompleter()
 	fmt.Printf("evolve-prompt\n")
@@ -25,19 +66,78 @@ func main() {
 		prompt.OptionTitle("evolve-prompt: interactive client"),
 		prompt.OptionPrefix(">>> "),
 		prompt.OptionInputTextColor(prompt.Yellow),
-		prompt.OptionCompletionWordSeparator(completer.FilePathCompletionSeparator),
 	)
 	p.Run()
 }
 
-func parseArgs() (addr string) {
-	flag.StringVar(&addr, "a", "127.0.0.1:8763", "address")
+func parseArgs() *args {
+	a := &args{tlsConf: &config.TLSConfig{}}
+	flag.StringVar(&a.addr, "a", "127.0.0.1:8763", "address of sync port")
+	flag.StringVar(&a.serverAddr, "s", "127.0.0.1:8762", "address of server port, or path of unix socket")
+	flag.StringVar(&a.tlsConf.CertFile, "cert", "", "client certificate file for mutual tls")
+	flag.StringVar(&a.tlsConf.KeyFile, "key", "", "client key file for mutual tls")
+	flag.StringVar(&a.tlsConf.CAFile, "ca", "", "ca file verifying the server, enables tls")
+	flag.StringVar(&a.tlsConf.ServerName, "server-name", "", "server name verifying the server")
+	flag.StringVar(&a.token, "token", "", "token of the sync port")
+	flag.StringVar(&a.user, "user", "", "user of the server port")
+	flag.StringVar(&a.password, "pass", "", "password of the server port")
+	flag.BoolVar(&a.cluster, "cluster", false, "follow the slots of cluster")
+	flag.StringVar(&a.command, "c", "", "run the command and exit")
+	flag.StringVar(&a.format, "o", client.FormatJSON, "output format of pull, json or table")
+	flag.DurationVar(&client.Timeout, "timeout", client.Timeout, "timeout of each command")
 	flag.Parse()
-	return
+	return a
 }
 
-func startRpc(addr string) {
-	if err := client.StartClient(addr); err != nil {
-		log.Fatalf("connect '%s' error, %v\n", addr, err)
+func loadTLS(tlsConf *config.TLSConfig) *tls.Config {
+	if tlsConf.CAFile == "" {
+		return nil
+	}
+	conf, err := tlsConf.SyncClientConfig()
+	if err != nil {
+		log.Fatalf("load tls error, %v\n", err)
+	}
+	return conf
+}
+
+// execute runs a command line, and returns false if failed
+func execute(line string) bool {
+	ret, err := client.Run(line)
+	if err == client.ErrExit {
+		return true
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "err: %s\n", err.Error())
+		return false
+	}
+	if ret != "" {
+		fmt.Println(ret)
+	}
+	return true
+}
+
+// runScript runs the commands from stdin line by line, skips the empty
+// lines and comments starting with #, exits with 1 if any failed
+func runScript() {
+	failed := false
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if words, _ := client.SplitArgs(line); len(words) > 0 &&
+			(words[0] == "exit" || words[0] == "quit") {
+			break
+		}
+		if !execute(line) {
+			failed = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("read script error, %v\n", err)
+	}
+	if failed {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,92 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Backup asks the running server to write a backup to the dir of name
+// under the backups of its data dir, the server is found by admin port
+// of config if adminAddr is empty
+func Backup(name, adminAddr string) error {
+	adminAddr, err := resolveAdmin(adminAddr)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+adminAddr+"/backup?to="+url.QueryEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	setAuth(req)
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request backup error")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "read response error")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup failed, %s", body)
+	}
+	fmt.Printf("%s", body)
+	return nil
+}
+
+// Restore rebuilds the data dir of config from the backup in dir, until
+// is a tx id or RFC3339 time, empty for the whole backup
+func Restore(dir, until string) error {
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var bound int64
+	if until != "" {
+		if bound, err = store.ParseTxBound(until); err != nil {
+			return err
+		}
+	}
+	result, err := store.Restore(conf, dir, bound)
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(result)
+	fmt.Println(string(data))
+	return nil
+}
+
+func loadConfig() (*config.Config, error) {
+	conf := config.NewConfig(viper.GetString("config"))
+	if err := conf.Init(); err != nil {
+		return nil, errors.Wrap(err, "init config error")
+	}
+	return conf, nil
+}
+
+// resolveAdmin returns the admin address, which is taken from config if
+// not given
+func resolveAdmin(adminAddr string) (string, error) {
+	if adminAddr != "" {
+		return adminAddr, nil
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	host := conf.Host
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	return host + ":" + conf.AdminPort, nil
+}
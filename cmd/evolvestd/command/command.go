@@ -2,8 +2,11 @@ package command
 
 import (
 	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/embed/admin"
 	"github.com/edditen/evolvest/embed/rpc"
 	"github.com/edditen/evolvest/embed/server"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/cluster"
 	"github.com/edditen/evolvest/pkg/common/config"
 	"github.com/edditen/evolvest/pkg/store"
 	"github.com/pkg/errors"
@@ -11,13 +14,17 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 type Evolvestd struct {
 	config         *config.Config
+	cluster        *cluster.Cluster
+	acl            *acl.ACL
 	syncer         *store.Syncer
 	syncServer     *rpc.SyncServer
 	evolvestServer *server.EvolvestServer
+	adminServer    *admin.AdminServer
 }
 
 func NewEvolvestd() *Evolvestd {
@@ -36,7 +43,17 @@ func (e *Evolvestd) Init() (err error) {
 		return errors.Wrap(err, "init config error")
 	}
 
-	e.syncer = store.NewSyncer(e.config)
+	e.cluster = cluster.NewCluster(e.config)
+	if err = e.cluster.Init(); err != nil {
+		return errors.Wrap(err, "init cluster error")
+	}
+
+	e.acl = acl.NewACL(e.config)
+	if err = e.acl.Init(); err != nil {
+		return errors.Wrap(err, "init acl error")
+	}
+
+	e.syncer = store.NewSyncer(e.config, e.cluster)
 	if err = e.syncer.Init(); err != nil {
 		return errors.Wrap(err, "init syncer error")
 	}
@@ -46,35 +63,49 @@ func (e *Evolvestd) Init() (err error) {
 		return errors.Wrap(err, "init syncServer error")
 	}
 
-	e.evolvestServer = server.NewEvolvestServer(e.config, e.syncer)
+	e.evolvestServer = server.NewEvolvestServer(e.config, e.syncer, e.cluster, e.acl)
 	if err = e.evolvestServer.Init(); err != nil {
 		return errors.Wrap(err, "init evolvestServer error")
 	}
 
+	e.adminServer = admin.NewAdminServer(e.config, e.syncer, e.acl)
+	if err = e.adminServer.Init(); err != nil {
+		return errors.Wrap(err, "init adminServer error")
+	}
+
 	return nil
 }
 
 func (e *Evolvestd) Run(errC chan<- error) {
 	go e.config.Run(errC)
+	go e.cluster.Run(errC)
+	go e.acl.Run(errC)
 	go e.syncer.Run(errC)
 	go e.syncServer.Run(errC)
 	go e.evolvestServer.Run(errC)
+	go e.adminServer.Run(errC)
 }
 
+// Shutdown stops the components in order: the clients are drained first,
+// then the queued requests are persisted and pushed to peers, and the sync
+// port is stopped at last so that peers are served meanwhile.
 func (e *Evolvestd) Shutdown() {
+	e.adminServer.Shutdown()
 	e.evolvestServer.Shutdown()
-	e.syncServer.Shutdown()
 	e.syncer.Shutdown()
+	e.syncServer.Shutdown()
+	e.acl.Shutdown()
+	e.cluster.Shutdown()
 	e.config.Shutdown()
 }
 
 func (e *Evolvestd) WaitSignal(errC <-chan error, hook func()) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	select {
-	case <-c:
-		log.Println("Server received interrupt signal")
+	case sig := <-c:
+		log.Println("Server received signal", sig)
 		hook()
 		os.Exit(0)
 	case err := <-errC:
@@ -0,0 +1,141 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/dump"
+	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Export writes the data to file, which is not stdout since the logs are
+// printed there. The data is read from the running server, or the data
+// dir of config if offline.
+func Export(to, format, adminAddr string, offline bool) (err error) {
+	if format == "" {
+		format = dump.FormatOf(to)
+	}
+	out, err := os.Create(to)
+	if err != nil {
+		return errors.Wrap(err, "create output error")
+	}
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	if !offline {
+		body, err := request(http.MethodGet, adminAddr, "/export?format="+url.QueryEscape(format), nil)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = io.Copy(out, body)
+		return errors.Wrap(err, "export error")
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	enc, err := dump.NewEncoder(format, out)
+	if err != nil {
+		return err
+	}
+	n, err := store.ExportDataDir(conf, enc)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", n)
+	return nil
+}
+
+// Import reads the data from file, "-" for stdin. The keys are written
+// to the running server, or appended to the data dir of config if offline.
+func Import(from, format, adminAddr string, offline bool) error {
+	if format == "" {
+		format = dump.FormatOf(from)
+	}
+	var in io.Reader = os.Stdin
+	if from != "-" {
+		f, err := os.Open(from)
+		if err != nil {
+			return errors.Wrap(err, "open input error")
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if !offline {
+		body, err := request(http.MethodPost, adminAddr, "/import?format="+url.QueryEscape(format), in)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = io.Copy(os.Stdout, body)
+		return err
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	dec, err := dump.NewDecoder(format, in)
+	if err != nil {
+		return err
+	}
+	result, err := store.ImportDataDir(conf, dec)
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(result)
+	fmt.Println(string(data))
+	return nil
+}
+
+// request calls the admin api, and returns the body if succeeded
+func request(method, adminAddr, uri string, body io.Reader) (io.ReadCloser, error) {
+	adminAddr, err := resolveAdmin(adminAddr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, "http://"+adminAddr+uri, body)
+	if err != nil {
+		return nil, err
+	}
+	setAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request admin error")
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s %s failed, %s", method, uri, msg)
+	}
+	return resp.Body, nil
+}
+
+// setAuth sets the credentials of admin api from env, the user defaults
+// to the default user if only the password is given
+func setAuth(req *http.Request) {
+	if token := os.Getenv(common.EnvAdminToken); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+	if pass := os.Getenv(common.EnvAdminPass); pass != "" {
+		user := os.Getenv(common.EnvAdminUser)
+		if user == "" {
+			user = acl.DefaultUser
+		}
+		req.SetBasicAuth(user, pass)
+	}
+}
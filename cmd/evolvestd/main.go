@@ -14,6 +14,10 @@ func main() {
 	)
 
 	cmd.AddCommand(GetServeCommand())
+	cmd.AddCommand(GetBackupCommand())
+	cmd.AddCommand(GetRestoreCommand())
+	cmd.AddCommand(GetExportCommand())
+	cmd.AddCommand(GetImportCommand())
 
 	if err := cmd.Execute(); err != nil {
 		log.Fatalf("cmd execute error: %+v\n", err)
@@ -41,3 +45,77 @@ func GetServeCommand() *cobra.Command {
 
 	return cmd
 }
+
+func GetBackupCommand() *cobra.Command {
+	var to, admin string
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Back up the data of a running server",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := command.Backup(to, admin); err != nil {
+				log.Fatalf("Backup error: %+v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&to, "to", "", "dir of backup under backups of data_dir on the server host")
+	cmd.Flags().StringVar(&admin, "admin", "", "admin address of server, taken from config if empty")
+	cmd.MarkFlagRequired("to")
+	return cmd
+}
+
+func GetRestoreCommand() *cobra.Command {
+	var from, until string
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the data dir from a backup, the server should be stopped",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := command.Restore(from, until); err != nil {
+				log.Fatalf("Restore error: %+v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "dir of backup")
+	cmd.Flags().StringVar(&until, "until", "", "restore until the tx id or RFC3339 time")
+	cmd.MarkFlagRequired("from")
+	return cmd
+}
+
+func GetExportCommand() *cobra.Command {
+	var to, format, admin string
+	var offline bool
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the data in rdb or jsonl format",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := command.Export(to, format, admin, offline); err != nil {
+				log.Fatalf("Export error: %+v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&to, "to", "", "output file")
+	cmd.Flags().StringVar(&format, "format", "", "rdb or jsonl, by extension of file if empty")
+	cmd.Flags().StringVar(&admin, "admin", "", "admin address of server, taken from config if empty")
+	cmd.Flags().BoolVar(&offline, "offline", false, "read the data dir instead of the server")
+	cmd.MarkFlagRequired("to")
+	return cmd
+}
+
+func GetImportCommand() *cobra.Command {
+	var from, format, admin string
+	var offline bool
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import the data in rdb or jsonl format",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := command.Import(from, format, admin, offline); err != nil {
+				log.Fatalf("Import error: %+v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "input file, - for stdin")
+	cmd.Flags().StringVar(&format, "format", "", "rdb or jsonl, by extension of file if empty")
+	cmd.Flags().StringVar(&admin, "admin", "", "admin address of server, taken from config if empty")
+	cmd.Flags().BoolVar(&offline, "offline", false, "append to the data dir, the server should be stopped")
+	cmd.MarkFlagRequired("from")
+	return cmd
+}
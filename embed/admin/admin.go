@@ -0,0 +1,293 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/dump"
+	"github.com/edditen/evolvest/pkg/metrics"
+	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"strings"
+)
+
+type AdminServer struct {
+	cfg    *config.Config
+	syncer *store.Syncer
+	acl    *acl.ACL
+	mux    *http.ServeMux
+	srv    *http.Server
+}
+
+func NewAdminServer(conf *config.Config, syncer *store.Syncer, a *acl.ACL) *AdminServer {
+	return &AdminServer{
+		cfg:    conf,
+		syncer: syncer,
+		acl:    a,
+		mux:    http.NewServeMux(),
+	}
+}
+
+func (s *AdminServer) Init() error {
+	log.Println("[Init] init adminServer")
+	s.mux.HandleFunc("/health", s.health)
+	s.mux.HandleFunc("/ready", s.ready)
+	s.mux.HandleFunc("/info", s.info)
+	s.mux.HandleFunc("/cluster/status", s.clusterStatus)
+	s.mux.HandleFunc("/snapshot", post(s.snapshot))
+	s.mux.HandleFunc("/compact", post(s.compact))
+	s.mux.HandleFunc("/backup", post(s.authorize("backup",
+		[]string{acl.CategoryAdmin, acl.CategorySlow, acl.CategoryDangerous}, s.backup)))
+	// the whole data is read or written, as the users allowed on all keys
+	s.mux.HandleFunc("/export", s.authorize("export",
+		[]string{acl.CategoryAdmin, acl.CategoryRead, acl.CategorySlow}, s.export))
+	s.mux.HandleFunc("/import", post(s.authorize("import",
+		[]string{acl.CategoryAdmin, acl.CategoryWrite, acl.CategorySlow, acl.CategoryDangerous}, s.importData)))
+	s.mux.HandleFunc("/anti-entropy", post(s.antiEntropy))
+	s.mux.Handle("/metrics", promhttp.Handler())
+	s.registerMetrics()
+
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	s.srv = &http.Server{
+		Addr:    s.cfg.Host + ":" + s.cfg.AdminPort,
+		Handler: s.mux,
+	}
+	return nil
+}
+
+func (s *AdminServer) Run(errC chan<- error) {
+	log.Println("[Run] run adminServer")
+	log.Println("listen admin server at", s.srv.Addr)
+	if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		errC <- err
+	}
+}
+
+func (s *AdminServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownDuration())
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		log.Println("[Shutdown] shutdown adminServer error:", err)
+	}
+	log.Println("[Shutdown] shutdown adminServer")
+}
+
+func (s *AdminServer) registerMetrics() {
+	metrics.RegisterGaugeFunc("syncer_queue_depth",
+		"Requests waiting to be applied by syncer.",
+		func() float64 { return float64(s.syncer.QueueDepth()) })
+	metrics.RegisterGaugeFunc("keys",
+		"Count of keys.",
+		func() float64 { return float64(s.syncer.Len()) })
+	metrics.RegisterGaugeFunc("memory_bytes",
+		"Estimated memory used by keys and values.",
+		func() float64 { return float64(s.syncer.Size()) })
+	metrics.RegisterGaugeVecFunc("replication", "lag_seconds",
+		"Seconds the oldest command not acknowledged by peer has been queued.",
+		"peer", s.syncer.ReplicationLag)
+}
+
+// post rejects the requests not in POST method, since they change states
+func post(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+				"error": "method not allowed",
+			})
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		etlog.Log.WithError(err).Warn("write admin response error")
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
+func (s *AdminServer) health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+func (s *AdminServer) ready(w http.ResponseWriter, r *http.Request) {
+	ready := s.syncer.Ready()
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"ready": ready,
+	})
+}
+
+func (s *AdminServer) info(w http.ResponseWriter, r *http.Request) {
+	role, upstream, state := s.syncer.Replicator.Role()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"node_id":    utils.ServId(),
+		"role":       role,
+		"upstream":   upstream,
+		"link_state": state,
+		"peers":      s.syncer.Peers(),
+		"replicas":   s.syncer.Replicator.Replicas(),
+		"last_tx_id": s.syncer.LastTxId(),
+		"keys":       s.syncer.Len(),
+		"ready":      s.syncer.Ready(),
+	})
+}
+
+// clusterStatus queries all nodes, and reports the ones whose digests
+// differ from the majority
+func (s *AdminServer) clusterStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := s.syncer.ClusterStatus()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"nodes":     statuses,
+		"divergent": store.Divergent(statuses),
+	})
+}
+
+func (s *AdminServer) snapshot(w http.ResponseWriter, r *http.Request) {
+	if err := s.syncer.Snapshot(); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok": true,
+	})
+}
+
+// backup writes a backup to the dir given by "to" under the backups of
+// data dir on the server host
+func (s *AdminServer) backup(w http.ResponseWriter, r *http.Request) {
+	dir, err := backupDir(s.cfg.DataDir, r.URL.Query().Get("to"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	manifest, err := s.syncer.Backup(dir)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+// backupDir returns the dir of backup name under the backups of data dir,
+// the names out of it are refused, so that no file of the host is
+// overwritten by the callers
+func backupDir(dataDir, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("missing backup dir 'to'")
+	}
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(name) || clean == "." || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("backup dir %s is not relative under %s", name, common.DirBackups)
+	}
+	return filepath.Join(dataDir, common.DirBackups, clean), nil
+}
+
+// export streams the data in the format given, rdb or jsonl
+func (s *AdminServer) export(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = dump.FormatJSONL
+	}
+	if format == dump.FormatRDB {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	enc, err := dump.NewEncoder(format, w)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	// the status is sent already, a broken output is told by the client
+	if n, err := store.Export(s.syncer.Stores(), enc); err != nil {
+		etlog.Log.WithError(err).WithField("exported", n).Warn("export error")
+	}
+}
+
+// importData reads the body in the format given, and writes the keys
+func (s *AdminServer) importData(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = dump.FormatJSONL
+	}
+	dec, err := dump.NewDecoder(format, r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	result, err := s.syncer.Import(dec)
+	if err == store.ErrReadOnly {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  err.Error(),
+			"result": result,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *AdminServer) compact(w http.ResponseWriter, r *http.Request) {
+	removed, err := s.syncer.Compact()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":      true,
+		"removed": removed,
+	})
+}
+
+func (s *AdminServer) antiEntropy(w http.ResponseWriter, r *http.Request) {
+	repaired, err := s.syncer.AntiEntropy()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":       true,
+		"repaired": repaired,
+	})
+}
@@ -0,0 +1,34 @@
+package admin
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"20210612", "data/backups/20210612", false},
+		{"daily/../20210612", "data/backups/20210612", false},
+		{"", "", true},
+		{".", "", true},
+		{"/etc", "", true},
+		{"..", "", true},
+		{"../snapshot.dat", "", true},
+		{"a/../../b", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := backupDir("data", tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("backupDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != filepath.FromSlash(tt.want) {
+				t.Errorf("backupDir() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
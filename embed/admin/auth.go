@@ -0,0 +1,97 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+var errOperatorWrite = errors.New("NOPERM operator tokens are read-only")
+
+// authorize lets the request through if the caller may run the command
+// of categories on all keys. The caller is an ACL user by http basic
+// auth, or the default user if it requires no password, as on the server
+// port. An operator token by bearer auth may run the reads only.
+func (s *AdminServer) authorize(command string, categories []string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := bearerToken(r); token != "" {
+			if !s.isOperator(token) {
+				s.deny(w, r, "token", command, http.StatusUnauthorized, acl.ErrNoAuth)
+				return
+			}
+			if !readOnly(categories) {
+				s.deny(w, r, "operator", command, http.StatusForbidden, errOperatorWrite)
+				return
+			}
+			fn(w, r)
+			return
+		}
+		user := s.acl.Anonymous()
+		if name, pass, ok := r.BasicAuth(); ok {
+			u, err := s.acl.Authenticate(name, pass)
+			if err != nil {
+				s.deny(w, r, name, command, http.StatusUnauthorized, err)
+				return
+			}
+			user = u
+		}
+		if user == nil {
+			s.deny(w, r, "", command, http.StatusUnauthorized, acl.ErrNoAuth)
+			return
+		}
+		err := s.acl.Check(user, command, categories, nil)
+		if err == nil {
+			err = s.acl.CheckAllKeys(user)
+		}
+		if err != nil {
+			s.deny(w, r, user.Name, command, http.StatusForbidden, err)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// deny audits the request denied, and replies the error
+func (s *AdminServer) deny(w http.ResponseWriter, r *http.Request, user, command string, code int, err error) {
+	s.acl.Audit(user, r.RemoteAddr, command, nil, err)
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="evolvest"`)
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
+func (s *AdminServer) isOperator(token string) bool {
+	for _, t := range s.cfg.Auth.OperatorTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token of bearer auth, empty if none
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// readOnly tells whether the command of categories only reads data
+func readOnly(categories []string) bool {
+	read := false
+	for _, c := range categories {
+		switch c {
+		case acl.CategoryRead:
+			read = true
+		case acl.CategoryWrite:
+			return false
+		}
+	}
+	return read
+}
@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminServer_authorize(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir(), Auth: config.AuthConfig{
+		RequirePass:    "secret",
+		OperatorTokens: []string{"op"},
+	}}
+	a := acl.NewACL(conf)
+	if err := a.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetUser("reader", []string{"on", ">pass", "~user:*", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewAdminServer(conf, nil, a)
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	export := s.authorize("export", []string{acl.CategoryAdmin, acl.CategoryRead}, ok)
+	imports := s.authorize("import", []string{acl.CategoryAdmin, acl.CategoryWrite}, ok)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		auth    func(r *http.Request)
+		want    int
+	}{
+		{"anonymous", export, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong pass", export, func(r *http.Request) { r.SetBasicAuth("default", "wrong") }, http.StatusUnauthorized},
+		{"user", imports, func(r *http.Request) { r.SetBasicAuth("default", "secret") }, http.StatusOK},
+		// the data of other keys would be exported
+		{"user of some keys", export, func(r *http.Request) { r.SetBasicAuth("reader", "pass") }, http.StatusForbidden},
+		{"operator reads", export, func(r *http.Request) { r.Header.Set("Authorization", "Bearer op") }, http.StatusOK},
+		{"operator writes", imports, func(r *http.Request) { r.Header.Set("Authorization", "Bearer op") }, http.StatusForbidden},
+		{"wrong token", export, func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			tt.auth(r)
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
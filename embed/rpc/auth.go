@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RolePeer replicates data between nodes
+	RolePeer = "peer"
+	// RoleOperator reads data only, e.g. evolvestcli
+	RoleOperator = "operator"
+)
+
+const methodPrefix = "/evolvest.EvolvestService/"
+
+// methodRoles are the roles allowed to call the methods
+var methodRoles = map[string][]string{
+	methodPrefix + "Keys":      {RolePeer, RoleOperator},
+	methodPrefix + "Pull":      {RolePeer, RoleOperator},
+	methodPrefix + "Push":      {RolePeer},
+	methodPrefix + "Stream":    {RolePeer},
+	methodPrefix + "Replicate": {RolePeer},
+	methodPrefix + "Status":    {RolePeer, RoleOperator},
+}
+
+type roleKey struct{}
+
+// memberTTL is how long the resolved addresses of members are cached
+const memberTTL = 30 * time.Second
+
+// resolved are the addresses of a host resolved at the time
+type resolved struct {
+	ips []net.IPAddr
+	at  time.Time
+}
+
+// authenticator resolves the role of caller by bearer token or the
+// name of mutual tls certificate, and checks the permission of methods.
+type authenticator struct {
+	cfg    *config.Config
+	syncer *store.Syncer
+
+	// the addresses of members by host, for the nodes without auth
+	mu       sync.Mutex
+	resolved map[string]resolved
+	lookup   func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func newAuthenticator(conf *config.Config, syncer *store.Syncer) *authenticator {
+	return &authenticator{
+		cfg:      conf,
+		syncer:   syncer,
+		resolved: make(map[string]resolved),
+		lookup:   net.DefaultResolver.LookupIPAddr,
+	}
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := a.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (a *authenticator) authorize(ctx context.Context, method string) (context.Context, error) {
+	role, identity := a.role(ctx)
+	log := etlog.Log.WithField("method", method).
+		WithField("identity", identity).
+		WithField("addr", remoteAddr(ctx))
+	if role == "" {
+		log.Warn("sync request unauthenticated")
+		return nil, status.Error(codes.Unauthenticated, "invalid token or certificate")
+	}
+	for _, r := range methodRoles[method] {
+		if r == role {
+			return context.WithValue(ctx, roleKey{}, role), nil
+		}
+	}
+	log.WithField("role", role).Warn("sync request denied")
+	return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s", role, method)
+}
+
+// role returns the role and the identity of caller, empty if unknown
+func (a *authenticator) role(ctx context.Context) (role, identity string) {
+	auth := a.cfg.Auth
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get("authorization") {
+			token := strings.TrimPrefix(v, "Bearer ")
+			if auth.SyncToken != "" && tokenEqual(token, auth.SyncToken) {
+				return RolePeer, "token"
+			}
+			for _, t := range auth.OperatorTokens {
+				if tokenEqual(token, t) {
+					return RoleOperator, "token"
+				}
+			}
+		}
+	}
+
+	names := certNames(ctx)
+	if len(names) == 0 {
+		return "", ""
+	}
+	if len(auth.PeerNames) == 0 && len(auth.OperatorNames) == 0 {
+		// any certificate verified by CA is a peer
+		return RolePeer, names[0]
+	}
+	for _, name := range names {
+		if contains(auth.PeerNames, name) {
+			return RolePeer, name
+		}
+		if contains(auth.OperatorNames, name) {
+			return RoleOperator, name
+		}
+	}
+	return "", names[0]
+}
+
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// certNames returns common name and dns names of the verified client certificate
+func certNames(ctx context.Context) []string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := info.State.VerifiedChains[0][0]
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// isMember tells whether the caller is one of the peers or the upstream,
+// which are the only nodes pushing requests to current node. With auth
+// enabled, the callers of peer role by token or certificate are members,
+// since the address is not their identity behind NAT. Otherwise the
+// caller is matched with the addresses of peers and upstream.
+func (a *authenticator) isMember(ctx context.Context) bool {
+	if a.cfg.Auth.SyncAuthEnabled(&a.cfg.TLS) {
+		role, _ := a.role(ctx)
+		return role == RolePeer
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr(ctx))
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	addrs := a.syncer.Peers()
+	if _, upstream, _ := a.syncer.Replicator.Role(); upstream != "" {
+		addrs = append(addrs, upstream)
+	}
+	for _, addr := range addrs {
+		h, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		for _, i := range a.resolve(ctx, h) {
+			if i.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve returns the addresses of host, which are cached for memberTTL
+// so that the pushes don't look up on each call. The failed lookups are
+// cached too.
+func (a *authenticator) resolve(ctx context.Context, host string) []net.IPAddr {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}
+	}
+	a.mu.Lock()
+	r, ok := a.resolved[host]
+	a.mu.Unlock()
+	if ok && time.Since(r.at) < memberTTL {
+		return r.ips
+	}
+	ips, err := a.lookup(ctx, host)
+	if err != nil {
+		etlog.Log.WithError(err).WithField("host", host).Warn("resolve member failed")
+	}
+	a.mu.Lock()
+	a.resolved[host] = resolved{ips: ips, at: time.Now()}
+	a.mu.Unlock()
+	return ips
+}
@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"context"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestAuthenticator_authorize(t *testing.T) {
+	conf := &config.Config{
+		Auth: config.AuthConfig{
+			SyncToken:      "peer-token",
+			OperatorTokens: []string{"op-token"},
+		},
+	}
+	a := newAuthenticator(conf, nil)
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		want   codes.Code
+	}{
+		{"peer push", "peer-token", methodPrefix + "Push", codes.OK},
+		{"peer stream", "peer-token", methodPrefix + "Stream", codes.OK},
+		{"peer pull", "peer-token", methodPrefix + "Pull", codes.OK},
+		{"operator pull", "op-token", methodPrefix + "Pull", codes.OK},
+		{"operator keys", "op-token", methodPrefix + "Keys", codes.OK},
+		{"operator push", "op-token", methodPrefix + "Push", codes.PermissionDenied},
+		{"operator stream", "op-token", methodPrefix + "Stream", codes.PermissionDenied},
+		{"operator replicate", "op-token", methodPrefix + "Replicate", codes.PermissionDenied},
+		{"wrong token", "bad-token", methodPrefix + "Pull", codes.Unauthenticated},
+		{"no token", "", methodPrefix + "Pull", codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.NewIncomingContext(ctx,
+					metadata.Pairs("authorization", "Bearer "+tt.token))
+			}
+			_, err := a.authorize(ctx, tt.method)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("authorize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_isMember(t *testing.T) {
+	// the caller of ctx from addr with token
+	callCtx := func(addr, token string) context.Context {
+		ip, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: p},
+		})
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+		}
+		return ctx
+	}
+
+	t.Run("by address", func(t *testing.T) {
+		conf := &config.Config{}
+		a := newAuthenticator(conf, startSyncer(t, conf, "peer.test:9620,10.0.0.2:9620"))
+		lookups := 0
+		a.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			lookups++
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+		}
+		tests := []struct {
+			addr string
+			want bool
+		}{
+			{"10.0.0.1:40000", true},
+			{"10.0.0.2:40000", true},
+			{"10.0.0.3:40000", false},
+			{"10.0.0.1:40001", true},
+		}
+		for _, tt := range tests {
+			if got := a.isMember(callCtx(tt.addr, "")); got != tt.want {
+				t.Errorf("isMember(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		}
+		// resolved once and cached
+		if lookups != 1 {
+			t.Errorf("lookups = %d, want 1", lookups)
+		}
+	})
+
+	t.Run("by identity", func(t *testing.T) {
+		conf := &config.Config{Auth: config.AuthConfig{
+			SyncToken:      "peer-token",
+			OperatorTokens: []string{"op-token"},
+		}}
+		a := newAuthenticator(conf, nil)
+		tests := []struct {
+			token string
+			want  bool
+		}{
+			// behind NAT, or not in the peers
+			{"peer-token", true},
+			{"op-token", false},
+			{"", false},
+		}
+		for _, tt := range tests {
+			if got := a.isMember(callCtx("192.168.1.1:40000", tt.token)); got != tt.want {
+				t.Errorf("isMember() of token %q = %v, want %v", tt.token, got, tt.want)
+			}
+		}
+	})
+}
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"github.com/edditen/etlog"
 	"github.com/edditen/evolvest/api/pb/evolvest"
@@ -9,53 +10,109 @@ import (
 	"github.com/edditen/evolvest/pkg/common/config"
 	"github.com/edditen/evolvest/pkg/common/utils"
 	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"log"
 	"net"
 	"regexp"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
 type SyncServer struct {
-	cfg    *config.Config
-	syncer *store.Syncer
+	cfg     *config.Config
+	syncer  *store.Syncer
+	auth    *authenticator
+	tlsConf *tls.Config
+	srv     *grpc.Server
+	// closing ends the streams of peers on shutdown
+	closing chan interface{}
 }
 
 func NewSyncServer(conf *config.Config, syncer *store.Syncer) *SyncServer {
 	return &SyncServer{
-		cfg:    conf,
-		syncer: syncer,
+		cfg:     conf,
+		syncer:  syncer,
+		auth:    newAuthenticator(conf, syncer),
+		closing: make(chan interface{}),
 	}
 }
 
 func (es *SyncServer) Init() error {
 	log.Println("[Init] init syncServer")
+	if es.cfg.TLS.Sync {
+		conf, err := es.cfg.TLS.SyncServerConfig()
+		if err != nil {
+			return errors.Wrap(err, "init syncServer tls error")
+		}
+		es.tlsConf = conf
+	}
+
+	opts := make([]grpc.ServerOption, 0)
+	if es.tlsConf != nil {
+		log.Println("sync over mutual tls")
+		opts = append(opts, grpc.Creds(credentials.NewTLS(es.tlsConf)))
+	}
+	if es.cfg.Auth.SyncAuthEnabled(&es.cfg.TLS) {
+		log.Println("sync with authentication")
+		opts = append(opts,
+			grpc.UnaryInterceptor(es.auth.unaryInterceptor),
+			grpc.StreamInterceptor(es.auth.streamInterceptor))
+	}
+	es.srv = grpc.NewServer(opts...)
+	evolvest.RegisterEvolvestServiceServer(es.srv, es)
 	return nil
 }
 
 func (es *SyncServer) Run(errC chan<- error) {
 	log.Println("[Run] run syncServer")
-	addr := es.cfg.Host + ":" + es.cfg.SyncPort
-	log.Println("listen sync server at", addr)
-	lis, err := net.Listen("tcp", addr)
-	if err != nil {
-		errC <- err
-		return
+	lns := make([]net.Listener, 0)
+	for _, lc := range es.cfg.SyncServerListeners() {
+		ln, err := utils.Listen(lc)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			errC <- errors.Wrapf(err, "listen %s error", lc)
+			return
+		}
+		log.Println("listen sync server at", lc)
+		lns = append(lns, ln)
 	}
 
-	srv := grpc.NewServer()
-	evolvest.RegisterEvolvestServiceServer(srv, es)
-
-	if err = srv.Serve(lis); err != nil {
-		errC <- err
-		return
+	var wg sync.WaitGroup
+	for _, ln := range lns {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			if err := es.srv.Serve(ln); err != nil {
+				errC <- err
+			}
+		}(ln)
 	}
-
+	wg.Wait()
 }
 
+// Shutdown stops accepting calls and waits for the ones being served,
+// the calls left are cancelled when the shutdown timeout is reached
 func (es *SyncServer) Shutdown() {
 	log.Println("[Shutdown] shutdown syncServer")
+	close(es.closing)
+	done := make(chan interface{})
+	go func() {
+		es.srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(es.cfg.ShutdownDuration()):
+		etlog.Log.Warn("graceful stop syncServer timeout")
+		es.srv.Stop()
+	}
 }
 
 func (es *SyncServer) Keys(ctx context.Context, request *evolvest.KeysRequest) (*evolvest.KeysResponse, error) {
@@ -67,7 +124,11 @@ func (es *SyncServer) Keys(ctx context.Context, request *evolvest.KeysRequest) (
 		return nil, err
 	}
 
-	allKeys, err := es.syncer.Store.Keys()
+	db := es.syncer.DB(int(request.GetDb()))
+	if db == nil {
+		return nil, status.Error(codes.InvalidArgument, "database out of range")
+	}
+	allKeys, err := db.Keys()
 	log.WithField("keys", allKeys).WithError(err).Debug("request keys")
 	if err != nil {
 		log.WithError(err).Warn("request keys")
@@ -88,18 +149,15 @@ func (es *SyncServer) Keys(ctx context.Context, request *evolvest.KeysRequest) (
 
 func (es *SyncServer) Pull(ctx context.Context, request *evolvest.PullRequest) (*evolvest.PullResponse, error) {
 	log := etlog.Log.WithField("ctx", ctx).WithField("params", request)
-	keys, err := es.syncer.Store.Keys()
-
-	if err != nil {
-		log.WithError(err).Warn("get keys error")
-		return nil, err
-	}
-
-	values, err := valuesByKeys(keys, es.syncer.Store)
-	if err != nil {
-		log.WithError(err).Warn("get values error")
-		return nil, err
+	db := es.syncer.DB(int(request.GetDb()))
+	if db == nil {
+		return nil, status.Error(codes.InvalidArgument, "database out of range")
 	}
+	values := make(map[string]store.DataItem, db.Len())
+	db.Range(func(key string, val store.DataItem) bool {
+		values[key] = val
+		return true
+	})
 	data, err := json.Marshal(values)
 	if err != nil {
 		log.WithError(err).Warn("convert to json error")
@@ -110,76 +168,105 @@ func (es *SyncServer) Pull(ctx context.Context, request *evolvest.PullRequest) (
 
 	return &evolvest.PullResponse{
 		Values: data,
+		Db:     request.GetDb(),
 	}, nil
 }
 
-func valuesByKeys(keys []string, s store.Store) (vals map[string]store.DataItem, err error) {
-	vals = make(map[string]store.DataItem, 0)
-	for _, key := range keys {
-		val, err := s.Get(key)
-		if err != nil {
-			return nil, err
-		}
-		vals[key] = val
+// Status returns the state of current node, and the other nodes if all
+func (es *SyncServer) Status(ctx context.Context, request *evolvest.StatusRequest) (*evolvest.StatusResponse, error) {
+	var statuses []store.NodeStatus
+	if request.GetAll() {
+		statuses = es.syncer.ClusterStatus()
+	} else {
+		statuses = []store.NodeStatus{es.syncer.Status()}
 	}
-	return vals, nil
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		etlog.Log.WithError(err).Warn("convert to json error")
+		return nil, err
+	}
+	return &evolvest.StatusResponse{
+		Statuses: data,
+	}, nil
 }
 
 func (es *SyncServer) Push(ctx context.Context, request *evolvest.PushRequest) (*evolvest.PushResponse, error) {
 	etlog.Log.WithField("ctx", ctx).WithField("params", request).
 		Debug("request push")
-	for _, req := range request.TxCmds {
-		if txReq := parseCmd(req); txReq != nil {
-			es.syncer.Submit(txReq)
+	if !es.auth.isMember(ctx) {
+		etlog.Log.WithField("addr", remoteAddr(ctx)).Warn("push from non-member rejected")
+		return nil, status.Error(codes.PermissionDenied, "not a member of the cluster")
+	}
+	// acked is the tx id of the last request accepted in order
+	var acked int64
+	for i, req := range request.TxCmds {
+		txReq := parseCmd(req)
+		if txReq == nil {
+			if i == 0 {
+				// skipped by the peer, as the invalid records of a stream
+				return nil, status.Errorf(codes.InvalidArgument, "invalid tx cmd %q", req)
+			}
+			// acks the ones before it, so that it's pushed first again
+			return &evolvest.PushResponse{
+				Ok:        false,
+				AckedTxId: acked,
+			}, nil
 		}
+		if err := es.syncer.Submit(txReq); err != nil {
+			if i == 0 || acked == 0 {
+				// let the peer retry later
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
+			// the peer pushes the rest again
+			return &evolvest.PushResponse{
+				Ok:        false,
+				AckedTxId: acked,
+			}, nil
+		}
+		acked = txReq.TxId
 	}
 	return &evolvest.PushResponse{
-		Ok: true,
+		Ok:        true,
+		AckedTxId: acked,
 	}, nil
 }
 
-func parseCmd(cmdText string) *common.TxRequest {
-	log := etlog.Log.WithField("cmdText", cmdText)
-	texts := strings.Fields(strings.TrimSpace(cmdText))
-	if len(texts) < 4 {
-		log.Warn("parse cmd error, missing required")
-		return nil
+func (es *SyncServer) Replicate(ctx context.Context, request *evolvest.ReplicateRequest) (*evolvest.ReplicateResponse, error) {
+	log := etlog.Log.WithField("ctx", ctx).WithField("params", request)
+	host, port, err := net.SplitHostPort(request.GetAddr())
+	if err != nil {
+		log.WithError(err).Warn("request replicate")
+		return nil, err
 	}
+	if host == "" {
+		// use the address seen by current node
+		if p, ok := peer.FromContext(ctx); ok {
+			host, _, _ = net.SplitHostPort(p.Addr.String())
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if request.GetDetach() {
+		es.syncer.Replicator.Detach(addr)
+	} else {
+		es.syncer.Replicator.Attach(addr)
+	}
+	log.WithField("addr", addr).Debug("request replicate")
 
-	txReq := &common.TxRequest{}
+	return &evolvest.ReplicateResponse{
+		Ok:       true,
+		LastTxId: es.syncer.LastTxId(),
+	}, nil
+}
 
-	id, err := strconv.Atoi(texts[0])
+func parseCmd(cmdText string) *common.TxRequest {
+	log := etlog.Log.WithField("cmdText", cmdText)
+	txReq, err := store.ParseTx(cmdText)
 	if err != nil {
-		log.Warn("parse cmd error, txid is wrong format")
+		log.WithError(err).Warn("parse cmd error")
 		return nil
 	}
-
-	txReq.TxId = int64(id)
 	txReq.Flag = common.FlagSync
-	txReq.Key = texts[3]
-
-	switch texts[2] {
-	case common.DEL:
-		txReq.Action = common.DEL
-	case common.SET:
-		txReq.Action = common.SET
-		if len(texts) == 4 {
-			txReq.Val = []byte{}
-		} else if len(texts) == 5 {
-			if val, err := utils.Base64Decode(texts[4]); err != nil {
-				log.Warn("parse cmd error, value is wrong format")
-				return nil
-			} else {
-				txReq.Val = val
-			}
-		} else {
-			log.Warn("parse cmd error, more than one values")
-			return nil
-		}
-	default:
-		log.Warn("parse cmd error, cmd not support")
-		return nil
-	}
 	log.WithField("req", txReq).Debug("parsed request")
 	return txReq
 }
@@ -0,0 +1,41 @@
+package rpc
+
+import (
+	"context"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestSyncServer_PushInvalid(t *testing.T) {
+	syncer, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	set := func(txId int64, key string) string {
+		return store.FormatTx(&common.TxRequest{TxId: txId, Action: common.SET, Key: key, Val: []byte("1")})
+	}
+
+	// the ones before the invalid cmd are acknowledged only
+	resp, err := client.Push(ctx, &evolvest.PushRequest{TxCmds: []string{set(1, "a"), "bogus", set(3, "c")}})
+	if err != nil || resp.Ok || resp.AckedTxId != 1 {
+		t.Fatalf("Push() = %v, %v, want acked 1", resp, err)
+	}
+	// and it's refused once pushed first again
+	_, err = client.Push(ctx, &evolvest.PushRequest{TxCmds: []string{"bogus", set(3, "c")}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Push() error = %v, want InvalidArgument", err)
+	}
+	if err = syncer.WaitApplied(ctx, syncer.Queued()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syncer.Store.Get("a"); err != nil {
+		t.Errorf("a not applied")
+	}
+	if _, err = syncer.Store.Get("c"); err == nil {
+		t.Errorf("c after the invalid cmd applied")
+	}
+}
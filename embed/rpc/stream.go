@@ -0,0 +1,145 @@
+package rpc
+
+import (
+	"context"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"time"
+)
+
+// streamAck is the tx id acknowledged once the requests queued before
+// seq are applied
+type streamAck struct {
+	seq  int64
+	txId int64
+}
+
+// Stream receives the records pushed by a peer in order, and acknowledges
+// the last one applied. Receiving waits while the apply queue is full, so
+// that the peer is slowed down by the flow control of the stream.
+func (es *SyncServer) Stream(stream evolvest.EvolvestService_StreamServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	addr := remoteAddr(ctx)
+	if !es.auth.isMember(ctx) {
+		etlog.Log.WithField("addr", addr).Warn("stream from non-member rejected")
+		return status.Error(codes.PermissionDenied, "not a member of the cluster")
+	}
+	// tells the peer the stream is accepted
+	if err := stream.Send(&evolvest.StreamResponse{}); err != nil {
+		return err
+	}
+	etlog.Log.WithField("addr", addr).Debug("stream opened")
+
+	acks := make(chan streamAck, 1024)
+	recvC, ackC := make(chan error, 1), make(chan error, 1)
+	go func() {
+		recvC <- es.receive(ctx, stream, acks)
+	}()
+	go func() {
+		ackC <- es.sendAcks(ctx, stream, acks)
+	}()
+
+	var err error
+	select {
+	case err = <-recvC:
+		close(acks)
+		invalid := status.Code(err) == codes.InvalidArgument
+		if err != io.EOF && !invalid {
+			cancel()
+		}
+		// acknowledges the ones received before closed by the peer,
+		// or before the invalid record
+		if ackErr := <-ackC; err == io.EOF || (invalid && ackErr != nil) {
+			err = ackErr
+		}
+	case err = <-ackC:
+	case <-es.closing:
+		cancel()
+		<-ackC
+		err = status.Error(codes.Unavailable, "node is shutting down")
+	}
+	etlog.Log.WithError(err).WithField("addr", addr).Debug("stream closed")
+	return err
+}
+
+// receive submits the records received in order, and queues the tx id
+// of the last one to be acknowledged. A record not parsed ends the stream
+// with InvalidArgument, after the ones before it are acknowledged, so
+// that it's never acknowledged without being applied.
+func (es *SyncServer) receive(ctx context.Context, stream evolvest.EvolvestService_StreamServer,
+	acks chan<- streamAck) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		var last int64
+		var invalid error
+		for _, rec := range req.Records {
+			txReq, err := store.ParseTxRecord(rec)
+			if err != nil {
+				etlog.Log.WithError(err).WithField("record", rec).Warn("parse tx record error")
+				invalid = status.Errorf(codes.InvalidArgument, "invalid tx record %d: %v", rec.TxId, err)
+				break
+			}
+			if err = es.submit(ctx, txReq); err != nil {
+				return status.Error(codes.Unavailable, err.Error())
+			}
+			last = rec.TxId
+		}
+		if last != 0 {
+			select {
+			case acks <- streamAck{seq: es.syncer.Queued(), txId: last}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if invalid != nil {
+			return invalid
+		}
+	}
+}
+
+// submit submits the request, waiting while the apply queue is full
+func (es *SyncServer) submit(ctx context.Context, req *common.TxRequest) error {
+	for {
+		err := es.syncer.Submit(req)
+		if err != store.ErrQueueFull {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// sendAcks acknowledges the tx ids once applied, until acks is closed
+func (es *SyncServer) sendAcks(ctx context.Context, stream evolvest.EvolvestService_StreamServer,
+	acks <-chan streamAck) error {
+	for {
+		var ack streamAck
+		select {
+		case a, ok := <-acks:
+			if !ok {
+				return nil
+			}
+			ack = a
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := es.syncer.WaitApplied(ctx, ack.seq); err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		if err := stream.Send(&evolvest.StreamResponse{AckedTxId: ack.txId}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"context"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// startSyncer runs a syncer of the peers addrs
+func startSyncer(t *testing.T, conf *config.Config, addrs string) *store.Syncer {
+	os.Setenv(common.EnvAddrs, addrs)
+	defer os.Unsetenv(common.EnvAddrs)
+	conf.DataDir, conf.ShutdownTimeout = t.TempDir(), 1
+	syncer := store.NewSyncer(conf, cluster.NewCluster(conf))
+	if err := syncer.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go syncer.Run(make(chan error, 16))
+	t.Cleanup(syncer.Shutdown)
+	return syncer
+}
+
+// startStreamServer serves the stream of a syncer whose peer is local
+func startStreamServer(t *testing.T) (*store.Syncer, evolvest.EvolvestServiceClient) {
+	conf := &config.Config{}
+	syncer := startSyncer(t, conf, "127.0.0.1:1")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	evolvest.RegisterEvolvestServiceServer(srv, NewSyncServer(conf, syncer))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return syncer, evolvest.NewEvolvestServiceClient(conn)
+}
+
+func TestSyncServer_StreamInvalid(t *testing.T) {
+	syncer, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Recv(); err != nil {
+		t.Fatalf("Recv() hello error = %v", err)
+	}
+
+	err = stream.Send(&evolvest.StreamRequest{Records: []*evolvest.TxRecord{
+		{TxId: 1, Action: common.SET, Key: "a", Val: []byte("1")},
+		{TxId: 2, Action: "bogus", Key: "b"},
+		{TxId: 3, Action: common.SET, Key: "c", Val: []byte("1")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ones before the invalid record are acknowledged only
+	resp, err := stream.Recv()
+	if err != nil || resp.AckedTxId != 1 {
+		t.Fatalf("Recv() = %v, %v, want acked 1", resp, err)
+	}
+	if _, err = stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Recv() error = %v, want InvalidArgument", err)
+	}
+	if _, err = syncer.Store.Get("a"); err != nil {
+		t.Errorf("a not applied")
+	}
+	if _, err = syncer.Store.Get("c"); err == nil {
+		t.Errorf("c after the invalid record applied")
+	}
+}
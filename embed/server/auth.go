@@ -0,0 +1,236 @@
+package server
+
+import (
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/acl"
+	"strings"
+)
+
+const flagNoAuth = "no_auth"
+
+// AuthHandler rejects the command if the connection is not authenticated,
+// or the user has no permission to run the command or access the keys.
+type AuthHandler struct {
+	info       CommandInfo
+	categories []string
+	noAuth     bool
+	acl        *acl.ACL
+	next       Handler
+}
+
+func NewAuthHandler(info CommandInfo, a *acl.ACL, next Handler) *AuthHandler {
+	h := &AuthHandler{
+		info:       info,
+		categories: commandCategories(info),
+		acl:        a,
+		next:       next,
+	}
+	for _, flag := range info.Flags {
+		if flag == flagNoAuth {
+			h.noAuth = true
+		}
+	}
+	return h
+}
+
+func (h *AuthHandler) ServeRESP(conn Conn, cmd Command) {
+	if h.noAuth {
+		h.next.ServeRESP(conn, cmd)
+		return
+	}
+	user := connContext(conn).User()
+	if user == nil {
+		if user = h.acl.Anonymous(); user == nil {
+			conn.WriteError(acl.ErrNoAuth.Error())
+			return
+		}
+	}
+	keys := commandKeys(h.info, cmd)
+	if err := h.acl.Check(user, h.info.Name, h.categories, keys); err != nil {
+		h.acl.Audit(user.Name, conn.RemoteAddr(), h.info.Name, keys, err)
+		conn.WriteError(err.Error())
+		return
+	}
+	h.next.ServeRESP(conn, cmd)
+}
+
+// commandCategories derives the ACL categories from flags of command
+func commandCategories(info CommandInfo) []string {
+	categories := make([]string, 0)
+	fast, write := false, false
+	for _, flag := range info.Flags {
+		switch flag {
+		case "readonly":
+			categories = append(categories, acl.CategoryRead)
+		case "write":
+			categories = append(categories, acl.CategoryWrite)
+			write = true
+		case "admin":
+			categories = append(categories, acl.CategoryAdmin, acl.CategoryDangerous)
+		case "pubsub":
+			categories = append(categories, acl.CategoryPubSub)
+		case "fast":
+			fast = true
+		}
+	}
+	if fast {
+		categories = append(categories, acl.CategoryFast)
+	} else {
+		categories = append(categories, acl.CategorySlow)
+	}
+	if info.FirstKey > 0 {
+		categories = append(categories, acl.CategoryKeyspace)
+	} else if write {
+		// writes the whole database, e.g. FLUSHDB
+		categories = append(categories, acl.CategoryKeyspace, acl.CategoryDangerous)
+	}
+	return categories
+}
+
+// commandKeys returns the keys in arguments by the key positions of command
+func commandKeys(info CommandInfo, cmd Command) []string {
+	keys := make([]string, 0)
+	if info.FirstKey <= 0 || info.Step <= 0 {
+		return keys
+	}
+	last := info.LastKey
+	if last < 0 {
+		last = len(cmd.Args) + last
+	}
+	for i := info.FirstKey; i <= last && i < len(cmd.Args); i += info.Step {
+		if len(cmd.Args[i]) > 0 {
+			keys = append(keys, string(cmd.Args[i]))
+		}
+	}
+	for _, flag := range info.Flags {
+		if flag != "movablekeys" {
+			continue
+		}
+		// the keys after KEYS option, e.g. MIGRATE
+		for i := last + 1; i < len(cmd.Args); i++ {
+			if strings.ToLower(string(cmd.Args[i])) == "keys" {
+				for _, key := range cmd.Args[i+1:] {
+					keys = append(keys, string(key))
+				}
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// auth handles AUTH [username] password
+func (h *CmdHandler) auth(conn Conn, cmd Command) {
+	var name, pass string
+	switch len(cmd.Args) {
+	case 2:
+		name, pass = acl.DefaultUser, string(cmd.Args[1])
+	case 3:
+		name, pass = string(cmd.Args[1]), string(cmd.Args[2])
+	default:
+		conn.WriteError("ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	user, err := h.acl.Authenticate(name, pass)
+	if err != nil {
+		h.acl.Audit(name, conn.RemoteAddr(), "auth", nil, err)
+		conn.WriteError(err.Error())
+		return
+	}
+	connContext(conn).SetUser(user)
+	etlog.Log.WithField("user", name).WithField("addr", conn.RemoteAddr()).Info("authenticated")
+	conn.WriteString("OK")
+}
+
+// aclCmd handles ACL SETUSER|GETUSER|DELUSER|USERS|LIST|WHOAMI|CAT|SAVE|LOAD
+func (h *CmdHandler) aclCmd(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'acl' command")
+		return
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	args := cmd.Args[2:]
+	switch sub {
+	case "setuser":
+		if len(args) < 1 {
+			conn.WriteError("ERR wrong number of arguments for 'acl|setuser' command")
+			return
+		}
+		rules := make([]string, 0, len(args)-1)
+		for _, rule := range args[1:] {
+			rules = append(rules, string(rule))
+		}
+		if err := h.acl.SetUser(string(args[0]), rules); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "getuser":
+		if len(args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for 'acl|getuser' command")
+			return
+		}
+		info, ok := h.acl.GetUser(string(args[0]))
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteArray(8)
+		conn.WriteBulkString("flags")
+		writeStrings(conn, info.Flags)
+		conn.WriteBulkString("passwords")
+		writeStrings(conn, info.Passwords)
+		conn.WriteBulkString("commands")
+		conn.WriteBulkString(info.Commands)
+		conn.WriteBulkString("keys")
+		writeStrings(conn, info.Keys)
+	case "deluser":
+		if len(args) < 1 {
+			conn.WriteError("ERR wrong number of arguments for 'acl|deluser' command")
+			return
+		}
+		names := make([]string, 0, len(args))
+		for _, name := range args {
+			names = append(names, string(name))
+		}
+		removed, err := h.acl.DelUser(names...)
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteInt(removed)
+	case "users":
+		writeStrings(conn, h.acl.Users())
+	case "list":
+		writeStrings(conn, h.acl.List())
+	case "whoami":
+		if user := connContext(conn).User(); user != nil {
+			conn.WriteBulkString(user.Name)
+		} else {
+			conn.WriteBulkString(acl.DefaultUser)
+		}
+	case "cat":
+		writeStrings(conn, acl.Categories)
+	case "save":
+		if err := h.acl.Save(); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "load":
+		if err := h.acl.Load(); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	}
+}
+
+func writeStrings(conn Conn, items []string) {
+	conn.WriteArray(len(items))
+	for _, item := range items {
+		conn.WriteBulkString(item)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/acl"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (h *CmdHandler) client(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'client' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "list":
+		h.clientList(conn)
+	case "kill":
+		h.clientKill(conn, cmd)
+	case "id":
+		conn.WriteInt64(connContext(conn).Id)
+	case "setname":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'client|setname' command")
+			return
+		}
+		name := string(cmd.Args[2])
+		for _, c := range name {
+			if c <= ' ' || c > '~' {
+				conn.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+		}
+		connContext(conn).SetName(name)
+		conn.WriteString("OK")
+	case "getname":
+		if name := connContext(conn).Name(); name != "" {
+			conn.WriteBulkString(name)
+		} else {
+			conn.WriteNull()
+		}
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	}
+}
+
+func (h *CmdHandler) clientList(conn Conn) {
+	var sb strings.Builder
+	now := time.Now()
+	for _, c := range h.conns() {
+		ctx := connContext(c)
+		lastCmd, lastActive := ctx.LastCmd()
+		user := acl.DefaultUser
+		if u := ctx.User(); u != nil {
+			user = u.Name
+		}
+		sb.WriteString(fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d db=%d cmd=%s user=%s\n",
+			ctx.Id, c.RemoteAddr(), c.NetConn().LocalAddr(), ctx.Name(),
+			int64(now.Sub(ctx.Created).Seconds()), int64(now.Sub(lastActive).Seconds()),
+			ctx.DB(), lastCmd, user))
+	}
+	conn.WriteBulkString(sb.String())
+}
+
+// clientKill handles CLIENT KILL addr, and the new form
+// CLIENT KILL [ID id] [ADDR addr] [SKIPME yes|no] which replies count of killed clients.
+func (h *CmdHandler) clientKill(conn Conn, cmd Command) {
+	if len(cmd.Args) == 3 {
+		addr := string(cmd.Args[2])
+		killed, self := h.killClients(conn, func(c Conn) bool { return c.RemoteAddr() == addr }, false)
+		if killed == 0 {
+			conn.WriteError("ERR No such client")
+			return
+		}
+		conn.WriteString("OK")
+		if self {
+			conn.Close()
+		}
+		return
+	}
+	if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+		conn.WriteError("ERR syntax error")
+		return
+	}
+
+	filters := make([]func(c Conn) bool, 0)
+	skipMe := true
+	for i := 2; i < len(cmd.Args); i += 2 {
+		val := string(cmd.Args[i+1])
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "id":
+			id, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				conn.WriteError("ERR client-id should be greater than 0")
+				return
+			}
+			filters = append(filters, func(c Conn) bool { return connContext(c).Id == id })
+		case "addr":
+			filters = append(filters, func(c Conn) bool { return c.RemoteAddr() == val })
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				conn.WriteError("ERR syntax error")
+				return
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	killed, self := h.killClients(conn, func(c Conn) bool {
+		for _, filter := range filters {
+			if !filter(c) {
+				return false
+			}
+		}
+		return true
+	}, skipMe)
+	conn.WriteInt(killed)
+	if self {
+		conn.Close()
+	}
+}
+
+// killClients closes the matched connections except the current one,
+// self tells whether the current one matches and should be closed
+// after the reply is written.
+func (h *CmdHandler) killClients(conn Conn, matched func(c Conn) bool, skipMe bool) (killed int, self bool) {
+	me := connContext(conn)
+	for _, c := range h.conns() {
+		if !matched(c) {
+			continue
+		}
+		ctx := connContext(c)
+		if ctx == me {
+			if skipMe {
+				continue
+			}
+			self = true
+		} else {
+			c.NetConn().Close()
+		}
+		etlog.Log.WithField("id", ctx.Id).WithField("addr", c.RemoteAddr()).Info("client killed")
+		killed++
+	}
+	return killed, self
+}
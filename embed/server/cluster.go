@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const errClusterDisabled = "ERR This instance has cluster support disabled"
+
+func (h *CmdHandler) asking(conn Conn, cmd Command) {
+	if !h.cluster.Enabled() {
+		conn.WriteError(errClusterDisabled)
+		return
+	}
+	connContext(conn).Asking = true
+	conn.WriteString("OK")
+}
+
+func (h *CmdHandler) clusterCmd(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'cluster' command")
+		return
+	}
+	if !h.cluster.Enabled() {
+		conn.WriteError(errClusterDisabled)
+		return
+	}
+
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "info":
+		h.clusterInfo(conn)
+	case "myid":
+		conn.WriteBulkString(h.cluster.Self().Name)
+	case "slots":
+		h.clusterSlots(conn)
+	case "nodes":
+		h.clusterNodes(conn)
+	case "keyslot":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster|keyslot' command")
+			return
+		}
+		conn.WriteInt(cluster.KeySlot(string(cmd.Args[2])))
+	case "countkeysinslot":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster|countkeysinslot' command")
+			return
+		}
+		slot, ok := parseSlot(conn, cmd.Args[2])
+		if !ok {
+			return
+		}
+		conn.WriteInt(len(h.keysInSlot(slot, -1)))
+	case "getkeysinslot":
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster|getkeysinslot' command")
+			return
+		}
+		slot, ok := parseSlot(conn, cmd.Args[2])
+		if !ok {
+			return
+		}
+		count, err := strconv.Atoi(string(cmd.Args[3]))
+		if err != nil || count < 0 {
+			conn.WriteError("ERR Invalid number of keys")
+			return
+		}
+		keys := h.keysInSlot(slot, count)
+		conn.WriteArray(len(keys))
+		for _, key := range keys {
+			conn.WriteBulkString(key)
+		}
+	case "setslot":
+		h.clusterSetSlot(conn, cmd)
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	}
+}
+
+func parseSlot(conn Conn, arg []byte) (int, bool) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= cluster.SlotCount {
+		conn.WriteError("ERR Invalid or out of range slot")
+		return 0, false
+	}
+	return slot, true
+}
+
+func (h *CmdHandler) keysInSlot(slot int, count int) []string {
+	keys := make([]string, 0)
+	allKeys, _ := h.syncer.Store.Keys()
+	for _, key := range allKeys {
+		if count >= 0 && len(keys) >= count {
+			break
+		}
+		if cluster.KeySlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (h *CmdHandler) clusterInfo(conn Conn) {
+	assigned := h.cluster.AssignedSlots()
+	state := "ok"
+	if assigned < cluster.SlotCount {
+		state = "fail"
+	}
+	size := 0
+	for _, node := range h.cluster.Nodes() {
+		if len(h.cluster.NodeSlots(node)) > 0 {
+			size++
+		}
+	}
+	info := fmt.Sprintf("cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:0\r\n"+
+		"cluster_slots_fail:0\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n",
+		state, assigned, assigned, len(h.cluster.Nodes()), size)
+	conn.WriteBulkString(info)
+}
+
+func (h *CmdHandler) clusterSlots(conn Conn) {
+	ranges := h.cluster.SlotRanges()
+	conn.WriteArray(len(ranges))
+	for _, r := range ranges {
+		conn.WriteArray(2 + len(r.Nodes))
+		conn.WriteInt(r.Start)
+		conn.WriteInt(r.End)
+		for _, node := range r.Nodes {
+			port, _ := strconv.Atoi(node.Port)
+			conn.WriteArray(3)
+			conn.WriteBulkString(node.Host)
+			conn.WriteInt(port)
+			conn.WriteBulkString(node.Name)
+		}
+	}
+}
+
+func (h *CmdHandler) clusterNodes(conn Conn) {
+	var sb strings.Builder
+	for _, node := range h.cluster.Nodes() {
+		flags := "master"
+		if node.Self {
+			flags = "myself,master"
+		}
+		fields := []string{
+			node.Name,
+			node.Addr() + "@" + node.SyncPort,
+			flags, "-", "0", "0", "0", "connected",
+		}
+		fields = append(fields, h.cluster.NodeSlots(node)...)
+		sb.WriteString(strings.Join(fields, " "))
+		sb.WriteString("\n")
+	}
+	conn.WriteBulkString(sb.String())
+}
+
+// clusterSetSlot handles CLUSTER SETSLOT <slot> IMPORTING|MIGRATING|NODE <node-id>
+// and CLUSTER SETSLOT <slot> STABLE. There is no gossip between nodes, so
+// SETSLOT NODE should be sent to every node of the cluster after migration.
+func (h *CmdHandler) clusterSetSlot(conn Conn, cmd Command) {
+	if len(cmd.Args) < 4 {
+		conn.WriteError("ERR wrong number of arguments for 'cluster|setslot' command")
+		return
+	}
+	slot, ok := parseSlot(conn, cmd.Args[2])
+	if !ok {
+		return
+	}
+	action := strings.ToLower(string(cmd.Args[3]))
+	if action == "stable" {
+		h.cluster.SetSlotStable(slot)
+		conn.WriteString("OK")
+		return
+	}
+	if len(cmd.Args) != 5 {
+		conn.WriteError("ERR wrong number of arguments for 'cluster|setslot' command")
+		return
+	}
+	nodeId := string(cmd.Args[4])
+
+	var err error
+	switch action {
+	case "migrating":
+		err = h.cluster.SetSlotMigrating(slot, nodeId)
+	case "importing":
+		err = h.cluster.SetSlotImporting(slot, nodeId)
+	case "node":
+		err = h.cluster.SetSlotNode(slot, nodeId)
+	default:
+		conn.WriteError("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+		return
+	}
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+// migrate handles MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [AUTH password] [AUTH2 username password] [KEYS key...]. The keys are written
+// to the target with ASKING and SET, and the target always replaces existing
+// keys. The target is authenticated by requirepass if no AUTH is given.
+func (h *CmdHandler) migrate(conn Conn, cmd Command) {
+	if len(cmd.Args) < 6 {
+		conn.WriteError("ERR wrong number of arguments for 'migrate' command")
+		return
+	}
+	if !h.writable(conn) {
+		return
+	}
+	addr := net.JoinHostPort(string(cmd.Args[1]), string(cmd.Args[2]))
+	timeout, err := strconv.Atoi(string(cmd.Args[5]))
+	if err != nil || timeout < 0 {
+		conn.WriteError("ERR timeout is not an integer or out of range")
+		return
+	}
+	if timeout == 0 {
+		timeout = 1000
+	}
+
+	keys := make([]string, 0)
+	if len(cmd.Args[3]) > 0 {
+		keys = append(keys, string(cmd.Args[3]))
+	}
+	copying := false
+	var auth []string
+	if h.cfg.Auth.RequirePass != "" {
+		auth = []string{h.cfg.Auth.RequirePass}
+	}
+	for i := 6; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "copy":
+			copying = true
+		case "replace":
+		case "auth":
+			if i+1 >= len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			auth = []string{string(cmd.Args[i+1])}
+			i++
+		case "auth2":
+			if i+2 >= len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			auth = []string{string(cmd.Args[i+1]), string(cmd.Args[i+2])}
+			i += 2
+		case "keys":
+			if len(keys) > 0 {
+				conn.WriteError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			for _, key := range cmd.Args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			i = len(cmd.Args)
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	db := connContext(conn).DB()
+	items := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		val, err := h.syncer.DB(db).Get(key)
+		if err != nil {
+			continue
+		}
+		if items[key], err = val.Value(); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+	if len(items) == 0 {
+		conn.WriteString("NOKEY")
+		return
+	}
+
+	log := etlog.Log.WithField("addr", addr).WithField("keys", keys)
+	if err := migrateItems(addr, time.Duration(timeout)*time.Millisecond, auth, items); err != nil {
+		log.WithError(err).Warn("migrate keys failed")
+		conn.WriteError("IOERR error or timeout migrating to target instance: " + err.Error())
+		return
+	}
+	log.Info("migrate keys success")
+
+	if !copying {
+		h.itemsMux.Lock()
+		var err error
+		for key := range items {
+			// not pushed to the target, whose copy would be deleted
+			// by the later tx id
+			if err = h.syncer.Submit(&common.TxRequest{
+				TxId:   utils.GenerateId(),
+				Flag:   common.FlagMigrated,
+				Action: common.DEL,
+				Key:    key,
+				Db:     db,
+			}); err != nil {
+				break
+			}
+		}
+		seq := h.syncer.Queued()
+		h.itemsMux.Unlock()
+
+		if err == nil {
+			err = h.commit(seq)
+		}
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+	conn.WriteString("OK")
+}
+
+// migrateItems writes the items to the target, authenticated by auth of
+// the password, or the username and password, if not empty
+func migrateItems(addr string, timeout time.Duration, auth []string, items map[string][]byte) error {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	wr := NewWriter(c)
+	replies := len(items) * 2
+	if len(auth) > 0 {
+		wr.WriteArray(len(auth) + 1)
+		wr.WriteBulkString("auth")
+		for _, arg := range auth {
+			wr.WriteBulkString(arg)
+		}
+		replies++
+	}
+	for key, val := range items {
+		wr.WriteArray(1)
+		wr.WriteBulkString("asking")
+		wr.WriteArray(3)
+		wr.WriteBulkString("set")
+		wr.WriteBulkString(key)
+		wr.WriteBulk(val)
+	}
+	if err := wr.Flush(); err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(c)
+	for i := 0; i < replies; i++ {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "-") {
+			return fmt.Errorf("target replied %s", strings.TrimSpace(line[1:]))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"net"
+	"testing"
+)
+
+// keyIn returns a key whose slot is in [start, end]
+func keyIn(start, end int) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if slot := cluster.KeySlot(key); slot >= start && slot <= end {
+			return key
+		}
+	}
+}
+
+// freeAddr returns a tcp address not listened
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestCluster_Redirect(t *testing.T) {
+	sock := startServerConf(t, &config.Config{Cluster: config.ClusterConfig{
+		Enabled: true,
+		NodeId:  "n1",
+		Nodes: []config.NodeConfig{
+			{Id: "n1", Host: "127.0.0.1", Port: "7001", Slots: []string{"0-8191"}},
+			{Id: "n2", Host: "127.0.0.1", Port: "7002", Slots: []string{"8192-16383"}},
+		},
+	}})
+	own, migrating, other := keyIn(0, 100), keyIn(101, 8191), keyIn(8192, 16383)
+	ownSlot, migratingSlot, otherSlot := cluster.KeySlot(own), cluster.KeySlot(migrating), cluster.KeySlot(other)
+
+	c := dialReplica(t, sock)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", own, "1"}, "+OK"},
+		{[]string{"GET", other}, fmt.Sprintf("-MOVED %d 127.0.0.1:7002", otherSlot)},
+		{[]string{"CLUSTER", "SETSLOT", fmt.Sprint(otherSlot), "MIGRATING", "n2"}, "-ERR I'm not the owner of hash slot " + fmt.Sprint(otherSlot)},
+		{[]string{"CLUSTER", "SETSLOT", fmt.Sprint(migratingSlot), "MIGRATING", "n2"}, "+OK"},
+		// the keys not migrated yet are still served
+		{[]string{"CLUSTER", "SETSLOT", fmt.Sprint(ownSlot), "MIGRATING", "n2"}, "+OK"},
+		{[]string{"GET", own}, "$1"},
+		{[]string{"GET", migrating}, fmt.Sprintf("-ASK %d 127.0.0.1:7002", migratingSlot)},
+		{[]string{"CLUSTER", "SETSLOT", fmt.Sprint(migratingSlot), "NODE", "n2"}, "+OK"},
+		{[]string{"GET", migrating}, fmt.Sprintf("-MOVED %d 127.0.0.1:7002", migratingSlot)},
+	}
+	for _, tt := range tests {
+		c.send(tt.args...)
+		if got := c.readLine(); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+		if tt.want == "$1" {
+			c.readLine()
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	addr := freeAddr(t)
+	host, port, _ := net.SplitHostPort(addr)
+	// n1 is the source owning all slots, n2 is the target
+	clusterConf := func(self string) config.ClusterConfig {
+		return config.ClusterConfig{
+			Enabled: true,
+			NodeId:  self,
+			Nodes: []config.NodeConfig{
+				{Id: "n1", Host: "127.0.0.1", Port: "7001", Slots: []string{"0-16383"}},
+				{Id: "n2", Host: host, Port: port},
+			},
+		}
+	}
+	startServerConf(t, &config.Config{
+		Auth:      config.AuthConfig{RequirePass: "secret"},
+		Listeners: []config.ListenerConfig{{Network: "tcp", Addr: addr}},
+		Cluster:   clusterConf("n2"),
+	})
+	sock := startServerConf(t, &config.Config{Cluster: clusterConf("n1")})
+
+	target := dialNetwork(t, "tcp", addr)
+	for _, args := range [][]string{{"AUTH", "secret"}, {"CLUSTER", "SETSLOT", fmt.Sprint(cluster.KeySlot("a")), "IMPORTING", "n1"}} {
+		target.send(args...)
+		if got := target.readLine(); got != "+OK" {
+			t.Fatalf("%v = %s", args, got)
+		}
+	}
+
+	c := dialReplica(t, sock)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "a", "1"}, "+OK"},
+		{[]string{"MIGRATE", host, port, "b", "0", "1000"}, "+NOKEY"},
+		{[]string{"MIGRATE", host, port, "a", "0", "1000"},
+			"-IOERR error or timeout migrating to target instance: target replied NOAUTH Authentication required."},
+		{[]string{"MIGRATE", host, port, "a", "0", "1000", "COPY", "AUTH", "secret"}, "+OK"},
+		{[]string{"MIGRATE", host, port, "", "0", "1000", "AUTH2", "default", "secret", "KEYS", "a"}, "+OK"},
+	}
+	for _, tt := range tests {
+		c.send(tt.args...)
+		if got := c.readLine(); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// deleted from the source once replied
+	c.send("GET", "a")
+	if got := c.readLine(); got != "$-1" {
+		t.Errorf("GET a = %s, want nil", got)
+	}
+	target.send("ASKING")
+	target.readLine()
+	target.send("GET", "a")
+	if got := target.readLine() + target.readLine(); got != "$11" {
+		t.Errorf("GET a of target = %q, want 1", got)
+	}
+}
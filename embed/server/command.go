@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strings"
+)
+
+// command handles COMMAND, COMMAND COUNT, COMMAND INFO name... and
+// COMMAND DOCS, the infos are derived from registrations of ServeMux.
+func (h *CmdHandler) command(conn Conn, cmd Command) {
+	if len(cmd.Args) == 1 {
+		infos := h.mux.Commands()
+		conn.WriteArray(len(infos))
+		for _, info := range infos {
+			writeCommandInfo(conn, &info)
+		}
+		return
+	}
+
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "count":
+		conn.WriteInt(len(h.mux.Commands()))
+	case "info":
+		conn.WriteArray(len(cmd.Args) - 2)
+		for _, arg := range cmd.Args[2:] {
+			name := strings.ToLower(string(arg))
+			if _, ok := h.mux.handlers[name]; !ok {
+				conn.WriteNull()
+				continue
+			}
+			info := h.mux.Command(name)
+			writeCommandInfo(conn, &info)
+		}
+	case "docs":
+		// no docs, replies empty map for redis-cli
+		conn.WriteArray(0)
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	}
+}
+
+func writeCommandInfo(conn Conn, info *CommandInfo) {
+	conn.WriteArray(6)
+	conn.WriteBulkString(info.Name)
+	conn.WriteInt(info.Arity)
+	conn.WriteArray(len(info.Flags))
+	for _, flag := range info.Flags {
+		conn.WriteString(flag)
+	}
+	conn.WriteInt(info.FirstKey)
+	conn.WriteInt(info.LastKey)
+	conn.WriteInt(info.Step)
+}
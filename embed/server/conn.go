@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/metrics"
 	"github.com/tidwall/btree"
 	"github.com/tidwall/match"
 	"io"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -605,15 +608,52 @@ func (f HandlerFunc) ServeRESP(conn Conn, cmd Command) {
 	f(conn, cmd)
 }
 
+// CommandInfo describes a command in the format of redis COMMAND INFO
+type CommandInfo struct {
+	Name string
+	// Arity is the number of arguments including the command name,
+	// negative means at least -Arity arguments
+	Arity    int
+	Flags    []string
+	FirstKey int
+	LastKey  int
+	Step     int
+}
+
+// NewCommandInfo creates info of command, flags are separated by space
+func NewCommandInfo(name string, arity int, flags string, firstKey, lastKey, step int) CommandInfo {
+	return CommandInfo{
+		Name:     name,
+		Arity:    arity,
+		Flags:    strings.Fields(flags),
+		FirstKey: firstKey,
+		LastKey:  lastKey,
+		Step:     step,
+	}
+}
+
+// accepts tells whether n arguments including the command name match
+// the arity
+func (info CommandInfo) accepts(n int) bool {
+	if info.Arity < 0 {
+		return n >= -info.Arity
+	}
+	return n == info.Arity
+}
+
 // ServeMux is an RESP command multiplexer.
 type ServeMux struct {
 	handlers map[string]Handler
+	infos    map[string]CommandInfo
+	acl      *acl.ACL
+	limits   *Limits
 }
 
 // NewServeMux allocates and returns a new ServeMux.
 func NewServeMux() *ServeMux {
 	return &ServeMux{
 		handlers: make(map[string]Handler),
+		infos:    make(map[string]CommandInfo),
 	}
 }
 
@@ -638,8 +678,43 @@ func (h *AccessLogHandler) ServeRESP(conn Conn, cmd Command) {
 	log.WithField("duration", duration).Debug("access")
 }
 
-func buildHandlerChain(handler Handler) Handler {
-	return NewAccessLogHandler(handler)
+// MetricsHandler counts commands and observes the latency
+type MetricsHandler struct {
+	command string
+	next    Handler
+}
+
+func NewMetricsHandler(command string, next Handler) *MetricsHandler {
+	return &MetricsHandler{command: command, next: next}
+}
+
+func (h *MetricsHandler) ServeRESP(conn Conn, cmd Command) {
+	start := time.Now()
+	h.next.ServeRESP(conn, cmd)
+	metrics.CommandDuration.WithLabelValues(h.command).Observe(time.Since(start).Seconds())
+	metrics.CommandsTotal.WithLabelValues(h.command).Inc()
+}
+
+func buildHandlerChain(info CommandInfo, a *acl.ACL, l *Limits, handler Handler) Handler {
+	if l != nil {
+		handler = NewLimitHandler(info, l, handler)
+	}
+	if a != nil {
+		handler = NewAuthHandler(info, a, handler)
+	}
+	return NewAccessLogHandler(NewMetricsHandler(info.Name, handler))
+}
+
+// SetACL enables authentication and permission checks of commands,
+// it should be called before any registration.
+func (m *ServeMux) SetACL(a *acl.ACL) {
+	m.acl = a
+}
+
+// SetLimits enables the rate limits and quotas of commands,
+// it should be called before any registration.
+func (m *ServeMux) SetLimits(l *Limits) {
+	m.limits = l
 }
 
 // HandleFunc registers the handler function for the given command.
@@ -650,6 +725,35 @@ func (m *ServeMux) HandleFunc(command string, handler func(conn Conn, cmd Comman
 	m.Handle(command, HandlerFunc(handler))
 }
 
+// HandleCommand registers the handler function with the info of command.
+func (m *ServeMux) HandleCommand(info CommandInfo, handler func(conn Conn, cmd Command)) {
+	if _, exist := m.handlers[info.Name]; !exist {
+		m.infos[info.Name] = info
+	}
+	m.HandleFunc(info.Name, handler)
+}
+
+// Commands returns infos of the registered commands sorted by name,
+// the commands registered without info have variable arity.
+func (m *ServeMux) Commands() []CommandInfo {
+	infos := make([]CommandInfo, 0, len(m.handlers))
+	for command := range m.handlers {
+		infos = append(infos, m.Command(command))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Command returns info of the registered command
+func (m *ServeMux) Command(command string) CommandInfo {
+	if info, ok := m.infos[command]; ok {
+		return info
+	}
+	return CommandInfo{Name: command, Arity: -1}
+}
+
 // Handle registers the handler for the given command.
 // If a handler already exists for command, Handle panics.
 func (m *ServeMux) Handle(command string, handler Handler) {
@@ -663,18 +767,25 @@ func (m *ServeMux) Handle(command string, handler Handler) {
 		panic("evolvest: multiple registrations for " + command)
 	}
 
-	m.handlers[command] = buildHandlerChain(handler)
+	m.handlers[command] = buildHandlerChain(m.Command(command), m.acl, m.limits, handler)
 }
 
-// ServeRESP dispatches the command to the handler.
+// ServeRESP dispatches the command to the handler, the ones of wrong
+// number of arguments are refused by the arity of info.
 func (m *ServeMux) ServeRESP(conn Conn, cmd Command) {
 	command := strings.ToLower(string(cmd.Args[0]))
 
-	if handler, ok := m.handlers[command]; ok {
-		handler.ServeRESP(conn, cmd)
-	} else {
+	handler, ok := m.handlers[command]
+	if !ok {
 		conn.WriteError("ERR unknown command '" + command + "'")
+		return
+	}
+	if !m.Command(command).accepts(len(cmd.Args)) {
+		conn.WriteError("ERR wrong number of arguments for '" + command + "' command")
+		return
 	}
+	connContext(conn).touch(command)
+	handler.ServeRESP(conn, cmd)
 }
 
 // PubSub is a Redis compatible pub/sub server
@@ -723,8 +834,8 @@ func (ps *PubSub) Publish(channel, message string) int {
 		if match.Match(channel, entry.channel) {
 			entry.sconn.writeMessage(entry.pattern, entry.channel, channel,
 				message)
+			sent++
 		}
-		sent++
 		return true
 	})
 
@@ -1005,7 +1116,7 @@ func (ps *PubSub) unsubscribe(conn Conn, pattern, all bool, channel string) {
 		var entry *pubSubEntry
 		for ient := range sconn.entries {
 			if ient.pattern == pattern && ient.channel == channel {
-				removeEntry(entry)
+				entry = ient
 				break
 			}
 		}
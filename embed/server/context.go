@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/edditen/evolvest/pkg/acl"
+	"sync"
+	"time"
+)
+
+// ConnContext holds the states of a client connection
+type ConnContext struct {
+	// Id is the unique id of client, assigned when accepted
+	Id      int64
+	Created time.Time
+	// Asking is set by ASKING, and only valid for the next keyed command
+	Asking bool
+	// listeningPort and capa are told by REPLCONF of the redis replicas
+	listeningPort string
+	capa          map[string]bool
+	// limiter is the token bucket of rate limit
+	limiter *tokenBucket
+
+	// the fields below may be read by other connections, e.g. CLIENT LIST
+	mu         sync.Mutex
+	user       *acl.User
+	name       string
+	db         int
+	lastCmd    string
+	lastActive time.Time
+}
+
+func NewConnContext(id int64) *ConnContext {
+	now := time.Now()
+	return &ConnContext{
+		Id:         id,
+		Created:    now,
+		lastActive: now,
+	}
+}
+
+// connContext returns the context of conn, create one if not exists
+func connContext(conn Conn) *ConnContext {
+	if ctx, ok := conn.Context().(*ConnContext); ok {
+		return ctx
+	}
+	ctx := NewConnContext(0)
+	conn.SetContext(ctx)
+	return ctx
+}
+
+// touch records the command being served
+func (ctx *ConnContext) touch(command string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.lastCmd = command
+	ctx.lastActive = time.Now()
+}
+
+func (ctx *ConnContext) Name() string {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.name
+}
+
+func (ctx *ConnContext) SetName(name string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.name = name
+}
+
+// DB returns the index of database selected
+func (ctx *ConnContext) DB() int {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.db
+}
+
+func (ctx *ConnContext) SetDB(db int) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.db = db
+}
+
+// User returns the authenticated user, nil if not authenticated
+func (ctx *ConnContext) User() *acl.User {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.user
+}
+
+func (ctx *ConnContext) SetUser(user *acl.User) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.user = user
+}
+
+// LastCmd returns the last command and the time it was served
+func (ctx *ConnContext) LastCmd() (string, time.Time) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.lastCmd, ctx.lastActive
+}
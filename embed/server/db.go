@@ -0,0 +1,241 @@
+package server
+
+import (
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"strconv"
+	"strings"
+)
+
+// parseDB parses the index or the namespace name of database,
+// writes the error to the client and returns false if invalid
+func (h *CmdHandler) parseDB(conn Conn, arg []byte) (int, bool) {
+	db, ok := h.cfg.Namespaces[string(arg)]
+	if !ok {
+		var err error
+		if db, err = strconv.Atoi(string(arg)); err != nil {
+			conn.WriteError("ERR invalid DB index")
+			return 0, false
+		}
+	}
+	if db < 0 || db >= h.syncer.Databases() {
+		conn.WriteError("ERR DB index is out of range")
+		return 0, false
+	}
+	return db, true
+}
+
+// standalone writes the error to the client and returns false in
+// cluster mode, which has the database 0 only
+func (h *CmdHandler) standalone(conn Conn, cmd Command) bool {
+	if h.cluster.Enabled() {
+		conn.WriteError("ERR " + strings.ToUpper(string(cmd.Args[0])) + " is not allowed in cluster mode")
+		return false
+	}
+	return true
+}
+
+// selectDB handles SELECT index|namespace
+func (h *CmdHandler) selectDB(conn Conn, cmd Command) {
+	db, ok := h.parseDB(conn, cmd.Args[1])
+	if !ok {
+		return
+	}
+	if db != 0 && !h.standalone(conn, cmd) {
+		return
+	}
+	connContext(conn).SetDB(db)
+	conn.WriteString("OK")
+}
+
+// swapDB handles SWAPDB index index, the connections selecting one of
+// them see the data of the other one at once
+func (h *CmdHandler) swapDB(conn Conn, cmd Command) {
+	if !h.standalone(conn, cmd) || !h.writable(conn) {
+		return
+	}
+	a, ok := h.parseDB(conn, cmd.Args[1])
+	if !ok {
+		return
+	}
+	b, ok := h.parseDB(conn, cmd.Args[2])
+	if !ok {
+		return
+	}
+	if err := h.syncer.CheckSwap(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	err := h.syncer.Submit(&common.TxRequest{
+		TxId:   utils.GenerateId(),
+		Flag:   common.FlagReq,
+		Action: common.SWAPDB,
+		Key:    "*",
+		Val:    []byte(strconv.Itoa(b)),
+		Db:     a,
+	})
+	if err == nil {
+		err = h.commit(h.syncer.Queued())
+	}
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+// flushDB handles FLUSHDB [ASYNC|SYNC], the keys written before are
+// deleted asynchronously either way
+func (h *CmdHandler) flushDB(conn Conn, cmd Command) {
+	if !h.flushable(conn, cmd) {
+		return
+	}
+	if err := h.flush(connContext(conn).DB()); err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+// flushAll handles FLUSHALL [ASYNC|SYNC]
+func (h *CmdHandler) flushAll(conn Conn, cmd Command) {
+	if !h.flushable(conn, cmd) {
+		return
+	}
+	for db := 0; db < h.syncer.Databases(); db++ {
+		if err := h.flush(db); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+	conn.WriteString("OK")
+}
+
+func (h *CmdHandler) flushable(conn Conn, cmd Command) bool {
+	if len(cmd.Args) > 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return false
+	}
+	if len(cmd.Args) == 2 {
+		mode := strings.ToLower(string(cmd.Args[1]))
+		if mode != "async" && mode != "sync" {
+			conn.WriteError("ERR syntax error")
+			return false
+		}
+	}
+	return h.writable(conn)
+}
+
+// flush submits the flush of database, and waits until it's applied
+func (h *CmdHandler) flush(db int) error {
+	h.itemsMux.Lock()
+	err := h.submitFlush(db)
+	seq := h.syncer.Queued()
+	h.itemsMux.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return h.commit(seq)
+}
+
+// submitFlush submits the flush of database, itemsMux should be held.
+// In cluster mode the keys of the slots owned by current node are deleted
+// one by one instead, since they are replicated to the replicas of their
+// slots only.
+func (h *CmdHandler) submitFlush(db int) error {
+	if !h.cluster.Enabled() {
+		return h.syncer.Submit(&common.TxRequest{
+			TxId:   utils.GenerateId(),
+			Flag:   common.FlagReq,
+			Action: common.FLUSH,
+			Key:    "*",
+			Db:     db,
+		})
+	}
+	keys, _ := h.syncer.DB(db).Keys()
+	for _, key := range keys {
+		if h.cluster.Owner(cluster.KeySlot(key)) != h.cluster.Self() {
+			continue
+		}
+		err := h.syncer.Submit(&common.TxRequest{
+			TxId:   utils.GenerateId(),
+			Flag:   common.FlagReq,
+			Action: common.DEL,
+			Key:    key,
+			Db:     db,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move handles MOVE key db, replies 0 if the key doesn't exist or exists
+// in the target database
+func (h *CmdHandler) move(conn Conn, cmd Command) {
+	if !h.standalone(conn, cmd) || !h.writable(conn) {
+		return
+	}
+	target, ok := h.parseDB(conn, cmd.Args[2])
+	if !ok {
+		return
+	}
+	key := string(cmd.Args[1])
+	source := connContext(conn).DB()
+	if source == target {
+		conn.WriteError("ERR source and destination objects are the same")
+		return
+	}
+	if !h.withinQuota(conn, target, key) {
+		return
+	}
+
+	h.itemsMux.Lock()
+	val, err := h.syncer.DB(source).Get(key)
+	if err != nil {
+		h.itemsMux.Unlock()
+		conn.WriteInt(0)
+		return
+	}
+	if _, err = h.syncer.DB(target).Get(key); err == nil {
+		h.itemsMux.Unlock()
+		conn.WriteInt(0)
+		return
+	}
+	txId := utils.GenerateId()
+	err = h.syncer.Submit(&common.TxRequest{
+		TxId:   txId,
+		Flag:   common.FlagReq,
+		Action: common.SET,
+		Key:    key,
+		Val:    val.Val,
+		Db:     target,
+		Codec:  val.Codec,
+	})
+	if err == nil && val.Exp > 0 {
+		err = h.submitExpire(target, key, val.Exp, utils.GenerateIdAfter(txId))
+	}
+	if err == nil {
+		err = h.syncer.Submit(&common.TxRequest{
+			TxId:   utils.GenerateId(),
+			Flag:   common.FlagReq,
+			Action: common.DEL,
+			Key:    key,
+			Db:     source,
+		})
+	}
+	seq := h.syncer.Queued()
+	h.itemsMux.Unlock()
+
+	if err == nil {
+		err = h.commit(seq)
+	}
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteInt(1)
+}
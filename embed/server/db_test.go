@@ -0,0 +1,64 @@
+package server
+
+import (
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCmdHandler_SwapDB(t *testing.T) {
+	os.Setenv(common.EnvAddrs, "127.0.0.1:1")
+	withPeers := startServerConf(t, &config.Config{})
+	os.Unsetenv(common.EnvAddrs)
+
+	tests := []struct {
+		name string
+		sock string
+		want string
+	}{
+		{"standalone", startServer(t), "+OK"},
+		// not ordered with the writes of peers
+		{"with peers", withPeers, "-ERR SWAPDB is not supported with peers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialReplica(t, tt.sock)
+			c.send("SWAPDB", "0", "1")
+			if got := c.readLine(); got != tt.want {
+				t.Errorf("SWAPDB = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeMux_Arity(t *testing.T) {
+	c := dialReplica(t, startServer(t))
+	tests := [][]string{
+		{"SELECT"},
+		{"SWAPDB"},
+		{"SWAPDB", "0"},
+		{"MOVE"},
+		{"MOVE", "a"},
+		{"EXPIRE"},
+		{"EXPIRE", "a"},
+		{"PEXPIRE"},
+		{"PERSIST"},
+		{"TTL"},
+		{"PTTL"},
+		{"GET", "a", "b"},
+	}
+	for _, args := range tests {
+		c.send(args...)
+		want := "-ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command"
+		if got := c.readLine(); got != want {
+			t.Errorf("%v = %q, want %q", args, got, want)
+		}
+	}
+	// still served after them
+	c.send("PING")
+	if got := c.readLine(); got != "+PONG" {
+		t.Errorf("PING = %q, want +PONG", got)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"strconv"
+	"strings"
+)
+
+// parseExpire parses the EX seconds or PX milliseconds option of SET,
+// and returns the expiring unix millis
+func parseExpire(conn Conn, unit string, arg []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR value is not an integer or out of range")
+		return 0, false
+	}
+	switch strings.ToLower(unit) {
+	case "ex":
+		n *= 1000
+	case "px":
+	default:
+		conn.WriteError("ERR syntax error")
+		return 0, false
+	}
+	if n <= 0 {
+		conn.WriteError("ERR invalid expire time in 'set' command")
+		return 0, false
+	}
+	return utils.CurrentMillis() + n, true
+}
+
+// submitExpire submits the expiry of key, at 0 persists the key
+func (h *CmdHandler) submitExpire(db int, key string, at int64, txId int64) error {
+	return h.syncer.Submit(&common.TxRequest{
+		TxId:   txId,
+		Flag:   common.FlagReq,
+		Action: common.EXPIRE,
+		Key:    key,
+		Val:    []byte(strconv.FormatInt(at, 10)),
+		Db:     db,
+	})
+}
+
+// expire handles EXPIRE key seconds and PEXPIRE key milliseconds,
+// the key is deleted if the time is not positive
+func (h *CmdHandler) expire(conn Conn, cmd Command) {
+	n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	if strings.ToLower(string(cmd.Args[0])) == "expire" {
+		n *= 1000
+	}
+	key := string(cmd.Args[1])
+	if !h.writable(conn) || !h.route(conn, key) {
+		return
+	}
+
+	db := connContext(conn).DB()
+	h.itemsMux.Lock()
+	val, err := h.syncer.DB(db).Get(key)
+	if err != nil {
+		h.itemsMux.Unlock()
+		conn.WriteInt(0)
+		return
+	}
+	// ordered after the version of key, otherwise it's not applied
+	txId := utils.GenerateIdAfter(val.Ver)
+	if n <= 0 {
+		err = h.syncer.Submit(&common.TxRequest{
+			TxId:   txId,
+			Flag:   common.FlagReq,
+			Action: common.DEL,
+			Key:    key,
+			Db:     db,
+		})
+	} else {
+		err = h.submitExpire(db, key, utils.CurrentMillis()+n, txId)
+	}
+	seq := h.syncer.Queued()
+	h.itemsMux.Unlock()
+
+	if err == nil {
+		err = h.commit(seq)
+	}
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteInt(1)
+}
+
+func (h *CmdHandler) persist(conn Conn, cmd Command) {
+	key := string(cmd.Args[1])
+	if !h.writable(conn) || !h.route(conn, key) {
+		return
+	}
+
+	db := connContext(conn).DB()
+	h.itemsMux.Lock()
+	val, err := h.syncer.DB(db).Get(key)
+	if err != nil || val.Exp == 0 {
+		h.itemsMux.Unlock()
+		conn.WriteInt(0)
+		return
+	}
+	err = h.submitExpire(db, key, 0, utils.GenerateIdAfter(val.Ver))
+	seq := h.syncer.Queued()
+	h.itemsMux.Unlock()
+
+	if err == nil {
+		err = h.commit(seq)
+	}
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteInt(1)
+}
+
+// ttl handles TTL and PTTL, replies -2 if key not exists and -1 if
+// key has no expiry
+func (h *CmdHandler) ttl(conn Conn, cmd Command) {
+	key := string(cmd.Args[1])
+	if !h.route(conn, key) {
+		return
+	}
+
+	h.itemsMux.RLock()
+	val, err := h.db(conn).Get(key)
+	h.itemsMux.RUnlock()
+
+	switch {
+	case err != nil:
+		conn.WriteInt(-2)
+	case val.Exp == 0:
+		conn.WriteInt(-1)
+	default:
+		left := val.Exp - utils.CurrentMillis()
+		if left < 0 {
+			left = 0
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "ttl" {
+			left = (left + 500) / 1000
+		}
+		conn.WriteInt64(left)
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestCmdHandler_Expire(t *testing.T) {
+	c := dialReplica(t, startServer(t))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EXPIRE", "a", "100"}, ":0"},
+		{[]string{"SET", "a", "1"}, "+OK"},
+		// applied right after the set, whose version is ordered before
+		{[]string{"EXPIRE", "a", "100"}, ":1"},
+		{[]string{"TTL", "a"}, ":100"},
+		{[]string{"PERSIST", "a"}, ":1"},
+		{[]string{"TTL", "a"}, ":-1"},
+		{[]string{"PERSIST", "a"}, ":0"},
+		{[]string{"PEXPIRE", "a", "0"}, ":1"},
+		{[]string{"TTL", "a"}, ":-2"},
+	}
+	for _, tt := range tests {
+		c.send(tt.args...)
+		if got := c.readLine(); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -1,24 +1,115 @@
 package server
 
 import (
+	"context"
 	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/cluster"
 	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
 	"github.com/edditen/evolvest/pkg/common/utils"
 	"github.com/edditen/evolvest/pkg/store"
 	"sync"
+	"time"
 )
 
 type CmdHandler struct {
+	cfg      *config.Config
 	itemsMux sync.RWMutex
 	syncer   *store.Syncer
+	cluster  *cluster.Cluster
+	acl      *acl.ACL
+	mux      *ServeMux
+	pubsub   *PubSub
+	repl     *replMaster
+	// limits is nil if no limit is configured
+	limits *Limits
+	// conns returns the client connections being served
+	conns   func() []Conn
+	started time.Time
 }
 
-func NewHandler(syncer *store.Syncer) *CmdHandler {
+func NewHandler(conf *config.Config, syncer *store.Syncer, c *cluster.Cluster, a *acl.ACL) *CmdHandler {
 	return &CmdHandler{
-		syncer: syncer,
+		cfg:     conf,
+		syncer:  syncer,
+		cluster: c,
+		acl:     a,
+		started: time.Now(),
 	}
 }
 
+// db returns the store of database selected by conn
+func (h *CmdHandler) db(conn Conn) store.Store {
+	return h.syncer.DB(connContext(conn).DB())
+}
+
+// commit waits until the first seq requests queued are applied and
+// logged, so that the writes are durable as appendfsync once replied.
+// The seq is taken with itemsMux held, and waited for without it, so
+// that the writes of other clients are batched meanwhile.
+func (h *CmdHandler) commit(seq int64) error {
+	return h.syncer.WaitApplied(context.Background(), seq)
+}
+
+// route writes MOVED or ASK error to the client and returns false
+// if the key is not served by current node.
+func (h *CmdHandler) route(conn Conn, key string) bool {
+	ctx := connContext(conn)
+	asking := ctx.Asking
+	ctx.Asking = false
+	err := h.cluster.Route(key, asking, func() bool {
+		_, err := h.db(conn).Get(key)
+		return err == nil
+	})
+	if err != nil {
+		conn.WriteError(err.Error())
+		return false
+	}
+	return true
+}
+
+// allocatable writes OOM error to the client and returns false
+// if the memory limit is reached and no key can be evicted.
+func (h *CmdHandler) allocatable(conn Conn) bool {
+	if err := h.syncer.CheckMemory(); err != nil {
+		conn.WriteError(err.Error())
+		return false
+	}
+	return true
+}
+
+// routeKeys routes the keys of a multi-key command, which should
+// belong to the same slot in cluster mode
+func (h *CmdHandler) routeKeys(conn Conn, keys []string) bool {
+	if !h.cluster.Enabled() {
+		return true
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			conn.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+			return false
+		}
+	}
+	ctx := connContext(conn)
+	asking := ctx.Asking
+	ctx.Asking = false
+	err := h.cluster.Route(keys[0], asking, func() bool {
+		for _, key := range keys {
+			if _, err := h.db(conn).Get(key); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		conn.WriteError(err.Error())
+		return false
+	}
+	return true
+}
+
 func (h *CmdHandler) detach(conn Conn, cmd Command) {
 	log := etlog.Log.WithField("cmd", cmd.Args[0])
 	detachedConn := conn.Detach()
@@ -41,21 +132,46 @@ func (h *CmdHandler) quit(conn Conn, cmd Command) {
 }
 
 func (h *CmdHandler) set(conn Conn, cmd Command) {
-	if len(cmd.Args) != 3 {
+	if len(cmd.Args) != 3 && len(cmd.Args) != 5 {
 		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 		return
 	}
+	var at int64
+	if len(cmd.Args) == 5 {
+		var ok bool
+		if at, ok = parseExpire(conn, string(cmd.Args[3]), cmd.Args[4]); !ok {
+			return
+		}
+	}
+	if !h.writable(conn) || !h.route(conn, string(cmd.Args[1])) || !h.allocatable(conn) {
+		return
+	}
 
+	db := connContext(conn).DB()
 	h.itemsMux.Lock()
-	h.syncer.Submit(&common.TxRequest{
-		TxId:   utils.GenerateId(),
+	txId := utils.GenerateId()
+	err := h.syncer.Submit(&common.TxRequest{
+		TxId:   txId,
 		Flag:   common.FlagReq,
 		Action: common.SET,
 		Key:    string(cmd.Args[1]),
 		Val:    cmd.Args[2],
+		Db:     db,
 	})
+	if err == nil && at > 0 {
+		// ordered after the set, which is discarded otherwise
+		err = h.submitExpire(db, string(cmd.Args[1]), at, utils.GenerateIdAfter(txId))
+	}
+	seq := h.syncer.Queued()
 	h.itemsMux.Unlock()
 
+	if err == nil {
+		err = h.commit(seq)
+	}
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
 	conn.WriteString("OK")
 }
 
@@ -64,33 +180,109 @@ func (h *CmdHandler) get(conn Conn, cmd Command) {
 		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 		return
 	}
+	if !h.route(conn, string(cmd.Args[1])) {
+		return
+	}
 
 	h.itemsMux.RLock()
-	val, err := h.syncer.Store.Get(string(cmd.Args[1]))
+	val, err := h.db(conn).Get(string(cmd.Args[1]))
 	h.itemsMux.RUnlock()
 
 	if err != nil {
 		conn.WriteNull()
-	} else {
-		conn.WriteBulk(val.Val)
+		return
+	}
+	writeValue(conn, val)
+}
+
+// writeValue writes the original bytes of the value to the client
+func writeValue(conn Conn, val store.DataItem) {
+	b, err := val.Value()
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
 	}
+	conn.WriteBulk(b)
 }
 
 func (h *CmdHandler) delete(conn Conn, cmd Command) {
-	if len(cmd.Args) != 2 {
+	if len(cmd.Args) < 2 {
 		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 		return
 	}
+	keys := make([]string, 0, len(cmd.Args)-1)
+	for _, arg := range cmd.Args[1:] {
+		keys = append(keys, string(arg))
+	}
+	if !h.writable(conn) || !h.routeKeys(conn, keys) {
+		return
+	}
 
+	// the keys are counted after the writes queued before are applied,
+	// which may set or delete them. It's waited without the lock, so the
+	// ones queued concurrently are not waited for.
+	if h.syncer.Pending() > 0 {
+		if err := h.commit(h.syncer.Queued()); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+	deleted := 0
+	db := connContext(conn).DB()
 	h.itemsMux.Lock()
-	h.syncer.Submit(&common.TxRequest{
-		TxId:   utils.GenerateId(),
-		Flag:   common.FlagReq,
-		Action: common.DEL,
-		Key:    string(cmd.Args[1]),
-	})
-
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, err := h.syncer.DB(db).Get(key); err == nil {
+			deleted++
+		}
+		if err := h.syncer.Submit(&common.TxRequest{
+			TxId:   utils.GenerateId(),
+			Flag:   common.FlagReq,
+			Action: common.DEL,
+			Key:    key,
+			Db:     db,
+		}); err != nil {
+			h.itemsMux.Unlock()
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+	seq := h.syncer.Queued()
 	h.itemsMux.Unlock()
 
-	conn.WriteInt(1)
+	if err := h.commit(seq); err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteInt(deleted)
+}
+
+func (h *CmdHandler) mget(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	keys := make([]string, 0, len(cmd.Args)-1)
+	for _, arg := range cmd.Args[1:] {
+		keys = append(keys, string(arg))
+	}
+	if !h.routeKeys(conn, keys) {
+		return
+	}
+
+	st := h.db(conn)
+	h.itemsMux.RLock()
+	defer h.itemsMux.RUnlock()
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		if val, err := st.Get(key); err != nil {
+			conn.WriteNull()
+		} else {
+			writeValue(conn, val)
+		}
+	}
 }
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestCmdHandler_Delete(t *testing.T) {
+	c := dialReplica(t, startServer(t))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "a", "1"}, "+OK"},
+		{[]string{"SET", "b", "1"}, "+OK"},
+		// the keys repeated are counted once
+		{[]string{"DEL", "a", "b", "c", "a"}, ":2"},
+		{[]string{"GET", "a"}, "$-1"},
+		{[]string{"DEL", "a"}, ":0"},
+	}
+	for _, tt := range tests {
+		c.send(tt.args...)
+		if got := c.readLine(); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/store"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redisVersion is the redis version reported to clients, some of which
+// choose the protocol features by it
+const redisVersion = "6.0.0"
+
+// infoSections are the sections of INFO in order
+var infoSections = []string{
+	"server", "clients", "memory", "persistence", "stats", "replication", "cluster", "keyspace",
+}
+
+func (h *CmdHandler) dbsize(conn Conn, cmd Command) {
+	conn.WriteInt(h.db(conn).Len())
+}
+
+// info handles INFO [section ...], all sections are returned if
+// no section, "all", "default" or "everything" is given.
+func (h *CmdHandler) info(conn Conn, cmd Command) {
+	sections := make([]string, 0)
+	for _, arg := range cmd.Args[1:] {
+		section := strings.ToLower(string(arg))
+		if section == "all" || section == "default" || section == "everything" {
+			sections = infoSections
+			break
+		}
+		sections = append(sections, section)
+	}
+	if len(sections) == 0 {
+		sections = infoSections
+	}
+
+	var sb strings.Builder
+	for _, section := range sections {
+		lines := h.infoSection(section)
+		if lines == nil {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		sb.WriteString("# " + strings.Title(section) + "\r\n")
+		for _, line := range lines {
+			sb.WriteString(line + "\r\n")
+		}
+	}
+	conn.WriteBulkString(sb.String())
+}
+
+func (h *CmdHandler) infoSection(section string) []string {
+	switch section {
+	case "server":
+		uptime := int64(time.Since(h.started).Seconds())
+		return []string{
+			"redis_version:" + redisVersion,
+			"redis_mode:" + h.redisMode(),
+			"os:" + runtime.GOOS + " " + runtime.GOARCH,
+			"go_version:" + runtime.Version(),
+			fmt.Sprintf("process_id:%d", os.Getpid()),
+			"tcp_port:" + h.cfg.ServerPort,
+			"sync_port:" + h.cfg.SyncPort,
+			fmt.Sprintf("uptime_in_seconds:%d", uptime),
+			fmt.Sprintf("uptime_in_days:%d", uptime/86400),
+		}
+	case "clients":
+		return []string{
+			fmt.Sprintf("connected_clients:%d", len(h.conns())),
+		}
+	case "memory":
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		used := h.syncer.Size()
+		policy := h.cfg.MaxMemoryPolicy
+		if policy == "" {
+			policy = store.PolicyNoEviction
+		}
+		return []string{
+			fmt.Sprintf("used_memory:%d", used),
+			"used_memory_human:" + humanBytes(used),
+			fmt.Sprintf("used_memory_rss:%d", ms.Sys),
+			"used_memory_rss_human:" + humanBytes(int64(ms.Sys)),
+			fmt.Sprintf("heap_alloc:%d", ms.HeapAlloc),
+			fmt.Sprintf("num_gc:%d", ms.NumGC),
+			fmt.Sprintf("maxmemory:%d", h.cfg.MaxMemory),
+			"maxmemory_human:" + humanBytes(h.cfg.MaxMemory),
+			"maxmemory_policy:" + policy,
+			fmt.Sprintf("evicted_keys:%d", h.syncer.Evicted()),
+		}
+	case "persistence":
+		loading := 0
+		if !h.syncer.Ready() {
+			loading = 1
+		}
+		return []string{
+			fmt.Sprintf("loading:%d", loading),
+			fmt.Sprintf("rdb_last_save_time:%d", h.syncer.LastSnapshot()),
+			"aof_enabled:1",
+			fmt.Sprintf("last_tx_id:%d", h.syncer.LastTxId()),
+		}
+	case "stats":
+		var throttled, rejected int64
+		if h.limits != nil {
+			throttled, rejected = h.limits.Throttled(), h.limits.Rejected()
+		}
+		return []string{
+			fmt.Sprintf("throttled_commands:%d", throttled),
+			fmt.Sprintf("quota_rejected_commands:%d", rejected),
+		}
+	case "replication":
+		return h.replicationInfo()
+	case "cluster":
+		enabled := 0
+		if h.cluster.Enabled() {
+			enabled = 1
+		}
+		return []string{
+			fmt.Sprintf("cluster_enabled:%d", enabled),
+		}
+	case "keyspace":
+		lines := make([]string, 0)
+		for i := 0; i < h.syncer.Databases(); i++ {
+			if keys := h.syncer.DB(i).Len(); keys > 0 {
+				lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=0,avg_ttl=0", i, keys))
+			}
+		}
+		return lines
+	}
+	return nil
+}
+
+func (h *CmdHandler) redisMode() string {
+	if h.cluster.Enabled() {
+		return "cluster"
+	}
+	return "standalone"
+}
+
+func (h *CmdHandler) replicationInfo() []string {
+	role, upstream, state := h.syncer.Replicator.Role()
+	offset := h.syncer.LastTxId()
+	lines := make([]string, 0)
+	if role == common.RoleReplica {
+		host, port, _ := net.SplitHostPort(store.UpstreamAddr(upstream))
+		status := "down"
+		if state == store.StateConnected {
+			status = "up"
+		}
+		lines = append(lines,
+			"role:slave",
+			"master_host:"+host,
+			"master_port:"+port,
+			"master_link_status:"+status,
+			"master_link_state:"+state,
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+
+	replicas := h.syncer.Replicator.Replicas()
+	redisReplicas := h.repl.Replicas()
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(replicas)+len(redisReplicas)))
+	for i, addr := range replicas {
+		host, port, _ := net.SplitHostPort(addr)
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=%d,lag=0",
+			i, host, port, offset))
+	}
+	// the redis replicas are streamed from the backlog, of its own offsets
+	for i, r := range redisReplicas {
+		host, port, _ := net.SplitHostPort(r.addr)
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=%d,lag=0",
+			len(replicas)+i, host, port, atomic.LoadInt64(&r.ack)))
+	}
+	b := h.repl.backlog
+	streamOffset, first := b.info()
+	active := 0
+	if b.covers(streamOffset) {
+		active = 1
+	}
+	return append(lines,
+		fmt.Sprintf("master_repl_offset:%d", offset),
+		"master_replid:"+b.replId,
+		fmt.Sprintf("repl_stream_offset:%d", streamOffset),
+		fmt.Sprintf("repl_backlog_active:%d", active),
+		fmt.Sprintf("repl_backlog_size:%d", len(b.ring)),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", first),
+		fmt.Sprintf("repl_backlog_histlen:%d", streamOffset-first+1),
+	)
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
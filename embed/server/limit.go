@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/metrics"
+	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	limitConn     = "conn"
+	limitUser     = "user"
+	limitMaxKeys  = "max_keys"
+	limitMaxBytes = "max_bytes"
+)
+
+// tokenBucket allows rate tokens per second, up to burst tokens at once
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes a token, returns false if there is none
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// quota is the quota of a database
+type quota struct {
+	config.QuotaConfig
+	// name is the namespace or the number of database in config
+	name string
+}
+
+// Limits enforces the rate limits of connections and users, and the
+// quotas of databases
+type Limits struct {
+	conf   config.RateLimitConfig
+	syncer *store.Syncer
+	// quotas by the number of database, nil if unlimited
+	quotas []*quota
+
+	mu    sync.Mutex
+	users map[string]*tokenBucket
+
+	throttled int64
+	rejected  int64
+}
+
+// NewLimits creates the limits of conf, the names of quotas should be
+// namespaces or numbers of databases
+func NewLimits(conf *config.Config, syncer *store.Syncer) (*Limits, error) {
+	l := &Limits{
+		conf:   conf.RateLimit,
+		syncer: syncer,
+		quotas: make([]*quota, conf.DatabaseCount()),
+		users:  make(map[string]*tokenBucket),
+	}
+	for name, qc := range conf.Quotas {
+		db, ok := conf.Namespaces[name]
+		if !ok {
+			var err error
+			if db, err = strconv.Atoi(name); err != nil {
+				return nil, errors.Errorf("quota of unknown namespace %s", name)
+			}
+		}
+		if db < 0 || db >= len(l.quotas) {
+			return nil, errors.Errorf("quota of database %s out of range", name)
+		}
+		if l.quotas[db] != nil {
+			return nil, errors.Errorf("multiple quotas of database %d", db)
+		}
+		l.quotas[db] = &quota{QuotaConfig: qc, name: name}
+	}
+	return l, nil
+}
+
+// Enabled tells whether any limit is configured
+func (l *Limits) Enabled() bool {
+	if l.conf.Conn > 0 || l.conf.User > 0 || len(l.conf.Users) > 0 {
+		return true
+	}
+	for _, q := range l.quotas {
+		if q != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// allow takes a token of the connection and its user, returns the
+// error replied if either is exhausted
+func (l *Limits) allow(ctx *ConnContext) error {
+	now := time.Now()
+	if l.conf.Conn > 0 {
+		if ctx.limiter == nil {
+			ctx.limiter = newTokenBucket(l.conf.Conn, l.conf.BurstSize(l.conf.Conn))
+		}
+		if !ctx.limiter.take(now) {
+			return l.throttle(limitConn, "THROTTLED rate limit of connection exceeded")
+		}
+	}
+
+	name := acl.DefaultUser
+	if user := ctx.User(); user != nil {
+		name = user.Name
+	}
+	rate := l.conf.UserRate(name)
+	if rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	bucket, ok := l.users[name]
+	if !ok {
+		bucket = newTokenBucket(rate, l.conf.BurstSize(rate))
+		l.users[name] = bucket
+	}
+	l.mu.Unlock()
+	if !bucket.take(now) {
+		return l.throttle(limitUser, fmt.Sprintf("THROTTLED rate limit of user '%s' exceeded", name))
+	}
+	return nil
+}
+
+func (l *Limits) throttle(limit, msg string) error {
+	atomic.AddInt64(&l.throttled, 1)
+	metrics.ThrottledCommands.WithLabelValues(limit).Inc()
+	return errors.New(msg)
+}
+
+// checkQuota returns the error replied if adding keys to database db
+// exceeds its quota, the keys existing already are not counted. The
+// writes queued are waited for once they may reach the quota, so that
+// they're counted too.
+func (l *Limits) checkQuota(db int, keys []string) error {
+	if db < 0 || db >= len(l.quotas) || l.quotas[db] == nil {
+		return nil
+	}
+	q, st := l.quotas[db], l.syncer.DB(db)
+	if pending := l.syncer.Pending(); pending > 0 &&
+		(q.MaxBytes > 0 || (q.MaxKeys > 0 && st.Len()+int(pending) >= q.MaxKeys)) {
+		if err := l.syncer.WaitApplied(context.Background(), l.syncer.Queued()); err != nil {
+			return errors.New("ERR " + err.Error())
+		}
+	}
+	if q.MaxBytes > 0 && st.Size() >= q.MaxBytes {
+		return l.reject(limitMaxBytes, q)
+	}
+	if q.MaxKeys > 0 && st.Len() >= q.MaxKeys {
+		for _, key := range keys {
+			if _, err := st.Get(key); err != nil {
+				return l.reject(limitMaxKeys, q)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Limits) reject(limit string, q *quota) error {
+	atomic.AddInt64(&l.rejected, 1)
+	metrics.ThrottledCommands.WithLabelValues(limit).Inc()
+	return errors.Errorf("QUOTA %s of namespace '%s' exceeded", limit, q.name)
+}
+
+// Throttled returns the count of commands refused by rate limits
+func (l *Limits) Throttled() int64 {
+	return atomic.LoadInt64(&l.throttled)
+}
+
+// Rejected returns the count of commands refused by quotas
+func (l *Limits) Rejected() int64 {
+	return atomic.LoadInt64(&l.rejected)
+}
+
+// withinQuota writes the error to the client and returns false if
+// adding key to database db exceeds its quota
+func (h *CmdHandler) withinQuota(conn Conn, db int, key string) bool {
+	if h.limits == nil {
+		return true
+	}
+	if err := h.limits.checkQuota(db, []string{key}); err != nil {
+		conn.WriteError(err.Error())
+		return false
+	}
+	return true
+}
+
+// LimitHandler refuses the command beyond the rate limits, or adding
+// data to the selected database beyond its quota.
+type LimitHandler struct {
+	info    CommandInfo
+	exempt  bool
+	denyoom bool
+	limits  *Limits
+	next    Handler
+}
+
+func NewLimitHandler(info CommandInfo, l *Limits, next Handler) *LimitHandler {
+	h := &LimitHandler{info: info, limits: l, next: next}
+	for _, flag := range info.Flags {
+		switch flag {
+		case flagNoAuth:
+			// AUTH and QUIT are always served
+			h.exempt = true
+		case "denyoom":
+			h.denyoom = true
+		}
+	}
+	return h
+}
+
+func (h *LimitHandler) ServeRESP(conn Conn, cmd Command) {
+	if h.exempt {
+		h.next.ServeRESP(conn, cmd)
+		return
+	}
+	ctx := connContext(conn)
+	if err := h.limits.allow(ctx); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if h.denyoom {
+		if err := h.limits.checkQuota(ctx.DB(), commandKeys(h.info, cmd)); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+	}
+	h.next.ServeRESP(conn, cmd)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/edditen/evolvest/pkg/common/config"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(10, 2)
+	b.last = start
+	tests := []struct {
+		elapsed time.Duration
+		want    bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{50 * time.Millisecond, false},
+		{100 * time.Millisecond, true},
+		{100 * time.Millisecond, false},
+		// refilled up to burst only
+		{time.Second, true},
+		{time.Second, true},
+		{time.Second, false},
+	}
+	for i, tt := range tests {
+		if got := b.take(start.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("#%d take(+%v) = %v, want %v", i, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestLimitHandler(t *testing.T) {
+	sock := startServerConf(t, &config.Config{
+		Namespaces: map[string]int{"small": 1},
+		Quotas:     map[string]config.QuotaConfig{"small": {MaxKeys: 1}},
+		RateLimit:  config.RateLimitConfig{Conn: 0.001, Burst: 6000},
+	})
+	c := dialReplica(t, sock)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SELECT", "small"}, "+OK"},
+		{[]string{"SET", "a", "1"}, "+OK"},
+		// overwriting adds no key
+		{[]string{"SET", "a", "2"}, "+OK"},
+		{[]string{"SET", "b", "1"}, "-QUOTA max_keys of namespace 'small' exceeded"},
+		{[]string{"DEL", "a"}, ":1"},
+		// the delete is counted once replied
+		{[]string{"SET", "b", "1"}, "+OK"},
+		// 6 tokens are taken
+		{[]string{"PING"}, "-THROTTLED rate limit of connection exceeded"},
+	}
+	for _, tt := range tests {
+		c.send(tt.args...)
+		if got := c.readLine(); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
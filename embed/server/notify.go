@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+)
+
+// flags of keyspace notifications, same as notify-keyspace-events of redis
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyAll = notifyGeneric | notifyString
+)
+
+// the channels of notifications, with the database and the key or event
+const (
+	keyspaceChannel = "__keyspace@%d__:%s"
+	keyeventChannel = "__keyevent@%d__:%s"
+)
+
+// parseNotifyFlags parses flags like "KEA" or "Kg$"
+func parseNotifyFlags(flags string) (int, error) {
+	f := 0
+	for _, c := range flags {
+		switch c {
+		case 'K':
+			f |= notifyKeyspace
+		case 'E':
+			f |= notifyKeyevent
+		case 'g':
+			f |= notifyGeneric
+		case '$':
+			f |= notifyString
+		case 'A':
+			f |= notifyAll
+		default:
+			return 0, fmt.Errorf("invalid keyspace events flag '%c'", c)
+		}
+	}
+	return f, nil
+}
+
+// notifier publishes the keyspace notifications of the applied requests,
+// the requests are queued so that the syncer is never blocked by the
+// slow subscribers.
+type notifier struct {
+	flags   int
+	pubsub  *PubSub
+	cluster *cluster.Cluster
+	reqC    chan *common.TxRequest
+}
+
+func newNotifier(flags int, ps *PubSub, c *cluster.Cluster) *notifier {
+	return &notifier{
+		flags:   flags,
+		pubsub:  ps,
+		cluster: c,
+		reqC:    make(chan *common.TxRequest, 10000),
+	}
+}
+
+func (n *notifier) notify(req *common.TxRequest) {
+	if req.Action == common.FLUSH || req.Action == common.SWAPDB {
+		return
+	}
+	class := notifyString
+	if req.Action == common.DEL || req.Action == common.EXPIRE {
+		class = notifyGeneric
+	}
+	if n.flags&class == 0 || n.flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return
+	}
+	// the replicas of slot keep silent, so that the events are not
+	// received twice by the ones subscribing all nodes
+	if n.cluster.Enabled() && n.cluster.Owner(cluster.KeySlot(req.Key)) != n.cluster.Self() {
+		return
+	}
+	select {
+	case n.reqC <- req:
+	default:
+		etlog.Log.WithField("key", req.Key).Warn("keyspace notification queue is full, drop")
+	}
+}
+
+func (n *notifier) run(stop <-chan interface{}) {
+	for {
+		select {
+		case req := <-n.reqC:
+			if n.flags&notifyKeyspace != 0 {
+				n.pubsub.Publish(fmt.Sprintf(keyspaceChannel, req.Db, req.Key), req.Action)
+			}
+			if n.flags&notifyKeyevent != 0 {
+				n.pubsub.Publish(fmt.Sprintf(keyeventChannel, req.Db, req.Action), req.Key)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *CmdHandler) subscribe(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	for _, channel := range cmd.Args[1:] {
+		h.pubsub.Subscribe(conn, string(channel))
+	}
+}
+
+func (h *CmdHandler) psubscribe(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	for _, pattern := range cmd.Args[1:] {
+		h.pubsub.Psubscribe(conn, string(pattern))
+	}
+}
+
+func (h *CmdHandler) publish(conn Conn, cmd Command) {
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	conn.WriteInt(h.pubsub.Publish(string(cmd.Args[1]), string(cmd.Args[2])))
+}
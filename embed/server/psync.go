@@ -0,0 +1,478 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/dump"
+	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// replPingInterval is the interval of PING sent to the redis replicas
+	replPingInterval = 10 * time.Second
+	// replTimeout closes the replicas which don't ack for the duration
+	replTimeout = 60 * time.Second
+)
+
+var errBacklogLost = errors.New("the replica fell out of the backlog")
+
+// backlog is the replication stream served to the redis replicas, the
+// applied requests are appended as RESP commands, and the latest bytes are
+// kept in a ring so that the replicas reconnected continue by offset.
+type backlog struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	replId string
+	ring   []byte
+	// offset is the count of bytes written to the stream
+	offset int64
+	// started is set by the first full sync, the requests applied before
+	// are in the rdb of the replicas
+	started bool
+	closed  bool
+}
+
+func newBacklog(size int) *backlog {
+	id := make([]byte, 20)
+	rand.Read(id)
+	b := &backlog{replId: hex.EncodeToString(id), ring: make([]byte, size)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// start starts the stream if not yet, and returns the current offset
+func (b *backlog) start() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.started = true
+	return b.offset
+}
+
+func (b *backlog) write(data []byte) {
+	b.mu.Lock()
+	if !b.started || b.closed {
+		b.mu.Unlock()
+		return
+	}
+	size := int64(len(b.ring))
+	for len(data) > 0 {
+		n := copy(b.ring[b.offset%size:], data)
+		data = data[n:]
+		b.offset += int64(n)
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// covers tells whether the stream after pos is still in the backlog
+func (b *backlog) covers(pos int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.started && pos >= 0 && pos <= b.offset && b.offset-pos <= int64(len(b.ring))
+}
+
+// read copies the stream after pos to p, it waits for the writes and
+// returns io.EOF if the backlog is closed or stopped returns true.
+func (b *backlog) read(pos int64, p []byte, stopped func() bool) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for pos == b.offset && !b.closed && !stopped() {
+		b.cond.Wait()
+	}
+	if b.closed || stopped() {
+		return 0, io.EOF
+	}
+	size := int64(len(b.ring))
+	if pos < 0 || pos > b.offset || b.offset-pos > size {
+		return 0, errBacklogLost
+	}
+	i := pos % size
+	end := i + b.offset - pos
+	if end > size {
+		end = size
+	}
+	return copy(p, b.ring[i:end]), nil
+}
+
+// wakeup wakes up the readers to check whether they are stopped
+func (b *backlog) wakeup() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *backlog) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// info returns the offset of stream, and the first offset in the backlog
+func (b *backlog) info() (offset, first int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	first = b.offset - int64(len(b.ring))
+	if first < 0 {
+		first = 0
+	}
+	return b.offset, first + 1
+}
+
+// appendCommand appends args as a RESP array of bulks
+func appendCommand(b []byte, args ...[]byte) []byte {
+	b = AppendArray(b, len(args))
+	for _, arg := range args {
+		b = AppendBulk(b, arg)
+	}
+	return b
+}
+
+// replCommand returns the redis command of the applied request,
+// an expire at 0 removes the ttl, and a compressed value is decompressed
+func replCommand(req *common.TxRequest) []byte {
+	key := []byte(req.Key)
+	switch req.Action {
+	case common.SET:
+		val, err := req.Codec.Decode(req.Val)
+		if err != nil {
+			etlog.Log.WithError(err).WithField("key", req.Key).Warn("decode value failed")
+			return nil
+		}
+		return appendCommand(nil, []byte("SET"), key, val)
+	case common.DEL:
+		return appendCommand(nil, []byte("DEL"), key)
+	case common.EXPIRE:
+		if string(req.Val) == "0" {
+			return appendCommand(nil, []byte("PERSIST"), key)
+		}
+		return appendCommand(nil, []byte("PEXPIREAT"), key, req.Val)
+	case common.FLUSH:
+		return appendCommand(nil, []byte("FLUSHDB"))
+	case common.SWAPDB:
+		return appendCommand(nil, []byte("SWAPDB"), []byte(strconv.Itoa(req.Db)), req.Val)
+	}
+	return nil
+}
+
+// keptCommands returns the commands writing the keys of st again after
+// the FLUSHDB of a flush, since the flush keeps the keys written after
+// its version but redis deletes all. st is read after the batch of the
+// flush applied, so the later writes of the batch are replayed on them.
+func keptCommands(st store.Store) []byte {
+	var b []byte
+	st.Range(func(key string, val store.DataItem) bool {
+		v, err := val.Value()
+		if err != nil {
+			etlog.Log.WithError(err).WithField("key", key).Warn("decode value failed")
+			return true
+		}
+		b = appendCommand(b, []byte("SET"), []byte(key), v)
+		if val.Exp > 0 {
+			b = appendCommand(b, []byte("PEXPIREAT"), []byte(key), []byte(strconv.FormatInt(val.Exp, 10)))
+		}
+		return true
+	})
+	return b
+}
+
+// redisReplica is a redis replica following current node
+type redisReplica struct {
+	addr string
+	// ack is the offset acked by the replica
+	ack     int64
+	stopped int32
+}
+
+// replMaster serves the redis replicas by SYNC and PSYNC, with the rdb
+// generated from the storage, followed by the stream of backlog.
+type replMaster struct {
+	syncer  *store.Syncer
+	backlog *backlog
+	mu      sync.Mutex
+	// replicas are the ones being streamed, excluding the ones in full sync
+	replicas map[*redisReplica]bool
+	// db is the database selected by the stream, -1 after a full sync
+	// started so that the replicas loading rdb select it again
+	db int
+}
+
+func newReplMaster(syncer *store.Syncer, size int) *replMaster {
+	return &replMaster{
+		syncer:   syncer,
+		backlog:  newBacklog(size),
+		replicas: make(map[*redisReplica]bool),
+	}
+}
+
+// feed appends the applied request to the stream
+func (m *replMaster) feed(req *common.TxRequest) {
+	cmd := replCommand(req)
+	if cmd == nil {
+		return
+	}
+	if st := m.syncer.DB(req.Db); req.Action == common.FLUSH && st != nil {
+		cmd = append(cmd, keptCommands(st)...)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if req.Db != m.db {
+		cmd = append(appendCommand(nil, []byte("SELECT"), []byte(strconv.Itoa(req.Db))), cmd...)
+		m.db = req.Db
+	}
+	m.backlog.write(cmd)
+}
+
+// startFull starts the backlog for a full sync, returns the offset
+// the stream starts at
+func (m *replMaster) startFull() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.db = -1
+	return m.backlog.start()
+}
+
+// run pings the replicas periodically through the stream,
+// and closes the stream once stopped
+func (m *replMaster) run(stop <-chan interface{}) {
+	ticker := time.NewTicker(replPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if len(m.Replicas()) > 0 {
+				m.backlog.write(appendCommand(nil, []byte("PING")))
+			}
+		case <-stop:
+			m.backlog.close()
+			return
+		}
+	}
+}
+
+// Replicas returns the redis replicas being streamed
+func (m *replMaster) Replicas() []*redisReplica {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	replicas := make([]*redisReplica, 0, len(m.replicas))
+	for r := range m.replicas {
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
+// fullSync writes the rdb of storage to w, by the diskless format of
+// "$EOF:<mark>" if eof is supported by replica, or "$<len>" of a temp file
+func (m *replMaster) fullSync(w io.Writer, eof bool) error {
+	if eof {
+		mark := make([]byte, 20)
+		rand.Read(mark)
+		delim := hex.EncodeToString(mark)
+		if _, err := io.WriteString(w, "$EOF:"+delim+"\r\n"); err != nil {
+			return err
+		}
+		if err := m.writeRDB(w); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, delim)
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "evolvest-sync-*.rdb")
+	if err != nil {
+		return errors.Wrap(err, "create rdb file error")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := m.writeRDB(f); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "$%d\r\n", size); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (m *replMaster) writeRDB(w io.Writer) error {
+	enc, err := dump.NewRDBEncoder(w)
+	if err != nil {
+		return err
+	}
+	_, err = store.Export(m.syncer.Stores(), enc)
+	return errors.Wrap(err, "write rdb error")
+}
+
+// serve syncs the replica, and streams the backlog after pos. The rdb
+// is not a point-in-time view, the writes applied since pos are replayed
+// on it, which makes the same data since the writes are idempotent.
+func (m *replMaster) serve(dc DetachedConn, r *redisReplica, pos int64, full, eof bool) {
+	defer dc.Close()
+	log := etlog.Log.WithField("replica", r.addr)
+	nc := dc.NetConn()
+	if full {
+		w := bufio.NewWriter(nc)
+		err := m.fullSync(w, eof)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.WithError(err).Warn("full sync redis replica failed")
+			return
+		}
+		log.WithField("offset", pos).Info("full sync redis replica done")
+	}
+
+	m.mu.Lock()
+	m.replicas[r] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.replicas, r)
+		m.mu.Unlock()
+	}()
+
+	go m.readAcks(dc, r)
+	stopped := func() bool { return atomic.LoadInt32(&r.stopped) == 1 }
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := m.backlog.read(pos, buf, stopped)
+		if err != nil {
+			if err != io.EOF {
+				log.WithError(err).Warn("stop streaming to redis replica")
+			}
+			return
+		}
+		if _, err := nc.Write(buf[:n]); err != nil {
+			log.WithError(err).Warn("stream to redis replica failed")
+			return
+		}
+		pos += int64(n)
+	}
+}
+
+// readAcks records the offsets acked by the replica, the stream is stopped
+// if the replica is disconnected or times out
+func (m *replMaster) readAcks(dc DetachedConn, r *redisReplica) {
+	defer func() {
+		atomic.StoreInt32(&r.stopped, 1)
+		m.backlog.wakeup()
+	}()
+	for {
+		dc.NetConn().SetReadDeadline(time.Now().Add(replTimeout))
+		cmd, err := dc.ReadCommand()
+		if err != nil {
+			return
+		}
+		if len(cmd.Args) >= 3 && strings.ToLower(string(cmd.Args[0])) == "replconf" &&
+			strings.ToLower(string(cmd.Args[1])) == "ack" {
+			if ack, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64); err == nil {
+				atomic.StoreInt64(&r.ack, ack)
+			}
+		}
+	}
+}
+
+// replconf handles REPLCONF <option> <value> [<option> <value> ...]
+// sent by the redis replicas before syncing
+func (h *CmdHandler) replconf(conn Conn, cmd Command) {
+	if len(cmd.Args)%2 == 0 {
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	ctx := connContext(conn)
+	for i := 1; i < len(cmd.Args); i += 2 {
+		val := string(cmd.Args[i+1])
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "listening-port":
+			if _, err := strconv.Atoi(val); err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			ctx.listeningPort = val
+		case "capa":
+			if ctx.capa == nil {
+				ctx.capa = make(map[string]bool)
+			}
+			ctx.capa[strings.ToLower(val)] = true
+		case "ack", "getack":
+			// only meaningful on the stream
+			return
+		case "ip-address", "rdb-only", "rdb-filter-only":
+		default:
+			conn.WriteError("ERR Unrecognized REPLCONF option: " + string(cmd.Args[i]))
+			return
+		}
+	}
+	conn.WriteString("OK")
+}
+
+// syncCmd handles SYNC and PSYNC <replid> <offset>, a partial resync is
+// continued if replid is current one and the offset is in the backlog
+func (h *CmdHandler) syncCmd(conn Conn, cmd Command) {
+	psync := strings.ToLower(string(cmd.Args[0])) == "psync"
+	if psync && len(cmd.Args) != 3 || !psync && len(cmd.Args) != 1 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	ctx := connContext(conn)
+	host, _, _ := net.SplitHostPort(conn.NetConn().RemoteAddr().String())
+	if host == "" {
+		host = conn.RemoteAddr()
+	}
+	port := ctx.listeningPort
+	if port == "" {
+		port = "0"
+	}
+	r := &redisReplica{addr: net.JoinHostPort(host, port)}
+	b := h.repl.backlog
+
+	full := true
+	var pos int64
+	if psync && string(cmd.Args[1]) == b.replId {
+		if offset, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64); err == nil && b.covers(offset-1) {
+			full, pos = false, offset-1
+		}
+	}
+	if full {
+		pos = h.repl.startFull()
+		if psync {
+			conn.WriteRaw([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", b.replId, pos)))
+		}
+	} else if ctx.capa["psync2"] {
+		conn.WriteRaw([]byte("+CONTINUE " + b.replId + "\r\n"))
+	} else {
+		conn.WriteRaw([]byte("+CONTINUE\r\n"))
+	}
+	atomic.StoreInt64(&r.ack, pos)
+	etlog.Log.WithField("replica", r.addr).WithField("full", full).
+		WithField("offset", pos).Info("redis replica attached")
+
+	dc := conn.Detach()
+	if err := dc.Flush(); err != nil {
+		dc.Close()
+		return
+	}
+	go h.repl.serve(dc, r, pos, full, psync && ctx.capa["eof"])
+}
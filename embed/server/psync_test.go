@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/dump"
+	"github.com/edditen/evolvest/pkg/store"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBacklog(t *testing.T) {
+	b := newBacklog(8)
+	stopped := func() bool { return false }
+	b.write([]byte("ignored"))
+	if pos := b.start(); pos != 0 {
+		t.Fatalf("start() = %d, want 0", pos)
+	}
+	b.write([]byte("abcdef"))
+	b.write([]byte("ghij"))
+
+	tests := []struct {
+		pos     int64
+		want    string
+		wantErr error
+	}{
+		{pos: 0, wantErr: errBacklogLost},
+		{pos: 2, want: "cdefgh"},
+		{pos: 8, want: "ij"},
+		{pos: 11, wantErr: errBacklogLost},
+	}
+	for _, tt := range tests {
+		p := make([]byte, 16)
+		n, err := b.read(tt.pos, p, stopped)
+		if err != tt.wantErr || string(p[:n]) != tt.want {
+			t.Errorf("read(%d) = %q, %v, want %q, %v", tt.pos, p[:n], err, tt.want, tt.wantErr)
+		}
+		if got := b.covers(tt.pos); got != (tt.wantErr == nil) {
+			t.Errorf("covers(%d) = %v", tt.pos, got)
+		}
+	}
+
+	b.close()
+	if _, err := b.read(10, make([]byte, 16), stopped); err != io.EOF {
+		t.Errorf("read() of closed = %v, want EOF", err)
+	}
+}
+
+func startServer(t *testing.T) string {
+	return startServerConf(t, &config.Config{})
+}
+
+// startServerConf starts a server of conf on a unix socket in a temp dir,
+// or the first listener of conf if any, and returns its address
+func startServerConf(t *testing.T, conf *config.Config) string {
+	dir := t.TempDir()
+	conf.DataDir = dir
+	if len(conf.Listeners) == 0 {
+		conf.Listeners = []config.ListenerConfig{{Network: "unix", Addr: path.Join(dir, "evolvest.sock")}}
+	}
+	lc := conf.Listeners[0]
+	conf.ShutdownTimeout = 1
+	c := cluster.NewCluster(conf)
+	syncer := store.NewSyncer(conf, c)
+	a := acl.NewACL(conf)
+	srv := NewEvolvestServer(conf, syncer, c, a)
+	for _, r := range []interface{ Init() error }{c, syncer, a, srv} {
+		if err := r.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errC := make(chan error, 10)
+	go syncer.Run(errC)
+	go srv.Run(errC)
+	t.Cleanup(func() {
+		srv.Shutdown()
+		syncer.Shutdown()
+	})
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial(lc.Network, lc.Addr); err == nil {
+			conn.Close()
+			return lc.Addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server is not started")
+	return ""
+}
+
+// fakeReplica talks to the server as a redis replica
+type fakeReplica struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	// rd reads the stream after the rdb
+	rd *Reader
+}
+
+func dialReplica(t *testing.T, sock string) *fakeReplica {
+	return dialNetwork(t, "unix", sock)
+}
+
+func dialNetwork(t *testing.T, network, addr string) *fakeReplica {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &fakeReplica{t: t, conn: conn, br: bufio.NewReader(conn)}
+}
+
+func (r *fakeReplica) send(args ...string) {
+	b := make([][]byte, len(args))
+	for i, arg := range args {
+		b[i] = []byte(arg)
+	}
+	if _, err := r.conn.Write(appendCommand(nil, b...)); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *fakeReplica) readLine() string {
+	line, err := r.br.ReadString('\n')
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func (r *fakeReplica) readCommand() string {
+	if r.rd == nil {
+		r.rd = NewReader(r.br)
+	}
+	cmd, err := r.rd.ReadCommand()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = string(arg)
+	}
+	return strings.Join(args, " ")
+}
+
+func TestPsync(t *testing.T) {
+	sock := startServer(t)
+	client := dialReplica(t, sock)
+	defer client.conn.Close()
+	client.send("SET", "a", "1")
+	if line := client.readLine(); line != "+OK" {
+		t.Fatalf("SET = %s", line)
+	}
+
+	replica := dialReplica(t, sock)
+	replica.send("REPLCONF", "listening-port", "6380")
+	replica.send("REPLCONF", "capa", "psync2")
+	replica.send("PSYNC", "?", "-1")
+	for i := 0; i < 2; i++ {
+		if line := replica.readLine(); line != "+OK" {
+			t.Fatalf("REPLCONF = %s", line)
+		}
+	}
+	var replId string
+	var offset int64
+	if _, err := fmt.Sscanf(replica.readLine(), "+FULLRESYNC %s %d", &replId, &offset); err != nil {
+		t.Fatalf("PSYNC reply error = %v", err)
+	}
+	size, _ := strconv.ParseInt(strings.TrimPrefix(replica.readLine(), "$"), 10, 64)
+	dec, err := dump.NewRDBDecoder(io.LimitReader(replica.br, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := dec.Decode(); err != nil || e.Key != "a" || string(e.Val) != "1" {
+		t.Fatalf("rdb entry = %+v, %v, want a", e, err)
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("rdb end = %v", err)
+	}
+
+	client.send("SET", "b", "2", "PX", "60000")
+	client.readLine()
+	client.send("DEL", "a")
+	client.readLine()
+	// the database is selected again after a full sync
+	want := []string{"SELECT 0", "SET b 2", "PEXPIREAT b ", "DEL a"}
+	for _, w := range want {
+		if got := replica.readCommand(); !strings.HasPrefix(got, w) {
+			t.Errorf("stream = %q, want %q", got, w)
+		}
+	}
+	replica.send("REPLCONF", "ACK", "0")
+	replica.conn.Close()
+
+	// continue from the offset of first set
+	skipped := int64(len(appendCommand(nil, []byte("SELECT"), []byte("0"))) +
+		len(appendCommand(nil, []byte("SET"), []byte("b"), []byte("2"))))
+	replica = dialReplica(t, sock)
+	defer replica.conn.Close()
+	replica.send("REPLCONF", "capa", "psync2")
+	replica.send("PSYNC", replId, strconv.FormatInt(offset+skipped+1, 10))
+	replica.readLine()
+	if line := replica.readLine(); line != "+CONTINUE "+replId {
+		t.Fatalf("PSYNC = %s, want continue", line)
+	}
+	for _, w := range want[2:] {
+		if got := replica.readCommand(); !strings.HasPrefix(got, w) {
+			t.Errorf("stream = %q, want %q", got, w)
+		}
+	}
+
+	// full resync if the id is not known
+	replica.conn.Close()
+	replica = dialReplica(t, sock)
+	defer replica.conn.Close()
+	replica.send("PSYNC", "unknown", "1")
+	if line := replica.readLine(); !strings.HasPrefix(line, "+FULLRESYNC "+replId) {
+		t.Errorf("PSYNC = %s, want full resync", line)
+	}
+}
+
+func TestKeptCommands(t *testing.T) {
+	st := store.NewStorage(&config.Config{})
+	st.Set("b", store.DataItem{Val: []byte("2"), Ver: 30})
+	st.Set("c", store.DataItem{Val: []byte("3"), Ver: 40, Exp: 1 << 50})
+
+	cmds := keptCommands(st)
+	for _, want := range [][]byte{
+		appendCommand(nil, []byte("SET"), []byte("b"), []byte("2")),
+		appendCommand(nil, []byte("SET"), []byte("c"), []byte("3")),
+		appendCommand(nil, []byte("PEXPIREAT"), []byte("c"), []byte(strconv.FormatInt(1<<50, 10))),
+	} {
+		if !bytes.Contains(cmds, want) {
+			t.Errorf("keptCommands() = %q, want %q in it", cmds, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/store"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const errReadOnly = "READONLY You can't write against a read only replica."
+
+// writable writes READONLY error to the client and returns false
+// if current node is a replica.
+func (h *CmdHandler) writable(conn Conn) bool {
+	if h.syncer.Replicator.ReadOnly() {
+		conn.WriteError(errReadOnly)
+		return false
+	}
+	return true
+}
+
+func (h *CmdHandler) role(conn Conn, cmd Command) {
+	role, upstream, state := h.syncer.Replicator.Role()
+	offset := h.syncer.LastTxId()
+	if role == common.RoleReplica {
+		host, port, _ := net.SplitHostPort(store.UpstreamAddr(upstream))
+		p, _ := strconv.Atoi(port)
+		conn.WriteArray(5)
+		conn.WriteBulkString("slave")
+		conn.WriteBulkString(host)
+		conn.WriteInt(p)
+		conn.WriteBulkString(state)
+		conn.WriteInt64(offset)
+		return
+	}
+
+	replicas := h.syncer.Replicator.Replicas()
+	redisReplicas := h.repl.Replicas()
+	conn.WriteArray(3)
+	conn.WriteBulkString("master")
+	conn.WriteInt64(offset)
+	conn.WriteArray(len(replicas) + len(redisReplicas))
+	for _, addr := range replicas {
+		host, port, _ := net.SplitHostPort(addr)
+		conn.WriteArray(3)
+		conn.WriteBulkString(host)
+		conn.WriteBulkString(port)
+		conn.WriteBulkString("0")
+	}
+	// the offsets of redis replicas are of the backlog
+	for _, r := range redisReplicas {
+		host, port, _ := net.SplitHostPort(r.addr)
+		conn.WriteArray(3)
+		conn.WriteBulkString(host)
+		conn.WriteBulkString(port)
+		conn.WriteBulkString(strconv.FormatInt(atomic.LoadInt64(&r.ack), 10))
+	}
+}
+
+// replicaOf handles REPLICAOF <host> <sync_port> and REPLICAOF NO ONE,
+// note the port is the sync port of upstream rather than the server port.
+// The host of a redis primary is given as redis://[user:password@]host.
+func (h *CmdHandler) replicaOf(conn Conn, cmd Command) {
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	host, port := string(cmd.Args[1]), string(cmd.Args[2])
+	log := etlog.Log.WithField("host", host).WithField("port", port)
+	if strings.ToLower(host) == "no" && strings.ToLower(port) == "one" {
+		h.syncer.Replicator.Promote()
+		log.Info("promoted to primary")
+		conn.WriteString("OK")
+		return
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		conn.WriteError("ERR Invalid master port")
+		return
+	}
+	upstream := net.JoinHostPort(host, port)
+	if strings.HasPrefix(strings.ToLower(host), "redis://") {
+		upstream = host + ":" + port
+		if _, ok := store.ParseRedisUpstream(upstream); !ok {
+			conn.WriteError("ERR Invalid master address")
+			return
+		}
+		log = etlog.Log.WithField("host", store.UpstreamAddr(upstream))
+	}
+	h.syncer.Replicator.ReplicaOf(upstream)
+	log.Info("become replica")
+	conn.WriteString("OK")
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/tidwall/match"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultScanCount = 10
+
+// scanKey is a key with its hash, which is the order of scanning
+type scanKey struct {
+	hash uint64
+	key  string
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// scan iterates the keys in order of their hash, the cursor is the hash
+// of the next key, so that the keys existing during the whole iteration
+// are always returned no matter how the others are changed.
+func (h *CmdHandler) scan(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	cursor, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 2; i < len(cmd.Args); i += 2 {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "match":
+			pattern = string(cmd.Args[i+1])
+		case "count":
+			count, err = strconv.Atoi(string(cmd.Args[i+1]))
+			if err != nil || count < 1 {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+		case "type":
+			// all values are strings
+			if strings.ToLower(string(cmd.Args[i+1])) != "string" {
+				pattern = ""
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	allKeys, _ := h.db(conn).Keys()
+	keys := make([]scanKey, 0, len(allKeys))
+	for _, key := range allKeys {
+		if hash := keyHash(key); hash >= cursor {
+			keys = append(keys, scanKey{hash: hash, key: key})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hash != keys[j].hash {
+			return keys[i].hash < keys[j].hash
+		}
+		return keys[i].key < keys[j].key
+	})
+
+	var next uint64
+	if len(keys) > count {
+		next = keys[count].hash
+		keys = keys[:count]
+	}
+	matched := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if pattern != "" && match.Match(k.key, pattern) {
+			matched = append(matched, k.key)
+		}
+	}
+
+	conn.WriteArray(2)
+	conn.WriteBulkString(strconv.FormatUint(next, 10))
+	conn.WriteArray(len(matched))
+	for _, key := range matched {
+		conn.WriteBulkString(key)
+	}
+}
@@ -2,14 +2,19 @@ package server
 
 import (
 	"crypto/tls"
-	"errors"
 	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/cluster"
 	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
 	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Server defines a server for clients for managing client connections.
@@ -23,6 +28,8 @@ type Server struct {
 	conns   map[*conn]bool
 	ln      net.Listener
 	done    bool
+	// draining keeps the connections open until their commands are served
+	draining bool
 
 	// AcceptError is an optional function used to handle Accept errors.
 	AcceptError func(err error)
@@ -115,6 +122,56 @@ func (s *Server) Close() error {
 	return s.ln.Close()
 }
 
+// Drain stops listening and waits for the in-flight commands of the
+// accepted connections, each connection is closed after the reply of its
+// current commands is flushed. The connections left are closed when the
+// timeout is reached.
+func (s *Server) Drain(timeout time.Duration) error {
+	s.mu.Lock()
+	if s.ln == nil {
+		s.mu.Unlock()
+		return errors.New("not serving")
+	}
+	s.done = true
+	s.draining = true
+	err := s.ln.Close()
+	for c := range s.conns {
+		// wake up the idle ones blocked in reading
+		c.conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	etlog.Log.WithField("conns", len(s.conns)).Warn("drain timeout, close the connections left")
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	return err
+}
+
+// Conns returns the connections being served.
+func (s *Server) Conns() []Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
 // ListenAndServe serves incoming connections.
 func (s *Server) ListenAndServe() error {
 	return s.ListenServeAndSignal(nil)
@@ -251,6 +308,10 @@ func serve(s *Server) error {
 		func() {
 			s.mu.Lock()
 			defer s.mu.Unlock()
+			if s.draining {
+				// closed by Drain once served
+				return
+			}
 			for c := range s.conns {
 				c.Close()
 			}
@@ -277,16 +338,18 @@ func serve(s *Server) error {
 			wr:   NewWriter(lnconn),
 			rd:   NewReader(lnconn),
 		}
-		s.mu.Lock()
-		s.conns[c] = true
-		s.mu.Unlock()
+		// accept before tracking, so that the context set by accept
+		// is visible to the ones listing the connections
 		if s.accept != nil && !s.accept(c) {
-			s.mu.Lock()
-			delete(s.conns, c)
-			s.mu.Unlock()
 			c.Close()
 			continue
 		}
+		s.mu.Lock()
+		s.conns[c] = true
+		if s.draining {
+			c.conn.SetReadDeadline(time.Now())
+		}
+		s.mu.Unlock()
 		go handle(s, c)
 	}
 }
@@ -347,62 +410,209 @@ func handle(s *Server, c *conn) {
 			if err := c.wr.Flush(); err != nil {
 				return err
 			}
+			s.mu.Lock()
+			draining := s.draining
+			s.mu.Unlock()
+			if draining {
+				return nil
+			}
 		}
 	}()
 }
 
 type EvolvestServer struct {
-	cfg    *config.Config
-	syncer *store.Syncer
+	cfg     *config.Config
+	syncer  *store.Syncer
+	cluster *cluster.Cluster
+	acl     *acl.ACL
+	mu      sync.Mutex
+	srvs    []*Server
+	tlsConf *tls.Config
+	nextId  int64
+	pubsub  *PubSub
+	// notifier is nil if keyspace notifications are disabled
+	notifier *notifier
+	// repl serves the redis replicas
+	repl *replMaster
+	// limits is nil if no limit is configured
+	limits *Limits
+	stop   chan interface{}
 }
 
-func NewEvolvestServer(conf *config.Config, syncer *store.Syncer) *EvolvestServer {
+func NewEvolvestServer(conf *config.Config, syncer *store.Syncer, c *cluster.Cluster, a *acl.ACL) *EvolvestServer {
 	return &EvolvestServer{
-		cfg:    conf,
-		syncer: syncer,
+		cfg:     conf,
+		syncer:  syncer,
+		cluster: c,
+		acl:     a,
+		pubsub:  &PubSub{},
+		stop:    make(chan interface{}),
 	}
 }
 
 func (s *EvolvestServer) Init() error {
 	log.Println("[Init] init evolvestServer")
+	if s.cfg.TLS.Enabled() {
+		conf, err := s.cfg.TLS.ServerConfig()
+		if err != nil {
+			return errors.Wrap(err, "init evolvestServer tls error")
+		}
+		s.tlsConf = conf
+	}
+	flags, err := parseNotifyFlags(s.cfg.NotifyKeyspaceEvents)
+	if err != nil {
+		return errors.Wrap(err, "init evolvestServer error")
+	}
+	if flags != 0 {
+		s.notifier = newNotifier(flags, s.pubsub, s.cluster)
+		s.syncer.OnApply(s.notifier.notify)
+	}
+	s.repl = newReplMaster(s.syncer, s.cfg.Replication.BacklogBytes())
+	s.syncer.OnApply(s.repl.feed)
+	limits, err := NewLimits(s.cfg, s.syncer)
+	if err != nil {
+		return errors.Wrap(err, "init evolvestServer limits error")
+	}
+	if limits.Enabled() {
+		s.limits = limits
+	}
 	return nil
 }
 
 func (s *EvolvestServer) Run(errC chan<- error) {
 	log.Println("[Run] run evolvestServer")
-	addr := s.cfg.Host + ":" + s.cfg.ServerPort
-	log.Println("listen server at", addr)
-
-	handler := NewHandler(s.syncer)
+	handler := NewHandler(s.cfg, s.syncer, s.cluster, s.acl)
 
 	mux := NewServeMux()
-	mux.HandleFunc("detach", handler.detach)
-	mux.HandleFunc("ping", handler.ping)
-	mux.HandleFunc("quit", handler.quit)
-	mux.HandleFunc("set", handler.set)
-	mux.HandleFunc("get", handler.get)
-	mux.HandleFunc("del", handler.delete)
-
-	err := ListenAndServe(addr,
-		mux.ServeRESP,
-		func(conn Conn) bool {
-			// use this function to accept or deny the connection.
-			// log.Printf("accept: %s", conn.RemoteAddr())
-			etlog.Log.WithField("addr", conn.RemoteAddr()).Info("accept conn")
-			return true
-		},
-		func(conn Conn, err error) {
-			// this is called when the connection has been closed
-			// log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
-			etlog.Log.WithField("addr", conn.RemoteAddr()).Warn("close conn error")
-		},
-	)
-	if err != nil {
-		errC <- err
-		return
+	mux.SetACL(s.acl)
+	mux.SetLimits(s.limits)
+	mux.HandleCommand(NewCommandInfo("auth", -2, "noscript loading stale fast no_auth", 0, 0, 0), handler.auth)
+	mux.HandleCommand(NewCommandInfo("acl", -2, "admin noscript loading stale", 0, 0, 0), handler.aclCmd)
+	mux.HandleCommand(NewCommandInfo("detach", 1, "admin", 0, 0, 0), handler.detach)
+	mux.HandleCommand(NewCommandInfo("ping", -1, "stale fast", 0, 0, 0), handler.ping)
+	mux.HandleCommand(NewCommandInfo("quit", 1, "loading stale fast no_auth", 0, 0, 0), handler.quit)
+	mux.HandleCommand(NewCommandInfo("set", -3, "write denyoom", 1, 1, 1), handler.set)
+	mux.HandleCommand(NewCommandInfo("get", 2, "readonly fast", 1, 1, 1), handler.get)
+	mux.HandleCommand(NewCommandInfo("del", -2, "write", 1, -1, 1), handler.delete)
+	mux.HandleCommand(NewCommandInfo("expire", 3, "write fast", 1, 1, 1), handler.expire)
+	mux.HandleCommand(NewCommandInfo("pexpire", 3, "write fast", 1, 1, 1), handler.expire)
+	mux.HandleCommand(NewCommandInfo("persist", 2, "write fast", 1, 1, 1), handler.persist)
+	mux.HandleCommand(NewCommandInfo("ttl", 2, "readonly fast", 1, 1, 1), handler.ttl)
+	mux.HandleCommand(NewCommandInfo("pttl", 2, "readonly fast", 1, 1, 1), handler.ttl)
+	mux.HandleCommand(NewCommandInfo("mget", -2, "readonly fast", 1, -1, 1), handler.mget)
+	mux.HandleCommand(NewCommandInfo("scan", -2, "readonly", 0, 0, 0), handler.scan)
+	mux.HandleCommand(NewCommandInfo("subscribe", -2, "pubsub noscript loading stale", 0, 0, 0), handler.subscribe)
+	mux.HandleCommand(NewCommandInfo("psubscribe", -2, "pubsub noscript loading stale", 0, 0, 0), handler.psubscribe)
+	mux.HandleCommand(NewCommandInfo("publish", 3, "pubsub loading stale fast", 0, 0, 0), handler.publish)
+	mux.HandleCommand(NewCommandInfo("dbsize", 1, "readonly fast", 0, 0, 0), handler.dbsize)
+	mux.HandleCommand(NewCommandInfo("select", 2, "loading stale fast", 0, 0, 0), handler.selectDB)
+	mux.HandleCommand(NewCommandInfo("swapdb", 3, "write fast", 0, 0, 0), handler.swapDB)
+	mux.HandleCommand(NewCommandInfo("flushdb", -1, "write", 0, 0, 0), handler.flushDB)
+	mux.HandleCommand(NewCommandInfo("flushall", -1, "write", 0, 0, 0), handler.flushAll)
+	mux.HandleCommand(NewCommandInfo("move", 3, "write fast", 1, 1, 1), handler.move)
+	mux.HandleCommand(NewCommandInfo("info", -1, "loading stale", 0, 0, 0), handler.info)
+	mux.HandleCommand(NewCommandInfo("client", -2, "admin noscript loading stale", 0, 0, 0), handler.client)
+	mux.HandleCommand(NewCommandInfo("command", -1, "loading stale", 0, 0, 0), handler.command)
+	mux.HandleCommand(NewCommandInfo("cluster", -2, "admin", 0, 0, 0), handler.clusterCmd)
+	mux.HandleCommand(NewCommandInfo("asking", 1, "fast", 0, 0, 0), handler.asking)
+	mux.HandleCommand(NewCommandInfo("migrate", -6, "write movablekeys", 3, 3, 1), handler.migrate)
+	mux.HandleCommand(NewCommandInfo("role", 1, "noscript loading stale fast", 0, 0, 0), handler.role)
+	mux.HandleCommand(NewCommandInfo("replicaof", 3, "admin noscript stale", 0, 0, 0), handler.replicaOf)
+	mux.HandleCommand(NewCommandInfo("slaveof", 3, "admin noscript stale", 0, 0, 0), handler.replicaOf)
+	mux.HandleCommand(NewCommandInfo("replconf", -1, "admin noscript loading stale", 0, 0, 0), handler.replconf)
+	mux.HandleCommand(NewCommandInfo("sync", 1, "admin noscript", 0, 0, 0), handler.syncCmd)
+	mux.HandleCommand(NewCommandInfo("psync", -3, "admin noscript", 0, 0, 0), handler.syncCmd)
+
+	accept := func(conn Conn) bool {
+		// use this function to accept or deny the connection.
+		conn.SetContext(NewConnContext(atomic.AddInt64(&s.nextId, 1)))
+		etlog.Log.WithField("addr", conn.RemoteAddr()).Info("accept conn")
+		return true
+	}
+	closed := func(conn Conn, err error) {
+		// this is called when the connection has been closed
+		// log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
+		etlog.Log.WithField("addr", conn.RemoteAddr()).Warn("close conn error")
+	}
+
+	handler.mux = mux
+	handler.pubsub = s.pubsub
+	handler.conns = s.Conns
+	handler.repl = s.repl
+	handler.limits = s.limits
+	if s.notifier != nil {
+		go s.notifier.run(s.stop)
+	}
+	go s.repl.run(s.stop)
+
+	lns := make([]net.Listener, 0)
+	for _, lc := range s.cfg.ServerListeners() {
+		ln, err := utils.Listen(lc)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			errC <- errors.Wrapf(err, "listen %s error", lc)
+			return
+		}
+		// unix sockets are protected by the permission instead
+		if s.tlsConf != nil && lc.Network != "unix" {
+			ln = tls.NewListener(ln, s.tlsConf)
+			log.Println("listen server at", lc, "over tls")
+		} else {
+			log.Println("listen server at", lc)
+		}
+		lns = append(lns, ln)
+	}
+
+	var wg sync.WaitGroup
+	for _, ln := range lns {
+		srv := NewServerNetwork(ln.Addr().Network(), ln.Addr().String(),
+			mux.ServeRESP, accept, closed)
+		s.mu.Lock()
+		s.srvs = append(s.srvs, srv)
+		s.mu.Unlock()
+
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			if err := srv.Serve(ln); err != nil {
+				errC <- err
+			}
+		}(ln)
 	}
+	wg.Wait()
 }
 
+// Conns returns the client connections of all listeners
+func (s *EvolvestServer) Conns() []Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]Conn, 0)
+	for _, srv := range s.srvs {
+		conns = append(conns, srv.Conns()...)
+	}
+	return conns
+}
+
+// Shutdown stops accepting connections, and waits for the in-flight
+// commands being served, so that the acknowledged writes are submitted
 func (s *EvolvestServer) Shutdown() {
 	log.Println("[Shutdown] shutdown evolvestServer")
+	// CLIENT LIST being served locks mu, do not hold it while draining
+	s.mu.Lock()
+	srvs := s.srvs
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range srvs {
+		wg.Add(1)
+		go func(srv *Server) {
+			defer wg.Done()
+			if err := srv.Drain(s.cfg.ShutdownDuration()); err != nil {
+				etlog.Log.WithError(err).Warn("drain server error")
+			}
+		}(srv)
+	}
+	wg.Wait()
+	close(s.stop)
 }
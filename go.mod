@@ -7,7 +7,9 @@ require (
 	github.com/edditen/etlog v1.3.0
 	github.com/ghodss/yaml v1.0.0
 	github.com/golang/protobuf v1.5.2
+	github.com/klauspost/compress v1.13.6
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.8.1
 	github.com/tidwall/btree v0.3.0
@@ -0,0 +1,348 @@
+package acl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultUser = "default"
+
+var (
+	ErrWrongPass  = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	ErrNoAuth     = errors.New("NOAUTH Authentication required.")
+	ErrNoPermKeys = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+)
+
+// ACL manages the users and checks the permissions of commands
+type ACL struct {
+	cfg      *config.Config
+	mu       sync.RWMutex
+	users    map[string]*User
+	filename string
+	auditMu  sync.Mutex
+	audit    *os.File
+}
+
+func NewACL(conf *config.Config) *ACL {
+	return &ACL{
+		cfg:   conf,
+		users: make(map[string]*User),
+	}
+}
+
+func (a *ACL) Init() error {
+	log.Println("[Init] init acl")
+	a.filename = a.cfg.Auth.UsersFile
+	if a.filename == "" {
+		a.filename = path.Join(a.cfg.DataDir, common.FileUsers)
+	}
+	if err := a.Load(); err != nil {
+		return errors.Wrap(err, "load users error")
+	}
+
+	if a.cfg.Auth.AuditFile != "" {
+		f, err := os.OpenFile(a.cfg.Auth.AuditFile,
+			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrap(err, "open audit file error")
+		}
+		a.audit = f
+	}
+	return nil
+}
+
+func (a *ACL) Run(errC chan<- error) {
+	log.Println("[Run] run acl")
+}
+
+func (a *ACL) Shutdown() {
+	log.Println("[Shutdown] shutdown acl")
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+	if a.audit != nil {
+		a.audit.Close()
+		a.audit = nil
+	}
+}
+
+// defaultUser returns the default user when it's not defined in users file,
+// which requires the password if requirepass is set
+func (a *ACL) defaultUser() *User {
+	u := newUser(DefaultUser)
+	rules := []string{"on", "allkeys", "allcommands", "nopass"}
+	if a.cfg.Auth.RequirePass != "" {
+		rules[3] = ">" + a.cfg.Auth.RequirePass
+	}
+	for _, rule := range rules {
+		u.apply(rule)
+	}
+	return u
+}
+
+// Load reads users from users file, lines are in format of
+// "user <name> <rules...>", and the ones not defined are removed.
+func (a *ACL) Load() error {
+	users := make(map[string]*User)
+	data, err := ioutil.ReadFile(a.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return fmt.Errorf("%s:%d: line should start with user keyword", a.filename, n)
+		}
+		u := newUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.apply(rule); err != nil {
+				return fmt.Errorf("%s:%d: %v", a.filename, n, err)
+			}
+		}
+		users[u.Name] = u
+	}
+	if _, ok := users[DefaultUser]; !ok {
+		users[DefaultUser] = a.defaultUser()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// keep the users authenticated by connections
+	for name, u := range users {
+		if old, ok := a.users[name]; ok {
+			*old = *u
+			users[name] = old
+		}
+	}
+	for name, old := range a.users {
+		if _, ok := users[name]; !ok {
+			old.enabled = false
+		}
+	}
+	a.users = users
+	return nil
+}
+
+// Save writes users to users file
+func (a *ACL) Save() error {
+	a.mu.RLock()
+	lines := a.list()
+	a.mu.RUnlock()
+
+	content := strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(a.filename+".tmp", []byte(content), 0600); err != nil {
+		return errors.Wrap(err, "write users file error")
+	}
+	if err := os.Rename(a.filename+".tmp", a.filename); err != nil {
+		return errors.Wrap(err, "rename users file error")
+	}
+	return nil
+}
+
+// Authenticate returns the user if the password matches
+func (a *ACL) Authenticate(name, pass string) (*User, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok || !u.enabled || !u.checkPassword(pass) {
+		return nil, ErrWrongPass
+	}
+	return u, nil
+}
+
+// Anonymous returns the default user if it requires no password,
+// which is used by the connections not authenticated
+func (a *ACL) Anonymous() *User {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u := a.users[DefaultUser]
+	if u == nil || !u.enabled || !u.nopass {
+		return nil
+	}
+	return u
+}
+
+// Check returns a NOPERM error if user can't run the command or access the keys
+func (a *ACL) Check(u *User, command string, categories []string, keys []string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !u.enabled {
+		return ErrNoAuth
+	}
+	if !u.canRun(command, categories) {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command or its subcommand", command)
+	}
+	for _, key := range keys {
+		if !u.canAccess(key) {
+			return ErrNoPermKeys
+		}
+	}
+	return nil
+}
+
+// CheckAllKeys returns a NOPERM error if user can't access all keys, which
+// is required by the commands of the whole data, like export
+func (a *ACL) CheckAllKeys(u *User) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !u.allKeys() {
+		return ErrNoPermKeys
+	}
+	return nil
+}
+
+// SetUser creates the user if not exists and applies the rules,
+// nothing is changed if any rule is invalid
+func (a *ACL) SetUser(name string, rules []string) error {
+	a.mu.Lock()
+	u, ok := a.users[name]
+	tmp := newUser(name)
+	if ok {
+		*tmp = *u
+		tmp.passwords = append([]string{}, u.passwords...)
+		tmp.keys = append([]string{}, u.keys...)
+		tmp.commands = append([]string{}, u.commands...)
+	}
+	for _, rule := range rules {
+		if err := tmp.apply(rule); err != nil {
+			a.mu.Unlock()
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %v", rule, err)
+		}
+	}
+	if ok {
+		*u = *tmp
+	} else {
+		a.users[name] = tmp
+	}
+	a.mu.Unlock()
+	return a.Save()
+}
+
+// DelUser removes the users, returns count of the removed
+func (a *ACL) DelUser(names ...string) (int, error) {
+	a.mu.Lock()
+	removed := 0
+	for _, name := range names {
+		if name == DefaultUser {
+			a.mu.Unlock()
+			return 0, errors.New("The 'default' user cannot be removed")
+		}
+		if u, ok := a.users[name]; ok {
+			u.enabled = false
+			delete(a.users, name)
+			removed++
+		}
+	}
+	a.mu.Unlock()
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, a.Save()
+}
+
+// UserInfo is the description of user for ACL GETUSER
+type UserInfo struct {
+	Flags     []string
+	Passwords []string
+	Commands  string
+	Keys      []string
+}
+
+func (a *ACL) GetUser(name string) (*UserInfo, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return nil, false
+	}
+	return &UserInfo{
+		Flags:     u.flags(),
+		Passwords: append([]string{}, u.passwords...),
+		Commands:  strings.Join(u.commands, " "),
+		Keys:      append([]string{}, u.keys...),
+	}, true
+}
+
+// Users returns names of users in order
+func (a *ACL) Users() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List returns users in the format of users file
+func (a *ACL) List() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.list()
+}
+
+func (a *ACL) list() []string {
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, "user "+name+" "+strings.Join(a.users[name].rules(), " "))
+	}
+	return lines
+}
+
+type auditRecord struct {
+	Time    string   `json:"time"`
+	User    string   `json:"user"`
+	Addr    string   `json:"addr"`
+	Command string   `json:"command"`
+	Keys    []string `json:"keys,omitempty"`
+	Reason  string   `json:"reason"`
+}
+
+// Audit records the denied command, the values are never recorded
+func (a *ACL) Audit(user, addr, command string, keys []string, reason error) {
+	etlog.Log.WithField("user", user).
+		WithField("addr", addr).
+		WithField("command", command).
+		WithField("keys", keys).
+		WithField("reason", reason.Error()).
+		Warn("command denied")
+
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+	if a.audit == nil {
+		return
+	}
+	data, _ := json.Marshal(&auditRecord{
+		Time:    time.Now().Format(time.RFC3339),
+		User:    user,
+		Addr:    addr,
+		Command: command,
+		Keys:    keys,
+		Reason:  reason.Error(),
+	})
+	if _, err := a.audit.Write(append(data, '\n')); err != nil {
+		etlog.Log.WithError(err).Warn("write audit file failed")
+	}
+}
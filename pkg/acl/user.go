@@ -0,0 +1,246 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/tidwall/match"
+	"strings"
+)
+
+const (
+	CategoryAll        = "all"
+	CategoryRead       = "read"
+	CategoryWrite      = "write"
+	CategoryAdmin      = "admin"
+	CategoryDangerous  = "dangerous"
+	CategoryFast       = "fast"
+	CategorySlow       = "slow"
+	CategoryKeyspace   = "keyspace"
+	CategoryConnection = "connection"
+	CategoryPubSub     = "pubsub"
+)
+
+// Categories are the known command categories
+var Categories = []string{
+	CategoryAll, CategoryRead, CategoryWrite, CategoryAdmin, CategoryDangerous,
+	CategoryFast, CategorySlow, CategoryKeyspace, CategoryConnection,
+	CategoryPubSub,
+}
+
+// User is a redis 6 style ACL user, the fields are guarded by ACL.
+type User struct {
+	Name    string
+	enabled bool
+	nopass  bool
+	// passwords are sha256 hex of the passwords
+	passwords []string
+	// keys are the glob patterns of accessible keys
+	keys []string
+	// commands are the command rules in order, like +@all or -del,
+	// the last matched rule decides whether a command is allowed
+	commands []string
+}
+
+func newUser(name string) *User {
+	return &User{
+		Name:      name,
+		passwords: make([]string, 0),
+		keys:      make([]string, 0),
+		commands:  []string{"-@all"},
+	}
+}
+
+// HashPassword returns sha256 hex of the password
+func HashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply applies a rule of ACL SETUSER
+func (u *User) apply(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = u.passwords[:0]
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = u.passwords[:0]
+		return nil
+	case "allkeys":
+		u.keys = []string{"*"}
+		return nil
+	case "resetkeys":
+		u.keys = u.keys[:0]
+		return nil
+	case "allcommands":
+		u.commands = []string{"+@all"}
+		return nil
+	case "nocommands":
+		u.commands = []string{"-@all"}
+		return nil
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "nocommands", "off"} {
+			u.apply(r)
+		}
+		return nil
+	}
+
+	if rule == "" {
+		return fmt.Errorf("syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		u.addPassword(HashPassword(rule[1:]))
+	case '<':
+		u.removePassword(HashPassword(rule[1:]))
+	case '#':
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return fmt.Errorf("the password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(hash)
+	case '!':
+		u.removePassword(strings.ToLower(rule[1:]))
+	case '~':
+		if u.allKeys() {
+			return fmt.Errorf("adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+		}
+		u.keys = append(u.keys, rule[1:])
+	case '+', '-':
+		name := strings.ToLower(rule[1:])
+		if name == "" {
+			return fmt.Errorf("syntax error")
+		}
+		if strings.HasPrefix(name, "@") && !knownCategory(name[1:]) {
+			return fmt.Errorf("unknown command category '%s'", name[1:])
+		}
+		if name == "@all" {
+			// the previous rules are overridden
+			u.commands = u.commands[:0]
+		}
+		u.commands = append(u.commands, rule[:1]+name)
+	default:
+		return fmt.Errorf("syntax error")
+	}
+	return nil
+}
+
+func (u *User) addPassword(hash string) {
+	u.removePassword(hash)
+	u.passwords = append(u.passwords, hash)
+	u.nopass = false
+}
+
+func (u *User) removePassword(hash string) {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return
+		}
+	}
+}
+
+func (u *User) allKeys() bool {
+	return len(u.keys) == 1 && u.keys[0] == "*"
+}
+
+func knownCategory(name string) bool {
+	for _, c := range Categories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword tells whether pass is one of the passwords of user
+func (u *User) checkPassword(pass string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := HashPassword(pass)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun tells whether the command with categories is allowed
+func (u *User) canRun(command string, categories []string) bool {
+	allowed := false
+	for _, rule := range u.commands {
+		name := rule[1:]
+		matched := name == "@all" || name == command
+		if !matched && strings.HasPrefix(name, "@") {
+			for _, c := range categories {
+				if name[1:] == c {
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// canAccess tells whether the key matches any pattern
+func (u *User) canAccess(key string) bool {
+	for _, pattern := range u.keys {
+		if match.Match(key, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) flags() []string {
+	flags := make([]string, 0)
+	if u.enabled {
+		flags = append(flags, "on")
+	} else {
+		flags = append(flags, "off")
+	}
+	if u.allKeys() {
+		flags = append(flags, "allkeys")
+	}
+	if len(u.commands) == 1 && u.commands[0] == "+@all" {
+		flags = append(flags, "allcommands")
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// rules describes the user in the format of ACL LIST
+func (u *User) rules() []string {
+	rules := make([]string, 0)
+	if u.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, p := range u.passwords {
+		rules = append(rules, "#"+p)
+	}
+	for _, k := range u.keys {
+		rules = append(rules, "~"+k)
+	}
+	return append(rules, u.commands...)
+}
@@ -0,0 +1,121 @@
+package acl
+
+import "testing"
+
+func TestUser_Check(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []string
+		command    string
+		categories []string
+		keys       []string
+		want       bool
+	}{
+		{
+			name:    "no commands",
+			rules:   []string{"on", "allkeys"},
+			command: "get",
+			want:    false,
+		},
+		{
+			name:       "all commands",
+			rules:      []string{"on", "allkeys", "+@all"},
+			command:    "set",
+			categories: []string{"write"},
+			keys:       []string{"foo"},
+			want:       true,
+		},
+		{
+			name:       "category allowed",
+			rules:      []string{"on", "~*", "+@read"},
+			command:    "get",
+			categories: []string{"read", "fast"},
+			keys:       []string{"foo"},
+			want:       true,
+		},
+		{
+			name:       "category denied",
+			rules:      []string{"on", "~*", "+@read"},
+			command:    "set",
+			categories: []string{"write"},
+			keys:       []string{"foo"},
+			want:       false,
+		},
+		{
+			name:       "command removed after category",
+			rules:      []string{"on", "~*", "+@all", "-del"},
+			command:    "del",
+			categories: []string{"write"},
+			keys:       []string{"foo"},
+			want:       false,
+		},
+		{
+			name:       "command added after category removed",
+			rules:      []string{"on", "~*", "-@write", "+set"},
+			command:    "set",
+			categories: []string{"write"},
+			keys:       []string{"foo"},
+			want:       true,
+		},
+		{
+			name:       "key pattern matched",
+			rules:      []string{"on", "~app:*", "+@all"},
+			command:    "get",
+			categories: []string{"read"},
+			keys:       []string{"app:1"},
+			want:       true,
+		},
+		{
+			name:       "key pattern not matched",
+			rules:      []string{"on", "~app:*", "+@all"},
+			command:    "get",
+			categories: []string{"read"},
+			keys:       []string{"other"},
+			want:       false,
+		},
+		{
+			name:    "disabled",
+			rules:   []string{"off", "allkeys", "+@all"},
+			command: "ping",
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &ACL{users: make(map[string]*User)}
+			u := newUser("alice")
+			for _, rule := range tt.rules {
+				if err := u.apply(rule); err != nil {
+					t.Fatalf("apply(%s) error = %v", rule, err)
+				}
+			}
+			err := a.Check(u, tt.command, tt.categories, tt.keys)
+			if got := err == nil; got != tt.want {
+				t.Errorf("Check() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUser_checkPassword(t *testing.T) {
+	u := newUser("alice")
+	for _, rule := range []string{">p1", ">p2", "<p1", "#" + HashPassword("p3")} {
+		if err := u.apply(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		pass string
+		want bool
+	}{
+		{"p1", false},
+		{"p2", true},
+		{"p3", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := u.checkPassword(tt.pass); got != tt.want {
+			t.Errorf("checkPassword(%s) = %v, want %v", tt.pass, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/store"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// AdminOptions configures the AdminClient
+type AdminOptions struct {
+	// TLS is used connecting to the sync port if not nil
+	TLS *tls.Config
+	// Token is the peer or operator token of the sync port
+	Token string
+	// Timeout is used if the context has no deadline, defaults to 3 seconds
+	Timeout time.Duration
+	// MaxRetries when the node is unavailable, defaults to 3,
+	// -1 disables retries
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the waiting between retries,
+	// default to 8ms and 512ms
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (o *AdminOptions) init() {
+	if o.Timeout <= 0 {
+		o.Timeout = 3 * time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 8 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 512 * time.Millisecond
+	}
+}
+
+// AdminClient calls the gRPC API on the sync port of a node
+type AdminClient struct {
+	opts   AdminOptions
+	conn   *grpc.ClientConn
+	client evolvest.EvolvestServiceClient
+}
+
+// NewAdminClient creates the client, the connection is made lazily
+func NewAdminClient(addr string, opts AdminOptions) (*AdminClient, error) {
+	opts.init()
+	dialOpts := make([]grpc.DialOption, 0, 2)
+	if opts.TLS != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(opts.TLS)))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	if opts.Token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(store.NewTokenCredentials(opts.Token)))
+	}
+	conn, err := grpc.Dial(addr, dialOpts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial %s error", addr)
+	}
+	return &AdminClient{
+		opts:   opts,
+		conn:   conn,
+		client: evolvest.NewEvolvestServiceClient(conn),
+	}, nil
+}
+
+// Close closes the connection
+func (ac *AdminClient) Close() error {
+	return ac.conn.Close()
+}
+
+// call runs fn with the default timeout, and retries if unavailable
+func (ac *AdminClient) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ac.opts.Timeout)
+		defer cancel()
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= ac.opts.MaxRetries || status.Code(err) != codes.Unavailable {
+			return err
+		}
+		if e := sleep(ctx, backoff(attempt, ac.opts.MinBackoff, ac.opts.MaxBackoff)); e != nil {
+			return err
+		}
+	}
+}
+
+// Keys returns the keys matching the regular expression
+func (ac *AdminClient) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	err := ac.call(ctx, func(ctx context.Context) error {
+		resp, err := ac.client.Keys(ctx, &evolvest.KeysRequest{Pattern: pattern})
+		if err != nil {
+			return err
+		}
+		keys = resp.GetKeys()
+		return nil
+	})
+	return keys, err
+}
+
+// Pull returns all data of the node
+func (ac *AdminClient) Pull(ctx context.Context) (map[string]store.DataItem, error) {
+	var values map[string]store.DataItem
+	err := ac.call(ctx, func(ctx context.Context) error {
+		resp, err := ac.client.Pull(ctx, &evolvest.PullRequest{})
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp.GetValues(), &values)
+	})
+	return values, err
+}
+
+// Push sends the requests to the node as a peer
+func (ac *AdminClient) Push(ctx context.Context, reqs ...*common.TxRequest) error {
+	cmds := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		cmds = append(cmds, store.FormatTx(req))
+	}
+	return ac.call(ctx, func(ctx context.Context) error {
+		resp, err := ac.client.Push(ctx, &evolvest.PushRequest{TxCmds: cmds})
+		if err != nil {
+			return err
+		}
+		if !resp.GetOk() {
+			return errors.New("push is not accepted")
+		}
+		return nil
+	})
+}
+
+// Status returns the state of the node, followed by the other nodes of
+// cluster if all
+func (ac *AdminClient) Status(ctx context.Context, all bool) ([]store.NodeStatus, error) {
+	var statuses []store.NodeStatus
+	err := ac.call(ctx, func(ctx context.Context) error {
+		resp, err := ac.client.Status(ctx, &evolvest.StatusRequest{All: all})
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp.GetStatuses(), &statuses)
+	})
+	return statuses, err
+}
@@ -0,0 +1,565 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNil is returned when the key does not exist
+var ErrNil = errors.New("evolvest: nil")
+
+// Options configures the Client
+type Options struct {
+	// Addrs are the nodes to connect, the slots are loaded from them
+	// in cluster mode, otherwise the first one serves all commands
+	Addrs []string
+	// Network is tcp (default) or unix
+	Network  string
+	Username string
+	Password string
+	// TLS is used connecting to the nodes if not nil
+	TLS *tls.Config
+	// Cluster routes keys to the owners of their slots,
+	// and follows MOVED and ASK redirections
+	Cluster bool
+	// PoolSize is the max connections to each node, defaults to 10
+	PoolSize int
+	// DialTimeout defaults to 5 seconds
+	DialTimeout time.Duration
+	// Timeout is used if the context has no deadline, defaults to 3 seconds
+	Timeout time.Duration
+	// MaxRetries on network errors and redirections, defaults to 3,
+	// -1 disables retries
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the waiting between retries,
+	// default to 8ms and 512ms
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (o *Options) init() error {
+	if len(o.Addrs) == 0 {
+		return errors.New("evolvest: no address")
+	}
+	if o.Network == "" {
+		o.Network = "tcp"
+	}
+	if o.PoolSize <= 0 {
+		o.PoolSize = 10
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 3 * time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 8 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 512 * time.Millisecond
+	}
+	return nil
+}
+
+// Client is a RESP client of evolvest, safe for concurrent use
+type Client struct {
+	opts  Options
+	mu    sync.RWMutex
+	pools map[string]*pool
+	// slots are the addresses of slot owners, nil if not in cluster mode
+	slots     []string
+	reloading int32
+	closed    bool
+}
+
+// New creates a client, the slots are loaded in cluster mode
+func New(opts Options) (*Client, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	c := &Client{
+		opts:  opts,
+		pools: make(map[string]*pool),
+	}
+	if opts.Cluster {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.DialTimeout)
+		defer cancel()
+		if err := c.ReloadSlots(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connections of all nodes
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, p := range c.pools {
+		p.close()
+	}
+	return nil
+}
+
+func (c *Client) pool(addr string) (*pool, error) {
+	c.mu.RLock()
+	p, ok := c.pools[addr]
+	closed := c.closed
+	c.mu.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if ok {
+		return p, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok = c.pools[addr]; ok {
+		return p, nil
+	}
+	p = newPool(c.network(addr), addr, &c.opts)
+	c.pools[addr] = p
+	return p, nil
+}
+
+// network returns network of the node, the nodes learned from
+// cluster are always on tcp
+func (c *Client) network(addr string) string {
+	for _, a := range c.opts.Addrs {
+		if a == addr {
+			return c.opts.Network
+		}
+	}
+	return "tcp"
+}
+
+// ReloadSlots loads the owners of slots by CLUSTER SLOTS
+func (c *Client) ReloadSlots(ctx context.Context) error {
+	addrs := append([]string{}, c.opts.Addrs...)
+	c.mu.RLock()
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		cmd := NewCmd("cluster", "slots")
+		cmd.addr = addr
+		c.exec(ctx, cmd, false)
+		if cmd.err != nil {
+			lastErr = cmd.err
+			continue
+		}
+		slots, err := parseSlots(cmd.val)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("evolvest: load slots error: %v", lastErr)
+}
+
+// parseSlots parses reply of CLUSTER SLOTS: [start, end, [host, port, id], ...]
+func parseSlots(reply interface{}) ([]string, error) {
+	ranges, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("evolvest: invalid slots reply %v", reply)
+	}
+	slots := make([]string, cluster.SlotCount)
+	for _, r := range ranges {
+		items, ok := r.([]interface{})
+		if !ok || len(items) < 3 {
+			return nil, fmt.Errorf("evolvest: invalid slot range %v", r)
+		}
+		start, ok1 := items[0].(int64)
+		end, ok2 := items[1].(int64)
+		node, ok3 := items[2].([]interface{})
+		if !ok1 || !ok2 || !ok3 || len(node) < 2 ||
+			start < 0 || end >= cluster.SlotCount || start > end {
+			return nil, fmt.Errorf("evolvest: invalid slot range %v", r)
+		}
+		host, _ := node[0].([]byte)
+		port, _ := node[1].(int64)
+		addr := net.JoinHostPort(string(host), strconv.FormatInt(port, 10))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+	}
+	return slots, nil
+}
+
+// addrOf returns address of the node serving key
+func (c *Client) addrOf(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.slots != nil && key != "" {
+		if addr := c.slots[cluster.KeySlot(key)]; addr != "" {
+			return addr
+		}
+	}
+	return c.opts.Addrs[0]
+}
+
+// nodes returns addresses of the nodes owning slots
+func (c *Client) nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.slots == nil {
+		return []string{c.opts.Addrs[0]}
+	}
+	seen := make(map[string]bool)
+	addrs := make([]string, 0)
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// moved updates owner of the slot, and reloads all slots in background
+func (c *Client) moved(slot int, addr string) {
+	c.mu.Lock()
+	if c.slots != nil && slot >= 0 && slot < len(c.slots) {
+		c.slots[slot] = addr
+	}
+	c.mu.Unlock()
+	if c.opts.Cluster && atomic.CompareAndSwapInt32(&c.reloading, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&c.reloading, 0)
+			ctx, cancel := context.WithTimeout(context.Background(), c.opts.DialTimeout)
+			defer cancel()
+			c.ReloadSlots(ctx)
+		}()
+	}
+}
+
+// exec runs the command once on its node
+func (c *Client) exec(ctx context.Context, cmd *Cmd, asking bool) {
+	addr := cmd.addr
+	if addr == "" {
+		addr = c.addrOf(cmd.key)
+	}
+	p, err := c.pool(addr)
+	if err != nil {
+		cmd.val, cmd.err, cmd.broken = nil, err, false
+		return
+	}
+	cn, err := p.get(ctx)
+	if err != nil {
+		// dial errors are worth retrying
+		cmd.val, cmd.err, cmd.broken = nil, err, err != ctx.Err() && err != ErrClosed
+		return
+	}
+	defer p.put(cn)
+
+	cn.setDeadline(ctx, c.opts.Timeout)
+	if asking {
+		if _, err = cn.do(ctx, "asking"); err != nil {
+			cmd.val, cmd.err, cmd.broken = nil, err, cn.broken
+			return
+		}
+	}
+	if err = cn.writeCommand(cmd.args...); err != nil {
+		cmd.val, cmd.err, cmd.broken = nil, err, false
+		return
+	}
+	if err = cn.flush(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		cmd.val, cmd.err, cmd.broken = nil, err, true
+		return
+	}
+	cmd.val, cmd.err = cn.readReply()
+	cmd.broken = cn.broken
+	if cmd.broken && ctx.Err() != nil {
+		// report the deadline of ctx instead of i/o timeout
+		cmd.err = ctx.Err()
+	}
+}
+
+// process runs the command, and retries on redirections and network errors
+func (c *Client) process(ctx context.Context, cmd *Cmd) error {
+	// a failed command of pipeline may be redirected by ASK already
+	asking := cmd.asking
+	for attempt := 0; ; attempt++ {
+		c.exec(ctx, cmd, asking)
+		if cmd.err == nil || attempt >= c.opts.MaxRetries {
+			return cmd.err
+		}
+		retry, wait := c.retryable(ctx, cmd)
+		if !retry {
+			return cmd.err
+		}
+		asking = cmd.asking
+		if wait {
+			if err := sleep(ctx, backoff(attempt, c.opts.MinBackoff, c.opts.MaxBackoff)); err != nil {
+				return cmd.err
+			}
+		}
+	}
+}
+
+// retryable tells whether the failed command should be retried, and
+// whether waiting before retrying. The command is redirected to the
+// node given by MOVED or ASK.
+func (c *Client) retryable(ctx context.Context, cmd *Cmd) (retry, wait bool) {
+	cmd.asking = false
+	if ctx.Err() != nil {
+		return false, false
+	}
+	if e, ok := cmd.err.(Error); ok {
+		msg := string(e)
+		switch {
+		case strings.HasPrefix(msg, "MOVED "), strings.HasPrefix(msg, "ASK "):
+			fields := strings.Fields(msg)
+			if len(fields) != 3 {
+				return false, false
+			}
+			slot, _ := strconv.Atoi(fields[1])
+			cmd.addr = fields[2]
+			if fields[0] == "MOVED" {
+				c.moved(slot, fields[2])
+			} else {
+				cmd.asking = true
+			}
+			return true, false
+		case strings.HasPrefix(msg, "TRYAGAIN"), strings.HasPrefix(msg, "LOADING"),
+			strings.HasPrefix(msg, "CLUSTERDOWN"):
+			return true, true
+		}
+		return false, false
+	}
+	if ne, ok := cmd.err.(net.Error); ok && ne.Timeout() {
+		// the command may have been run, and the node is too slow
+		return false, false
+	}
+	return cmd.broken, true
+}
+
+// backoff returns the exponential waiting with jitter
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min << uint(attempt)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do runs a command routed by its first argument, the reply is string,
+// int64, []byte, nil or []interface{} of them
+func (c *Client) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	cmd := NewCmd(args...)
+	err := c.process(ctx, cmd)
+	return cmd.val, err
+}
+
+// Get returns value of the key, ErrNil if not exists
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	cmd := NewCmd("get", key)
+	c.process(ctx, cmd)
+	return cmd.Bytes()
+}
+
+// Set sets value of the key
+func (c *Client) Set(ctx context.Context, key string, val interface{}) error {
+	cmd := NewCmd("set", key, val)
+	return c.process(ctx, cmd)
+}
+
+// SetEX sets value of the key expiring after ttl in milliseconds precision
+func (c *Client) SetEX(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
+	cmd := NewCmd("set", key, val, "px", ttl.Milliseconds())
+	return c.process(ctx, cmd)
+}
+
+// Expire sets the ttl of the key, the key is deleted if ttl is not
+// positive. Returns false if the key not exists.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	cmd := NewCmd("pexpire", key, ttl.Milliseconds())
+	c.process(ctx, cmd)
+	n, err := cmd.Int()
+	return n == 1, err
+}
+
+// TTL returns the remaining time to live of the key, -1 if the key has
+// no expiry, and -2 if not exists
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	cmd := NewCmd("pttl", key)
+	c.process(ctx, cmd)
+	n, err := cmd.Int()
+	if err != nil || n < 0 {
+		return time.Duration(n), err
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// Del deletes the keys, returns count of the existing ones
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	p := c.Pipeline()
+	for _, group := range c.groupBySlot(keys) {
+		args := []interface{}{"del"}
+		for _, i := range group {
+			args = append(args, keys[i])
+		}
+		p.Do(args...)
+	}
+	cmds, err := p.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, cmd := range cmds {
+		n, _ := cmd.Int()
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// MGet returns values of the keys, nil for the ones not exist
+func (c *Client) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return [][]byte{}, nil
+	}
+	groups := c.groupBySlot(keys)
+	p := c.Pipeline()
+	for _, group := range groups {
+		args := []interface{}{"mget"}
+		for _, i := range group {
+			args = append(args, keys[i])
+		}
+		p.Do(args...)
+	}
+	cmds, err := p.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([][]byte, len(keys))
+	for g, cmd := range cmds {
+		items, err := cmd.BytesSlice()
+		if err != nil {
+			return nil, err
+		}
+		if len(items) != len(groups[g]) {
+			return nil, fmt.Errorf("evolvest: mget got %d values, want %d", len(items), len(groups[g]))
+		}
+		for j, i := range groups[g] {
+			vals[i] = items[j]
+		}
+	}
+	return vals, nil
+}
+
+// groupBySlot groups the indexes of keys by slot in cluster mode,
+// all keys are in one group otherwise
+func (c *Client) groupBySlot(keys []string) [][]int {
+	if !c.opts.Cluster {
+		group := make([]int, len(keys))
+		for i := range keys {
+			group[i] = i
+		}
+		return [][]int{group}
+	}
+	bySlot := make(map[int]int)
+	groups := make([][]int, 0)
+	for i, key := range keys {
+		slot := cluster.KeySlot(key)
+		g, ok := bySlot[slot]
+		if !ok {
+			g = len(groups)
+			bySlot[slot] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// Scan iterates the keys matching pattern on all nodes, count is
+// the hint of keys scanned in each round trip
+func (c *Client) Scan(ctx context.Context, match string, count int, fn func(key string) error) error {
+	if match == "" {
+		match = "*"
+	}
+	if count <= 0 {
+		count = 100
+	}
+	for _, addr := range c.nodes() {
+		cursor := "0"
+		for {
+			cmd := NewCmd("scan", cursor, "match", match, "count", count)
+			cmd.addr = addr
+			if err := c.process(ctx, cmd); err != nil {
+				return err
+			}
+			next, keys, err := parseScan(cmd.val)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err = fn(key); err != nil {
+					return err
+				}
+			}
+			if next == "0" {
+				break
+			}
+			cursor = next
+		}
+	}
+	return nil
+}
+
+func parseScan(reply interface{}) (cursor string, keys []string, err error) {
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return "", nil, fmt.Errorf("evolvest: invalid scan reply %v", reply)
+	}
+	next, ok := items[0].([]byte)
+	if !ok {
+		return "", nil, fmt.Errorf("evolvest: invalid scan cursor %v", items[0])
+	}
+	keys, err = toStrings(items[1])
+	return string(next), keys, err
+}
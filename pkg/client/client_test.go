@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/edditen/evolvest/embed/server"
+	"github.com/edditen/evolvest/pkg/acl"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/store"
+	"net"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+// startServer runs a node listening on a unix socket
+func startServer(t *testing.T) string {
+	dir := t.TempDir()
+	sock := path.Join(dir, "evolvest.sock")
+	conf := &config.Config{
+		DataDir:              dir,
+		Listeners:            []config.ListenerConfig{{Network: "unix", Addr: sock}},
+		NotifyKeyspaceEvents: "KA",
+		ShutdownTimeout:      1,
+	}
+	c := cluster.NewCluster(conf)
+	syncer := store.NewSyncer(conf, c)
+	a := acl.NewACL(conf)
+	srv := server.NewEvolvestServer(conf, syncer, c, a)
+	for _, r := range []interface{ Init() error }{c, syncer, a, srv} {
+		if err := r.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errC := make(chan error, 10)
+	go syncer.Run(errC)
+	go srv.Run(errC)
+	t.Cleanup(func() {
+		srv.Shutdown()
+		syncer.Shutdown()
+	})
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			conn.Close()
+			return sock
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server is not started")
+	return ""
+}
+
+// eventually retries fn, since the writes are applied asynchronously
+func eventually(t *testing.T, fn func() error) {
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = fn(); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(err)
+}
+
+func TestClient(t *testing.T) {
+	sock := startServer(t)
+	c, err := New(Options{Addrs: []string{sock}, Network: "unix", PoolSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	w, err := c.Watch(ctx, "watched:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	p := c.Pipeline()
+	for i := 0; i < 20; i++ {
+		p.Set(fmt.Sprintf("key:%02d", i), i)
+	}
+	p.Set("watched:a", "1")
+	if _, err = p.Exec(ctx); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+
+	eventually(t, func() error {
+		val, err := c.Get(ctx, "key:07")
+		if err != nil || string(val) != "7" {
+			return fmt.Errorf("Get() = %q, %v, want 7", val, err)
+		}
+		return nil
+	})
+	select {
+	case e := <-w.C:
+		if e.Key != "watched:a" || e.Action != "set" {
+			t.Errorf("event = %+v, want set watched:a", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("no event received")
+	}
+
+	vals, err := c.MGet(ctx, "key:00", "missing", "key:19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(vals[0]) != "0" || vals[1] != nil || string(vals[2]) != "19" {
+		t.Errorf("MGet() = %q", vals)
+	}
+
+	keys := make([]string, 0)
+	err = c.Scan(ctx, "key:*", 3, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 20 || keys[0] != "key:00" || keys[19] != "key:19" {
+		t.Errorf("Scan() = %v", keys)
+	}
+
+	if n, err := c.Del(ctx, "key:00", "key:01", "missing"); err != nil || n != 2 {
+		t.Errorf("Del() = %d, %v, want 2", n, err)
+	}
+	eventually(t, func() error {
+		if _, err := c.Get(ctx, "key:00"); err != ErrNil {
+			return fmt.Errorf("Get() deleted key error = %v, want %v", err, ErrNil)
+		}
+		return nil
+	})
+
+	if _, err = c.Do(ctx, "nocommand"); err == nil {
+		t.Error("Do() unknown command, want error")
+	} else if _, ok := err.(Error); !ok {
+		t.Errorf("Do() error = %T, want Error", err)
+	}
+}
+
+func TestParseSlots(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(8191),
+			[]interface{}{[]byte("127.0.0.1"), int64(7001), []byte("a")}},
+		[]interface{}{int64(8192), int64(16383),
+			[]interface{}{[]byte("127.0.0.1"), int64(7002), []byte("b")}},
+	}
+	slots, err := parseSlots(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slots[0] != "127.0.0.1:7001" || slots[8191] != "127.0.0.1:7001" ||
+		slots[8192] != "127.0.0.1:7002" || slots[cluster.SlotCount-1] != "127.0.0.1:7002" {
+		t.Errorf("parseSlots() = %v ... %v", slots[:1], slots[cluster.SlotCount-1:])
+	}
+	if _, err = parseSlots([]interface{}{[]interface{}{int64(1)}}); err == nil {
+		t.Error("parseSlots() invalid range, want error")
+	}
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Cmd is a command and its reply
+type Cmd struct {
+	args []interface{}
+	// key routes the command, empty for the keyless ones
+	key string
+	// addr is the node running the command, overrides the routing by key
+	addr   string
+	asking bool
+	val    interface{}
+	err    error
+	// broken tells the connection was broken running the command
+	broken bool
+}
+
+// NewCmd creates a command routed by the first argument
+func NewCmd(args ...interface{}) *Cmd {
+	cmd := &Cmd{args: args}
+	if len(args) > 1 {
+		switch key := args[1].(type) {
+		case string:
+			cmd.key = key
+		case []byte:
+			cmd.key = string(key)
+		}
+	}
+	return cmd
+}
+
+// Args returns arguments of the command
+func (cmd *Cmd) Args() []interface{} {
+	return cmd.args
+}
+
+// Val returns the reply, which is string, int64, []byte, nil or
+// []interface{} of them
+func (cmd *Cmd) Val() interface{} {
+	return cmd.val
+}
+
+// Err returns the error of running the command
+func (cmd *Cmd) Err() error {
+	return cmd.err
+}
+
+// Bytes returns the reply of bulk or simple string, ErrNil if nil
+func (cmd *Cmd) Bytes() ([]byte, error) {
+	if cmd.err != nil {
+		return nil, cmd.err
+	}
+	switch v := cmd.val.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, ErrNil
+	}
+	return nil, fmt.Errorf("evolvest: unexpected reply type %T", cmd.val)
+}
+
+// Text returns the reply as string, ErrNil if nil
+func (cmd *Cmd) Text() (string, error) {
+	b, err := cmd.Bytes()
+	return string(b), err
+}
+
+// Int returns the reply of integer
+func (cmd *Cmd) Int() (int64, error) {
+	if cmd.err != nil {
+		return 0, cmd.err
+	}
+	switch v := cmd.val.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case nil:
+		return 0, ErrNil
+	}
+	return 0, fmt.Errorf("evolvest: unexpected reply type %T", cmd.val)
+}
+
+// BytesSlice returns the reply of array, the nil items are kept
+func (cmd *Cmd) BytesSlice() ([][]byte, error) {
+	if cmd.err != nil {
+		return nil, cmd.err
+	}
+	items, ok := cmd.val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("evolvest: unexpected reply type %T", cmd.val)
+	}
+	vals := make([][]byte, len(items))
+	for i, item := range items {
+		switch v := item.(type) {
+		case []byte:
+			vals[i] = v
+		case string:
+			vals[i] = []byte(v)
+		case nil:
+		default:
+			return nil, fmt.Errorf("evolvest: unexpected item type %T", item)
+		}
+	}
+	return vals, nil
+}
+
+// Strings returns the reply of array as strings
+func (cmd *Cmd) Strings() ([]string, error) {
+	if cmd.err != nil {
+		return nil, cmd.err
+	}
+	return toStrings(cmd.val)
+}
+
+func toStrings(reply interface{}) ([]string, error) {
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("evolvest: unexpected reply type %T", reply)
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		switch v := item.(type) {
+		case []byte:
+			strs[i] = string(v)
+		case string:
+			strs[i] = v
+		case int64:
+			strs[i] = strconv.FormatInt(v, 10)
+		case nil:
+		default:
+			return nil, fmt.Errorf("evolvest: unexpected item type %T", item)
+		}
+	}
+	return strs, nil
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error is the error replied by server, the connection is still usable
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// conn is a RESP connection to a node
+type conn struct {
+	netConn net.Conn
+	rd      *bufio.Reader
+	wr      *bufio.Writer
+	// broken is set on network or protocol errors
+	broken bool
+}
+
+func dial(ctx context.Context, network, addr string, opts *Options) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.DialTimeout)
+	defer cancel()
+	d := net.Dialer{}
+	netConn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TLS != nil {
+		tlsConn := tls.Client(netConn, opts.TLS)
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, errors.Wrap(err, "tls handshake error")
+		}
+		netConn = tlsConn
+	}
+	c := &conn{
+		netConn: netConn,
+		rd:      bufio.NewReader(netConn),
+		wr:      bufio.NewWriter(netConn),
+	}
+
+	if opts.Password != "" {
+		args := []interface{}{"auth", opts.Password}
+		if opts.Username != "" {
+			args = []interface{}{"auth", opts.Username, opts.Password}
+		}
+		if _, err = c.do(ctx, args...); err != nil {
+			c.close()
+			return nil, errors.Wrap(err, "auth error")
+		}
+	}
+	return c, nil
+}
+
+func (c *conn) close() error {
+	return c.netConn.Close()
+}
+
+// setDeadline applies the deadline of ctx, or the default timeout
+func (c *conn) setDeadline(ctx context.Context, timeout time.Duration) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	c.netConn.SetDeadline(deadline)
+}
+
+// do sends a command and reads its reply
+func (c *conn) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.netConn.SetDeadline(deadline)
+	}
+	if err := c.writeCommand(args...); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *conn) flush() error {
+	if err := c.wr.Flush(); err != nil {
+		c.broken = true
+		return err
+	}
+	return nil
+}
+
+// writeCommand buffers a command as an array of bulk strings
+func (c *conn) writeCommand(args ...interface{}) error {
+	// encode first, so that nothing is buffered for invalid arguments
+	bs := make([][]byte, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case []byte:
+			bs[i] = v
+		case string:
+			bs[i] = []byte(v)
+		case int:
+			bs[i] = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			bs[i] = strconv.AppendInt(nil, v, 10)
+		case uint64:
+			bs[i] = strconv.AppendUint(nil, v, 10)
+		case float64:
+			bs[i] = strconv.AppendFloat(nil, v, 'f', -1, 64)
+		case nil:
+			bs[i] = []byte{}
+		default:
+			return fmt.Errorf("unsupported argument type %T", arg)
+		}
+	}
+	c.wr.WriteString("*" + strconv.Itoa(len(bs)) + "\r\n")
+	for _, b := range bs {
+		c.wr.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+		c.wr.Write(b)
+		c.wr.WriteString("\r\n")
+	}
+	return nil
+}
+
+// readReply reads a reply, which is string, int64, []byte, nil or
+// []interface{} of them. The error replied by server is returned as Error.
+func (c *conn) readReply() (interface{}, error) {
+	reply, err := readReply(c.rd)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			c.broken = true
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("invalid bulk length '%s'", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("invalid array length '%s'", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readReply(rd)
+			if err != nil {
+				if e, ok := err.(Error); ok {
+					// keep the errors in array as items
+					items[i] = e
+					continue
+				}
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid reply '%s'", line)
+}
+
+func readLine(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply line '%s'", line)
+	}
+	return line[:len(line)-2], nil
+}
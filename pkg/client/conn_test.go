@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    interface{}
+		wantErr bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"error", "-ERR wrong\r\n", nil, true},
+		{"integer", ":42\r\n", int64(42), false},
+		{"bulk", "$5\r\nhello\r\n", []byte("hello"), false},
+		{"empty bulk", "$0\r\n\r\n", []byte{}, false},
+		{"nil bulk", "$-1\r\n", nil, false},
+		{"array", "*3\r\n$1\r\na\r\n$-1\r\n:1\r\n",
+			[]interface{}{[]byte("a"), nil, int64(1)}, false},
+		{"error in array", "*1\r\n-MOVED 1 a:1\r\n",
+			[]interface{}{Error("MOVED 1 a:1")}, false},
+		{"nested array", "*2\r\n*1\r\n+a\r\n*0\r\n",
+			[]interface{}{[]interface{}{"a"}, []interface{}{}}, false},
+		{"invalid type", "?1\r\n", nil, true},
+		{"missing cr", "+OK\n", nil, true},
+		{"short bulk", "$5\r\nhi\r\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readReply(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readReply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readReply() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
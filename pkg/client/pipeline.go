@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// Pipeline sends the queued commands in one round trip to each node,
+// the order of commands on the same node is kept
+type Pipeline struct {
+	c    *Client
+	cmds []*Cmd
+}
+
+// Pipeline creates a pipeline, which is not safe for concurrent use
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do queues a command routed by its first argument
+func (p *Pipeline) Do(args ...interface{}) *Cmd {
+	cmd := NewCmd(args...)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// Get queues a GET
+func (p *Pipeline) Get(key string) *Cmd {
+	return p.Do("get", key)
+}
+
+// Set queues a SET
+func (p *Pipeline) Set(key string, val interface{}) *Cmd {
+	return p.Do("set", key, val)
+}
+
+// Del queues a DEL
+func (p *Pipeline) Del(key string) *Cmd {
+	return p.Do("del", key)
+}
+
+// Exec sends the queued commands and returns them with replies, the
+// error is the first one of commands. The failed commands are retried
+// one by one on redirections and network errors.
+func (p *Pipeline) Exec(ctx context.Context) ([]*Cmd, error) {
+	cmds := p.cmds
+	p.cmds = nil
+
+	byAddr := make(map[string][]*Cmd)
+	for _, cmd := range cmds {
+		addr := p.c.addrOf(cmd.key)
+		byAddr[addr] = append(byAddr[addr], cmd)
+	}
+	var wg sync.WaitGroup
+	for addr, group := range byAddr {
+		wg.Add(1)
+		go func(addr string, group []*Cmd) {
+			defer wg.Done()
+			p.c.execPipeline(ctx, addr, group)
+		}(addr, group)
+	}
+	wg.Wait()
+
+	var firstErr error
+	for _, cmd := range cmds {
+		if cmd.err != nil && p.c.opts.MaxRetries > 0 {
+			if retry, wait := p.c.retryable(ctx, cmd); retry {
+				if wait {
+					sleep(ctx, p.c.opts.MinBackoff)
+				}
+				p.c.process(ctx, cmd)
+			}
+		}
+		if cmd.err != nil && firstErr == nil {
+			firstErr = cmd.err
+		}
+	}
+	return cmds, firstErr
+}
+
+// execPipeline runs the commands on one connection of the node
+func (c *Client) execPipeline(ctx context.Context, addr string, cmds []*Cmd) {
+	fail := func(cmds []*Cmd, err error, broken bool) {
+		for _, cmd := range cmds {
+			cmd.val, cmd.err, cmd.broken = nil, err, broken
+		}
+	}
+	pl, err := c.pool(addr)
+	if err != nil {
+		fail(cmds, err, false)
+		return
+	}
+	cn, err := pl.get(ctx)
+	if err != nil {
+		fail(cmds, err, err != ctx.Err() && err != ErrClosed)
+		return
+	}
+	defer pl.put(cn)
+
+	cn.setDeadline(ctx, c.opts.Timeout)
+	written := make([]*Cmd, 0, len(cmds))
+	for _, cmd := range cmds {
+		if err = cn.writeCommand(cmd.args...); err != nil {
+			cmd.val, cmd.err = nil, err
+			continue
+		}
+		written = append(written, cmd)
+	}
+	if err = cn.flush(); err != nil {
+		fail(written, err, true)
+		return
+	}
+	for i, cmd := range written {
+		cmd.val, cmd.err = cn.readReply()
+		if cn.broken {
+			fail(written[i:], cmd.err, true)
+			return
+		}
+	}
+}
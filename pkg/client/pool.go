@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when using a closed client
+var ErrClosed = errors.New("evolvest: client is closed")
+
+// pool keeps at most PoolSize connections to a node
+type pool struct {
+	network string
+	addr    string
+	opts    *Options
+	idle    chan *conn
+	// tokens limits the opened connections
+	tokens chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+func newPool(network, addr string, opts *Options) *pool {
+	return &pool{
+		network: network,
+		addr:    addr,
+		opts:    opts,
+		idle:    make(chan *conn, opts.PoolSize),
+		tokens:  make(chan struct{}, opts.PoolSize),
+	}
+}
+
+// get returns an idle connection, or dials a new one if the pool is not
+// full, otherwise waits for the connections put back until ctx is done
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	if p.isClosed() {
+		return nil, ErrClosed
+	}
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	select {
+	case c := <-p.idle:
+		return c, nil
+	case p.tokens <- struct{}{}:
+		c, err := dial(ctx, p.network, p.addr, p.opts)
+		if err != nil {
+			<-p.tokens
+			return nil, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns the connection to pool, the broken one is closed
+func (p *pool) put(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.broken || p.closed {
+		c.close()
+		<-p.tokens
+		return
+	}
+	// never blocks, the idle ones are not more than tokens
+	p.idle <- c
+}
+
+func (p *pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.close()
+			<-p.tokens
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyspacePrefix = "__keyspace@0__:"
+
+// Event is a keyspace notification
+type Event struct {
+	// Key is the changed key
+	Key string
+	// Action is the command changed the key, e.g. set or del
+	Action string
+}
+
+// Watcher receives the events of keys matching a pattern, which are
+// published only if notify_keyspace_events of the nodes includes K and
+// the classes of events, e.g. "KA".
+type Watcher struct {
+	// C is closed when the watcher is closed or any connection is lost
+	C      <-chan Event
+	conns  []*conn
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+	once   sync.Once
+	closed chan interface{}
+}
+
+// Watch subscribes the keyspace events of keys matching pattern on all
+// nodes, the nodes owning slots later are not watched in cluster mode.
+func (c *Client) Watch(ctx context.Context, pattern string) (*Watcher, error) {
+	events := make(chan Event, 100)
+	w := &Watcher{
+		C:      events,
+		closed: make(chan interface{}),
+	}
+	channel := keyspacePrefix + pattern
+	for _, addr := range c.nodes() {
+		cn, err := dial(ctx, c.network(addr), addr, &c.opts)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.conns = append(w.conns, cn)
+		cn.setDeadline(ctx, c.opts.Timeout)
+		reply, err := cn.do(ctx, "psubscribe", channel)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		if items, ok := reply.([]interface{}); !ok || len(items) != 3 {
+			w.Close()
+			return nil, fmt.Errorf("evolvest: invalid psubscribe reply %v", reply)
+		}
+		// wait for events without deadline
+		cn.netConn.SetDeadline(time.Time{})
+	}
+
+	for _, cn := range w.conns {
+		w.wg.Add(1)
+		go w.receive(cn, events)
+	}
+	go func() {
+		w.wg.Wait()
+		close(events)
+	}()
+	return w, nil
+}
+
+func (w *Watcher) receive(cn *conn, events chan<- Event) {
+	defer w.wg.Done()
+	// stop the others, so that C is closed
+	defer w.Close()
+	for {
+		reply, err := cn.readReply()
+		if err != nil {
+			select {
+			case <-w.closed:
+			default:
+				w.mu.Lock()
+				if w.err == nil {
+					w.err = err
+				}
+				w.mu.Unlock()
+			}
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 4 {
+			continue
+		}
+		if kind, _ := items[0].([]byte); string(kind) != "pmessage" {
+			continue
+		}
+		channel, _ := items[2].([]byte)
+		action, _ := items[3].([]byte)
+		event := Event{
+			Key:    strings.TrimPrefix(string(channel), keyspacePrefix),
+			Action: string(action),
+		}
+		select {
+		case events <- event:
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// Err returns the error stopped the watcher, nil if stopped by Close
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	w.once.Do(func() {
+		close(w.closed)
+		for _, cn := range w.conns {
+			cn.close()
+		}
+	})
+	return nil
+}
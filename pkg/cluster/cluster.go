@@ -0,0 +1,405 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	Moved = "MOVED"
+	Ask   = "ASK"
+)
+
+var ErrClusterDown = errors.New("CLUSTERDOWN Hash slot not served")
+
+// Redirect is returned by Route when the key should be served by other node.
+type Redirect struct {
+	Kind string
+	Slot int
+	Addr string
+}
+
+func (r *Redirect) Error() string {
+	return fmt.Sprintf("%s %d %s", r.Kind, r.Slot, r.Addr)
+}
+
+type Node struct {
+	// Id is the configured id
+	Id string
+	// Name is the redis style node id, 40 hex characters
+	Name     string
+	Host     string
+	Port     string
+	SyncPort string
+	Self     bool
+}
+
+func (n *Node) Addr() string {
+	return n.Host + ":" + n.Port
+}
+
+func (n *Node) SyncAddr() string {
+	return n.Host + ":" + n.SyncPort
+}
+
+// SlotRange is a range of continuous slots served by the same node.
+type SlotRange struct {
+	Start int
+	End   int
+	Nodes []*Node
+}
+
+type Cluster struct {
+	cfg       *config.Config
+	mu        sync.RWMutex
+	enabled   bool
+	replicas  int
+	self      *Node
+	nodes     []*Node
+	slots     [SlotCount]*Node
+	migrating map[int]*Node
+	importing map[int]*Node
+}
+
+func NewCluster(conf *config.Config) *Cluster {
+	return &Cluster{
+		cfg:       conf,
+		nodes:     make([]*Node, 0),
+		migrating: make(map[int]*Node),
+		importing: make(map[int]*Node),
+	}
+}
+
+func (c *Cluster) Init() error {
+	log.Println("[Init] init cluster")
+	cc := c.cfg.Cluster
+	if !cc.Enabled {
+		return nil
+	}
+
+	selfId := cc.NodeId
+	if selfId == "" {
+		selfId = os.Getenv(common.EnvSid)
+	}
+
+	for _, nc := range cc.Nodes {
+		node := &Node{
+			Id:       nc.Id,
+			Name:     nodeName(nc.Id),
+			Host:     nc.Host,
+			Port:     nc.Port,
+			SyncPort: nc.SyncPort,
+			Self:     nc.Id == selfId,
+		}
+		if c.node(nc.Id) != nil {
+			return fmt.Errorf("duplicated cluster node %s", nc.Id)
+		}
+		c.nodes = append(c.nodes, node)
+		if node.Self {
+			c.self = node
+		}
+		for _, text := range nc.Slots {
+			start, end, err := parseSlots(text)
+			if err != nil {
+				return errors.Wrapf(err, "node %s", nc.Id)
+			}
+			for slot := start; slot <= end; slot++ {
+				if c.slots[slot] != nil {
+					return fmt.Errorf("slot %d assigned to both %s and %s",
+						slot, c.slots[slot].Id, nc.Id)
+				}
+				c.slots[slot] = node
+			}
+		}
+	}
+	if c.self == nil {
+		return fmt.Errorf("node id '%s' not found in cluster nodes", selfId)
+	}
+
+	c.replicas = cc.Replicas
+	if c.replicas >= len(c.nodes) {
+		c.replicas = len(c.nodes) - 1
+	}
+	c.enabled = true
+	return nil
+}
+
+func (c *Cluster) Run(errC chan<- error) {
+	log.Println("[Run] run cluster")
+}
+
+func (c *Cluster) Shutdown() {
+	log.Println("[Shutdown] shutdown cluster")
+}
+
+// nodeName generates a stable redis style node id from the configured id
+func nodeName(id string) string {
+	sum := sha1.Sum([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseSlots(text string) (start, end int, err error) {
+	parts := strings.SplitN(strings.TrimSpace(text), "-", 2)
+	if start, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid slots '%s'", text)
+	}
+	end = start
+	if len(parts) == 2 {
+		if end, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid slots '%s'", text)
+		}
+	}
+	if start < 0 || end >= SlotCount || start > end {
+		return 0, 0, fmt.Errorf("invalid slots '%s'", text)
+	}
+	return start, end, nil
+}
+
+func (c *Cluster) Enabled() bool {
+	return c.enabled
+}
+
+func (c *Cluster) Self() *Node {
+	return c.self
+}
+
+func (c *Cluster) Nodes() []*Node {
+	return c.nodes
+}
+
+func (c *Cluster) node(id string) *Node {
+	for _, node := range c.nodes {
+		if node.Id == id || node.Name == id {
+			return node
+		}
+	}
+	return nil
+}
+
+// Node finds node by configured id or redis style node id
+func (c *Cluster) Node(id string) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.node(id)
+}
+
+// Owner returns the node serving the slot, nil if not assigned
+func (c *Cluster) Owner(slot int) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot]
+}
+
+// Replicas returns the nodes holding data of the slot, the owner is the
+// first one, followed by the next nodes in configured order.
+func (c *Cluster) Replicas(slot int) []*Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.replicasOf(slot)
+}
+
+func (c *Cluster) replicasOf(slot int) []*Node {
+	owner := c.slots[slot]
+	if owner == nil {
+		return nil
+	}
+	idx := 0
+	for i, node := range c.nodes {
+		if node == owner {
+			idx = i
+			break
+		}
+	}
+	nodes := make([]*Node, 0, c.replicas+1)
+	for i := 0; i <= c.replicas; i++ {
+		nodes = append(nodes, c.nodes[(idx+i)%len(c.nodes)])
+	}
+	return nodes
+}
+
+// Holds tells whether data of the key should be stored on node
+func (c *Cluster) Holds(node *Node, key string) bool {
+	if !c.enabled {
+		return true
+	}
+	for _, n := range c.Replicas(KeySlot(key)) {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Route checks whether key can be served by current node. A *Redirect
+// is returned if the client should ask another node, asking is true
+// if the client sent ASKING before, exists tells whether the key is
+// still in current node when the slot is migrating.
+func (c *Cluster) Route(key string, asking bool, exists func() bool) error {
+	if !c.enabled {
+		return nil
+	}
+	slot := KeySlot(key)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	owner := c.slots[slot]
+	if owner == nil {
+		return ErrClusterDown
+	}
+	if owner == c.self {
+		if target, ok := c.migrating[slot]; ok && !exists() {
+			return &Redirect{Kind: Ask, Slot: slot, Addr: target.Addr()}
+		}
+		return nil
+	}
+	if _, ok := c.importing[slot]; ok && asking {
+		return nil
+	}
+	return &Redirect{Kind: Moved, Slot: slot, Addr: owner.Addr()}
+}
+
+// SetSlotMigrating marks the slot is migrating to node id
+func (c *Cluster) SetSlotMigrating(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots[slot] != c.self {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+	node := c.node(id)
+	if node == nil {
+		return fmt.Errorf("I don't know about node %s", id)
+	}
+	c.migrating[slot] = node
+	return nil
+}
+
+// Migrating returns the node which the slot is migrating to, nil if not
+func (c *Cluster) Migrating(slot int) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.migrating[slot]
+}
+
+// SetSlotImporting marks the slot is importing from node id
+func (c *Cluster) SetSlotImporting(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots[slot] == c.self {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+	node := c.node(id)
+	if node == nil {
+		return fmt.Errorf("I don't know about node %s", id)
+	}
+	c.importing[slot] = node
+	return nil
+}
+
+// SetSlotNode assigns the slot to node id and clears migrating states
+func (c *Cluster) SetSlotNode(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node := c.node(id)
+	if node == nil {
+		return fmt.Errorf("I don't know about node %s", id)
+	}
+	c.slots[slot] = node
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+	return nil
+}
+
+// SetSlotStable clears migrating and importing states of the slot
+func (c *Cluster) SetSlotStable(slot int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+// SlotRanges returns continuous slot ranges grouped by owner
+func (c *Cluster) SlotRanges() []SlotRange {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ranges := make([]SlotRange, 0)
+	for slot := 0; slot < SlotCount; slot++ {
+		owner := c.slots[slot]
+		if owner == nil {
+			continue
+		}
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].End == slot-1 && ranges[last].Nodes[0] == owner {
+			ranges[last].End = slot
+			continue
+		}
+		ranges = append(ranges, SlotRange{
+			Start: slot,
+			End:   slot,
+			Nodes: c.replicasOf(slot),
+		})
+	}
+	return ranges
+}
+
+// NodeSlots returns the slot ranges owned by node, and the migrating or
+// importing slots in redis CLUSTER NODES format when node is self
+func (c *Cluster) NodeSlots(node *Node) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	slots := make([]string, 0)
+	start := -1
+	for slot := 0; slot <= SlotCount; slot++ {
+		owned := slot < SlotCount && c.slots[slot] == node
+		if owned && start < 0 {
+			start = slot
+		} else if !owned && start >= 0 {
+			if start == slot-1 {
+				slots = append(slots, strconv.Itoa(start))
+			} else {
+				slots = append(slots, fmt.Sprintf("%d-%d", start, slot-1))
+			}
+			start = -1
+		}
+	}
+	if node == c.self {
+		slots = append(slots, c.transferring(c.migrating, "->-")...)
+		slots = append(slots, c.transferring(c.importing, "-<-")...)
+	}
+	return slots
+}
+
+func (c *Cluster) transferring(m map[int]*Node, sep string) []string {
+	keys := make([]int, 0, len(m))
+	for slot := range m {
+		keys = append(keys, slot)
+	}
+	sort.Ints(keys)
+	items := make([]string, 0, len(keys))
+	for _, slot := range keys {
+		items = append(items, fmt.Sprintf("[%d%s%s]", slot, sep, m[slot].Name))
+	}
+	return items
+}
+
+// AssignedSlots returns count of slots assigned to any node
+func (c *Cluster) AssignedSlots() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	count := 0
+	for _, node := range c.slots {
+		if node != nil {
+			count++
+		}
+	}
+	return count
+}
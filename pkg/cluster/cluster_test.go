@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"reflect"
+	"testing"
+)
+
+// newTestCluster creates a cluster of self n1 owning 0-8191, n2 owning
+// 8192-12000 and n3 owning none, the slots after 12000 are not assigned
+func newTestCluster(t *testing.T, replicas int) *Cluster {
+	c := NewCluster(&config.Config{Cluster: config.ClusterConfig{
+		Enabled:  true,
+		NodeId:   "n1",
+		Replicas: replicas,
+		Nodes: []config.NodeConfig{
+			{Id: "n1", Host: "127.0.0.1", Port: "7001", Slots: []string{"0-8191"}},
+			{Id: "n2", Host: "127.0.0.1", Port: "7002", Slots: []string{"8192-12000"}},
+			{Id: "n3", Host: "127.0.0.1", Port: "7003"},
+		},
+	}})
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// keyIn returns a key whose slot is in [start, end]
+func keyIn(start, end int) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if slot := KeySlot(key); slot >= start && slot <= end {
+			return key
+		}
+	}
+}
+
+func TestCluster_Route(t *testing.T) {
+	c := newTestCluster(t, 0)
+	own, other, down := keyIn(0, 8191), keyIn(8192, 12000), keyIn(12001, SlotCount-1)
+	migrating, importing := keyIn(0, 8191), keyIn(8192, 12000)
+	for migrating == own {
+		migrating = keyIn(KeySlot(own)+1, 8191)
+	}
+	if err := c.SetSlotMigrating(KeySlot(migrating), "n3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSlotImporting(KeySlot(importing), "n2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		asking bool
+		exists bool
+		want   error
+	}{
+		{"own", own, false, false, nil},
+		{"moved", other, false, false, &Redirect{Kind: Moved, Slot: KeySlot(other), Addr: "127.0.0.1:7002"}},
+		{"down", down, false, false, ErrClusterDown},
+		{"migrating exists", migrating, false, true, nil},
+		{"migrating asked", migrating, false, false, &Redirect{Kind: Ask, Slot: KeySlot(migrating), Addr: "127.0.0.1:7003"}},
+		{"importing asking", importing, true, false, nil},
+		{"importing not asking", importing, false, false, &Redirect{Kind: Moved, Slot: KeySlot(importing), Addr: "127.0.0.1:7002"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.Route(tt.key, tt.asking, func() bool { return tt.exists })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Route(%s) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCluster_SetSlot(t *testing.T) {
+	c := newTestCluster(t, 0)
+	tests := []struct {
+		name    string
+		fn      func() error
+		wantErr bool
+	}{
+		{"migrate own", func() error { return c.SetSlotMigrating(1, "n2") }, false},
+		{"migrate not own", func() error { return c.SetSlotMigrating(9000, "n3") }, true},
+		{"migrate to unknown", func() error { return c.SetSlotMigrating(1, "n9") }, true},
+		{"import other", func() error { return c.SetSlotImporting(9000, "n2") }, false},
+		{"import own", func() error { return c.SetSlotImporting(1, "n2") }, true},
+		{"node by name", func() error { return c.SetSlotNode(2, nodeName("n3")) }, false},
+		{"node unknown", func() error { return c.SetSlotNode(2, "n9") }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// assigning the slot clears the migrating state
+	if err := c.SetSlotNode(1, "n2"); err != nil {
+		t.Fatal(err)
+	}
+	key := keyIn(1, 1)
+	want := &Redirect{Kind: Moved, Slot: 1, Addr: "127.0.0.1:7002"}
+	if got := c.Route(key, true, func() bool { return false }); !reflect.DeepEqual(got, want) {
+		t.Errorf("Route() after SetSlotNode = %v, want %v", got, want)
+	}
+	c.SetSlotStable(9000)
+	if got := c.Route(keyIn(9000, 9000), true, func() bool { return false }); got == nil {
+		t.Errorf("Route() after SetSlotStable = nil, want MOVED")
+	}
+	if c.Owner(2).Id != "n3" {
+		t.Errorf("Owner(2) = %s, want n3", c.Owner(2).Id)
+	}
+}
+
+func TestCluster_Holds(t *testing.T) {
+	c := newTestCluster(t, 1)
+	key := keyIn(0, 8191)
+	for _, node := range c.Nodes() {
+		// the owner and the next node
+		want := node.Id == "n1" || node.Id == "n2"
+		if got := c.Holds(node, key); got != want {
+			t.Errorf("Holds(%s) = %v, want %v", node.Id, got, want)
+		}
+	}
+}
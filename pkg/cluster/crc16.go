@@ -0,0 +1,49 @@
+package cluster
+
+// SlotCount is the number of hash slots, same as redis cluster
+const SlotCount = 16384
+
+// crc16 implementation according to CCITT standards (XMODEM),
+// which is what redis cluster uses for key hashing.
+var crc16tab [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16tab[i] = crc
+	}
+}
+
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key, only the part between the first
+// '{' and the following '}' is hashed if it's not empty (hash tags).
+func KeySlot(key string) int {
+	for s := 0; s < len(key); s++ {
+		if key[s] == '{' {
+			for e := s + 1; e < len(key); e++ {
+				if key[e] == '}' {
+					if e > s+1 {
+						key = key[s+1 : e]
+					}
+					return int(crc16(key)) & (SlotCount - 1)
+				}
+			}
+			break
+		}
+	}
+	return int(crc16(key)) & (SlotCount - 1)
+}
@@ -0,0 +1,24 @@
+package cluster
+
+import "testing"
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{name: "check value", key: "123456789", want: 12739},
+		{name: "foo", key: "foo", want: 12182},
+		{name: "bar", key: "bar", want: 5061},
+		{name: "empty", key: "", want: 0},
+		{name: "hash tag", key: "{user1000}.following", want: KeySlot("user1000")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KeySlot(tt.key); got != tt.want {
+				t.Errorf("KeySlot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
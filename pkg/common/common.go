@@ -1,9 +1,17 @@
 package common
 
+import (
+	"github.com/edditen/evolvest/pkg/compress"
+)
+
 type TxRequest struct {
 	TxId   int64
 	Flag   string
 	Action string
 	Key    string
 	Val    []byte
+	// Db is the index of database
+	Db int
+	// Codec tags how Val of SET is compressed
+	Codec compress.Codec
 }
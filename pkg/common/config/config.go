@@ -6,6 +6,8 @@ import (
 	"github.com/pkg/errors"
 	"io/ioutil"
 	"log"
+	"net/url"
+	"time"
 )
 
 type Config struct {
@@ -15,6 +17,277 @@ type Config struct {
 	SyncPort   string `json:"sync_port"`
 	AdminPort  string `json:"admin_port"`
 	DataDir    string `json:"data_dir"`
+	// Listeners of the server port, host:server_port is used if empty
+	Listeners []ListenerConfig `json:"listeners"`
+	// SyncListeners of the sync port, host:sync_port is used if empty
+	SyncListeners []ListenerConfig `json:"sync_listeners"`
+	// ShutdownTimeout is the seconds waiting for the in-flight commands
+	// and queued pushes on shutdown, defaults to 10
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// NotifyKeyspaceEvents selects the keyspace notifications published,
+	// with the flags of redis: K, E, g, $ and A, disabled if empty
+	NotifyKeyspaceEvents string `json:"notify_keyspace_events"`
+	// MaxMemory is the bytes of the keys and values estimated, beyond
+	// which the keys are evicted by MaxMemoryPolicy, unlimited if 0
+	MaxMemory int64 `json:"maxmemory"`
+	// MaxMemoryPolicy is noeviction (default), allkeys-lru, allkeys-lfu,
+	// volatile-ttl or allkeys-random
+	MaxMemoryPolicy string `json:"maxmemory_policy"`
+	// Engine is the storage engine, memory (default) keeps the data in
+	// memory with snapshots, lsm keeps it in the files of data_dir/lsm
+	Engine string `json:"engine"`
+	// CacheSize is the bytes of blocks cached by lsm engine, defaults to 64mb
+	CacheSize int64 `json:"cache_size"`
+	// ApplyBatch is the max count of requests applied, logged with a
+	// single write and handed over to peers at once, defaults to 256
+	ApplyBatch int `json:"apply_batch"`
+	// AppendFsync is always (default) which fsyncs the tx file after each
+	// batch, or everysec which fsyncs it every second
+	AppendFsync string `json:"appendfsync"`
+	// Databases is the count of numbered databases, defaults to 16
+	Databases int `json:"databases"`
+	// Namespaces are the names of databases, SELECT takes the name or
+	// the number
+	Namespaces map[string]int `json:"namespaces"`
+	// Quotas limit the keys and bytes of databases, by the namespace
+	// name or the number of database
+	Quotas      map[string]QuotaConfig `json:"quotas"`
+	RateLimit   RateLimitConfig        `json:"rate_limit"`
+	Compression CompressionConfig      `json:"compression"`
+	Cluster     ClusterConfig          `json:"cluster"`
+	Replication ReplicationConfig      `json:"replication"`
+	TLS         TLSConfig              `json:"tls"`
+	Auth        AuthConfig             `json:"auth"`
+}
+
+// QuotaConfig limits a database, the writes adding data are refused
+// beyond the limits. Zero means unlimited.
+type QuotaConfig struct {
+	MaxKeys  int   `json:"max_keys"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// CompressionConfig describes the compression of the values written
+// to current node, the values written to other nodes are kept as is
+type CompressionConfig struct {
+	// Codec is none (default), gzip, snappy or zstd
+	Codec string `json:"codec"`
+	// Threshold is the bytes of the smallest value compressed,
+	// defaults to 1024
+	Threshold int `json:"threshold"`
+}
+
+// RateLimitConfig limits the commands per second by token buckets,
+// the commands beyond the limits are refused. Zero means unlimited.
+type RateLimitConfig struct {
+	// Conn is the commands per second of each connection
+	Conn float64 `json:"conn"`
+	// User is the commands per second of all the connections of each
+	// user not in Users
+	User float64 `json:"user"`
+	// Users are the commands per second by user name
+	Users map[string]float64 `json:"users"`
+	// Burst is the seconds of commands allowed at once, defaults to 1
+	Burst float64 `json:"burst"`
+}
+
+// UserRate returns the commands per second of user, 0 if unlimited
+func (r *RateLimitConfig) UserRate(name string) float64 {
+	if rate, ok := r.Users[name]; ok {
+		return rate
+	}
+	return r.User
+}
+
+// BurstSize returns the tokens of bucket with the rate
+func (r *RateLimitConfig) BurstSize(rate float64) float64 {
+	burst := r.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	if rate*burst < 1 {
+		return 1
+	}
+	return rate * burst
+}
+
+// AuthConfig describes the authentication of the server port
+type AuthConfig struct {
+	// RequirePass is the password of the default user, which is used
+	// only when the default user is not defined in UsersFile
+	RequirePass string `json:"requirepass"`
+	// UsersFile persists the ACL users, defaults to users.acl in data_dir
+	UsersFile string `json:"users_file"`
+	// AuditFile records the denied commands and failed authentications,
+	// the denials are only logged if empty
+	AuditFile string `json:"audit_file"`
+	// SyncToken is the bearer token of peers on the sync port,
+	// which is also sent by current node to its peers
+	SyncToken string `json:"sync_token"`
+	// OperatorTokens grant read-only access to the sync port, e.g. evolvestcli
+	OperatorTokens []string `json:"operator_tokens"`
+	// PeerNames are the common names or dns names of mutual tls
+	// certificates granted peer access, any verified certificate
+	// is a peer if empty
+	PeerNames []string `json:"peer_names"`
+	// OperatorNames are the names of mutual tls certificates
+	// granted read-only access
+	OperatorNames []string `json:"operator_names"`
+}
+
+// SyncAuthEnabled tells whether callers of the sync port are authenticated
+func (a *AuthConfig) SyncAuthEnabled(tls *TLSConfig) bool {
+	return tls.Sync || a.SyncToken != "" || len(a.OperatorTokens) > 0
+}
+
+// ListenerConfig describes an address to listen on
+type ListenerConfig struct {
+	// Network is tcp (default), tcp4, tcp6 or unix
+	Network string `json:"network"`
+	// Addr is host:port, or path of the unix socket
+	Addr string `json:"addr"`
+	// Perm is the permission of the unix socket in octal, like "0660"
+	Perm string `json:"perm"`
+}
+
+func (l ListenerConfig) String() string {
+	network := l.Network
+	if network == "" {
+		network = "tcp"
+	}
+	return network + "://" + l.Addr
+}
+
+// ShutdownDuration returns the deadline of draining on shutdown
+func (c *Config) ShutdownDuration() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+// the policies of fsync of tx file
+const (
+	FsyncEverySec = "everysec"
+	FsyncAlways   = "always"
+)
+
+// FsyncBatch tells whether the tx file is fsynced after each batch
+func (c *Config) FsyncBatch() bool {
+	return c.AppendFsync != FsyncEverySec
+}
+
+// ApplyBatchSize returns the max count of requests applied at once
+func (c *Config) ApplyBatchSize() int {
+	if c.ApplyBatch <= 0 {
+		return 256
+	}
+	return c.ApplyBatch
+}
+
+// DatabaseCount returns the count of numbered databases
+func (c *Config) DatabaseCount() int {
+	if c.Databases <= 0 {
+		return 16
+	}
+	return c.Databases
+}
+
+// ServerListeners returns the listeners of server port
+func (c *Config) ServerListeners() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{{Addr: c.Host + ":" + c.ServerPort}}
+}
+
+// SyncServerListeners returns the listeners of sync port
+func (c *Config) SyncServerListeners() []ListenerConfig {
+	if len(c.SyncListeners) > 0 {
+		return c.SyncListeners
+	}
+	return []ListenerConfig{{Addr: c.Host + ":" + c.SyncPort}}
+}
+
+// ReplicationConfig describes the role of current node,
+// a replica is read-only and follows its upstream, which may
+// be a primary or another replica.
+type ReplicationConfig struct {
+	// Role is primary (default) or replica
+	Role string `json:"role"`
+	// ReplicaOf is the sync address of upstream when role is replica,
+	// or redis://[user:password@]host[:port] of a redis primary
+	ReplicaOf string `json:"replica_of"`
+	// Announce is the sync address told to upstream,
+	// defaults to sync_port at the host seen by upstream
+	Announce string `json:"announce"`
+	// BacklogSize is the bytes of the replication backlog kept for the
+	// redis replicas to resync partially, defaults to 1mb
+	BacklogSize int `json:"backlog_size"`
+	// Window is the max count of requests pushed to a peer and not
+	// acknowledged yet, defaults to 64
+	Window int `json:"window"`
+	// MaxPending is the count of requests queued for a peer, beyond which
+	// the writes are refused until the peer catches up, defaults to 10000
+	MaxPending int `json:"max_pending"`
+	// PeerTimeout is the seconds a peer failing the pushes is considered
+	// down, whose queue is dropped, defaults to 30
+	PeerTimeout int `json:"peer_timeout"`
+}
+
+// WindowSize returns the max count of requests in flight to a peer
+func (r *ReplicationConfig) WindowSize() int {
+	if r.Window <= 0 {
+		return 64
+	}
+	return r.Window
+}
+
+// MaxPendingSize returns the count of requests queued for a peer,
+// beyond which the writes are refused
+func (r *ReplicationConfig) MaxPendingSize() int {
+	if r.MaxPending <= 0 {
+		return 10000
+	}
+	return r.MaxPending
+}
+
+// PeerTimeoutDuration returns the duration a failing peer is considered down
+func (r *ReplicationConfig) PeerTimeoutDuration() time.Duration {
+	if r.PeerTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(r.PeerTimeout) * time.Second
+}
+
+// BacklogBytes returns the size of the replication backlog
+func (r *ReplicationConfig) BacklogBytes() int {
+	if r.BacklogSize <= 0 {
+		return 1 << 20
+	}
+	return r.BacklogSize
+}
+
+// ClusterConfig describes the hash slot sharding of the cluster,
+// every node of the cluster should have the same nodes and slots.
+type ClusterConfig struct {
+	Enabled bool `json:"enabled"`
+	// NodeId is the id of current node in Nodes,
+	// env evolvest_serv_id is used if empty
+	NodeId string `json:"node_id"`
+	// Replicas is the count of nodes each slot replicated to
+	// besides the owner of the slot
+	Replicas int          `json:"replicas"`
+	Nodes    []NodeConfig `json:"nodes"`
+}
+
+type NodeConfig struct {
+	Id       string `json:"id"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	SyncPort string `json:"sync_port"`
+	// Slots owned by the node, like "0-5460" or "5461"
+	Slots []string `json:"slots"`
 }
 
 func NewConfig(configFile string) *Config {
@@ -47,6 +320,14 @@ func (c *Config) Shutdown() {
 	log.Println("[Shutdown] shutdown config")
 }
 
+// redact masks the password of upstream url
+func redact(upstream string) string {
+	if u, err := url.Parse(upstream); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return upstream
+}
+
 func (c *Config) Print() {
 	fmt.Println("~~~~~~~~~~~~~~")
 	fmt.Println("config_file:", c.configFile)
@@ -55,5 +336,24 @@ func (c *Config) Print() {
 	fmt.Println("admin_port:", c.AdminPort)
 	fmt.Println("sync_port:", c.SyncPort)
 	fmt.Println("data_dir:", c.DataDir)
+	fmt.Println("listeners:", c.ServerListeners())
+	fmt.Println("sync_listeners:", c.SyncServerListeners())
+	fmt.Println("shutdown_timeout:", c.ShutdownDuration())
+	fmt.Println("notify_keyspace_events:", c.NotifyKeyspaceEvents)
+	fmt.Println("replication.role:", c.Replication.Role)
+	fmt.Println("replication.replica_of:", redact(c.Replication.ReplicaOf))
+	fmt.Println("tls.enabled:", c.TLS.Enabled())
+	fmt.Println("tls.sync:", c.TLS.Sync)
+	fmt.Println("auth.requirepass:", c.Auth.RequirePass != "")
+	fmt.Println("auth.users_file:", c.Auth.UsersFile)
+	fmt.Println("cluster.enabled:", c.Cluster.Enabled)
+	if c.Cluster.Enabled {
+		fmt.Println("cluster.node_id:", c.Cluster.NodeId)
+		fmt.Println("cluster.replicas:", c.Cluster.Replicas)
+		for _, node := range c.Cluster.Nodes {
+			fmt.Printf("cluster.node: %s %s:%s@%s %v\n",
+				node.Id, node.Host, node.Port, node.SyncPort, node.Slots)
+		}
+	}
 	fmt.Println("~~~~~~~~~~~~~~")
 }
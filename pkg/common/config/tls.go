@@ -0,0 +1,129 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+const (
+	ClientAuthNone             = "none"
+	ClientAuthRequest          = "request"
+	ClientAuthRequire          = "require"
+	ClientAuthVerifyIfGiven    = "verify_if_given"
+	ClientAuthRequireAndVerify = "require_and_verify"
+)
+
+// TLSConfig describes the certificates of current node. The server port
+// is served over TLS when cert_file is set, and the sync port requires
+// mutual TLS between peers when sync is true, so that only the processes
+// holding a certificate signed by the CA can push tx commands.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CAFile verifies the certificates of clients and peers
+	CAFile string `json:"ca_file"`
+	// ClientAuth is the client auth mode of server port: none (default),
+	// request, require, verify_if_given or require_and_verify
+	ClientAuth string `json:"client_auth"`
+	// Sync enables mutual TLS on the sync port
+	Sync bool `json:"sync"`
+	// ServerName verifies the certificates of peers instead of their hosts
+	ServerName string `json:"server_name"`
+}
+
+// Enabled tells whether the server port is served over TLS
+func (t *TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// ServerConfig returns tls config of the server port
+func (t *TLSConfig) ServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load key pair error")
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch t.ClientAuth {
+	case "", ClientAuthNone:
+		conf.ClientAuth = tls.NoClientCert
+	case ClientAuthRequest:
+		conf.ClientAuth = tls.RequestClientCert
+	case ClientAuthRequire:
+		conf.ClientAuth = tls.RequireAnyClientCert
+	case ClientAuthVerifyIfGiven:
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequireAndVerify:
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth '%s'", t.ClientAuth)
+	}
+	if conf.ClientAuth == tls.VerifyClientCertIfGiven ||
+		conf.ClientAuth == tls.RequireAndVerifyClientCert {
+		if conf.ClientCAs, err = t.certPool(); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+// SyncServerConfig returns tls config of the sync port,
+// which always requires and verifies the certificates of peers
+func (t *TLSConfig) SyncServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load key pair error")
+	}
+	pool, err := t.certPool()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// SyncClientConfig returns tls config connecting to the sync port of peers
+func (t *TLSConfig) SyncClientConfig() (*tls.Config, error) {
+	pool, err := t.certPool()
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		RootCAs:    pool,
+		ServerName: t.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load key pair error")
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func (t *TLSConfig) certPool() (*x509.CertPool, error) {
+	if t.CAFile == "" {
+		return nil, errors.New("ca_file is required")
+	}
+	data, err := ioutil.ReadFile(t.CAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read ca file error")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig_Sync(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "node", ca, caKey)
+	writeCert(t, dir, "rogue", nil, nil)
+
+	server := &TLSConfig{
+		CertFile: path.Join(dir, "node.crt"),
+		KeyFile:  path.Join(dir, "node.key"),
+		CAFile:   path.Join(dir, "ca.crt"),
+		Sync:     true,
+	}
+
+	tests := []struct {
+		name    string
+		client  *TLSConfig
+		wantErr bool
+	}{
+		{
+			name:    "peer",
+			client:  server,
+			wantErr: false,
+		},
+		{
+			name: "rogue",
+			client: &TLSConfig{
+				CertFile: path.Join(dir, "rogue.crt"),
+				KeyFile:  path.Join(dir, "rogue.key"),
+				CAFile:   path.Join(dir, "ca.crt"),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "no cert",
+			client:  &TLSConfig{CAFile: path.Join(dir, "ca.crt")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConf, err := server.SyncServerConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConf, err := tt.client.SyncClientConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConf.ServerName = "127.0.0.1"
+
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			errC := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					errC <- err
+					return
+				}
+				defer conn.Close()
+				errC <- conn.(*tls.Conn).Handshake()
+			}()
+			cli, err := tls.Dial("tcp", ln.Addr().String(), clientConf)
+			if err == nil {
+				cli.Close()
+			}
+
+			if err := <-errC; (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSConfig_ServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "node", nil, nil)
+
+	tests := []struct {
+		clientAuth string
+		want       tls.ClientAuthType
+		wantErr    bool
+	}{
+		{"", tls.NoClientCert, false},
+		{ClientAuthRequest, tls.RequestClientCert, false},
+		{ClientAuthRequire, tls.RequireAnyClientCert, false},
+		{ClientAuthRequireAndVerify, 0, true}, // missing ca_file
+		{"unknown", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.clientAuth, func(t *testing.T) {
+			tc := &TLSConfig{
+				CertFile:   path.Join(dir, "node.crt"),
+				KeyFile:    path.Join(dir, "node.key"),
+				ClientAuth: tt.clientAuth,
+			}
+			got, err := tc.ServerConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ServerConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.ClientAuth != tt.want {
+				t.Errorf("ServerConfig() ClientAuth = %v, want %v", got.ClientAuth, tt.want)
+			}
+		})
+	}
+}
+
+// writeCert writes name.crt and name.key to dir, the cert is self-signed
+// if parent is nil
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = ioutil.WriteFile(path.Join(dir, name+".crt"), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, name+".key"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -3,19 +3,48 @@ package common
 const (
 	FileSnapshot = "snapshot.dat"
 	FileTx       = "tx.dat"
+	// FileTxSegment is the archived tx file covered by snapshot, with sequence
+	FileTxSegment = "tx-%06d.dat"
+	FileUsers     = "users.acl"
+	// FileManifest describes the files of backup
+	FileManifest = "manifest.json"
+	// DirLSM keeps the files of lsm engine
+	DirLSM = "lsm"
+	// DirBackups keeps the backups written by the admin port
+	DirBackups = "backups"
 )
 
 const (
 	EnvAddrs = "evolvest_serv_addrs"
 	EnvSid   = "evolvest_serv_id"
+	// EnvAdminUser and EnvAdminPass are the ACL user calling the admin
+	// port by evolvestd commands, EnvAdminToken is an operator token
+	EnvAdminUser  = "evolvest_admin_user"
+	EnvAdminPass  = "evolvest_admin_pass"
+	EnvAdminToken = "evolvest_admin_token"
 )
 
 const (
 	SET = "set"
 	DEL = "del"
+	// EXPIRE sets the expiring unix millis of key in val, "0" persists the key
+	EXPIRE = "expire"
+	// FLUSH deletes the keys of database with versions not greater than
+	// the tx id, the key is ignored
+	FLUSH = "flush"
+	// SWAPDB swaps the database with the one indexed by val
+	SWAPDB = "swapdb"
 )
 
 const (
 	FlagReq  = "req"
 	FlagSync = "sync"
+	// FlagMigrated deletes the keys migrated to another node, which is
+	// pushed to the peers holding the slot except the target of migration
+	FlagMigrated = "migrated"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
 )
@@ -43,3 +43,19 @@ func GenerateId() int64 {
 	return millis*1e6 + int64(sid*1e3) + int64(increaseCount())
 
 }
+
+// GenerateIdAfter generates an id greater than id, so that the request
+// of it is ordered after the one of id. The ids of GenerateId are not in
+// order once the count wraps within a millisecond.
+func GenerateIdAfter(id int64) int64 {
+	for {
+		if next := GenerateId(); next > id {
+			return next
+		}
+	}
+}
+
+// ServId returns the server id from env
+func ServId() int {
+	return sid
+}
@@ -75,3 +75,14 @@ func TestGenerateId(t *testing.T) {
 		t.Log(GenerateId())
 	})
 }
+
+func TestGenerateIdAfter(t *testing.T) {
+	id := GenerateId()
+	for i := 0; i < 3*maxVal; i++ {
+		next := GenerateIdAfter(id)
+		if next <= id {
+			t.Fatalf("GenerateIdAfter(%d) = %d, want greater", id, next)
+		}
+		id = next
+	}
+}
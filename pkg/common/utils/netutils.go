@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Listen listens on the address, the stale unix socket file left by
+// previous process is removed, and the permission of socket is applied.
+func Listen(lc config.ListenerConfig) (net.Listener, error) {
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return net.Listen(network, lc.Addr)
+	case "unix":
+	default:
+		return nil, fmt.Errorf("unsupported network '%s'", network)
+	}
+
+	if fi, err := os.Stat(lc.Addr); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", lc.Addr)
+		}
+		// refuse to take over the socket still served by others
+		if c, err := net.Dial("unix", lc.Addr); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", lc.Addr)
+		}
+		if err = os.Remove(lc.Addr); err != nil {
+			return nil, errors.Wrap(err, "remove stale socket error")
+		}
+	}
+	ln, err := net.Listen(network, lc.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if lc.Perm != "" {
+		perm, err := strconv.ParseUint(lc.Perm, 8, 32)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("invalid perm '%s'", lc.Perm)
+		}
+		if err = os.Chmod(lc.Addr, os.FileMode(perm)); err != nil {
+			ln.Close()
+			return nil, errors.Wrap(err, "chmod socket error")
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"github.com/edditen/evolvest/pkg/common/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	sock := path.Join(dir, "evolvest.sock")
+
+	ln, err := Listen(config.ListenerConfig{Network: "unix", Addr: sock, Perm: "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("perm = %o, want 600", perm)
+	}
+
+	// the socket in use can't be taken over
+	if _, err = Listen(config.ListenerConfig{Network: "unix", Addr: sock}); err == nil {
+		t.Error("listen on socket in use, want error")
+	}
+
+	// leave a stale socket file behind
+	ln.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = Listen(config.ListenerConfig{Network: "unix", Addr: sock})
+	if err != nil {
+		t.Fatalf("listen on stale socket error = %v", err)
+	}
+	ln.Close()
+
+	tests := []struct {
+		name string
+		lc   config.ListenerConfig
+	}{
+		{"regular file", config.ListenerConfig{Network: "unix", Addr: path.Join(dir, "conf.yaml")}},
+		{"invalid perm", config.ListenerConfig{Network: "unix", Addr: path.Join(dir, "a.sock"), Perm: "rw"}},
+		{"unknown network", config.ListenerConfig{Network: "udp", Addr: "127.0.0.1:0"}},
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "conf.yaml"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ln, err := Listen(tt.lc); err == nil {
+				ln.Close()
+				t.Errorf("Listen() want error")
+			}
+		})
+	}
+}
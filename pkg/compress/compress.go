@@ -0,0 +1,141 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec tags how a value is compressed, the tag is kept with the value
+// so that the nodes with different settings read the values of others
+type Codec uint8
+
+const (
+	None Codec = iota
+	Gzip
+	Snappy
+	Zstd
+)
+
+var names = []string{"none", "gzip", "snappy", "zstd"}
+
+// DefaultThreshold is the bytes of the smallest value compressed
+const DefaultThreshold = 1024
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// Parse returns the codec of name, None if empty
+func Parse(name string) (Codec, error) {
+	if name == "" {
+		return None, nil
+	}
+	for i, n := range names {
+		if n == name {
+			return Codec(i), nil
+		}
+	}
+	return None, errors.Errorf("unknown codec %s", name)
+}
+
+func (c Codec) String() string {
+	if int(c) < len(names) {
+		return names[c]
+	}
+	return "unknown"
+}
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		// EncodeAll and DecodeAll are safe for concurrent use
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+// Encode compresses src by the codec
+func (c Codec) Encode(src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(src); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return s2.EncodeSnappy(nil, src), nil
+	case Zstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(src, nil), nil
+	}
+	return nil, errors.Errorf("unknown codec %d", c)
+}
+
+// Decode decompresses src compressed by the codec
+func (c Codec) Decode(src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip decode error")
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		return b, errors.Wrap(err, "gzip decode error")
+	case Snappy:
+		b, err := s2.Decode(nil, src)
+		return b, errors.Wrap(err, "snappy decode error")
+	case Zstd:
+		initZstd()
+		b, err := zstdDecoder.DecodeAll(src, nil)
+		return b, errors.Wrap(err, "zstd decode error")
+	}
+	return nil, errors.Errorf("unknown codec %d", c)
+}
+
+// Compressor compresses the values not smaller than the threshold
+type Compressor struct {
+	codec     Codec
+	threshold int
+}
+
+// NewCompressor creates the compressor of codec name, nil if none,
+// threshold defaults to DefaultThreshold if not positive
+func NewCompressor(name string, threshold int) (*Compressor, error) {
+	codec, err := Parse(name)
+	if err != nil || codec == None {
+		return nil, err
+	}
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	return &Compressor{codec: codec, threshold: threshold}, nil
+}
+
+// Compress returns the value compressed and its codec, or the value
+// itself if it's small or not compressible
+func (c *Compressor) Compress(val []byte) ([]byte, Codec) {
+	if c == nil || len(val) < c.threshold {
+		return val, None
+	}
+	b, err := c.codec.Encode(val)
+	if err != nil || len(b) >= len(val) {
+		return val, None
+	}
+	return b, c.codec
+}
@@ -0,0 +1,42 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"name":"evolvest","tags":["a","b"]}`), 100)
+	tests := []struct {
+		codec     string
+		val       []byte
+		wantCodec Codec
+	}{
+		{codec: "", val: large, wantCodec: None},
+		{codec: "gzip", val: large, wantCodec: Gzip},
+		{codec: "snappy", val: large, wantCodec: Snappy},
+		{codec: "zstd", val: large, wantCodec: Zstd},
+		// below the threshold
+		{codec: "zstd", val: large[:100], wantCodec: None},
+	}
+	for _, tt := range tests {
+		c, err := NewCompressor(tt.codec, 0)
+		if err != nil {
+			t.Fatalf("NewCompressor(%s) error = %v", tt.codec, err)
+		}
+		b, codec := c.Compress(tt.val)
+		if codec != tt.wantCodec {
+			t.Errorf("Compress() of %s codec = %v, want %v", tt.codec, codec, tt.wantCodec)
+		}
+		if codec != None && len(b) >= len(tt.val) {
+			t.Errorf("Compress() of %s = %d bytes, not smaller than %d", tt.codec, len(b), len(tt.val))
+		}
+		got, err := codec.Decode(b)
+		if err != nil || !bytes.Equal(got, tt.val) {
+			t.Errorf("Decode() of %s = %d bytes, %v, want the original", tt.codec, len(got), err)
+		}
+	}
+	if _, err := NewCompressor("lz4", 0); err == nil {
+		t.Error("NewCompressor(lz4) error = nil")
+	}
+}
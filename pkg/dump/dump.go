@@ -0,0 +1,64 @@
+package dump
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	FormatRDB   = "rdb"
+	FormatJSONL = "jsonl"
+)
+
+// Entry is a key with its value
+type Entry struct {
+	DB  int
+	Key string
+	Val []byte
+	// ExpireAt is the unix time in milliseconds, 0 if never expires
+	ExpireAt int64
+}
+
+// Encoder writes the entries one by one, Close must be called at last
+// to complete the output
+type Encoder interface {
+	Encode(e *Entry) error
+	Close() error
+}
+
+// Decoder reads the entries one by one, returns io.EOF at the end
+type Decoder interface {
+	Decode() (*Entry, error)
+	// Skipped returns count of the keys of types not supported
+	Skipped() int
+}
+
+func NewEncoder(format string, w io.Writer) (Encoder, error) {
+	switch format {
+	case FormatRDB:
+		return NewRDBEncoder(w)
+	case FormatJSONL:
+		return NewJSONLEncoder(w), nil
+	}
+	return nil, fmt.Errorf("format %s not support", format)
+}
+
+func NewDecoder(format string, r io.Reader) (Decoder, error) {
+	switch format {
+	case FormatRDB:
+		return NewRDBDecoder(r)
+	case FormatJSONL:
+		return NewJSONLDecoder(r), nil
+	}
+	return nil, fmt.Errorf("format %s not support", format)
+}
+
+// FormatOf guesses the format by extension of filename, jsonl by default
+func FormatOf(filename string) string {
+	if strings.ToLower(path.Ext(filename)) == ".rdb" {
+		return FormatRDB
+	}
+	return FormatJSONL
+}
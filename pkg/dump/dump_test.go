@@ -0,0 +1,126 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCRC64(t *testing.T) {
+	// the check value of redis crc64
+	if got := crc64Update(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64Update() = %x, want e9c6d914c4b8d9ca", got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	entries := []*Entry{
+		{Key: "a", Val: []byte("1")},
+		{Key: "empty", Val: []byte{}},
+		{Key: "binary", Val: []byte{0xff, 0x00, 0xfe}, ExpireAt: 1623456789000},
+		{Key: "long", Val: bytes.Repeat([]byte("x"), 20000)},
+		{DB: 1, Key: "b", Val: []byte("2")},
+	}
+	for _, format := range []string{FormatRDB, FormatJSONL} {
+		t.Run(format, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			enc, err := NewEncoder(format, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if err = enc.Encode(e); err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+			}
+			if err = enc.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			dec, err := NewDecoder(format, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range entries {
+				got, err := dec.Decode()
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Decode() = %+v, want %+v", got, want)
+				}
+			}
+			if _, err = dec.Decode(); err != io.EOF {
+				t.Errorf("Decode() at end error = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// rdbOf builds a rdb file by redis encodings which aren't written
+// by RDBEncoder
+func rdbOf(body ...[]byte) []byte {
+	b := []byte("REDIS0011")
+	b = append(b, rdbOpAux, 9)
+	b = append(b, "redis-ver"...)
+	b = append(b, 5)
+	b = append(b, "7.0.0"...)
+	b = append(b, rdbOpSelectDB, 0, rdbOpResizeDB, 4, 1)
+	for _, p := range body {
+		b = append(b, p...)
+	}
+	b = append(b, rdbOpEOF)
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, crc64Update(0, b))
+	return append(b, sum...)
+}
+
+func TestRDBDecoder(t *testing.T) {
+	data := rdbOf(
+		// int8 and int16 encoded values
+		[]byte{rdbTypeString, 1, 'i', 0xc0, 0x85},
+		[]byte{rdbOpIdle, 10, rdbTypeString, 1, 'j', 0xc1, 0x39, 0x30},
+		// a list is skipped
+		[]byte{rdbTypeList, 1, 'l', 2, 1, 'x', 1, 'y'},
+		// lzf compressed "aaaaaaaaaa", expiring in seconds
+		[]byte{rdbOpExpireTime, 0x15, 0xfc, 0xc3, 0x60,
+			rdbTypeString, 1, 'z', 0xc3, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00},
+	)
+	dec, err := NewRDBDecoder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Entry{
+		{Key: "i", Val: []byte("-123")},
+		{Key: "j", Val: []byte("12345")},
+		{Key: "z", Val: []byte("aaaaaaaaaa"), ExpireAt: 1623456789000},
+	}
+	for _, w := range want {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("Decode() = %+v, want %+v", got, w)
+		}
+	}
+	if _, err = dec.Decode(); err != io.EOF {
+		t.Errorf("Decode() at end error = %v, want EOF", err)
+	}
+	if dec.Skipped() != 1 {
+		t.Errorf("Skipped() = %d, want 1", dec.Skipped())
+	}
+
+	// a flipped byte of redis-ver fails the checksum
+	data[21] ^= 1
+	dec, _ = NewRDBDecoder(bytes.NewReader(data))
+	for err = nil; err == nil; {
+		_, err = dec.Decode()
+	}
+	if !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Decode() of corrupt rdb error = %v, want checksum mismatch", err)
+	}
+}
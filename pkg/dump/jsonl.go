@@ -0,0 +1,78 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// jsonEntry is a line of JSON Lines, the value is kept as string if it's
+// valid UTF-8, otherwise in base64
+type jsonEntry struct {
+	DB       int     `json:"db,omitempty"`
+	Key      string  `json:"key"`
+	Value    *string `json:"value,omitempty"`
+	Base64   []byte  `json:"value_base64,omitempty"`
+	ExpireAt int64   `json:"expire_at,omitempty"`
+}
+
+type JSONLEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewJSONLEncoder(w io.Writer) *JSONLEncoder {
+	bw := bufio.NewWriter(w)
+	return &JSONLEncoder{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (e *JSONLEncoder) Encode(entry *Entry) error {
+	je := jsonEntry{DB: entry.DB, Key: entry.Key, ExpireAt: entry.ExpireAt}
+	if utf8.Valid(entry.Val) {
+		val := string(entry.Val)
+		je.Value = &val
+	} else {
+		je.Base64 = entry.Val
+	}
+	return e.enc.Encode(&je)
+}
+
+func (e *JSONLEncoder) Close() error {
+	return e.w.Flush()
+}
+
+type JSONLDecoder struct {
+	dec  *json.Decoder
+	line int
+}
+
+func NewJSONLDecoder(r io.Reader) *JSONLDecoder {
+	return &JSONLDecoder{dec: json.NewDecoder(bufio.NewReader(r))}
+}
+
+func (d *JSONLDecoder) Decode() (*Entry, error) {
+	je := jsonEntry{}
+	if err := d.dec.Decode(&je); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("entry %d is invalid, %v", d.line+1, err)
+	}
+	d.line++
+	entry := &Entry{DB: je.DB, Key: je.Key, ExpireAt: je.ExpireAt}
+	switch {
+	case je.Value != nil:
+		entry.Val = []byte(*je.Value)
+	case je.Base64 != nil:
+		entry.Val = je.Base64
+	default:
+		return nil, fmt.Errorf("entry %d of key %s has no value", d.line, je.Key)
+	}
+	return entry, nil
+}
+
+func (d *JSONLDecoder) Skipped() int {
+	return 0
+}
@@ -0,0 +1,513 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc64"
+	"io"
+	"strconv"
+)
+
+// opcodes and value types of redis rdb file
+const (
+	rdbOpSlotInfo     = 244
+	rdbOpFunction2    = 245
+	rdbOpModuleAux    = 247
+	rdbOpIdle         = 248
+	rdbOpFreq         = 249
+	rdbOpAux          = 250
+	rdbOpResizeDB     = 251
+	rdbOpExpireTimeMs = 252
+	rdbOpExpireTime   = 253
+	rdbOpSelectDB     = 254
+	rdbOpEOF          = 255
+
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5
+	rdbTypeHashZipmap     = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZSetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeSetListpack    = 20
+
+	// the first 2 bits of length
+	rdbLen6       = 0
+	rdbLen14      = 1
+	rdbLenEncoded = 3
+	rdbLen32      = 0x80
+	rdbLen64      = 0x81
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// the zset scores of 253 and above are special values without bytes
+	rdbDoubleSpecial = 253
+
+	rdbMagic      = "REDIS"
+	rdbVersion    = 9
+	rdbMaxVersion = 12
+	// rdbMaxString is the max length of string, same as the bulk of redis
+	rdbMaxString = 512 << 20
+)
+
+// crcTable is of the Jones polynomial used by redis, reversed
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Update updates the redis crc, which has no inversion unlike the
+// crc64 package
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// RDBEncoder writes the entries as strings in a rdb file of version 9,
+// which is loadable by redis 5.0 and later
+type RDBEncoder struct {
+	w   *bufio.Writer
+	crc uint64
+	db  int
+	buf [9]byte
+}
+
+func NewRDBEncoder(w io.Writer) (*RDBEncoder, error) {
+	e := &RDBEncoder{w: bufio.NewWriter(w), db: -1}
+	if err := e.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, rdbVersion))); err != nil {
+		return nil, err
+	}
+	return e, e.writeAux("redis-ver", "5.0.0")
+}
+
+func (e *RDBEncoder) write(p []byte) error {
+	e.crc = crc64Update(e.crc, p)
+	_, err := e.w.Write(p)
+	return err
+}
+
+func (e *RDBEncoder) writeAux(key, val string) error {
+	if err := e.write([]byte{rdbOpAux}); err != nil {
+		return err
+	}
+	if err := e.writeString([]byte(key)); err != nil {
+		return err
+	}
+	return e.writeString([]byte(val))
+}
+
+func (e *RDBEncoder) writeLength(n uint64) error {
+	switch {
+	case n < 1<<6:
+		return e.write([]byte{byte(n)})
+	case n < 1<<14:
+		return e.write([]byte{rdbLen14<<6 | byte(n>>8), byte(n)})
+	case n <= 0xffffffff:
+		e.buf[0] = rdbLen32
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+		return e.write(e.buf[:5])
+	default:
+		e.buf[0] = rdbLen64
+		binary.BigEndian.PutUint64(e.buf[1:], n)
+		return e.write(e.buf[:9])
+	}
+}
+
+func (e *RDBEncoder) writeString(s []byte) error {
+	if err := e.writeLength(uint64(len(s))); err != nil {
+		return err
+	}
+	return e.write(s)
+}
+
+func (e *RDBEncoder) Encode(entry *Entry) error {
+	if entry.DB != e.db {
+		if err := e.write([]byte{rdbOpSelectDB}); err != nil {
+			return err
+		}
+		if err := e.writeLength(uint64(entry.DB)); err != nil {
+			return err
+		}
+		e.db = entry.DB
+	}
+	if entry.ExpireAt > 0 {
+		e.buf[0] = rdbOpExpireTimeMs
+		binary.LittleEndian.PutUint64(e.buf[1:], uint64(entry.ExpireAt))
+		if err := e.write(e.buf[:9]); err != nil {
+			return err
+		}
+	}
+	if err := e.write([]byte{rdbTypeString}); err != nil {
+		return err
+	}
+	if err := e.writeString([]byte(entry.Key)); err != nil {
+		return err
+	}
+	return e.writeString(entry.Val)
+}
+
+// Close writes the end of file with checksum
+func (e *RDBEncoder) Close() error {
+	if err := e.write([]byte{rdbOpEOF}); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(e.buf[:8], e.crc)
+	if _, err := e.w.Write(e.buf[:8]); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// RDBDecoder reads the strings of rdb file, the keys of other types
+// are skipped, and the checksum is verified at the end
+type RDBDecoder struct {
+	r        *bufio.Reader
+	crc      uint64
+	version  int
+	db       int
+	expireAt int64
+	skipped  int
+	done     bool
+}
+
+func NewRDBDecoder(r io.Reader) (*RDBDecoder, error) {
+	d := &RDBDecoder{r: bufio.NewReader(r)}
+	header, err := d.read(9)
+	if err != nil {
+		return nil, errors.Wrap(err, "read rdb header error")
+	}
+	if string(header[:5]) != rdbMagic {
+		return nil, errors.New("not a rdb file")
+	}
+	if d.version, err = strconv.Atoi(string(header[5:])); err != nil {
+		return nil, fmt.Errorf("invalid rdb version %q", header[5:])
+	}
+	if d.version < 1 || d.version > rdbMaxVersion {
+		return nil, fmt.Errorf("rdb version %d is not supported", d.version)
+	}
+	return d, nil
+}
+
+func (d *RDBDecoder) read(n int) ([]byte, error) {
+	p := make([]byte, n)
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	d.crc = crc64Update(d.crc, p)
+	return p, nil
+}
+
+func (d *RDBDecoder) readByte() (byte, error) {
+	p, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+// readLength returns the length, or the encoding of a special string
+func (d *RDBDecoder) readLength() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdbLen6:
+		return uint64(b & 0x3f), false, nil
+	case rdbLen14:
+		next, err := d.readByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case rdbLenEncoded:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case rdbLen32:
+		p, err := d.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case rdbLen64:
+		p, err := d.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, fmt.Errorf("invalid rdb length 0x%x", b)
+}
+
+func (d *RDBDecoder) readLen() (int, error) {
+	n, encoded, err := d.readLength()
+	if err == nil && encoded {
+		err = errors.New("unexpected encoded length")
+	} else if err == nil && n > 1<<31 {
+		err = fmt.Errorf("rdb length %d is too large", n)
+	}
+	return int(n), err
+}
+
+func (d *RDBDecoder) readString() ([]byte, error) {
+	n, encoded, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if n > rdbMaxString {
+			return nil, fmt.Errorf("rdb string of %d bytes is too long", n)
+		}
+		return d.read(int(n))
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := d.readByte()
+		return []byte(strconv.Itoa(int(int8(b)))), err
+	case rdbEncInt16:
+		p, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p))))), nil
+	case rdbEncInt32:
+		p, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p))))), nil
+	case rdbEncLZF:
+		clen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if clen > rdbMaxString || ulen > rdbMaxString {
+			return nil, fmt.Errorf("rdb string of %d bytes is too long", ulen)
+		}
+		p, err := d.read(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(p, ulen)
+	}
+	return nil, fmt.Errorf("invalid rdb string encoding %d", n)
+}
+
+func (d *RDBDecoder) skipStrings(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := d.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipValue skips the value of types other than string
+func (d *RDBDecoder) skipValue(typ byte, key []byte) error {
+	switch typ {
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		return d.skipStrings(1)
+	}
+	n, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		return d.skipStrings(n)
+	case rdbTypeHash:
+		return d.skipStrings(2 * n)
+	case rdbTypeListQuicklist2:
+		for i := 0; i < n; i++ {
+			if _, err = d.readLen(); err != nil {
+				return err
+			}
+			if err = d.skipStrings(1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeZSet2:
+		for i := 0; i < n; i++ {
+			if err = d.skipStrings(1); err != nil {
+				return err
+			}
+			if _, err = d.read(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeZSet:
+		for i := 0; i < n; i++ {
+			if err = d.skipStrings(1); err != nil {
+				return err
+			}
+			size, err := d.readByte()
+			if err != nil {
+				return err
+			}
+			if size < rdbDoubleSpecial {
+				if _, err = d.read(int(size)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("rdb type %d of key %s is not supported", typ, key)
+}
+
+func (d *RDBDecoder) Decode() (*Entry, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case rdbOpAux:
+			err = d.skipStrings(2)
+		case rdbOpFunction2:
+			err = d.skipStrings(1)
+		case rdbOpResizeDB:
+			if _, err = d.readLen(); err == nil {
+				_, err = d.readLen()
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = d.readLen()
+			}
+		case rdbOpSelectDB:
+			d.db, err = d.readLen()
+		case rdbOpExpireTime:
+			var p []byte
+			if p, err = d.read(4); err == nil {
+				d.expireAt = int64(binary.LittleEndian.Uint32(p)) * 1000
+			}
+		case rdbOpExpireTimeMs:
+			var p []byte
+			if p, err = d.read(8); err == nil {
+				d.expireAt = int64(binary.LittleEndian.Uint64(p))
+			}
+		case rdbOpIdle:
+			_, err = d.readLen()
+		case rdbOpFreq:
+			_, err = d.readByte()
+		case rdbOpModuleAux:
+			return nil, errors.New("rdb module aux is not supported")
+		case rdbOpEOF:
+			d.done = true
+			return nil, d.verifyChecksum()
+		default:
+			entry, err := d.decodeValue(op)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				return entry, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeValue reads the key and value, returns nil if the type is skipped
+func (d *RDBDecoder) decodeValue(typ byte) (*Entry, error) {
+	expireAt := d.expireAt
+	d.expireAt = 0
+	key, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	if typ != rdbTypeString {
+		d.skipped++
+		return nil, d.skipValue(typ, key)
+	}
+	val, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{DB: d.db, Key: string(key), Val: val, ExpireAt: expireAt}, nil
+}
+
+// verifyChecksum reads the checksum after EOF, which is 0 if disabled
+func (d *RDBDecoder) verifyChecksum() error {
+	if d.version < 5 {
+		return io.EOF
+	}
+	expected := d.crc
+	p := make([]byte, 8)
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		return errors.Wrap(err, "read rdb checksum error")
+	}
+	if sum := binary.LittleEndian.Uint64(p); sum != 0 && sum != expected {
+		return fmt.Errorf("rdb checksum mismatch, got %x, want %x", expected, sum)
+	}
+	return io.EOF
+}
+
+func (d *RDBDecoder) Skipped() int {
+	return d.skipped
+}
+
+// lzfDecompress decompresses the lzf data into n bytes
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// literal run
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, errors.New("lzf literal out of input")
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errors.New("lzf length out of input")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("lzf offset out of input")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("lzf reference out of output")
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, fmt.Errorf("lzf decompressed %d bytes, want %d", len(out), n)
+	}
+	return out, nil
+}
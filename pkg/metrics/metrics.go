@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "evolvest"
+
+var (
+	CommandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commands_total",
+		Help:      "Count of commands processed, by command.",
+	}, []string{"command"})
+
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Latency of commands, by command.",
+		Buckets:   []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+	}, []string{"command"})
+
+	WalBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wal",
+		Name:      "bytes_total",
+		Help:      "Bytes appended to the tx file.",
+	})
+
+	WalFsyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "wal",
+		Name:      "fsync_duration_seconds",
+		Help:      "Latency of fsync of the tx file.",
+		Buckets:   prometheus.ExponentialBuckets(.0001, 2, 14),
+	})
+
+	ApplyBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "apply_batch_size",
+		Help:      "Count of requests applied and logged at once.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	})
+
+	EvictedKeys = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "evicted_keys_total",
+		Help:      "Count of keys evicted by the memory limit.",
+	})
+
+	ThrottledCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttled_commands_total",
+		Help:      "Count of commands refused by rate limits and quotas, by limit.",
+	}, []string{"limit"})
+
+	ReplicationQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "replication",
+		Name:      "queue_depth",
+		Help:      "Commands waiting to be pushed to peer.",
+	}, []string{"peer"})
+
+	ReplicationRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "replication",
+		Name:      "retries_total",
+		Help:      "Count of failed pushes to peer which are retried.",
+	}, []string{"peer"})
+
+	ReplicationDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "replication",
+		Name:      "dropped_total",
+		Help:      "Count of commands abandoned after reaching max retry times.",
+	}, []string{"peer"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		CommandsTotal,
+		CommandDuration,
+		WalBytes,
+		WalFsyncDuration,
+		ApplyBatchSize,
+		EvictedKeys,
+		ThrottledCommands,
+		ReplicationQueueDepth,
+		ReplicationRetries,
+		ReplicationDropped,
+	)
+}
+
+// RegisterGaugeFunc registers a gauge whose value is taken from fn when
+// collecting, registering the same name twice is ignored.
+func RegisterGaugeFunc(name, help string, fn func() float64) {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn)
+	if err := prometheus.Register(gauge); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			panic(err)
+		}
+	}
+}
+
+// gaugeVecFunc is a gauge of one label, whose values are taken from fn
+// when collecting
+type gaugeVecFunc struct {
+	desc *prometheus.Desc
+	fn   func() map[string]float64
+}
+
+func (g *gaugeVecFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeVecFunc) Collect(ch chan<- prometheus.Metric) {
+	for value, v := range g.fn() {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v, value)
+	}
+}
+
+// RegisterGaugeVecFunc registers a gauge of label, whose values by the
+// label value are taken from fn when collecting, registering the same
+// name twice is ignored.
+func RegisterGaugeVecFunc(subsystem, name, help, label string, fn func() map[string]float64) {
+	g := &gaugeVecFunc{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, []string{label}, nil),
+		fn:   fn,
+	}
+	if err := prometheus.Register(g); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+func TestRegisterGaugeVecFunc(t *testing.T) {
+	lags := map[string]float64{"10.0.0.1:9620": 1.5, "10.0.0.2:9620": 0}
+	fn := func() map[string]float64 { return lags }
+	RegisterGaugeVecFunc("test", "lag_seconds", "Lag of peer.", "peer", fn)
+	// ignored
+	RegisterGaugeVecFunc("test", "lag_seconds", "Lag of peer.", "peer", fn)
+
+	want := `
+# HELP evolvest_test_lag_seconds Lag of peer.
+# TYPE evolvest_test_lag_seconds gauge
+evolvest_test_lag_seconds{peer="10.0.0.1:9620"} 1.5
+evolvest_test_lag_seconds{peer="10.0.0.2:9620"} 0
+`
+	err := testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(want), "evolvest_test_lag_seconds")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// taken when collecting
+	lags = map[string]float64{"10.0.0.1:9620": 3}
+	want = `
+# HELP evolvest_test_lag_seconds Lag of peer.
+# TYPE evolvest_test_lag_seconds gauge
+evolvest_test_lag_seconds{peer="10.0.0.1:9620"} 3
+`
+	err = testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(want), "evolvest_test_lag_seconds")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"strconv"
+)
+
+// AntiEntropy pulls the data of peers, and submits the items which are
+// missing or older in current node with their expiry. Deleted keys are not repaired since
+// there is no tombstone.
+func (s *Syncer) AntiEntropy() (repaired int, err error) {
+	for _, peer := range s.sender.Peers() {
+		log := etlog.Log.WithField("peer", peer.addr)
+		count := 0
+		for db := range s.dbs {
+			data, err := peer.Pull(db)
+			if err == ErrDbUnsupported {
+				break
+			} else if err != nil {
+				log.WithError(err).WithField("db", db).Warn("pull from peer failed")
+				break
+			}
+			values := make(map[string]DataItem)
+			if err = json.Unmarshal(data, &values); err != nil {
+				log.WithError(err).Warn("unmarshal peer data failed")
+				break
+			}
+
+			now := utils.CurrentMillis()
+			for key, val := range values {
+				if !s.cluster.Holds(s.cluster.Self(), key) {
+					continue
+				}
+				if val.Exp > 0 && val.Exp <= now {
+					continue
+				}
+				if local, err := s.dbs[db].Get(key); err == nil && local.Ver >= val.Ver {
+					continue
+				}
+				if err = submitItem(s.Submit, db, key, val); err != nil {
+					return repaired, err
+				}
+				count++
+			}
+		}
+		log.WithField("repaired", count).Info("anti-entropy with peer finished")
+		repaired += count
+	}
+	return repaired, nil
+}
+
+// submitItem submits the item synced from another node by a set, and an
+// expire of the same version if it expires, which is applied after the
+// set and keeps the version of the item
+func submitItem(submit func(req *common.TxRequest) error, db int, key string, val DataItem) error {
+	err := submit(&common.TxRequest{
+		TxId:   val.Ver,
+		Flag:   common.FlagSync,
+		Action: common.SET,
+		Key:    key,
+		Val:    val.Val,
+		Db:     db,
+		Codec:  val.Codec,
+	})
+	if err != nil || val.Exp == 0 {
+		return err
+	}
+	return submit(&common.TxRequest{
+		TxId:   val.Ver,
+		Flag:   common.FlagSync,
+		Action: common.EXPIRE,
+		Key:    key,
+		Val:    []byte(strconv.FormatInt(val.Exp, 10)),
+		Db:     db,
+	})
+}
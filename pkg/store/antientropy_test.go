@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"google.golang.org/grpc"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestSyncer_AntiEntropy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := utils.CurrentMillis() + 60000
+	peer := &upstreamPeer{values: map[string]DataItem{
+		"a":       {Val: []byte("1"), Ver: 90},
+		"b":       {Val: []byte("1"), Ver: 91, Exp: exp},
+		"expired": {Val: []byte("1"), Ver: 92, Exp: 1},
+	}}
+	srv := grpc.NewServer()
+	evolvest.RegisterEvolvestServiceServer(srv, peer)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	os.Setenv(common.EnvAddrs, ln.Addr().String())
+	s := startSyncer(t, &config.Config{DataDir: t.TempDir(), ShutdownTimeout: 1})
+	os.Unsetenv(common.EnvAddrs)
+	defer s.Shutdown()
+
+	repaired, err := s.AntiEntropy()
+	if err != nil || repaired != 2 {
+		t.Fatalf("AntiEntropy() = %d, %v, want 2 repaired", repaired, err)
+	}
+	if err = s.WaitApplied(context.Background(), s.Queued()); err != nil {
+		t.Fatal(err)
+	}
+	// repaired with the expiry and the version of peer
+	want := map[string]DataItem{
+		"a": {Val: []byte("1"), Ver: 90},
+		"b": {Val: []byte("1"), Ver: 91, Exp: exp},
+	}
+	for key, w := range want {
+		got, err := s.Store.Get(key)
+		if err != nil || string(got.Val) != string(w.Val) || got.Ver != w.Ver || got.Exp != w.Exp {
+			t.Errorf("%s = %+v, %v, want %+v", key, got, err, w)
+		}
+	}
+	if _, err = s.Store.Get("expired"); err == nil {
+		t.Errorf("expired repaired")
+	}
+}
@@ -1,26 +1,42 @@
 package store
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/edditen/etlog"
 	"github.com/edditen/evolvest/pkg/common"
 	"github.com/edditen/evolvest/pkg/common/config"
 	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/compress"
+	"github.com/edditen/evolvest/pkg/metrics"
 	"github.com/edditen/evolvest/pkg/runnable"
 	"github.com/pkg/errors"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Appender interface {
 	runnable.Runnable
-	Append(req *common.TxRequest) error
+	// Append writes the requests to the tx file at once
+	Append(reqs ...*common.TxRequest) error
+	// Rotate archives the current tx file as a segment,
+	// and returns the sequence of the segment
+	Rotate() (seq int, err error)
 }
 
 type TxAppender struct {
 	cfg      *config.Config
+	mu       sync.Mutex
 	writer   *os.File
+	dirty    bool
+	seq      int
 	shutdown chan interface{}
 }
 
@@ -37,7 +53,18 @@ func (ta *TxAppender) Init() error {
 	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
 		return errors.Wrap(err, "init syncUp error")
 	}
-	filename := path.Join(dataDir, common.FileTx)
+	segments, err := TxSegments(dataDir)
+	if err != nil {
+		return errors.Wrap(err, "list tx segments error")
+	}
+	if len(segments) > 0 {
+		ta.seq = segments[len(segments)-1]
+	}
+	return ta.open()
+}
+
+func (ta *TxAppender) open() error {
+	filename := path.Join(ta.cfg.DataDir, common.FileTx)
 	f, err := os.OpenFile(filename,
 		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -47,21 +74,217 @@ func (ta *TxAppender) Init() error {
 	return nil
 }
 
+// Run fsyncs the tx file every second if there are new appends, which
+// are fsynced already unless appendfsync is everysec
 func (ta *TxAppender) Run(errC chan<- error) {
 	log.Println("[Run] run txAppender")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ta.Sync(); err != nil {
+				etlog.Log.WithError(err).Warn("fsync tx file failed")
+			}
+		case <-ta.shutdown:
+			return
+		}
+	}
+}
+
+// Sync commits the appended requests to disk
+func (ta *TxAppender) Sync() error {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.sync()
+}
+
+func (ta *TxAppender) sync() error {
+	if !ta.dirty || ta.writer == nil {
+		return nil
+	}
+	start := time.Now()
+	if err := ta.writer.Sync(); err != nil {
+		return err
+	}
+	metrics.WalFsyncDuration.Observe(time.Since(start).Seconds())
+	ta.dirty = false
+	return nil
 }
 
+// Shutdown fsyncs and closes the tx file
 func (ta *TxAppender) Shutdown() {
+	close(ta.shutdown)
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	if ta.writer == nil {
+		return
+	}
+	if err := ta.writer.Sync(); err != nil {
+		etlog.Log.WithError(err).Warn("fsync tx file failed")
+	}
+	ta.dirty = false
+	if err := ta.writer.Close(); err != nil {
+		etlog.Log.WithError(err).Warn("close tx file failed")
+	}
+	ta.writer = nil
+	log.Println("[Shutdown] shutdown txAppender")
 }
 
-func (ta *TxAppender) Append(req *common.TxRequest) error {
-	text := fmt.Sprintf("%d %s %s %s %s\n",
-		req.TxId, req.Flag, req.Action, req.Key, utils.Base64Encode(req.Val))
+// errTxFileClosed is returned by the appends after shutdown
+var errTxFileClosed = errors.New("tx file is closed")
+
+// Append writes the requests with a single write, and fsyncs the tx file
+// right away unless appendfsync is everysec, so that a batch costs one fsync
+func (ta *TxAppender) Append(reqs ...*common.TxRequest) error {
+	var b strings.Builder
+	for _, req := range reqs {
+		fmt.Fprintf(&b, "%d %s %s %s %s\n",
+			req.TxId, req.Flag, txAction(req), req.Key, txValue(req))
+	}
+	text := b.String()
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	if ta.writer == nil {
+		return errTxFileClosed
+	}
 	if _, err := ta.writer.WriteString(text); err != nil {
 		etlog.Log.WithError(err).
-			WithField("text", text).
+			WithField("count", len(reqs)).
 			Warn("append text to tx file failed")
 		return errors.Wrap(err, "append tx to file error")
 	}
+	ta.dirty = true
+	metrics.WalBytes.Add(float64(len(text)))
+	if ta.cfg.FsyncBatch() {
+		return errors.Wrap(ta.sync(), "fsync tx file error")
+	}
 	return nil
 }
+
+func (ta *TxAppender) Rotate() (seq int, err error) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	// the tx file is fsynced and closed already once shut down
+	closed := ta.writer == nil
+	if !closed {
+		if err = ta.writer.Sync(); err != nil {
+			return 0, errors.Wrap(err, "fsync tx file error")
+		}
+		ta.dirty = false
+		if err = ta.writer.Close(); err != nil {
+			return 0, errors.Wrap(err, "close tx file error")
+		}
+	}
+	seq = ta.seq + 1
+	filename := path.Join(ta.cfg.DataDir, common.FileTx)
+	if err = os.Rename(filename, path.Join(ta.cfg.DataDir, SegmentName(seq))); err != nil {
+		// keep appending to the original file
+		if !closed {
+			if e := ta.open(); e != nil {
+				etlog.Log.WithError(e).Error("reopen tx file failed")
+			}
+		}
+		return 0, errors.Wrap(err, "archive tx file error")
+	}
+	ta.seq = seq
+	if closed {
+		return seq, errors.Wrap(syncDir(ta.cfg.DataDir), "fsync data dir error")
+	}
+	return seq, ta.open()
+}
+
+// SegmentName returns file name of the archived tx segment
+func SegmentName(seq int) string {
+	return fmt.Sprintf(common.FileTxSegment, seq)
+}
+
+// TxSegments returns sequences of the archived tx segments in order
+func TxSegments(dataDir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int, 0)
+	for _, f := range files {
+		var seq int
+		if _, err := fmt.Sscanf(f.Name(), common.FileTxSegment, &seq); err == nil {
+			segments = append(segments, seq)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// ReplayTxFile reads the tx file and calls fn with each request in order,
+// the lines can't be parsed are skipped.
+func ReplayTxFile(filename string, fn func(req *common.TxRequest)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 512*1024*1024)
+	for scanner.Scan() {
+		req, err := ParseTx(scanner.Text())
+		if err != nil {
+			etlog.Log.WithError(err).WithField("file", filename).Warn("skip tx")
+			continue
+		}
+		fn(req)
+	}
+	return scanner.Err()
+}
+
+// ParseTx parses the text of request in format: txid flag action[@db] key [[codec:]base64 val]
+func ParseTx(text string) (*common.TxRequest, error) {
+	texts := strings.Fields(strings.TrimSpace(text))
+	if len(texts) < 4 {
+		return nil, errors.New("missing required")
+	}
+
+	id, err := strconv.ParseInt(texts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("txid is wrong format")
+	}
+	req := &common.TxRequest{
+		TxId: id,
+		Flag: texts[1],
+		Key:  texts[3],
+	}
+
+	action := texts[2]
+	if i := strings.IndexByte(action, '@'); i >= 0 {
+		if req.Db, err = strconv.Atoi(action[i+1:]); err != nil || req.Db < 0 {
+			return nil, errors.New("db is wrong format")
+		}
+		action = action[:i]
+	}
+	switch action {
+	case common.DEL, common.FLUSH:
+		req.Action = action
+	case common.SET, common.EXPIRE, common.SWAPDB:
+		req.Action = action
+		if len(texts) == 4 {
+			req.Val = []byte{}
+		} else if len(texts) == 5 {
+			val := texts[4]
+			if i := strings.IndexByte(val, ':'); i >= 0 {
+				if req.Codec, err = compress.Parse(val[:i]); err != nil || req.Codec == compress.None {
+					return nil, errors.New("codec is wrong format")
+				}
+				val = val[i+1:]
+			}
+			if req.Val, err = utils.Base64Decode(val); err != nil {
+				return nil, errors.New("value is wrong format")
+			}
+		} else {
+			return nil, errors.New("more than one values")
+		}
+	default:
+		return nil, errors.New("cmd not support")
+	}
+	return req, nil
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const manifestVersion = 1
+
+// BackupFile is a file of backup with its checksum
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Seq is the sequence of tx segment
+	Seq int `json:"seq,omitempty"`
+}
+
+// Manifest describes a backup, which consists of a snapshot and the tx
+// segments not compacted yet. The segments are contiguous, and cover the
+// log from empty data if the first one is 1.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// SnapshotSeq is the last segment covered by snapshot
+	SnapshotSeq int          `json:"snapshot_seq"`
+	LastTxId    int64        `json:"last_tx_id"`
+	Snapshot    BackupFile   `json:"snapshot"`
+	Segments    []BackupFile `json:"segments"`
+}
+
+// FullLog tells whether the data can be rebuilt by replaying the segments
+func (m *Manifest) FullLog() bool {
+	return len(m.Segments) > 0 && m.Segments[0].Seq == 1
+}
+
+// Backup takes a snapshot, and copies it with the tx segments to dir,
+// the manifest is written at last so that a backup is never partial.
+func (s *Syncer) Backup(dir string) (*Manifest, error) {
+	if _, err := os.Stat(path.Join(dir, common.FileManifest)); err == nil {
+		return nil, fmt.Errorf("backup already exists in %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create backup dir error")
+	}
+
+	// no snapshot or compaction until all files are copied
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	snap, err := s.snapshot(true)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		Version:     manifestVersion,
+		CreatedAt:   time.Now().UTC(),
+		SnapshotSeq: snap.Seq,
+		LastTxId:    snap.LastTxId,
+		Segments:    make([]BackupFile, 0),
+	}
+	if m.Snapshot, err = copyFile(s.cfg.DataDir, dir, common.FileSnapshot); err != nil {
+		return nil, err
+	}
+	segments, err := TxSegments(s.cfg.DataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list tx segments error")
+	}
+	for _, seq := range segments {
+		f, err := copyFile(s.cfg.DataDir, dir, SegmentName(seq))
+		if err != nil {
+			return nil, err
+		}
+		f.Seq = seq
+		m.Segments = append(m.Segments, f)
+	}
+
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal manifest error")
+	}
+	if err = writeFileSync(path.Join(dir, common.FileManifest), content); err != nil {
+		return nil, errors.Wrap(err, "write manifest error")
+	}
+	etlog.Log.WithField("dir", dir).WithField("segments", len(m.Segments)).
+		WithField("last_tx_id", m.LastTxId).Info("backup success!")
+	return m, nil
+}
+
+// copyFile copies the file and fsyncs it, returns its size and checksum
+func copyFile(srcDir, dstDir, name string) (BackupFile, error) {
+	f := BackupFile{Name: name}
+	src, err := os.Open(path.Join(srcDir, name))
+	if err != nil {
+		return f, errors.Wrapf(err, "open %s error", name)
+	}
+	defer src.Close()
+	dst, err := os.Create(path.Join(dstDir, name))
+	if err != nil {
+		return f, errors.Wrapf(err, "create %s error", name)
+	}
+	defer dst.Close()
+
+	h := sha256.New()
+	if f.Size, err = io.Copy(io.MultiWriter(dst, h), src); err != nil {
+		return f, errors.Wrapf(err, "copy %s error", name)
+	}
+	if err = dst.Sync(); err != nil {
+		return f, errors.Wrapf(err, "fsync %s error", name)
+	}
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, nil
+}
+
+// writeFileSync writes content to a temp file and renames it, both the
+// file and its dir are fsynced, so that the file is never partial and
+// survives a crash once returned
+func writeFileSync(filename string, content []byte) error {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(filename))
+}
+
+// syncDir fsyncs the dir, so that the files created or renamed in it
+// are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// VerifyBackup reads the manifest of backup in dir, and checks the size
+// and checksum of each file
+func VerifyBackup(dir string) (*Manifest, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, common.FileManifest))
+	if err != nil {
+		return nil, errors.Wrap(err, "read manifest error")
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(content, m); err != nil {
+		return nil, errors.Wrap(err, "backup is corrupt, invalid manifest")
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("backup version %d is not supported", m.Version)
+	}
+	if m.Snapshot.Name != common.FileSnapshot {
+		return nil, errors.New("backup is corrupt, snapshot is missing")
+	}
+	for i, f := range m.Segments {
+		if f.Name != SegmentName(f.Seq) {
+			return nil, fmt.Errorf("backup is corrupt, invalid segment %s", f.Name)
+		}
+		if i > 0 && f.Seq != m.Segments[i-1].Seq+1 {
+			return nil, fmt.Errorf("backup is corrupt, segment %d is missing", m.Segments[i-1].Seq+1)
+		}
+	}
+	for _, f := range append([]BackupFile{m.Snapshot}, m.Segments...) {
+		if err = verifyFile(dir, f); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func verifyFile(dir string, f BackupFile) error {
+	src, err := os.Open(path.Join(dir, f.Name))
+	if err != nil {
+		return errors.Wrapf(err, "backup is corrupt, open %s error", f.Name)
+	}
+	defer src.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, src)
+	if err != nil {
+		return errors.Wrapf(err, "read %s error", f.Name)
+	}
+	if size != f.Size {
+		return fmt.Errorf("backup is corrupt, size of %s is %d, want %d", f.Name, size, f.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != f.SHA256 {
+		return fmt.Errorf("backup is corrupt, checksum of %s mismatch", f.Name)
+	}
+	return nil
+}
+
+// ParseTxBound parses the bound of restoring, which is a tx id or a time
+// in RFC3339, the time is converted to the last tx id of its millisecond
+func ParseTxBound(text string) (int64, error) {
+	if id, err := strconv.ParseInt(text, 10, 64); err == nil {
+		if id <= 0 {
+			return 0, fmt.Errorf("invalid tx id %d", id)
+		}
+		return id, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is neither a tx id nor a RFC3339 time", text)
+	}
+	millis := t.UnixNano() / int64(time.Millisecond)
+	return (millis+1)*1e6 - 1, nil
+}
+
+// RestoreResult is the summary of restoring
+type RestoreResult struct {
+	Keys int `json:"keys"`
+	// Replayed is count of tx replayed, 0 if restored from snapshot only
+	Replayed int   `json:"replayed"`
+	LastTxId int64 `json:"last_tx_id"`
+}
+
+// Restore rebuilds the data from the backup in dir into the empty data dir
+// of conf. With until > 0, the tx of log not beyond it are replayed, which
+// requires the full log if until is before the snapshot.
+func Restore(conf *config.Config, dir string, until int64) (*RestoreResult, error) {
+	m, err := VerifyBackup(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkEmptyDataDir(conf.DataDir); err != nil {
+		return nil, err
+	}
+
+	// restored in memory regardless of the engine
+	dbs := make([]Store, conf.DatabaseCount())
+	for i := range dbs {
+		dbs[i] = NewStorage(conf)
+	}
+	result := &RestoreResult{}
+	switch {
+	case until > 0 && m.FullLog():
+		files := make([]string, 0, len(m.Segments))
+		for _, f := range m.Segments {
+			files = append(files, f.Name)
+		}
+		if err = replayUntil(dbs, dir, files, until, result); err != nil {
+			return nil, err
+		}
+	case until > 0 && until < m.LastTxId:
+		return nil, fmt.Errorf("tx %d is before the snapshot of backup, and the log is compacted", until)
+	default:
+		snap, err := readSnapshot(dir)
+		if err != nil {
+			return nil, err
+		}
+		if snap.Seq != m.SnapshotSeq {
+			return nil, errors.New("backup is corrupt, snapshot doesn't match manifest")
+		}
+		if err = loadAll(dbs, snap.Data, snap.Dbs); err != nil {
+			return nil, errors.Wrap(err, "load snapshot error")
+		}
+		result.LastTxId = snap.LastTxId
+	}
+
+	if err = writeBase(dbs, conf.DataDir); err != nil {
+		return nil, err
+	}
+	for _, db := range dbs {
+		result.Keys += db.Len()
+	}
+	etlog.Log.WithField("from", dir).WithField("keys", result.Keys).
+		WithField("last_tx_id", result.LastTxId).Info("restore success!")
+	return result, nil
+}
+
+// checkEmptyDataDir refuses to overwrite the existing data
+func checkEmptyDataDir(dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return errors.Wrap(err, "create data dir error")
+	}
+	segments, err := TxSegments(dataDir)
+	if err != nil {
+		return errors.Wrap(err, "list tx segments error")
+	}
+	if len(segments) > 0 {
+		return fmt.Errorf("data dir %s is not empty", dataDir)
+	}
+	for _, name := range []string{common.FileSnapshot, common.FileTx} {
+		if fi, err := os.Stat(path.Join(dataDir, name)); err == nil && fi.Size() > 0 {
+			return fmt.Errorf("data dir %s is not empty", dataDir)
+		}
+	}
+	if files, err := ioutil.ReadDir(path.Join(dataDir, common.DirLSM)); err == nil && len(files) > 0 {
+		return fmt.Errorf("data dir %s is not empty", dataDir)
+	}
+	return nil
+}
+
+// replayUntil replays the tx of files not beyond until. The tx ids of log
+// are not monotonic, since they're generated by the clocks of peers, so
+// the ones beyond are skipped rather than stopping at the first one.
+func replayUntil(dbs []Store, dir string, files []string, until int64, result *RestoreResult) error {
+	for _, name := range files {
+		f, err := os.Open(path.Join(dir, name))
+		if err != nil {
+			return errors.Wrapf(err, "open %s error", name)
+		}
+		err = func() error {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(make([]byte, 64*1024), 512*1024*1024)
+			for scanner.Scan() {
+				req, err := ParseTx(scanner.Text())
+				if err != nil {
+					return errors.Wrapf(err, "backup is corrupt, invalid tx in %s", name)
+				}
+				if req.TxId > until {
+					continue
+				}
+				applyTo(dbs, req)
+				result.Replayed++
+				if req.TxId > result.LastTxId {
+					result.LastTxId = req.TxId
+				}
+			}
+			return scanner.Err()
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBase writes the data as the first tx segment in order of versions,
+// so that the log of restored node is still replayable from empty
+func writeBase(dbs []Store, dataDir string) error {
+	type entry struct {
+		db  int
+		key string
+		val DataItem
+	}
+	entries := make([]entry, 0, dbs[0].Len())
+	for i, st := range dbs {
+		st.Range(func(key string, val DataItem) bool {
+			entries = append(entries, entry{i, key, val})
+			return true
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].val.Ver < entries[j].val.Ver
+	})
+
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(FormatTx(&common.TxRequest{
+			TxId: e.val.Ver, Action: common.SET, Key: e.key, Val: e.val.Val, Db: e.db, Codec: e.val.Codec}))
+		b.WriteByte('\n')
+		if e.val.Exp > 0 {
+			b.WriteString(FormatTx(&common.TxRequest{
+				TxId: e.val.Ver, Action: common.EXPIRE, Key: e.key,
+				Val: []byte(strconv.FormatInt(e.val.Exp, 10)), Db: e.db}))
+			b.WriteByte('\n')
+		}
+	}
+	if err := writeFileSync(path.Join(dataDir, SegmentName(1)), []byte(b.String())); err != nil {
+		return errors.Wrap(err, "write restored data error")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncer_BackupRestore(t *testing.T) {
+	conf := &config.Config{
+		DataDir:         t.TempDir(),
+		ShutdownTimeout: 5,
+	}
+	s := startSyncer(t, conf)
+	txIds := make([]int64, 0)
+	txId := utils.GenerateId()
+	for i := 0; i < 6; i++ {
+		txId++
+		req := &common.TxRequest{
+			TxId:   txId,
+			Flag:   common.FlagReq,
+			Action: common.SET,
+			Key:    fmt.Sprintf("key-%d", i),
+			Val:    []byte(fmt.Sprintf("val-%d", i)),
+		}
+		if err := s.Submit(req); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+		txIds = append(txIds, txId)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.LastTxId() != txId && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dir := t.TempDir()
+	m, err := s.Backup(dir)
+	s.Shutdown()
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	if m.LastTxId != txId || !m.FullLog() {
+		t.Fatalf("Backup() = %+v, want last tx %d with full log", m, txId)
+	}
+
+	tests := []struct {
+		name  string
+		until int64
+		keys  int
+	}{
+		{"snapshot", 0, 6},
+		{"point in time", txIds[2], 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := &config.Config{DataDir: t.TempDir(), ShutdownTimeout: 5}
+			result, err := Restore(restored, dir, tt.until)
+			if err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			if result.Keys != tt.keys {
+				t.Errorf("Restore() keys = %d, want %d", result.Keys, tt.keys)
+			}
+			if _, err = Restore(restored, dir, tt.until); err == nil {
+				t.Error("Restore() into non-empty data dir, want error")
+			}
+
+			s := startSyncer(t, restored)
+			defer s.Shutdown()
+			for i := 0; i < 6; i++ {
+				_, err := s.Store.Get(fmt.Sprintf("key-%d", i))
+				if (i < tt.keys) != (err == nil) {
+					t.Errorf("key-%d restored = %v, want %v", i, err == nil, i < tt.keys)
+				}
+			}
+		})
+	}
+
+	// a tampered segment is refused
+	seg := path.Join(dir, m.Segments[0].Name)
+	content, _ := ioutil.ReadFile(seg)
+	tampered := strings.Replace(string(content), "key-1", "key-x", 1)
+	if err = ioutil.WriteFile(seg, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(&config.Config{DataDir: t.TempDir()}, dir, 0)
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Restore() corrupt backup error = %v, want corrupt", err)
+	}
+}
+
+func TestParseTxBound(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    int64
+		wantErr bool
+	}{
+		{"1623456789000000001", 1623456789000000001, false},
+		{"2021-06-12T00:13:09Z", 1623456789000999999, false},
+		{"2021-06-12T00:13:09.5+00:00", 1623456789500999999, false},
+		{"0", 0, true},
+		{"yesterday", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := ParseTxBound(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTxBound() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTxBound() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayUntil(t *testing.T) {
+	dir := t.TempDir()
+	// the tx ids of peers are not in order of log
+	var b strings.Builder
+	for _, req := range []*common.TxRequest{
+		{TxId: 10, Action: common.SET, Key: "a", Val: []byte("1")},
+		{TxId: 30, Action: common.SET, Key: "b", Val: []byte("1")},
+		{TxId: 20, Action: common.SET, Key: "c", Val: []byte("1")},
+	} {
+		b.WriteString(FormatTx(req) + "\n")
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "tx.log"), []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := []Store{NewStorage(&config.Config{})}
+	result := &RestoreResult{}
+	if err := replayUntil(dbs, dir, []string{"tx.log"}, 20, result); err != nil {
+		t.Fatalf("replayUntil() error = %v", err)
+	}
+	if result.Replayed != 2 || result.LastTxId != 20 {
+		t.Errorf("replayUntil() = %+v, want 2 replayed until 20", result)
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, err := dbs[0].Get(key); (err == nil) != want {
+			t.Errorf("%s restored = %v, want %v", key, err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockCache is the page cache of sstable blocks, the least recently
+// used blocks are dropped when the capacity in bytes is exceeded
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	blocks   map[blockKey]*list.Element
+	hits     int64
+	misses   int64
+}
+
+type blockKey struct {
+	table uint64
+	block int
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[blockKey]*list.Element),
+	}
+}
+
+func (c *blockCache) get(table uint64, block int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.blocks[blockKey{table, block}]; ok {
+		c.lru.MoveToFront(el)
+		c.hits++
+		return el.Value.(*cachedBlock).data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *blockCache) put(table uint64, block int, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := blockKey{table, block}
+	if _, ok := c.blocks[key]; ok {
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.capacity && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		b := c.lru.Remove(el).(*cachedBlock)
+		delete(c.blocks, b.key)
+		c.size -= int64(len(b.data))
+	}
+}
+
+// drop removes the blocks of the table removed by compaction
+func (c *blockCache) drop(table uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.blocks {
+		if key.table == table {
+			c.lru.Remove(el)
+			delete(c.blocks, key)
+			c.size -= int64(len(el.Value.(*cachedBlock).data))
+		}
+	}
+}
+
+// stats returns the hits and misses of cache
+func (c *blockCache) stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
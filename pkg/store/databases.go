@@ -0,0 +1,174 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+// ErrSwapUnsupported is returned by SWAPDB if the engine keeps each
+// database in its own files
+var ErrSwapUnsupported = errors.New("ERR SWAPDB is not supported by the storage engine")
+
+// ErrSwapPeers is returned by SWAPDB if the node has peers, whose writes
+// applied concurrently are not ordered with the swap
+var ErrSwapPeers = errors.New("ERR SWAPDB is not supported with peers")
+
+// ErrDbUnsupported is returned by pulling a database other than 0 from
+// the nodes without databases
+var ErrDbUnsupported = errors.New("database is not supported by node")
+
+// newDatabases creates the stores of numbered databases
+func newDatabases(conf *config.Config) []Store {
+	dbs := make([]Store, conf.DatabaseCount())
+	for i := range dbs {
+		dbs[i] = NewStore(conf, i)
+	}
+	return dbs
+}
+
+// DB returns the store of database i, nil if out of range. The stores
+// are kept by SWAPDB, which exchanges their data.
+func (s *Syncer) DB(i int) Store {
+	if i < 0 || i >= len(s.dbs) {
+		return nil
+	}
+	return s.dbs[i]
+}
+
+// Stores returns the stores of databases by index
+func (s *Syncer) Stores() []Store {
+	return append([]Store{}, s.dbs...)
+}
+
+// Databases returns the count of databases
+func (s *Syncer) Databases() int {
+	return len(s.dbs)
+}
+
+// Len returns count of keys of all databases
+func (s *Syncer) Len() int {
+	n := 0
+	for _, db := range s.dbs {
+		n += db.Len()
+	}
+	return n
+}
+
+// Size returns the estimated bytes of all databases
+func (s *Syncer) Size() int64 {
+	var n int64
+	for _, db := range s.dbs {
+		n += db.Size()
+	}
+	return n
+}
+
+// CheckSwap returns why SWAPDB is not supported, nil if it is. The swap
+// is applied by the peers in their own orders with the writes, so that
+// it's only served by the nodes without peers keeping data in memory.
+func (s *Syncer) CheckSwap() error {
+	if _, ok := s.Store.(*Storage); !ok {
+		return ErrSwapUnsupported
+	}
+	if len(s.Peers()) > 0 {
+		return ErrSwapPeers
+	}
+	return nil
+}
+
+// serializeAll returns the data of database 0, and the other databases
+// not empty by index
+func serializeAll(dbs []Store) (data []byte, others map[int]json.RawMessage, err error) {
+	if data, err = dbs[0].Serialize(); err != nil {
+		return nil, nil, err
+	}
+	for i, db := range dbs[1:] {
+		if db.Len() == 0 {
+			continue
+		}
+		if others == nil {
+			others = make(map[int]json.RawMessage)
+		}
+		if others[i+1], err = db.Serialize(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, others, nil
+}
+
+// loadAll loads the data serialized by serializeAll
+func loadAll(dbs []Store, data []byte, others map[int]json.RawMessage) error {
+	for i := range others {
+		if i <= 0 || i >= len(dbs) {
+			return fmt.Errorf("database %d out of range, %d databases configured", i, len(dbs))
+		}
+	}
+	if len(data) > 0 {
+		if err := dbs[0].Load(data); err != nil {
+			return err
+		}
+	}
+	for i, d := range others {
+		if err := dbs[i].Load(d); err != nil {
+			return errors.Wrapf(err, "load database %d error", i)
+		}
+	}
+	return nil
+}
+
+// applyTo applies the request to the database of stores
+func applyTo(dbs []Store, req *common.TxRequest) {
+	if req.Db < 0 || req.Db >= len(dbs) {
+		etlog.Log.WithField("req", req).Warn("database out of range")
+		return
+	}
+	st := dbs[req.Db]
+	switch req.Action {
+	case common.SET:
+		st.Set(req.Key, DataItem{Val: req.Val, Ver: req.TxId, Codec: req.Codec})
+	case common.DEL:
+		st.Del(req.Key, req.TxId)
+	case common.EXPIRE:
+		at, err := strconv.ParseInt(string(req.Val), 10, 64)
+		if err != nil {
+			etlog.Log.WithField("req", req).Warn("invalid expire")
+			return
+		}
+		st.Expire(req.Key, at, req.TxId)
+	case common.FLUSH:
+		flushTo(st, req.TxId)
+	case common.SWAPDB:
+		other, err := strconv.Atoi(string(req.Val))
+		if err != nil || other < 0 || other >= len(dbs) {
+			etlog.Log.WithField("req", req).Warn("invalid swapdb")
+			return
+		}
+		a, ok := st.(*Storage)
+		b, ok2 := dbs[other].(*Storage)
+		if !ok || !ok2 {
+			etlog.Log.WithField("req", req).Warn(ErrSwapUnsupported.Error())
+			return
+		}
+		a.swap(b)
+	}
+}
+
+// flushTo deletes the keys of st with versions not greater than ver,
+// so that the writes ordered after the flush by other nodes are kept
+func flushTo(st Store, ver int64) {
+	keys := make([]string, 0)
+	st.Range(func(key string, val DataItem) bool {
+		if val.Ver <= ver {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		st.Del(key, ver)
+	}
+}
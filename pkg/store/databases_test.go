@@ -0,0 +1,90 @@
+package store
+
+import (
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/compress"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncer_Databases(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir(), Databases: 3, ShutdownTimeout: 5}
+	s := startSyncer(t, conf)
+	txId := utils.GenerateId()
+	reqs := []*common.TxRequest{
+		{Action: common.SET, Key: "a", Val: []byte("0")},
+		{Action: common.SET, Key: "a", Val: []byte("1"), Db: 1},
+		{Action: common.SET, Key: "b", Val: []byte("1"), Db: 1},
+		{Action: common.SET, Key: "c", Val: []byte("2"), Db: 2},
+		{Action: common.SWAPDB, Key: "*", Val: []byte("2"), Db: 1},
+		{Action: common.FLUSH, Key: "*", Db: 0},
+		{Action: common.SET, Key: "d", Val: []byte("0")},
+	}
+	for _, req := range reqs {
+		txId++
+		req.TxId, req.Flag = txId, common.FlagReq
+		if err := s.Submit(req); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.LastTxId() != txId && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	s.Shutdown()
+
+	// recovered from the snapshot
+	s = startSyncer(t, conf)
+	defer s.Shutdown()
+	tests := []struct {
+		db    int
+		key   string
+		val   string
+		exist bool
+	}{
+		{0, "a", "", false},
+		{0, "d", "0", true},
+		{1, "c", "2", true},
+		{1, "a", "", false},
+		{2, "a", "1", true},
+		{2, "b", "1", true},
+	}
+	for _, tt := range tests {
+		val, err := s.DB(tt.db).Get(tt.key)
+		if (err == nil) != tt.exist || string(val.Val) != tt.val {
+			t.Errorf("DB(%d).Get(%s) = %q, %v, want %q", tt.db, tt.key, val.Val, err, tt.val)
+		}
+	}
+	if s.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", s.Len())
+	}
+}
+
+func TestParseTx_Db(t *testing.T) {
+	tests := []*common.TxRequest{
+		{TxId: 1, Flag: common.FlagReq, Action: common.SET, Key: "a", Val: []byte("1"), Db: 3},
+		{TxId: 2, Flag: common.FlagReq, Action: common.FLUSH, Key: "*", Db: 1},
+		{TxId: 3, Flag: common.FlagReq, Action: common.SWAPDB, Key: "*", Val: []byte("2")},
+		{TxId: 4, Flag: common.FlagReq, Action: common.SET, Key: "b", Val: []byte{0xff}, Db: 2, Codec: compress.Zstd},
+	}
+	for _, want := range tests {
+		got, err := ParseTx(FormatTx(want))
+		if err != nil {
+			t.Fatalf("ParseTx(%q) error = %v", FormatTx(want), err)
+		}
+		if got.TxId != want.TxId || got.Action != want.Action || got.Db != want.Db || got.Codec != want.Codec ||
+			string(got.Val) != string(want.Val) {
+			t.Errorf("ParseTx(%q) = %+v, want %+v", FormatTx(want), got, want)
+		}
+		rec, err := ParseTxRecord(NewTxRecord(want))
+		if err != nil || !reflect.DeepEqual(rec, got) {
+			t.Errorf("ParseTxRecord() = %+v, %v, want %+v", rec, err, got)
+		}
+	}
+}
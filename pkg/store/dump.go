@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bufio"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/dump"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ImportResult is the summary of importing
+type ImportResult struct {
+	Imported int `json:"imported"`
+	// Expired is count of the keys expired already
+	Expired int `json:"expired"`
+	// Skipped is count of the keys of types not supported, of databases
+	// not configured, or with spaces which can't be logged
+	Skipped int `json:"skipped"`
+	// Moved is count of the keys of slots served by other nodes in
+	// cluster mode, which should be imported there
+	Moved int `json:"moved"`
+}
+
+// ErrReadOnly is returned by importing to a read only replica
+var ErrReadOnly = errors.New("READONLY You can't write against a read only replica.")
+
+// Export writes the keys not expired of databases to enc. The keys are
+// listed first and the values are read one by one, so writes are not
+// blocked during export, and the output isn't a point-in-time view.
+func Export(dbs []Store, enc dump.Encoder) (n int, err error) {
+	for db, st := range dbs {
+		keys, err := st.Keys()
+		if err != nil {
+			return n, errors.Wrap(err, "list keys error")
+		}
+		for _, key := range keys {
+			val, err := st.Get(key)
+			if err != nil {
+				// deleted or expired since listed
+				continue
+			}
+			b, err := val.Value()
+			if err != nil {
+				return n, errors.Wrapf(err, "decode value of %s error", key)
+			}
+			if err = enc.Encode(&dump.Entry{DB: db, Key: key, Val: b, ExpireAt: val.Exp}); err != nil {
+				return n, errors.Wrap(err, "encode error")
+			}
+			n++
+		}
+	}
+	return n, enc.Close()
+}
+
+// ExportDataDir exports the data recovered from the data dir of conf,
+// the node should be stopped or the latest writes may be missing
+func ExportDataDir(conf *config.Config, enc dump.Encoder) (int, error) {
+	dbs := newDatabases(conf)
+	s := &Syncer{cfg: conf, Store: dbs[0], dbs: dbs}
+	for _, db := range dbs {
+		if err := db.Init(); err != nil {
+			return 0, err
+		}
+		defer db.Shutdown()
+	}
+	if err := s.Recover(); err != nil {
+		return 0, err
+	}
+	return Export(s.dbs, enc)
+}
+
+// Import reads the entries from dec, and calls fn with a set request for
+// each, followed by an expire request if the entry expires. The entries
+// of databases beyond the count of databases are skipped.
+func Import(dec dump.Decoder, databases int, fn func(req *common.TxRequest) error) (*ImportResult, error) {
+	result := &ImportResult{}
+	now := utils.CurrentMillis()
+	for {
+		entry, err := dec.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, err
+		}
+		if entry.Key == "" || strings.ContainsAny(entry.Key, " \t\r\n") {
+			etlog.Log.WithField("key", entry.Key).Warn("skip key can't be logged")
+			result.Skipped++
+			continue
+		}
+		if entry.DB >= databases {
+			result.Skipped++
+			continue
+		}
+		if entry.ExpireAt > 0 && entry.ExpireAt <= now {
+			result.Expired++
+			continue
+		}
+		txId := utils.GenerateId()
+		err = fn(&common.TxRequest{
+			TxId:   txId,
+			Flag:   common.FlagReq,
+			Action: common.SET,
+			Key:    entry.Key,
+			Val:    entry.Val,
+			Db:     entry.DB,
+		})
+		if err == nil && entry.ExpireAt > 0 {
+			// ordered after the set
+			err = fn(&common.TxRequest{
+				TxId:   utils.GenerateIdAfter(txId),
+				Flag:   common.FlagReq,
+				Action: common.EXPIRE,
+				Key:    entry.Key,
+				Val:    []byte(strconv.FormatInt(entry.ExpireAt, 10)),
+				Db:     entry.DB,
+			})
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Imported++
+	}
+	result.Skipped += dec.Skipped()
+	return result, nil
+}
+
+// Import submits the entries of dec, waiting for the queue if it's full.
+// It's refused by a read only replica, and only the keys routed to
+// current node are imported in cluster mode.
+func (s *Syncer) Import(dec dump.Decoder) (*ImportResult, error) {
+	if s.Replicator.ReadOnly() {
+		return nil, ErrReadOnly
+	}
+	rd := &routedDecoder{Decoder: dec, syncer: s}
+	result, err := Import(rd, len(s.dbs), s.submitWait)
+	result.Moved = rd.moved
+	return result, err
+}
+
+// routedDecoder skips the entries not routed to current node
+type routedDecoder struct {
+	dump.Decoder
+	syncer *Syncer
+	moved  int
+}
+
+func (d *routedDecoder) Decode() (*dump.Entry, error) {
+	for {
+		entry, err := d.Decoder.Decode()
+		if err != nil {
+			return nil, err
+		}
+		exists := func() bool {
+			_, err := d.syncer.Store.Get(entry.Key)
+			return err == nil
+		}
+		if d.syncer.cluster.Route(entry.Key, false, exists) == nil {
+			return entry, nil
+		}
+		d.moved++
+	}
+}
+
+// ImportDataDir appends the entries of dec to the tx file of the data dir
+// of conf, which are applied when the node starts. The node should be
+// stopped, the tx file is synced before returning, or truncated back if
+// failed so that no partial line is left.
+func ImportDataDir(conf *config.Config, dec dump.Decoder) (*ImportResult, error) {
+	if err := os.MkdirAll(conf.DataDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create data dir error")
+	}
+	f, err := os.OpenFile(path.Join(conf.DataDir, common.FileTx),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open tx file failed")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat tx file error")
+	}
+
+	w := bufio.NewWriter(f)
+	result, err := Import(dec, conf.DatabaseCount(), func(req *common.TxRequest) error {
+		if _, err := w.WriteString(FormatTx(req)); err != nil {
+			return err
+		}
+		return w.WriteByte('\n')
+	})
+	if err == nil {
+		err = errors.Wrap(w.Flush(), "write tx file error")
+	}
+	if err == nil {
+		err = errors.Wrap(f.Sync(), "fsync tx file error")
+	}
+	if err != nil {
+		if e := f.Truncate(fi.Size()); e != nil {
+			etlog.Log.WithError(e).Warn("truncate tx file failed")
+		}
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/dump"
+	"io"
+	"testing"
+)
+
+func TestImportExportDataDir(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir()}
+	later := utils.CurrentMillis() + 60000
+	entries := []*dump.Entry{
+		{Key: "a", Val: []byte("1")},
+		{Key: "b", Val: []byte{0xff}, ExpireAt: later},
+		{Key: "expired", Val: []byte("1"), ExpireAt: 1},
+		{Key: "with space", Val: []byte("1")},
+		{DB: 1, Key: "c", Val: []byte("1")},
+	}
+	in := &bytes.Buffer{}
+	enc := dump.NewJSONLEncoder(in)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+	enc.Close()
+
+	result, err := ImportDataDir(conf, dump.NewJSONLDecoder(in))
+	if err != nil {
+		t.Fatalf("ImportDataDir() error = %v", err)
+	}
+	if *result != (ImportResult{Imported: 3, Expired: 1, Skipped: 1}) {
+		t.Errorf("ImportDataDir() = %+v", result)
+	}
+
+	out := &bytes.Buffer{}
+	rdb, _ := dump.NewRDBEncoder(out)
+	if n, err := ExportDataDir(conf, rdb); err != nil || n != 3 {
+		t.Fatalf("ExportDataDir() = %d, %v, want 3 keys", n, err)
+	}
+	dec, err := dump.NewRDBDecoder(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*dump.Entry)
+	for {
+		e, err := dec.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		got[e.Key] = e
+	}
+	if e := got["a"]; e == nil || string(e.Val) != "1" || e.ExpireAt != 0 {
+		t.Errorf("exported a = %+v", e)
+	}
+	if e := got["b"]; e == nil || !bytes.Equal(e.Val, []byte{0xff}) || e.ExpireAt != later {
+		t.Errorf("exported b = %+v", e)
+	}
+	if e := got["c"]; e == nil || e.DB != 1 {
+		t.Errorf("exported c = %+v", e)
+	}
+}
+
+func TestSyncer_Import(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir(), ShutdownTimeout: 1, Cluster: config.ClusterConfig{
+		Enabled: true,
+		NodeId:  "n1",
+		Nodes: []config.NodeConfig{
+			{Id: "n1", Host: "127.0.0.1", Port: "7001", Slots: []string{"0-8191"}},
+			{Id: "n2", Host: "127.0.0.1", Port: "7002", Slots: []string{"8192-16383"}},
+		},
+	}}
+	c := cluster.NewCluster(conf)
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s := runSyncer(t, NewSyncer(conf, c))
+	defer s.Shutdown()
+	keys := map[bool]string{}
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys[cluster.KeySlot(key) <= 8191] = key
+	}
+	in := &bytes.Buffer{}
+	enc := dump.NewJSONLEncoder(in)
+	enc.Encode(&dump.Entry{Key: keys[true], Val: []byte("1")})
+	enc.Encode(&dump.Entry{Key: keys[false], Val: []byte("1")})
+	enc.Close()
+	data := in.Bytes()
+
+	// the keys served by other nodes are not imported
+	result, err := s.Import(dump.NewJSONLDecoder(bytes.NewReader(data)))
+	if err != nil || *result != (ImportResult{Imported: 1, Moved: 1}) {
+		t.Errorf("Import() = %+v, %v, want 1 imported, 1 moved", result, err)
+	}
+
+	s.Replicator.mu.Lock()
+	s.Replicator.role = common.RoleReplica
+	s.Replicator.mu.Unlock()
+	if _, err = s.Import(dump.NewJSONLDecoder(bytes.NewReader(data))); err != ErrReadOnly {
+		t.Errorf("Import() of replica error = %v, want %v", err, ErrReadOnly)
+	}
+}
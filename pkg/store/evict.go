@@ -0,0 +1,307 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/metrics"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// eviction policies, same as maxmemory-policy of redis
+const (
+	PolicyNoEviction    = "noeviction"
+	PolicyAllKeysLRU    = "allkeys-lru"
+	PolicyAllKeysLFU    = "allkeys-lfu"
+	PolicyVolatileTTL   = "volatile-ttl"
+	PolicyAllKeysRandom = "allkeys-random"
+)
+
+const (
+	evictInterval = 100 * time.Millisecond
+	// evictBatch is the max count of keys evicted in one round
+	evictBatch = 200
+	// evictSamples is the count of keys sampled for each eviction
+	evictSamples = 5
+	// maxEvictBackoff is the max backoff of evicting while no key can be
+	// evicted, the backoff starts at evictInterval and is doubled
+	maxEvictBackoff = 5 * time.Second
+)
+
+// the counter of lfu is logarithmic like redis, it's halved roughly every
+// 10 times of the accesses, and decreased by 1 every minute not accessed
+const (
+	lfuInitVal    = 5
+	lfuMaxVal     = 255
+	lfuLogFactor  = 10
+	lfuDecayMilli = 60 * 1000
+)
+
+// ErrOOM is returned to the writes when the memory limit is reached
+// and no key can be evicted
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// keyIndex is a set of keys, which are picked uniformly at random
+type keyIndex struct {
+	keys []string
+	pos  map[string]int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{pos: make(map[string]int)}
+}
+
+func (x *keyIndex) add(key string) {
+	if _, ok := x.pos[key]; ok {
+		return
+	}
+	x.pos[key] = len(x.keys)
+	x.keys = append(x.keys, key)
+}
+
+// remove moves the last key to the place of key removed
+func (x *keyIndex) remove(key string) {
+	i, ok := x.pos[key]
+	if !ok {
+		return
+	}
+	last := len(x.keys) - 1
+	x.keys[i] = x.keys[last]
+	x.pos[x.keys[i]] = i
+	x.keys = x.keys[:last]
+	delete(x.pos, key)
+}
+
+// random returns a key at random, false if there is none
+func (x *keyIndex) random() (string, bool) {
+	if len(x.keys) == 0 {
+		return "", false
+	}
+	return x.keys[rand.Intn(len(x.keys))], true
+}
+
+// accessStat records the access of a key, updated with atomics
+// since the keys are read under the read lock
+type accessStat struct {
+	access  int64
+	counter int32
+}
+
+func newAccessStat(now int64) *accessStat {
+	return &accessStat{access: now, counter: lfuInitVal}
+}
+
+// touch increases the counter decayed with the probability of
+// 1/((counter-lfuInitVal)*lfuLogFactor+1)
+func (a *accessStat) touch(now int64) {
+	if a == nil {
+		return
+	}
+	c := a.freq(now)
+	if c < lfuMaxVal {
+		base := float64(c - lfuInitVal)
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			c++
+		}
+	}
+	atomic.StoreInt32(&a.counter, c)
+	atomic.StoreInt64(&a.access, now)
+}
+
+// freq returns the counter decayed by the minutes since the last access
+func (a *accessStat) freq(now int64) int32 {
+	if a == nil {
+		return 0
+	}
+	c := atomic.LoadInt32(&a.counter)
+	decay := (now - atomic.LoadInt64(&a.access)) / lfuDecayMilli
+	if decay >= int64(c) {
+		return 0
+	}
+	return c - int32(decay)
+}
+
+func (a *accessStat) lastAccess() int64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&a.access)
+}
+
+// validPolicy checks the eviction policy of config
+func validPolicy(policy string) error {
+	switch policy {
+	case "", PolicyNoEviction, PolicyAllKeysLRU, PolicyAllKeysLFU,
+		PolicyVolatileTTL, PolicyAllKeysRandom:
+		return nil
+	}
+	return fmt.Errorf("invalid maxmemory policy %q", policy)
+}
+
+// evicts tells whether the keys are evicted when the memory limit is reached
+func (s *Syncer) evicts() bool {
+	policy := s.cfg.MaxMemoryPolicy
+	return s.cfg.MaxMemory > 0 && policy != "" && policy != PolicyNoEviction
+}
+
+// CheckMemory returns ErrOOM if the memory limit is reached and no key
+// can be evicted, otherwise the eviction is triggered if needed and the
+// write is allowed, since the evicted keys are deleted asynchronously.
+func (s *Syncer) CheckMemory() error {
+	if s.cfg.MaxMemory <= 0 || s.Size() <= s.cfg.MaxMemory {
+		return nil
+	}
+	if !s.evicts() || atomic.LoadInt32(&s.oom) == 1 {
+		return ErrOOM
+	}
+	select {
+	case s.evictC <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Evicted returns count of the keys evicted since started
+func (s *Syncer) Evicted() int64 {
+	return atomic.LoadInt64(&s.evicted)
+}
+
+// evictLoop evicts the keys when the memory limit is reached, checked
+// periodically or triggered by the writes. The evictions are deleted as
+// the expired keys, see expireLoop. While no key can be evicted, it's
+// retried with backoff rather than on each trigger.
+func (s *Syncer) evictLoop() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	var backoff time.Duration
+	var next time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.evictC:
+		case <-s.shutdown:
+			return
+		}
+		if time.Now().Before(next) {
+			continue
+		}
+		if s.evict() {
+			backoff = 0
+			continue
+		}
+		if backoff *= 2; backoff < evictInterval {
+			backoff = evictInterval
+		} else if backoff > maxEvictBackoff {
+			backoff = maxEvictBackoff
+		}
+		next = time.Now().Add(backoff)
+	}
+}
+
+// evict evicts the keys over the memory limit, returns false if it's
+// over the limit but no key can be evicted
+func (s *Syncer) evict() bool {
+	if !s.evicts() || s.Replicator.ReadOnly() {
+		return true
+	}
+	over := s.Size() - s.cfg.MaxMemory
+	if over <= 0 {
+		atomic.StoreInt32(&s.oom, 0)
+		return true
+	}
+	chosen := make(map[dbKey]bool)
+	var lastTxId int64
+	for over > 0 && len(chosen) < evictBatch {
+		victim, ok := s.pickVictim(chosen)
+		if !ok {
+			break
+		}
+		chosen[dbKey{victim.Db, victim.Key}] = true
+		lastTxId = utils.GenerateId()
+		err := s.Submit(&common.TxRequest{
+			TxId:   lastTxId,
+			Flag:   common.FlagReq,
+			Action: common.DEL,
+			Key:    victim.Key,
+			Db:     victim.Db,
+		})
+		if err != nil {
+			etlog.Log.WithError(err).WithField("key", victim.Key).Warn("evict key failed")
+			return false
+		}
+		over -= victim.Size
+		atomic.AddInt64(&s.evicted, 1)
+		metrics.EvictedKeys.Inc()
+	}
+	if len(chosen) == 0 {
+		// e.g. no key with expiry for volatile-ttl
+		atomic.StoreInt32(&s.oom, 1)
+		return false
+	}
+	atomic.StoreInt32(&s.oom, 0)
+
+	// the size is not decreased until the deletions are applied
+	deadline := time.Now().Add(time.Second)
+	for s.LastTxId() < lastTxId && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// dbKey identifies a key of database
+type dbKey struct {
+	db  int
+	key string
+}
+
+// pickVictim returns the best key to evict of the samples of databases
+// by policy, the chosen ones and the ones of other nodes are excluded
+func (s *Syncer) pickVictim(chosen map[dbKey]bool) (KeyStat, bool) {
+	policy := s.cfg.MaxMemoryPolicy
+	var best KeyStat
+	found := false
+	for i, db := range s.dbs {
+		if db.Len() == 0 {
+			continue
+		}
+		for _, st := range db.Sample(evictSamples, policy == PolicyVolatileTTL) {
+			st.Db = i
+			if chosen[dbKey{i, st.Key}] {
+				continue
+			}
+			if s.cluster.Enabled() && s.cluster.Owner(cluster.KeySlot(st.Key)) != s.cluster.Self() {
+				continue
+			}
+			if !found || better(policy, st, best) {
+				best, found = st, true
+			}
+			if policy == PolicyAllKeysRandom {
+				return best, found
+			}
+		}
+	}
+	return best, found
+}
+
+// better tells whether a is better to evict than b by policy
+func better(policy string, a, b KeyStat) bool {
+	switch policy {
+	case PolicyAllKeysLFU:
+		if a.Freq != b.Freq {
+			return a.Freq < b.Freq
+		}
+		return a.Access < b.Access
+	case PolicyVolatileTTL:
+		return a.Exp < b.Exp
+	default:
+		return a.Access < b.Access
+	}
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncer_Evict(t *testing.T) {
+	tests := []struct {
+		policy    string
+		maxMemory int64
+		wantOOM   bool
+		// wantEvicted is the prefix of keys which may be evicted
+		wantEvicted string
+	}{
+		{policy: PolicyNoEviction, maxMemory: 700, wantOOM: true},
+		{policy: PolicyAllKeysLRU, maxMemory: 700, wantEvicted: ""},
+		{policy: PolicyAllKeysLFU, maxMemory: 700, wantEvicted: ""},
+		{policy: PolicyAllKeysRandom, maxMemory: 700, wantEvicted: ""},
+		{policy: PolicyVolatileTTL, maxMemory: 700, wantEvicted: "v"},
+		// not enough keys with expiry
+		{policy: PolicyVolatileTTL, maxMemory: 300, wantOOM: true, wantEvicted: "v"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%d", tt.policy, tt.maxMemory), func(t *testing.T) {
+			conf := &config.Config{
+				DataDir:         t.TempDir(),
+				ShutdownTimeout: 5,
+				MaxMemory:       tt.maxMemory,
+				MaxMemoryPolicy: tt.policy,
+			}
+			s := startSyncer(t, conf)
+			// each key takes 100 bytes, 1000 in total
+			txId := utils.GenerateId()
+			keys := make([]string, 0)
+			for i := 0; i < 5; i++ {
+				for _, prefix := range []string{"k", "v"} {
+					key := fmt.Sprintf("%s%d", prefix, i)
+					keys = append(keys, key)
+					txId += 2
+					reqs := []*common.TxRequest{{TxId: txId, Flag: common.FlagReq, Action: common.SET,
+						Key: key, Val: []byte(strings.Repeat("x", 34))}}
+					if prefix == "v" {
+						reqs = append(reqs, &common.TxRequest{TxId: txId + 1, Flag: common.FlagReq,
+							Action: common.EXPIRE, Key: key, Val: []byte(fmt.Sprint(utils.CurrentMillis() + 60000))})
+					}
+					for _, req := range reqs {
+						if err := s.Submit(req); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for s.Store.Len() < len(keys) && s.Evicted() == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			for {
+				err := s.CheckMemory()
+				if tt.wantOOM && err == ErrOOM || !tt.wantOOM && s.Store.Size() <= tt.maxMemory {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("CheckMemory() = %v, size %d, evicted %d", err, s.Store.Size(), s.Evicted())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			s.Shutdown()
+
+			// the evictions are logged as deletions
+			s = startSyncer(t, conf)
+			defer s.Shutdown()
+			var evicted int64
+			for _, key := range keys {
+				if _, err := s.Store.Get(key); err != nil {
+					evicted++
+					if !strings.HasPrefix(key, tt.wantEvicted) {
+						t.Errorf("%s is evicted", key)
+					}
+				}
+			}
+			if tt.policy == PolicyNoEviction && evicted != 0 {
+				t.Errorf("%d keys evicted by noeviction", evicted)
+			}
+			if tt.policy != PolicyNoEviction && evicted == 0 {
+				t.Error("no key evicted")
+			}
+		})
+	}
+}
+
+func TestAccessStat(t *testing.T) {
+	now := utils.CurrentMillis()
+	a := newAccessStat(now)
+	for i := 0; i < 1000; i++ {
+		a.touch(now)
+	}
+	f := a.freq(now)
+	if f <= lfuInitVal || f >= 100 {
+		t.Errorf("freq after 1000 accesses = %d", f)
+	}
+	if got := a.freq(now + 3*lfuDecayMilli); got != f-3 {
+		t.Errorf("freq after 3 minutes = %d, want %d", got, f-3)
+	}
+	if got := a.freq(now + 1000*lfuDecayMilli); got != 0 {
+		t.Errorf("freq after long = %d, want 0", got)
+	}
+}
+
+func TestStorage_Sample(t *testing.T) {
+	s := NewStorage(&config.Config{})
+	const n = 20
+	for i := 0; i < n; i++ {
+		s.Set(fmt.Sprintf("k%d", i), DataItem{Val: []byte("1"), Ver: 1})
+	}
+	s.Set("v", DataItem{Val: []byte("1"), Ver: 1, Exp: utils.CurrentMillis() + 60000})
+	s.Del("k0", 2)
+
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		for _, st := range s.Sample(5, false) {
+			counts[st.Key]++
+		}
+	}
+	// each of the 20 keys is expected 500 times
+	if _, ok := counts["k0"]; ok || len(counts) != n {
+		t.Fatalf("sampled %d keys, want %d without the deleted", len(counts), n)
+	}
+	for key, c := range counts {
+		if c < 350 || c > 650 {
+			t.Errorf("%s sampled %d times, want about 500", key, c)
+		}
+	}
+
+	if got := s.Sample(3, true); len(got) != 3 || got[0].Key != "v" {
+		t.Errorf("Sample() of volatile = %v, want v only", got)
+	}
+	s.Expire("v", 0, 3)
+	if got := s.Sample(3, true); len(got) != 0 {
+		t.Errorf("Sample() of volatile = %v, want none after persisted", got)
+	}
+}
+
+func TestSyncer_EvictNothing(t *testing.T) {
+	conf := &config.Config{
+		DataDir:         t.TempDir(),
+		ShutdownTimeout: 5,
+		MaxMemory:       1,
+		MaxMemoryPolicy: PolicyVolatileTTL,
+	}
+	s := startSyncer(t, conf)
+	defer s.Shutdown()
+	s.Store.Set("a", DataItem{Val: []byte("1"), Ver: 1})
+	// retried with backoff
+	if s.evict() {
+		t.Error("evict() = true, want false if no key with expiry")
+	}
+	if err := s.CheckMemory(); err != ErrOOM {
+		t.Errorf("CheckMemory() = %v, want %v", err, ErrOOM)
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"time"
+)
+
+const (
+	expireInterval = 100 * time.Millisecond
+	// expireBatch is the max count of keys deleted in one round
+	expireBatch = 200
+)
+
+// expireLoop deletes the expired keys actively, the expired keys are
+// invisible before deleted. Only the primary of key deletes it, and the
+// deletion is replicated as the other requests.
+func (s *Syncer) expireLoop() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.expire()
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+func (s *Syncer) expire() {
+	if s.Replicator.ReadOnly() {
+		return
+	}
+	for i, db := range s.dbs {
+		for _, key := range db.Expired(utils.CurrentMillis(), expireBatch) {
+			if s.cluster.Enabled() && s.cluster.Owner(cluster.KeySlot(key)) != s.cluster.Self() {
+				continue
+			}
+			err := s.Submit(&common.TxRequest{
+				TxId:   utils.GenerateId(),
+				Flag:   common.FlagReq,
+				Action: common.DEL,
+				Key:    key,
+				Db:     i,
+			})
+			if err != nil {
+				etlog.Log.WithError(err).WithField("key", key).Warn("delete expired key failed")
+				return
+			}
+		}
+	}
+}
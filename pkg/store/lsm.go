@@ -0,0 +1,741 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// storage engines
+const (
+	EngineMemory = "memory"
+	EngineLSM    = "lsm"
+)
+
+const (
+	lsmManifestFile = "MANIFEST"
+	lsmExpiresFile  = "EXPIRES"
+	lsmTableFile    = "%06d.sst"
+)
+
+var (
+	// lsmMemtableSize is the bytes of memtable flushed as a table
+	lsmMemtableSize int64 = 4 << 20
+	// lsmTablesPerLevel is the count of tables merged to the next level
+	lsmTablesPerLevel = 4
+)
+
+// Persistent is implemented by the stores keeping the data in their own
+// files, which are recovered when opened rather than loaded from snapshot
+type Persistent interface {
+	// Engine returns the name of engine
+	Engine() string
+	// Flush persists the data applied so far
+	Flush() error
+}
+
+// NewStore returns the store of database db by the engine configured
+func NewStore(conf *config.Config, db int) Store {
+	if conf.Engine == EngineLSM {
+		return NewLSMStorage(conf, db)
+	}
+	return NewStorage(conf)
+}
+
+func validEngine(engine string) error {
+	switch engine {
+	case "", EngineMemory, EngineLSM:
+		return nil
+	}
+	return fmt.Errorf("invalid storage engine %q", engine)
+}
+
+// lsmManifest lists the tables from the newest to the oldest
+type lsmManifest struct {
+	NextId uint64         `json:"next_id"`
+	Tables []lsmTableMeta `json:"tables"`
+	// Count and Size are of the data in tables
+	Count int   `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+type lsmTableMeta struct {
+	Id    uint64 `json:"id"`
+	Level int    `json:"level"`
+}
+
+// LSMStorage is a log-structured merge tree. The writes go to the memtable,
+// which is flushed as a sorted table when it's full or on snapshot, and
+// the tables of the same level are merged to the next level in background.
+// The tx log is the write-ahead log, the writes since the snapshot are
+// replayed on recovery, which are idempotent by the versions.
+type LSMStorage struct {
+	cfg     *config.Config
+	dir     string
+	mu      sync.RWMutex
+	mem     map[string]lsmEntry
+	memSize int64
+	// tables are ordered from the newest to the oldest, the levels
+	// are ascending in this order
+	tables []*sstable
+	nextId uint64
+	cache  *blockCache
+	// expires indexes the keys with expiry, saved on flush
+	expires map[string]int64
+	count   int
+	size    int64
+	// flushedCount and flushedSize are of the tables
+	flushedCount int
+	flushedSize  int64
+	compactC     chan struct{}
+	running      bool
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewLSMStorage returns the storage of database db, which is kept in
+// data_dir/lsm for database 0, and in a sub dir named by index for others
+func NewLSMStorage(conf *config.Config, db int) *LSMStorage {
+	cacheSize := conf.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = 64 << 20
+	}
+	dir := path.Join(conf.DataDir, common.DirLSM)
+	if db > 0 {
+		dir = path.Join(dir, strconv.Itoa(db))
+	}
+	return &LSMStorage{
+		cfg:      conf,
+		dir:      dir,
+		mem:      make(map[string]lsmEntry),
+		cache:    newBlockCache(cacheSize),
+		expires:  make(map[string]int64),
+		compactC: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *LSMStorage) tablePath(id uint64) string {
+	return path.Join(s.dir, fmt.Sprintf(lsmTableFile, id))
+}
+
+// Init opens the tables of manifest, and removes the files left by
+// the flushes or compactions not finished
+func (s *LSMStorage) Init() error {
+	log.Println("[Init] init lsm storage")
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return errors.Wrap(err, "create lsm dir error")
+	}
+	m := &lsmManifest{NextId: 1}
+	content, err := ioutil.ReadFile(path.Join(s.dir, lsmManifestFile))
+	if err == nil {
+		if err = json.Unmarshal(content, m); err != nil {
+			return errors.Wrap(err, "unmarshal lsm manifest error")
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "read lsm manifest error")
+	}
+
+	live := make(map[string]bool)
+	for _, meta := range m.Tables {
+		t, err := openTable(s.tablePath(meta.Id), meta.Id, meta.Level)
+		if err != nil {
+			s.closeTables()
+			return err
+		}
+		s.tables = append(s.tables, t)
+		live[path.Base(s.tablePath(meta.Id))] = true
+	}
+	s.nextId = m.NextId
+	s.count, s.flushedCount = m.Count, m.Count
+	s.size, s.flushedSize = m.Size, m.Size
+	if err = s.loadExpires(); err != nil {
+		s.closeTables()
+		return err
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "list lsm dir error")
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if (strings.HasSuffix(name, ".sst") && !live[name]) || strings.HasSuffix(name, ".tmp") {
+			if err = os.Remove(path.Join(s.dir, name)); err != nil {
+				etlog.Log.WithError(err).WithField("file", name).Warn("remove orphan lsm file failed")
+			}
+		}
+	}
+	s.running = true
+	go s.compactLoop()
+	return nil
+}
+
+func (s *LSMStorage) Run(errC chan<- error) {
+	log.Println("[Run] run lsm storage")
+}
+
+// Shutdown stops the compaction and closes the tables, the memtable is
+// not flushed here since it's recovered from the tx log
+func (s *LSMStorage) Shutdown() {
+	if s.running {
+		s.running = false
+		close(s.stop)
+		<-s.done
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeTables()
+}
+
+func (s *LSMStorage) closeTables() {
+	for _, t := range s.tables {
+		t.close()
+	}
+	s.tables = nil
+}
+
+func (s *LSMStorage) Engine() string {
+	return EngineLSM
+}
+
+// lookup returns the latest entry of key, which may be a tombstone
+func (s *LSMStorage) lookup(key string) (lsmEntry, bool) {
+	if e, ok := s.mem[key]; ok {
+		return e, true
+	}
+	for _, t := range s.tables {
+		e, ok, err := t.get(key, s.cache)
+		if err != nil {
+			etlog.Log.WithError(err).WithField("key", key).Warn("read sstable failed")
+			continue
+		}
+		if ok {
+			return e, true
+		}
+	}
+	return lsmEntry{}, false
+}
+
+func (s *LSMStorage) put(key string, e lsmEntry) {
+	if old, ok := s.mem[key]; ok {
+		s.memSize -= entrySize(key, old.DataItem)
+	}
+	s.mem[key] = e
+	s.memSize += entrySize(key, e.DataItem)
+	if s.memSize >= lsmMemtableSize {
+		if err := s.flush(); err != nil {
+			etlog.Log.WithError(err).Warn("flush memtable failed")
+		}
+	}
+}
+
+func (s *LSMStorage) index(key string, at int64) {
+	if at > 0 {
+		s.expires[key] = at
+	} else {
+		delete(s.expires, key)
+	}
+}
+
+func (s *LSMStorage) Set(key string, val DataItem) (oldVal DataItem, exist bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.lookup(key)
+	exist = ok && !old.Deleted
+	if exist && val.Ver < old.Ver {
+		return old.DataItem, true
+	}
+	if exist {
+		s.size -= entrySize(key, old.DataItem)
+	} else {
+		s.count++
+	}
+	s.size += entrySize(key, val)
+	s.index(key, val.Exp)
+	s.put(key, lsmEntry{DataItem: val})
+	if exist {
+		return old.DataItem, true
+	}
+	return DataItem{}, false
+}
+
+func (s *LSMStorage) Get(key string) (val DataItem, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e, ok := s.lookup(key); ok && !e.Deleted && !e.Expired(utils.CurrentMillis()) {
+		return e.DataItem, nil
+	}
+	return DataItem{}, fmt.Errorf("key %s not exists", key)
+}
+
+func (s *LSMStorage) Del(key string, ver int64) (val DataItem, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.lookup(key)
+	if !ok || old.Deleted {
+		return DataItem{}, fmt.Errorf("key %s not exists", key)
+	}
+	if ver < old.Ver {
+		return DataItem{}, fmt.Errorf("ver %d is less than Store", ver)
+	}
+	s.count--
+	s.size -= entrySize(key, old.DataItem)
+	delete(s.expires, key)
+	s.put(key, lsmEntry{DataItem: DataItem{Ver: ver}, Deleted: true})
+	return old.DataItem, nil
+}
+
+func (s *LSMStorage) Expire(key string, at int64, ver int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	if !ok || e.Deleted {
+		return fmt.Errorf("key %s not exists", key)
+	}
+	if ver < e.Ver {
+		return fmt.Errorf("ver %d is less than Store", ver)
+	}
+	e.Exp = at
+	e.Ver = ver
+	s.index(key, at)
+	s.put(key, e)
+	return nil
+}
+
+func (s *LSMStorage) Expired(now int64, limit int) (keys []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, at := range s.expires {
+		if len(keys) >= limit {
+			break
+		}
+		if at > now {
+			continue
+		}
+		// the index saved may be newer than the tables after a crash
+		if e, ok := s.lookup(k); ok && !e.Deleted && e.Exp == at {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// iterate calls fn with the latest entry of each key in order, including
+// the expired ones, until fn returns false. The lock should be held.
+func (s *LSMStorage) iterate(fn func(key string, e lsmEntry) bool) error {
+	iters := make([]entryIter, 0, len(s.tables)+1)
+	iters = append(iters, &memIter{keys: sortedKeys(s.mem), mem: s.mem})
+	for _, t := range s.tables {
+		iters = append(iters, &tableIter{t: t})
+	}
+	it, err := newMergeIter(iters...)
+	if err != nil {
+		return err
+	}
+	for {
+		key, e, err := it.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !e.Deleted && !fn(key, e) {
+			return nil
+		}
+	}
+}
+
+func (s *LSMStorage) Keys() (keys []string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := utils.CurrentMillis()
+	keys = make([]string, 0, s.count)
+	err = s.iterate(func(key string, e lsmEntry) bool {
+		if !e.Expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Range iterates the keys in order
+func (s *LSMStorage) Range(fn func(key string, val DataItem) bool) {
+	s.AscendRange("", "", fn)
+}
+
+// AscendRange iterates the keys in [start, end) in order,
+// the range is unbounded if start or end is empty
+func (s *LSMStorage) AscendRange(start, end string, fn func(key string, val DataItem) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := utils.CurrentMillis()
+	err := s.iterate(func(key string, e lsmEntry) bool {
+		if key < start {
+			return true
+		}
+		if end != "" && key >= end {
+			return false
+		}
+		return e.Expired(now) || fn(key, e.DataItem)
+	})
+	if err != nil {
+		etlog.Log.WithError(err).Warn("iterate lsm storage failed")
+	}
+}
+
+func (s *LSMStorage) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
+
+func (s *LSMStorage) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// Sample picks the keys from random blocks, the access is not tracked
+// so that the lru and lfu policies are random with this engine
+func (s *LSMStorage) Sample(n int, volatile bool) []KeyStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := make([]KeyStat, 0, n)
+	for i := 0; i < n*2 && len(stats) < n; i++ {
+		var key string
+		var found bool
+		if volatile {
+			for k := range s.expires {
+				key, found = k, true
+				break
+			}
+		} else {
+			key, found = s.randomKey()
+		}
+		if !found {
+			break
+		}
+		if e, ok := s.lookup(key); ok && !e.Deleted {
+			stats = append(stats, KeyStat{Key: key, Size: entrySize(key, e.DataItem), Exp: e.Exp})
+		}
+	}
+	return stats
+}
+
+func (s *LSMStorage) randomKey() (string, bool) {
+	r := rand.Intn(len(s.tables) + 1)
+	if r == len(s.tables) || len(s.tables[r].index) == 0 {
+		for k := range s.mem {
+			return k, true
+		}
+		return "", false
+	}
+	t := s.tables[r]
+	block, err := t.readBlock(rand.Intn(len(t.index)))
+	if err != nil {
+		return "", false
+	}
+	keys := make([]string, 0)
+	for len(block) > 0 {
+		key, _, n, err := decodeRecord(block)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+		block = block[n:]
+	}
+	if len(keys) == 0 {
+		return "", false
+	}
+	return keys[rand.Intn(len(keys))], true
+}
+
+// Serialize returns the data in the format of Storage, which is
+// used by backups only since the data is in memory.
+func (s *LSMStorage) Serialize() (data []byte, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nodes := make(map[string]DataItem, s.count)
+	err = s.iterate(func(key string, e lsmEntry) bool {
+		nodes[key] = e.DataItem
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Nodes map[string]DataItem `json:"nodes"`
+	}{nodes})
+}
+
+// Load writes the data in the format of Storage, e.g. the snapshot
+// of memory engine, and flushes it
+func (s *LSMStorage) Load(data []byte) (err error) {
+	snap := struct {
+		Nodes map[string]DataItem `json:"nodes"`
+	}{}
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	for key, val := range snap.Nodes {
+		s.Set(key, val)
+	}
+	return s.Flush()
+}
+
+func (s *LSMStorage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// flush writes the memtable as a table of level 0, the lock should be held
+func (s *LSMStorage) flush() error {
+	if len(s.mem) == 0 {
+		return nil
+	}
+	id := s.nextId
+	filename := s.tablePath(id)
+	w, err := newTableWriter(filename)
+	if err != nil {
+		return err
+	}
+	// the tombstones shadow the keys of older tables only
+	dropTombstones := len(s.tables) == 0
+	for _, key := range sortedKeys(s.mem) {
+		e := s.mem[key]
+		if e.Deleted && dropTombstones {
+			continue
+		}
+		if err = w.add(key, e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.finish()
+	} else {
+		w.f.Close()
+	}
+	var t *sstable
+	if err == nil {
+		t, err = openTable(filename, id, 0)
+	}
+	if err != nil {
+		os.Remove(filename)
+		return errors.Wrap(err, "write sstable error")
+	}
+
+	s.nextId++
+	s.tables = append([]*sstable{t}, s.tables...)
+	s.mem = make(map[string]lsmEntry)
+	s.memSize = 0
+	s.flushedCount, s.flushedSize = s.count, s.size
+	if err = s.saveExpires(); err != nil {
+		return err
+	}
+	if err = s.saveManifest(); err != nil {
+		return err
+	}
+	select {
+	case s.compactC <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// saveManifest writes the manifest, the lock should be held
+func (s *LSMStorage) saveManifest() error {
+	m := &lsmManifest{
+		NextId: s.nextId,
+		Tables: make([]lsmTableMeta, 0, len(s.tables)),
+		Count:  s.flushedCount,
+		Size:   s.flushedSize,
+	}
+	for _, t := range s.tables {
+		m.Tables = append(m.Tables, lsmTableMeta{Id: t.id, Level: t.level})
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeFileSync(path.Join(s.dir, lsmManifestFile), content),
+		"write lsm manifest error")
+}
+
+func (s *LSMStorage) saveExpires() error {
+	var b []byte
+	for key, at := range s.expires {
+		b = appendUvarint(b, uint64(len(key)))
+		b = append(b, key...)
+		b = appendVarint(b, at)
+	}
+	return errors.Wrap(writeFileSync(path.Join(s.dir, lsmExpiresFile), b),
+		"write lsm expires error")
+}
+
+func (s *LSMStorage) loadExpires() error {
+	b, err := ioutil.ReadFile(path.Join(s.dir, lsmExpiresFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read lsm expires error")
+	}
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return errors.New("lsm expires is corrupt")
+		}
+		key := string(b[n : n+int(l)])
+		b = b[n+int(l):]
+		at, n := binary.Varint(b)
+		if n <= 0 {
+			return errors.New("lsm expires is corrupt")
+		}
+		b = b[n:]
+		s.expires[key] = at
+	}
+	return nil
+}
+
+func (s *LSMStorage) compactLoop() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.compactC:
+			for s.compact() {
+				select {
+				case <-s.stop:
+					return
+				default:
+				}
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// compact merges the tables of the lowest level having enough tables to
+// a table of the next level, returns false if there is nothing to merge.
+// The tables are immutable, so they are merged without the lock.
+func (s *LSMStorage) compact() bool {
+	s.mu.Lock()
+	var group []*sstable
+	for i := 0; i < len(s.tables); {
+		j := i
+		for j < len(s.tables) && s.tables[j].level == s.tables[i].level {
+			j++
+		}
+		if j-i >= lsmTablesPerLevel {
+			group = append(group, s.tables[i:j]...)
+			break
+		}
+		i = j
+	}
+	if len(group) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	// no older tables, which may have the keys deleted
+	oldest := group[len(group)-1] == s.tables[len(s.tables)-1]
+	id := s.nextId
+	s.nextId++
+	s.mu.Unlock()
+
+	level := group[0].level + 1
+	t, err := s.merge(id, level, group, oldest)
+	if err != nil {
+		etlog.Log.WithError(err).Warn("compact sstables failed")
+		return false
+	}
+
+	s.mu.Lock()
+	start := 0
+	for start < len(s.tables) && s.tables[start] != group[0] {
+		start++
+	}
+	tables := append([]*sstable{}, s.tables[:start]...)
+	if t != nil {
+		tables = append(tables, t)
+	}
+	s.tables = append(tables, s.tables[start+len(group):]...)
+	err = s.saveManifest()
+	s.mu.Unlock()
+	if err != nil {
+		etlog.Log.WithError(err).Warn("save manifest after compaction failed")
+		return false
+	}
+
+	// no reader of the merged tables since they're removed under the lock
+	for _, old := range group {
+		old.close()
+		s.cache.drop(old.id)
+		os.Remove(s.tablePath(old.id))
+	}
+	etlog.Log.WithField("tables", len(group)).WithField("level", level).Info("compact sstables success")
+	return true
+}
+
+// merge writes the latest entries of the tables ordered from the newest,
+// returns nil table if all entries are dropped
+func (s *LSMStorage) merge(id uint64, level int, group []*sstable, dropTombstones bool) (*sstable, error) {
+	iters := make([]entryIter, 0, len(group))
+	for _, t := range group {
+		iters = append(iters, &tableIter{t: t})
+	}
+	it, err := newMergeIter(iters...)
+	if err != nil {
+		return nil, err
+	}
+	filename := s.tablePath(id)
+	w, err := newTableWriter(filename)
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for {
+		key, e, err := it.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			w.f.Close()
+			os.Remove(filename)
+			return nil, err
+		}
+		if e.Deleted && dropTombstones {
+			continue
+		}
+		if err = w.add(key, e); err != nil {
+			w.f.Close()
+			os.Remove(filename)
+			return nil, err
+		}
+		count++
+	}
+	if err = w.finish(); err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+	if count == 0 {
+		os.Remove(filename)
+		return nil, nil
+	}
+	return openTable(filename, id, level)
+}
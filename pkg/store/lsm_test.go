@@ -0,0 +1,132 @@
+package store
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"testing"
+	"time"
+)
+
+func openLSM(t *testing.T, dataDir string) *LSMStorage {
+	s := NewLSMStorage(&config.Config{DataDir: dataDir, Engine: EngineLSM}, 0)
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	return s
+}
+
+func TestLSMStorage(t *testing.T) {
+	memtableSize, tablesPerLevel := lsmMemtableSize, lsmTablesPerLevel
+	lsmMemtableSize, lsmTablesPerLevel = 512, 2
+	defer func() { lsmMemtableSize, lsmTablesPerLevel = memtableSize, tablesPerLevel }()
+
+	dir := t.TempDir()
+	s := openLSM(t, dir)
+	for i := 0; i < 200; i++ {
+		s.Set(fmt.Sprintf("key-%03d", i), DataItem{Val: []byte(fmt.Sprintf("val-%d", i)), Ver: int64(i + 1)})
+	}
+	for i := 0; i < 200; i += 2 {
+		if _, err := s.Del(fmt.Sprintf("key-%03d", i), 1000); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+	}
+	if err := s.Expire("key-001", utils.CurrentMillis()-1, 1000); err != nil {
+		t.Fatalf("Expire() error = %v", err)
+	}
+	if _, exist := s.Set("key-003", DataItem{Val: []byte("stale"), Ver: 1}); !exist {
+		t.Error("Set() key-003 exist = false, want true")
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.RLock()
+		n := len(s.tables)
+		s.mu.RUnlock()
+		if n < 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Shutdown()
+
+	s = openLSM(t, dir)
+	defer s.Shutdown()
+	if s.Len() != 100 {
+		t.Errorf("Len() = %d, want 100", s.Len())
+	}
+	tests := []struct {
+		key   string
+		val   string
+		exist bool
+	}{
+		{"key-000", "", false},
+		{"key-001", "", false},
+		{"key-003", "val-3", true},
+		{"key-199", "val-199", true},
+		{"key-200", "", false},
+	}
+	for _, tt := range tests {
+		val, err := s.Get(tt.key)
+		if (err == nil) != tt.exist || string(val.Val) != tt.val {
+			t.Errorf("Get(%s) = %q, %v, want %q", tt.key, val.Val, err, tt.val)
+		}
+	}
+	if keys := s.Expired(utils.CurrentMillis(), 10); len(keys) != 1 || keys[0] != "key-001" {
+		t.Errorf("Expired() = %v, want [key-001]", keys)
+	}
+
+	var keys []string
+	s.AscendRange("key-100", "key-110", func(key string, val DataItem) bool {
+		keys = append(keys, key)
+		return true
+	})
+	want := []string{"key-101", "key-103", "key-105", "key-107", "key-109"}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("AscendRange() = %v, want %v", keys, want)
+	}
+}
+
+func TestSyncer_LSMRecover(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir(), Engine: EngineLSM, ShutdownTimeout: 5}
+	s := startSyncer(t, conf)
+	txId := utils.GenerateId()
+	for i := 0; i < 10; i++ {
+		txId++
+		req := &common.TxRequest{TxId: txId, Flag: common.FlagReq, Action: common.SET,
+			Key: fmt.Sprintf("key-%d", i), Val: []byte(fmt.Sprintf("val-%d", i))}
+		if err := s.Submit(req); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+		// writes after the snapshot are replayed from the tx file
+		if i == 5 {
+			for s.LastTxId() != txId {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err := s.Snapshot(); err != nil {
+				t.Fatalf("Snapshot() error = %v", err)
+			}
+		}
+	}
+	txId++
+	if err := s.Submit(&common.TxRequest{TxId: txId, Flag: common.FlagReq, Action: common.DEL, Key: "key-0"}); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.LastTxId() != txId && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Shutdown()
+
+	s = startSyncer(t, conf)
+	defer s.Shutdown()
+	if s.Store.Len() != 9 || s.LastTxId() != txId {
+		t.Errorf("recovered %d keys to tx %d, want 9 keys to tx %d", s.Store.Len(), s.LastTxId(), txId)
+	}
+	if val, err := s.Store.Get("key-9"); err != nil || string(val.Val) != "val-9" {
+		t.Errorf("Get(key-9) = %q, %v, want val-9", val.Val, err)
+	}
+}
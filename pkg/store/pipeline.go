@@ -0,0 +1,395 @@
+package store
+
+import (
+	"context"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/metrics"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// the backoff of retrying the failed pushes
+const (
+	minPushBackoff = 100 * time.Millisecond
+	maxPushBackoff = 5 * time.Second
+)
+
+var errClientClosed = errors.New("client closed")
+
+// pushItem is a request queued for the peer at the time
+type pushItem struct {
+	id  int64
+	req *common.TxRequest
+	at  time.Time
+}
+
+// pushStream is the state of a stream to the peer, guarded by ec.mu
+type pushStream struct {
+	// sent counts the items from the head of queue sent on the stream
+	// and not acknowledged yet
+	sent int
+	// err is set once the stream is broken
+	err error
+}
+
+// Push queues the request for the peer without blocking. The requests are
+// pushed in order, and dequeued only when the peer acknowledges them, so
+// the ones not acknowledged are sent again before the later ones. The
+// requests are dropped while the peer is down.
+func (ec *EvolvestClient) Push(req *common.TxRequest) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.closed {
+		return
+	}
+	if ec.down {
+		metrics.ReplicationDropped.WithLabelValues(ec.addr).Inc()
+		return
+	}
+	ec.queue = append(ec.queue, pushItem{id: req.TxId, req: req, at: time.Now()})
+	ec.queued()
+	ec.cond.Signal()
+}
+
+// queued updates the count of pending requests, ec.mu should be held
+func (ec *EvolvestClient) queued() {
+	atomic.StoreInt64(&ec.pending, int64(len(ec.queue)))
+	metrics.ReplicationQueueDepth.WithLabelValues(ec.addr).Set(float64(len(ec.queue)))
+}
+
+// Full tells whether the requests queued reach the max pending, the
+// writes should be refused until the peer catches up
+func (ec *EvolvestClient) Full() bool {
+	return atomic.LoadInt64(&ec.pending) >= int64(ec.cfg.Replication.MaxPendingSize())
+}
+
+// Drain waits for the pending pushes until deadline,
+// returns count of the ones left
+func (ec *EvolvestClient) Drain(deadline time.Time) int64 {
+	for time.Now().Before(deadline) {
+		if left := atomic.LoadInt64(&ec.pending); left <= 0 {
+			return 0
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return atomic.LoadInt64(&ec.pending)
+}
+
+// Process streams the queued requests in order until the client is
+// closed, and reconnects with backoff once the stream is broken, resuming
+// from the first request not acknowledged. The peers not serving the
+// stream are pushed by unary calls instead.
+func (ec *EvolvestClient) Process() {
+	go func() {
+		var backoff time.Duration
+		for {
+			if backoff > 0 {
+				select {
+				case <-ec.shutdown:
+					return
+				case <-time.After(backoff):
+				}
+			}
+			var err error
+			if ec.unary {
+				err = ec.pushNext()
+			} else {
+				err = ec.stream()
+			}
+			select {
+			case <-ec.shutdown:
+				return
+			default:
+			}
+			if err == nil {
+				backoff = 0
+				continue
+			}
+			if !ec.unary && status.Code(err) == codes.Unimplemented {
+				etlog.Log.WithField("addr", ec.addr).Info("peer does not serve stream, push by calls")
+				ec.unary = true
+				backoff = 0
+				continue
+			}
+			if status.Code(err) == codes.InvalidArgument {
+				ec.skip(err)
+				backoff = 0
+				continue
+			}
+			ec.fail(err)
+			if backoff *= 2; backoff < minPushBackoff {
+				backoff = minPushBackoff
+			} else if backoff > maxPushBackoff {
+				backoff = maxPushBackoff
+			}
+		}
+	}()
+}
+
+// stream opens a stream to the peer, and sends the queued requests until
+// it's broken. At most a window of requests are in flight, the peer
+// acknowledges the last one applied.
+func (ec *EvolvestClient) stream() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ec.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	stream, err := ec.client.Stream(ctx)
+	if err != nil {
+		return err
+	}
+
+	ps := &pushStream{}
+	ec.mu.Lock()
+	ec.cur = ps
+	ec.mu.Unlock()
+	defer func() {
+		ec.mu.Lock()
+		ec.cur = nil
+		ec.mu.Unlock()
+	}()
+
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				ec.mu.Lock()
+				ps.err = err
+				ec.cond.Broadcast()
+				ec.mu.Unlock()
+				return
+			}
+			ec.ackStream(ps, resp.AckedTxId)
+		}
+	}()
+
+	for {
+		records, err := ec.window(ps)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&evolvest.StreamRequest{Records: records}); err == io.EOF {
+			// the stream is closed by the peer, whose status is got by Recv
+			_, err = ec.window(ps)
+			return err
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// window waits for the requests not sent on the stream while less than a
+// window are in flight, and returns them as records
+func (ec *EvolvestClient) window(ps *pushStream) ([]*evolvest.TxRecord, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	n := ec.cfg.Replication.WindowSize()
+	for ps.err == nil && !ec.closed && (ps.sent >= len(ec.queue) || ps.sent >= n) {
+		ec.cond.Wait()
+	}
+	if ec.closed {
+		return nil, errClientClosed
+	}
+	if ps.err != nil {
+		return nil, ps.err
+	}
+	if n > len(ec.queue) {
+		n = len(ec.queue)
+	}
+	records := make([]*evolvest.TxRecord, 0, n-ps.sent)
+	for _, item := range ec.queue[ps.sent:n] {
+		records = append(records, NewTxRecord(item.req))
+	}
+	ps.sent = n
+	return records, nil
+}
+
+// pushNext pushes a window of requests from the head by a unary call
+func (ec *EvolvestClient) pushNext() error {
+	items, ok := ec.next()
+	if !ok {
+		return errClientClosed
+	}
+	acked, err := ec.push(items)
+	if err != nil {
+		return err
+	}
+	ec.ack(acked)
+	return nil
+}
+
+// next waits for the requests queued, and returns a window of them from
+// the head. An empty window probes the peer while it's down.
+func (ec *EvolvestClient) next() ([]pushItem, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	for len(ec.queue) == 0 && !ec.down && !ec.closed {
+		ec.cond.Wait()
+	}
+	if ec.closed {
+		return nil, false
+	}
+	n := ec.cfg.Replication.WindowSize()
+	if n > len(ec.queue) {
+		n = len(ec.queue)
+	}
+	return append([]pushItem{}, ec.queue[:n]...), true
+}
+
+// push pushes the items, and returns the count of them acknowledged
+func (ec *EvolvestClient) push(items []pushItem) (int, error) {
+	req := &evolvest.PushRequest{TxCmds: make([]string, len(items))}
+	for i, item := range items {
+		req.TxCmds[i] = FormatTx(item.req)
+	}
+	resp, err := ec.CallGrpcWithTimeout(func(ctx context.Context) (interface{}, error) {
+		return ec.client.Push(ctx, req)
+	})
+	if err != nil {
+		return 0, err
+	}
+	pushResp, ok := resp.(*evolvest.PushResponse)
+	if !ok {
+		return 0, errors.New("type convert error")
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	if pushResp.Ok {
+		// all accepted, older nodes do not ack by tx id
+		return len(items), nil
+	}
+	n := position(items, pushResp.AckedTxId)
+	if n == 0 {
+		return 0, errors.New("none is accepted by peer")
+	}
+	return n, nil
+}
+
+// position returns the count of items up to the one of tx id acknowledged,
+// 0 if none. The tx ids are not in order of the queue, which are generated
+// before submitting, wrap within a millisecond or come from the clocks of
+// peers, so the acknowledged one is found by its position rather than
+// compared. The first one of a repeated tx id is taken, acknowledging
+// fewer at worst, whose requests are pushed again.
+func position(items []pushItem, txId int64) int {
+	if txId == 0 {
+		return 0
+	}
+	for i, item := range items {
+		if item.id == txId {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// ackStream dequeues the requests sent on the stream up to the one of tx
+// id acknowledged by the peer
+func (ec *EvolvestClient) ackStream(ps *pushStream, txId int64) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	sent := ps.sent
+	if sent > len(ec.queue) {
+		sent = len(ec.queue)
+	}
+	ec.dequeue(position(ec.queue[:sent], txId))
+}
+
+// ack dequeues the first n requests acknowledged by the peer, 0
+// acknowledges none but tells the peer is reachable
+func (ec *EvolvestClient) ack(n int) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.dequeue(n)
+}
+
+// dequeue dequeues the first n requests, ec.mu should be held
+func (ec *EvolvestClient) dequeue(n int) {
+	if ec.down {
+		etlog.Log.WithField("addr", ec.addr).Warn("peer is back, repair the writes dropped by anti-entropy")
+		ec.down = false
+	}
+	ec.failing = time.Time{}
+	if n > len(ec.queue) {
+		n = len(ec.queue)
+	}
+	if n == 0 {
+		return
+	}
+	acked := ec.queue[n-1].id
+	ec.queue = ec.queue[n:]
+	ec.queued()
+	if ec.cur != nil {
+		if ec.cur.sent -= n; ec.cur.sent < 0 {
+			ec.cur.sent = 0
+		}
+	}
+	ec.cond.Broadcast()
+	atomic.StoreInt64(&ec.lastPushed, acked)
+}
+
+// Lag returns how long the oldest request not acknowledged by the peer
+// has been queued, 0 if none. It's measured by the local clock rather
+// than the tx id, which is skewed by the clocks of peers.
+func (ec *EvolvestClient) Lag() time.Duration {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if len(ec.queue) == 0 {
+		return 0
+	}
+	return time.Since(ec.queue[0].at)
+}
+
+// skip drops the first request not acknowledged, which is refused by the
+// peer as invalid, so that the later ones are not blocked by it
+func (ec *EvolvestClient) skip(err error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if len(ec.queue) == 0 {
+		return
+	}
+	etlog.Log.WithError(err).WithField("addr", ec.addr).WithField("tx_id", ec.queue[0].id).
+		Warn("tx request refused by peer, skip it")
+	metrics.ReplicationDropped.WithLabelValues(ec.addr).Inc()
+	ec.queue = ec.queue[1:]
+	ec.queued()
+}
+
+// fail records the failed push, and drops the queue once the peer fails
+// longer than the peer timeout, so that the writes are not refused
+// because of a peer down
+func (ec *EvolvestClient) fail(err error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	log := etlog.Log.WithError(err).WithField("addr", ec.addr).WithField("pending", len(ec.queue))
+	now := time.Now()
+	if ec.failing.IsZero() {
+		ec.failing = now
+	}
+	if ec.down {
+		log.Debug("probe peer failed")
+		return
+	}
+	metrics.ReplicationRetries.WithLabelValues(ec.addr).Inc()
+	if now.Sub(ec.failing) < ec.cfg.Replication.PeerTimeoutDuration() {
+		log.Info("push tx request to remote failed, retry")
+		return
+	}
+	ec.down = true
+	metrics.ReplicationDropped.WithLabelValues(ec.addr).Add(float64(len(ec.queue)))
+	log.Warn("peer is down, drop the pushes until it's back")
+	ec.queue = nil
+	ec.queued()
+}
@@ -0,0 +1,341 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePeer accepts at most accept commands of a push, or fails the
+// pushes while down
+type fakePeer struct {
+	evolvest.EvolvestServiceClient
+	mu       sync.Mutex
+	accept   int
+	down     bool
+	received []string
+	windows  []int
+}
+
+func (p *fakePeer) Push(ctx context.Context, in *evolvest.PushRequest, opts ...grpc.CallOption) (*evolvest.PushResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return nil, errors.New("unavailable")
+	}
+	p.windows = append(p.windows, len(in.TxCmds))
+	n := len(in.TxCmds)
+	if n > p.accept {
+		n = p.accept
+	}
+	p.received = append(p.received, in.TxCmds[:n]...)
+	if n == len(in.TxCmds) {
+		return &evolvest.PushResponse{Ok: true}, nil
+	}
+	req, _ := ParseTx(in.TxCmds[n-1])
+	return &evolvest.PushResponse{AckedTxId: req.TxId}, nil
+}
+
+// Stream is not served, so that the requests are pushed by calls
+func (p *fakePeer) Stream(ctx context.Context, opts ...grpc.CallOption) (evolvest.EvolvestService_StreamClient, error) {
+	return nil, status.Error(codes.Unimplemented, "unknown method Stream")
+}
+
+func newTestClient(peer *fakePeer, repl config.ReplicationConfig) *EvolvestClient {
+	ec := NewEvolvestClient(&config.Config{Replication: repl}, "fake")
+	ec.client = peer
+	return ec
+}
+
+func TestEvolvestClient_Unary(t *testing.T) {
+	peer := &fakePeer{accept: 2}
+	ec := newTestClient(peer, config.ReplicationConfig{Window: 3, MaxPending: 5})
+	defer ec.Close()
+
+	var want []string
+	for i := 1; i <= 5; i++ {
+		req := &common.TxRequest{TxId: int64(i), Action: common.SET, Key: fmt.Sprintf("k%d", i), Val: []byte("1")}
+		want = append(want, FormatTx(req))
+		ec.Push(req)
+	}
+	if !ec.Full() {
+		t.Errorf("Full() = false, want true")
+	}
+
+	ec.Process()
+	if left := ec.Drain(time.Now().Add(5 * time.Second)); left != 0 {
+		t.Fatalf("Drain() = %d, want 0", left)
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	// partially accepted windows are pushed again from the first not acked
+	if !reflect.DeepEqual(peer.received, want) {
+		t.Errorf("received = %v, want %v", peer.received, want)
+	}
+	if !reflect.DeepEqual(peer.windows, []int{3, 3, 1}) {
+		t.Errorf("windows = %v, want [3 3 1]", peer.windows)
+	}
+	if ec.Full() || ec.Status().LastPushed != 5 {
+		t.Errorf("Full() = %v, LastPushed = %d, want false, 5", ec.Full(), ec.Status().LastPushed)
+	}
+}
+
+func TestEvolvestClient_Down(t *testing.T) {
+	peer := &fakePeer{accept: 10, down: true}
+	ec := newTestClient(peer, config.ReplicationConfig{MaxPending: 2, PeerTimeout: 1})
+	defer ec.Close()
+	ec.Push(&common.TxRequest{TxId: 1, Action: common.SET, Key: "a"})
+	ec.Push(&common.TxRequest{TxId: 2, Action: common.SET, Key: "b"})
+
+	items, _ := ec.next()
+	_, err := ec.push(items)
+	ec.fail(err)
+	if ec.Status().Down || !ec.Full() {
+		t.Fatalf("Down = %v, Full() = %v, want retried before peer timeout", ec.Status().Down, ec.Full())
+	}
+	ec.mu.Lock()
+	ec.failing = time.Now().Add(-2 * time.Second)
+	ec.mu.Unlock()
+	ec.fail(err)
+	if !ec.Status().Down || ec.Full() {
+		t.Fatalf("Down = %v, Full() = %v, want queue dropped", ec.Status().Down, ec.Full())
+	}
+	ec.Push(&common.TxRequest{TxId: 3, Action: common.SET, Key: "c"})
+	if ec.Status().Pending != 0 {
+		t.Errorf("Pending = %d, want dropped while down", ec.Status().Pending)
+	}
+
+	// an empty probe brings the peer back
+	peer.mu.Lock()
+	peer.down = false
+	peer.mu.Unlock()
+	items, _ = ec.next()
+	acked, err := ec.push(items)
+	if err != nil {
+		t.Fatalf("push() error = %v", err)
+	}
+	ec.ack(acked)
+	if ec.Status().Down {
+		t.Errorf("Down = true, want back")
+	}
+}
+
+func TestEvolvestClient_OutOfOrder(t *testing.T) {
+	peer := &fakePeer{accept: 2}
+	ec := newTestClient(peer, config.ReplicationConfig{Window: 4})
+	defer ec.Close()
+	// queued out of order of tx id, as the ones generated concurrently
+	ids := []int64{101, 100, 103, 102}
+	var want []string
+	for _, id := range ids {
+		req := &common.TxRequest{TxId: id, Action: common.SET, Key: fmt.Sprintf("k%d", id), Val: []byte("1")}
+		want = append(want, FormatTx(req))
+		ec.Push(req)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ec.pushNext(); err != nil {
+			t.Fatalf("pushNext() error = %v", err)
+		}
+	}
+	peer.mu.Lock()
+	if !reflect.DeepEqual(peer.received, want) {
+		t.Errorf("received = %v, want %v", peer.received, want)
+	}
+	peer.mu.Unlock()
+	if n := ec.Status().Pending; n != 0 {
+		t.Errorf("Pending = %d, want 0", n)
+	}
+
+	// a stream acks the one sent, not the ones of lower tx ids
+	for _, id := range []int64{101, 100} {
+		ec.Push(&common.TxRequest{TxId: id, Action: common.SET, Key: "a"})
+	}
+	ps := &pushStream{sent: 1}
+	ec.ackStream(ps, 101)
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if len(ec.queue) != 1 || ec.queue[0].id != 100 {
+		t.Errorf("queue = %v, want 100 left", ec.queue)
+	}
+}
+
+func TestEvolvestClient_Lag(t *testing.T) {
+	ec := newTestClient(&fakePeer{}, config.ReplicationConfig{})
+	defer ec.Close()
+	if lag := ec.Lag(); lag != 0 {
+		t.Errorf("Lag() = %v, want 0 if none queued", lag)
+	}
+	// the tx ids of skewed clocks don't matter
+	ec.Push(&common.TxRequest{TxId: 1, Action: common.SET, Key: "a"})
+	ec.Push(&common.TxRequest{TxId: 2, Action: common.SET, Key: "b"})
+	ec.mu.Lock()
+	ec.queue[0].at = time.Now().Add(-3 * time.Second)
+	ec.queue[1].at = time.Now().Add(-time.Second)
+	ec.mu.Unlock()
+
+	if lag := ec.Lag(); lag < 3*time.Second || lag > 4*time.Second {
+		t.Errorf("Lag() = %v, want the oldest not acked", lag)
+	}
+	ec.ack(1)
+	if lag := ec.Status().LagSeconds; lag < 1 || lag > 2 {
+		t.Errorf("LagSeconds = %v, want the oldest not acked", lag)
+	}
+	ec.ack(1)
+	if lag := ec.Lag(); lag != 0 {
+		t.Errorf("Lag() = %v, want 0 once acked", lag)
+	}
+}
+
+// streamPeer applies the records streamed in order of tx id, and breaks
+// the first stream after receiving breakAfter records without acking.
+// The record of tx id invalid is refused after acking the ones before.
+type streamPeer struct {
+	evolvest.UnimplementedEvolvestServiceServer
+	mu         sync.Mutex
+	breakAfter int
+	invalid    int64
+	received   int
+	streams    int
+	maxWindow  int
+	applied    []int64
+}
+
+func (p *streamPeer) Stream(stream evolvest.EvolvestService_StreamServer) error {
+	p.mu.Lock()
+	p.streams++
+	p.mu.Unlock()
+	if err := stream.Send(&evolvest.StreamResponse{}); err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		if len(req.Records) > p.maxWindow {
+			p.maxWindow = len(req.Records)
+		}
+		p.received += len(req.Records)
+		if p.breakAfter > 0 && p.received >= p.breakAfter {
+			p.breakAfter = 0
+			p.mu.Unlock()
+			return status.Error(codes.Unavailable, "broken")
+		}
+		var last int64
+		for _, rec := range req.Records {
+			if rec.TxId == p.invalid {
+				p.mu.Unlock()
+				if last > 0 {
+					if err := stream.Send(&evolvest.StreamResponse{AckedTxId: last}); err != nil {
+						return err
+					}
+				}
+				return status.Error(codes.InvalidArgument, "invalid")
+			}
+			if n := len(p.applied); n == 0 || rec.TxId > p.applied[n-1] {
+				p.applied = append(p.applied, rec.TxId)
+			}
+			last = rec.TxId
+		}
+		p.mu.Unlock()
+		if err := stream.Send(&evolvest.StreamResponse{AckedTxId: last}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestEvolvestClient_Stream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &streamPeer{breakAfter: 5}
+	srv := grpc.NewServer()
+	evolvest.RegisterEvolvestServiceServer(srv, peer)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	ec := NewEvolvestClient(&config.Config{Replication: config.ReplicationConfig{Window: 4}}, ln.Addr().String())
+	if err := ec.StartClient(); err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+	var want []int64
+	for i := 1; i <= 20; i++ {
+		ec.Push(&common.TxRequest{TxId: int64(i), Action: common.SET, Key: fmt.Sprintf("k%d", i), Val: []byte("1")})
+		want = append(want, int64(i))
+	}
+	if left := ec.Drain(time.Now().Add(5 * time.Second)); left != 0 {
+		t.Fatalf("Drain() = %d, want 0", left)
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	// resumed from the first one not acked after reconnecting
+	if !reflect.DeepEqual(peer.applied, want) {
+		t.Errorf("applied = %v, want %v", peer.applied, want)
+	}
+	if peer.streams != 2 || peer.maxWindow > 4 {
+		t.Errorf("streams = %d, max window = %d, want 2, <= 4", peer.streams, peer.maxWindow)
+	}
+}
+
+func TestEvolvestClient_StreamInvalid(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &streamPeer{invalid: 3}
+	srv := grpc.NewServer()
+	evolvest.RegisterEvolvestServiceServer(srv, peer)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	ec := NewEvolvestClient(&config.Config{}, ln.Addr().String())
+	if err := ec.StartClient(); err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+	for i := 1; i <= 5; i++ {
+		ec.Push(&common.TxRequest{TxId: int64(i), Action: common.SET, Key: fmt.Sprintf("k%d", i), Val: []byte("1")})
+	}
+	if left := ec.Drain(time.Now().Add(5 * time.Second)); left != 0 {
+		t.Fatalf("Drain() = %d, want 0", left)
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	// the refused one is skipped rather than pushed again
+	if want := []int64{1, 2, 4, 5}; !reflect.DeepEqual(peer.applied, want) {
+		t.Errorf("applied = %v, want %v", peer.applied, want)
+	}
+}
+
+// fullSender is a sender whose peers are always behind
+type fullSender struct {
+	Sender
+}
+
+func (fullSender) Full() bool { return true }
+
+func TestSyncer_Backpressure(t *testing.T) {
+	s := &Syncer{sender: fullSender{}, reqC: make(chan *common.TxRequest, 1)}
+	if err := s.Submit(&common.TxRequest{Flag: common.FlagReq, Action: common.DEL, Key: "a"}); err != ErrBackpressure {
+		t.Errorf("Submit() error = %v, want %v", err, ErrBackpressure)
+	}
+	if err := s.Submit(&common.TxRequest{Flag: common.FlagSync, Action: common.DEL, Key: "a"}); err != nil {
+		t.Errorf("Submit() of synced error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,683 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/compress"
+	"github.com/edditen/evolvest/pkg/dump"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redisScheme prefixes the upstream of a redis primary
+const redisScheme = "redis://"
+
+var (
+	redisRetryInterval = time.Second
+	redisAckInterval   = time.Second
+	// redisTimeout is the timeout of reading from primary,
+	// which pings every 10 seconds by default
+	redisTimeout = 60 * time.Second
+)
+
+// ParseRedisUpstream parses the upstream in form of
+// redis://[user:password@]host[:port], returns false if it's not redis
+func ParseRedisUpstream(upstream string) (*url.URL, bool) {
+	if !strings.HasPrefix(strings.ToLower(upstream), redisScheme) {
+		return nil, false
+	}
+	u, err := url.Parse(upstream)
+	if err != nil || u.Hostname() == "" {
+		return nil, false
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	return u, true
+}
+
+// UpstreamAddr returns the address of upstream, without the scheme and
+// credentials of redis
+func UpstreamAddr(upstream string) string {
+	if u, ok := ParseRedisUpstream(upstream); ok {
+		return u.Host
+	}
+	return upstream
+}
+
+// redisLink follows a redis primary by its replication protocol. The full
+// data and the command stream are applied through the syncer as sync
+// requests, and sent to the peers as well since current node is their
+// only entry.
+type redisLink struct {
+	r        *Replicator
+	addr     string
+	user     string
+	password string
+	log      etlog.Logger
+
+	conn net.Conn
+	rd   *bufio.Reader
+	wmu  sync.Mutex
+	// replId and offset are of the stream applied, for partial resync
+	replId string
+	offset int64
+	psync  bool
+	db     int
+	// lastTxId is of the last request submitted
+	lastTxId int64
+	warned   map[string]bool
+}
+
+func newRedisLink(r *Replicator, u *url.URL) *redisLink {
+	l := &redisLink{
+		r:      r,
+		addr:   u.Host,
+		log:    etlog.Log.WithField("upstream", u.Host),
+		replId: "?",
+		offset: -1,
+		warned: make(map[string]bool),
+	}
+	if u.User != nil {
+		l.user = u.User.Username()
+		l.password, _ = u.User.Password()
+	}
+	return l
+}
+
+// process connects to the primary until stopped, a partial resync is
+// tried after the link is broken
+func (l *redisLink) process(stop <-chan interface{}) {
+	for {
+		err := l.run(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		l.log.WithError(err).Warn("link to redis primary broken")
+		l.r.setState(StateConnect)
+		select {
+		case <-stop:
+			return
+		case <-time.After(redisRetryInterval):
+		}
+	}
+}
+
+func (l *redisLink) run(stop <-chan interface{}) error {
+	conn, err := net.DialTimeout("tcp", l.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	l.wmu.Lock()
+	l.conn = conn
+	l.wmu.Unlock()
+	l.rd = bufio.NewReaderSize(conn, 64*1024)
+	done := make(chan interface{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	if err = l.handshake(); err != nil {
+		return err
+	}
+	if l.psync {
+		go l.ackLoop(done)
+	}
+	l.r.setState(StateConnected)
+	return l.stream()
+}
+
+// handshake authenticates, and syncs the full data if the partial
+// resync is not accepted
+func (l *redisLink) handshake() error {
+	if l.password != "" {
+		args := []string{"AUTH", l.password}
+		if l.user != "" {
+			args = []string{"AUTH", l.user, l.password}
+		}
+		if _, err := l.call(args...); err != nil {
+			return errors.Wrap(err, "auth error")
+		}
+	}
+	if _, err := l.call("PING"); err != nil {
+		return errors.Wrap(err, "ping error")
+	}
+	// the errors are ignored by old versions
+	l.call("REPLCONF", "listening-port", l.r.cfg.ServerPort)
+	l.call("REPLCONF", "capa", "eof", "capa", "psync2")
+
+	offset := "-1"
+	if l.replId != "?" {
+		offset = strconv.FormatInt(atomic.LoadInt64(&l.offset)+1, 10)
+	}
+	reply, err := l.call("PSYNC", l.replId, offset)
+	if err != nil && strings.HasPrefix(err.Error(), "ERR") {
+		// no psync before redis 2.8
+		l.log.Info("psync not supported, fallback to sync")
+		l.psync = false
+		if err = l.send("SYNC"); err != nil {
+			return err
+		}
+		return l.fullSync()
+	} else if err != nil {
+		return errors.Wrap(err, "psync error")
+	}
+	l.psync = true
+	fields := strings.Fields(reply)
+	switch {
+	case fields[0] == "CONTINUE":
+		if len(fields) > 1 {
+			l.replId = fields[1]
+		}
+		l.log.WithField("offset", offset).Info("partial resync from redis primary")
+		return nil
+	case fields[0] == "FULLRESYNC" && len(fields) == 3:
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid reply of psync '%s'", reply)
+		}
+		l.replId = fields[1]
+		atomic.StoreInt64(&l.offset, offset)
+		return l.fullSync()
+	}
+	return fmt.Errorf("invalid reply of psync '%s'", reply)
+}
+
+// fullSync loads the rdb sent by primary, and deletes the local keys not
+// in it, which are the keys older than the sync
+func (l *redisLink) fullSync() error {
+	l.r.setState(StateSync)
+	// the newlines are sent while the rdb is being generated
+	var line string
+	for line == "" {
+		l.conn.SetReadDeadline(time.Now().Add(redisTimeout))
+		text, err := l.rd.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "read rdb error")
+		}
+		line = strings.TrimRight(text, "\r\n")
+	}
+	if line[0] == '-' {
+		return errors.New(line[1:])
+	} else if line[0] != '$' {
+		return fmt.Errorf("invalid rdb header '%s'", line)
+	}
+
+	var src io.Reader = l.rd
+	var eofMark []byte
+	if strings.HasPrefix(line, "$EOF:") {
+		// diskless, the rdb is ended by the mark
+		eofMark = []byte(line[5:])
+	} else {
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rdb header '%s'", line)
+		}
+		src = io.LimitReader(l.rd, n)
+	}
+
+	start := utils.GenerateId()
+	dec, err := dump.NewRDBDecoder(src)
+	if err != nil {
+		return err
+	}
+	l.db = 0
+	keys := 0
+	now := utils.CurrentMillis()
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(redisTimeout))
+		entry, err := dec.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "load rdb error")
+		}
+		if entry.DB >= len(l.r.dbs) || entry.ExpireAt > 0 && entry.ExpireAt <= now {
+			continue
+		}
+		l.db = entry.DB
+		if err = l.set(entry.Key, entry.Val, entry.ExpireAt); err != nil {
+			return err
+		}
+		keys++
+	}
+	if eofMark != nil {
+		mark := make([]byte, len(eofMark))
+		if _, err = io.ReadFull(l.rd, mark); err != nil || !bytes.Equal(mark, eofMark) {
+			return errors.New("rdb is not ended by the mark")
+		}
+	} else if _, err = io.Copy(ioutil.Discard, src); err != nil {
+		return err
+	}
+
+	// the stale keys are the ones written before the sync
+	if err = l.waitApplied(); err != nil {
+		return err
+	}
+	stale := 0
+	for i, st := range l.r.dbs {
+		l.db = i
+		allKeys, _ := st.Keys()
+		for _, key := range allKeys {
+			if val, err := st.Get(key); err == nil && val.Ver < start {
+				if err = l.submit(common.DEL, key, nil); err != nil {
+					return err
+				}
+				stale++
+			}
+		}
+	}
+	l.db = 0
+	l.log.WithField("keys", keys).WithField("stale", stale).
+		WithField("skipped", dec.Skipped()).Info("full sync from redis primary success")
+	return nil
+}
+
+// stream applies the commands from primary
+func (l *redisLink) stream() error {
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(redisTimeout))
+		args, n, err := readCommand(l.rd)
+		if err != nil {
+			return err
+		}
+		if len(args) > 0 {
+			if err = l.apply(args); err != nil {
+				return err
+			}
+		}
+		atomic.AddInt64(&l.offset, int64(n))
+	}
+}
+
+func (l *redisLink) ackLoop(done <-chan interface{}) {
+	ticker := time.NewTicker(redisAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			l.ack()
+		}
+	}
+}
+
+func (l *redisLink) ack() {
+	offset := strconv.FormatInt(atomic.LoadInt64(&l.offset), 10)
+	if err := l.send("REPLCONF", "ACK", offset); err != nil {
+		l.log.WithError(err).Warn("ack to redis primary failed")
+	}
+}
+
+// send writes a command without reading the reply
+func (l *redisLink) send(args ...string) error {
+	var b bytes.Buffer
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	l.conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+	_, err := l.conn.Write(b.Bytes())
+	return err
+}
+
+// call sends a command during handshake and reads the status reply
+func (l *redisLink) call(args ...string) (string, error) {
+	if err := l.send(args...); err != nil {
+		return "", err
+	}
+	l.conn.SetReadDeadline(time.Now().Add(redisTimeout))
+	line, err := l.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+	if line[0] == '-' {
+		return "", errors.New(line[1:])
+	}
+	return line[1:], nil
+}
+
+// readCommand reads a command of array, returns the count of bytes read,
+// and no args for the newlines
+func readCommand(rd *bufio.Reader) (args [][]byte, n int, err error) {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	n = len(line)
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, n, nil
+	}
+	if line[0] != '*' {
+		return nil, n, fmt.Errorf("invalid command '%s'", line)
+	}
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count < 0 {
+		return nil, n, fmt.Errorf("invalid array length '%s'", line[1:])
+	}
+	args = make([][]byte, count)
+	for i := range args {
+		head, err := rd.ReadBytes('\n')
+		if err != nil {
+			return nil, n, err
+		}
+		n += len(head)
+		head = bytes.TrimRight(head, "\r\n")
+		if len(head) == 0 || head[0] != '$' {
+			return nil, n, fmt.Errorf("invalid bulk '%s'", head)
+		}
+		size, err := strconv.Atoi(string(head[1:]))
+		if err != nil || size < 0 || size > 512*1024*1024 {
+			return nil, n, fmt.Errorf("invalid bulk length '%s'", head[1:])
+		}
+		b := make([]byte, size+2)
+		if _, err = io.ReadFull(rd, b); err != nil {
+			return nil, n, err
+		}
+		n += len(b)
+		args[i] = b[:size]
+	}
+	return args, n, nil
+}
+
+func (l *redisLink) submit(action, key string, val []byte) error {
+	l.lastTxId = utils.GenerateId()
+	return l.r.submit(&common.TxRequest{
+		TxId:   l.lastTxId,
+		Flag:   common.FlagSync,
+		Action: action,
+		Key:    key,
+		Val:    val,
+		Db:     l.db,
+	})
+}
+
+// set submits the value, with the expiry unless at is 0
+func (l *redisLink) set(key string, val []byte, at int64) error {
+	if err := l.submit(common.SET, key, val); err != nil {
+		return err
+	}
+	if at > 0 {
+		return l.expire(key, at)
+	}
+	return nil
+}
+
+func (l *redisLink) expire(key string, at int64) error {
+	if at > 0 && at <= utils.CurrentMillis() {
+		return l.submit(common.DEL, key, nil)
+	}
+	return l.submit(common.EXPIRE, key, []byte(strconv.FormatInt(at, 10)))
+}
+
+// waitApplied waits until the submitted requests are applied, before
+// reading the store
+func (l *redisLink) waitApplied() error {
+	deadline := time.Now().Add(redisTimeout)
+	for l.r.applied() < l.lastTxId {
+		if time.Now().After(deadline) {
+			return errors.New("wait for requests applied timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// current returns the value of key decompressed, after the submitted
+// requests applied
+func (l *redisLink) current(key string) (DataItem, bool, error) {
+	if err := l.waitApplied(); err != nil {
+		return DataItem{}, false, err
+	}
+	val, err := l.r.dbs[l.db].Get(key)
+	if err != nil {
+		return DataItem{}, false, nil
+	}
+	if val.Val, err = val.Value(); err != nil {
+		return DataItem{}, false, err
+	}
+	val.Codec = compress.None
+	return val, true, nil
+}
+
+// apply converts the command of string type to requests, the commands of
+// other types are skipped, so are the commands on databases not configured
+func (l *redisLink) apply(args [][]byte) error {
+	name := strings.ToLower(string(args[0]))
+	switch name {
+	case "select":
+		if len(args) == 2 {
+			l.db, _ = strconv.Atoi(string(args[1]))
+		}
+		return nil
+	case "ping", "multi", "exec":
+		return nil
+	case "replconf":
+		if len(args) > 1 && strings.ToLower(string(args[1])) == "getack" {
+			l.ack()
+		}
+		return nil
+	}
+	if l.db < 0 || l.db >= len(l.r.dbs) {
+		return nil
+	}
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		keys = append(keys, string(arg))
+	}
+	err := l.applyCommand(name, keys)
+	if err == errSkipCommand {
+		if !l.warned[name] {
+			l.warned[name] = true
+			l.log.WithField("command", name).Warn("skip command not supported")
+		}
+		return nil
+	}
+	return err
+}
+
+var errSkipCommand = errors.New("command not supported")
+
+func (l *redisLink) applyCommand(name string, args []string) error {
+	argc := len(args)
+	switch {
+	case name == "set" && argc >= 2:
+		return l.applySet(args)
+	case (name == "setnx" || name == "getset") && argc == 2:
+		return l.set(args[0], []byte(args[1]), 0)
+	case (name == "setex" || name == "psetex") && argc == 3:
+		ttl, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil
+		}
+		if name == "setex" {
+			ttl *= 1000
+		}
+		return l.set(args[0], []byte(args[2]), utils.CurrentMillis()+ttl)
+	case (name == "mset" || name == "msetnx") && argc%2 == 0:
+		for i := 0; i < argc; i += 2 {
+			if err := l.set(args[i], []byte(args[i+1]), 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	case name == "del" || name == "unlink" || name == "getdel":
+		for _, key := range args {
+			if err := l.submit(common.DEL, key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	case (name == "expire" || name == "pexpire" || name == "expireat" || name == "pexpireat") && argc >= 2:
+		t, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil
+		}
+		switch name {
+		case "expire":
+			t = utils.CurrentMillis() + t*1000
+		case "pexpire":
+			t = utils.CurrentMillis() + t
+		case "expireat":
+			t *= 1000
+		}
+		if t <= 0 {
+			// expired already
+			t = 1
+		}
+		return l.expire(args[0], t)
+	case name == "persist" && argc == 1:
+		return l.submit(common.EXPIRE, args[0], []byte("0"))
+	case (name == "incr" || name == "decr") && argc == 1,
+		(name == "incrby" || name == "decrby") && argc == 2:
+		return l.applyIncr(name, args)
+	case name == "append" && argc == 2:
+		val, _, err := l.current(args[0])
+		if err != nil {
+			return err
+		}
+		return l.set(args[0], append(val.Val, args[1]...), val.Exp)
+	case (name == "rename" || name == "renamenx") && argc == 2:
+		val, ok, err := l.current(args[0])
+		if err != nil || !ok {
+			return err
+		}
+		if err = l.submit(common.DEL, args[0], nil); err != nil {
+			return err
+		}
+		return l.set(args[1], val.Val, val.Exp)
+	case name == "flushdb":
+		return l.submit(common.FLUSH, "*", nil)
+	case name == "flushall":
+		db := l.db
+		defer func() { l.db = db }()
+		for l.db = 0; l.db < len(l.r.dbs); l.db++ {
+			if err := l.submit(common.FLUSH, "*", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	case name == "swapdb" && argc == 2:
+		a, err := strconv.Atoi(args[0])
+		b, err2 := strconv.Atoi(args[1])
+		if err != nil || err2 != nil || a < 0 || b < 0 || a >= len(l.r.dbs) || b >= len(l.r.dbs) {
+			return nil
+		}
+		db := l.db
+		defer func() { l.db = db }()
+		l.db = a
+		return l.submit(common.SWAPDB, "*", []byte(args[1]))
+	case name == "move" && argc == 2:
+		target, err := strconv.Atoi(args[1])
+		if err != nil || target < 0 || target >= len(l.r.dbs) {
+			return nil
+		}
+		val, ok, err := l.current(args[0])
+		if err != nil || !ok {
+			return err
+		}
+		if err = l.submit(common.DEL, args[0], nil); err != nil {
+			return err
+		}
+		db := l.db
+		defer func() { l.db = db }()
+		l.db = target
+		return l.set(args[0], val.Val, val.Exp)
+	}
+	return errSkipCommand
+}
+
+// applySet handles SET key val [NX|XX] [GET] [EX s|PX ms|EXAT s|PXAT ms|KEEPTTL],
+// the conditions are ignored since the command is replicated only if it's done
+func (l *redisLink) applySet(args []string) error {
+	var at int64
+	keep := false
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToLower(args[i])
+		switch opt {
+		case "keepttl":
+			keep = true
+		case "ex", "px", "exat", "pxat":
+			if i+1 >= len(args) {
+				return nil
+			}
+			i++
+			t, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return nil
+			}
+			switch opt {
+			case "ex":
+				at = utils.CurrentMillis() + t*1000
+			case "px":
+				at = utils.CurrentMillis() + t
+			case "exat":
+				at = t * 1000
+			case "pxat":
+				at = t
+			}
+		}
+	}
+	if keep {
+		val, _, err := l.current(args[0])
+		if err != nil {
+			return err
+		}
+		at = val.Exp
+	}
+	return l.set(args[0], []byte(args[1]), at)
+}
+
+// applyIncr computes the value, keeping the expiry like redis
+func (l *redisLink) applyIncr(name string, args []string) error {
+	delta := int64(1)
+	if len(args) == 2 {
+		d, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil
+		}
+		delta = d
+	}
+	if name == "decr" || name == "decrby" {
+		delta = -delta
+	}
+	val, ok, err := l.current(args[0])
+	if err != nil {
+		return err
+	}
+	var n int64
+	if ok {
+		if n, err = strconv.ParseInt(string(val.Val), 10, 64); err != nil {
+			l.log.WithField("key", args[0]).Warn("incr on value not integer")
+			return nil
+		}
+	}
+	return l.set(args[0], []byte(strconv.FormatInt(n+delta, 10)), val.Exp)
+}
@@ -0,0 +1,203 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/dump"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func respCommand(args ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.Bytes()
+}
+
+// fakeRedis is a redis primary which serves the handshake of replicas,
+// and hands over the links to test
+type fakeRedis struct {
+	ln    net.Listener
+	rdb   []byte
+	links chan *fakeLink
+}
+
+type fakeLink struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	// psync is the arguments of PSYNC
+	psync []string
+}
+
+func startFakeRedis(t *testing.T, rdb []byte) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, rdb: rdb, links: make(chan *fakeLink, 1)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+	for {
+		args, _, err := readCommand(rd)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		switch strings.ToUpper(string(args[0])) {
+		case "PING":
+			conn.Write([]byte("+PONG\r\n"))
+		case "PSYNC":
+			link := &fakeLink{conn: conn, rd: rd, psync: []string{string(args[1]), string(args[2])}}
+			if string(args[1]) == "?" {
+				fmt.Fprintf(conn, "+FULLRESYNC fakeid 100\r\n\n\n$%d\r\n", len(f.rdb))
+				conn.Write(f.rdb)
+			} else {
+				conn.Write([]byte("+CONTINUE\r\n"))
+			}
+			f.links <- link
+			return
+		default:
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+func TestSyncer_FollowRedis(t *testing.T) {
+	later := utils.CurrentMillis() + 60000
+	rdb := &bytes.Buffer{}
+	enc, _ := dump.NewRDBEncoder(rdb)
+	for _, e := range []*dump.Entry{
+		{Key: "a", Val: []byte("1")},
+		{Key: "c", Val: []byte("3")},
+		{Key: "n", Val: []byte("10"), ExpireAt: later},
+		{DB: 1, Key: "other", Val: []byte("1")},
+	} {
+		enc.Encode(e)
+	}
+	enc.Close()
+	primary := startFakeRedis(t, rdb.Bytes())
+
+	conf := &config.Config{
+		DataDir:         t.TempDir(),
+		ShutdownTimeout: 5,
+		Replication: config.ReplicationConfig{
+			Role:      "replica",
+			ReplicaOf: "redis://" + primary.ln.Addr().String(),
+		},
+	}
+	// the local key not in rdb is removed by full sync
+	local := &bytes.Buffer{}
+	jsonl := dump.NewJSONLEncoder(local)
+	jsonl.Encode(&dump.Entry{Key: "stale", Val: []byte("1")})
+	jsonl.Close()
+	if _, err := ImportDataDir(conf, dump.NewJSONLDecoder(local)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startSyncer(t, conf)
+	defer s.Shutdown()
+	link := <-primary.links
+	if link.psync[0] != "?" || link.psync[1] != "-1" {
+		t.Errorf("PSYNC %v, want full resync", link.psync)
+	}
+	if !s.Replicator.FollowsRedis() || !s.Replicator.ReadOnly() {
+		t.Error("not a read-only replica of redis")
+	}
+
+	stream := bytes.Join([][]byte{
+		respCommand("SET", "a", "2"),
+		respCommand("SET", "b", "x", "PXAT", strconv.FormatInt(later, 10)),
+		respCommand("DEL", "c"),
+		respCommand("INCR", "n"),
+		respCommand("SELECT", "1"),
+		respCommand("SET", "other", "2"),
+		respCommand("SELECT", "0"),
+		respCommand("MULTI"),
+		respCommand("APPEND", "a", "z"),
+		respCommand("EXEC"),
+		respCommand("LPUSH", "list", "x"),
+	}, nil)
+	getAck := respCommand("REPLCONF", "GETACK", "*")
+	link.conn.Write(stream)
+	link.conn.Write(getAck)
+
+	// the ack replied to GETACK has the offset before it
+	want := strconv.Itoa(100 + len(stream))
+	link.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		args, _, err := readCommand(link.rd)
+		if err != nil {
+			t.Fatalf("read ack error = %v", err)
+		}
+		if string(args[2]) == want {
+			break
+		}
+	}
+
+	// the append is the last one submitted
+	eventuallyGet := func(key, want string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if val, err := s.Store.Get(key); err == nil && string(val.Val) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is not %q", key, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	eventuallyGet("a", "2z")
+	wantVals := map[string]string{"b": "x", "n": "11"}
+	for key, want := range wantVals {
+		val, err := s.Store.Get(key)
+		if err != nil || string(val.Val) != want {
+			t.Errorf("%s = %q, %v, want %q", key, val.Val, err, want)
+		}
+	}
+	if val, _ := s.Store.Get("n"); val.Exp != later {
+		t.Errorf("n expires at %d, want %d", val.Exp, later)
+	}
+	for _, key := range []string{"c", "other", "stale", "list"} {
+		if _, err := s.Store.Get(key); err == nil {
+			t.Errorf("%s exists", key)
+		}
+	}
+
+	// a partial resync is tried after the link is broken
+	link.conn.Close()
+	select {
+	case link = <-primary.links:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no resync after the link is broken")
+	}
+	wantOffset := strconv.Itoa(100 + len(stream) + len(getAck) + 1)
+	if link.psync[0] != "fakeid" || link.psync[1] != wantOffset {
+		t.Errorf("PSYNC %v, want fakeid %s", link.psync, wantOffset)
+	}
+	link.conn.Write(respCommand("SET", "d", "1"))
+	eventuallyGet("d", "1")
+	link.conn.Close()
+}
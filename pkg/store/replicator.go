@@ -0,0 +1,319 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateConnect   = "connect"
+	StateSync      = "sync"
+	StateConnected = "connected"
+)
+
+// heartbeatInterval is the interval attaching to upstream, a var so
+// that it's shortened by tests
+var heartbeatInterval = 3 * time.Second
+
+// minDialBackoff is the first backoff redialing the upstream, which is
+// doubled up to the heartbeat interval
+const minDialBackoff = 100 * time.Millisecond
+
+// Replicator manages the role of current node. A replica attaches itself
+// to the upstream, pulls the full data, and then receives the requests
+// pushed by upstream, which are forwarded to its own replicas.
+type Replicator struct {
+	cfg      *config.Config
+	dbs      []Store
+	sender   Sender
+	mu       sync.RWMutex
+	role     string
+	upstream string
+	state    string
+	synced   bool
+	stop     chan interface{}
+	// submit and applied are of the syncer, to apply the data of redis
+	// and upstream
+	submit  func(req *common.TxRequest) error
+	applied func() int64
+	// commit waits for the requests submitted applied and logged
+	commit func() error
+	// recovered tells whether the local data is recovered, before which
+	// the data of upstream is not resynced
+	recovered func() bool
+}
+
+func NewReplicator(conf *config.Config, dbs []Store, sender Sender) *Replicator {
+	return &Replicator{
+		cfg:    conf,
+		dbs:    dbs,
+		sender: sender,
+		role:   common.RolePrimary,
+	}
+}
+
+func (r *Replicator) Init() error {
+	log.Println("[Init] init replicator")
+	rc := r.cfg.Replication
+	switch rc.Role {
+	case "", common.RolePrimary:
+	case common.RoleReplica:
+		if rc.ReplicaOf == "" {
+			return fmt.Errorf("replica_of is required for replica")
+		}
+		if _, ok := ParseRedisUpstream(rc.ReplicaOf); !ok && strings.Contains(rc.ReplicaOf, "://") {
+			return fmt.Errorf("invalid replica_of '%s'", rc.ReplicaOf)
+		}
+		r.role = common.RoleReplica
+		r.upstream = rc.ReplicaOf
+	default:
+		return fmt.Errorf("unknown role '%s'", rc.Role)
+	}
+	return nil
+}
+
+func (r *Replicator) Run(errC chan<- error) {
+	log.Println("[Run] run replicator")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == common.RoleReplica {
+		r.follow(r.upstream)
+	}
+}
+
+func (r *Replicator) Shutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unfollow()
+	log.Println("[Shutdown] shutdown replicator")
+}
+
+// Role returns role, upstream and link state of current node,
+// the password of redis upstream is masked
+func (r *Replicator) Role() (role, upstream, state string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	upstream = r.upstream
+	if u, ok := ParseRedisUpstream(upstream); ok {
+		upstream = u.Redacted()
+	}
+	return r.role, upstream, r.state
+}
+
+// FollowsRedis tells whether current node is a replica of redis primary
+func (r *Replicator) FollowsRedis() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := ParseRedisUpstream(r.upstream)
+	return r.role == common.RoleReplica && ok
+}
+
+// Synced tells whether the data has been synced from upstream once,
+// it's always true for primary
+func (r *Replicator) Synced() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.role == common.RolePrimary || r.synced
+}
+
+// ReadOnly tells whether writes from clients should be rejected
+func (r *Replicator) ReadOnly() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.role == common.RoleReplica
+}
+
+// ReplicaOf turns current node into a replica of the upstream sync address
+func (r *Replicator) ReplicaOf(upstream string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == common.RoleReplica && r.upstream == upstream {
+		return
+	}
+	r.unfollow()
+	r.role = common.RoleReplica
+	r.upstream = upstream
+	r.synced = false
+	r.follow(upstream)
+}
+
+// Promote turns current node into a primary
+func (r *Replicator) Promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unfollow()
+	r.role = common.RolePrimary
+	r.upstream = ""
+	r.state = ""
+}
+
+// Attach adds a downstream replica
+func (r *Replicator) Attach(addr string) {
+	r.sender.AddReplica(addr)
+}
+
+// Detach removes a downstream replica
+func (r *Replicator) Detach(addr string) {
+	r.sender.RemoveReplica(addr)
+}
+
+// Replicas returns the downstream replicas
+func (r *Replicator) Replicas() []string {
+	return r.sender.Replicas()
+}
+
+func (r *Replicator) announce() string {
+	if r.cfg.Replication.Announce != "" {
+		return r.cfg.Replication.Announce
+	}
+	return ":" + r.cfg.SyncPort
+}
+
+func (r *Replicator) setState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = state
+	if state == StateConnected {
+		r.synced = true
+	}
+}
+
+func (r *Replicator) follow(upstream string) {
+	r.stop = make(chan interface{})
+	r.state = StateConnect
+	if u, ok := ParseRedisUpstream(upstream); ok {
+		go newRedisLink(r, u).process(r.stop)
+		return
+	}
+	go r.process(upstream, r.stop)
+}
+
+func (r *Replicator) unfollow() {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// process attaches to upstream periodically, so that the upstream knows
+// current node again after restarting, and a full resync is done
+// whenever the link is recovered. The upstream is redialed with backoff
+// until connected.
+func (r *Replicator) process(upstream string, stop <-chan interface{}) {
+	log := etlog.Log.WithField("upstream", upstream)
+	client := NewEvolvestClient(r.cfg, upstream)
+	defer client.Close()
+
+	synced := false
+	var backoff time.Duration
+	for {
+		wait := heartbeatInterval
+		if client.client == nil {
+			if err := client.Dial(); err != nil {
+				log.WithError(err).Warn("connect upstream failed, retry")
+				if backoff *= 2; backoff < minDialBackoff {
+					backoff = minDialBackoff
+				} else if backoff > heartbeatInterval {
+					backoff = heartbeatInterval
+				}
+				wait = backoff
+			}
+		}
+		if client.client != nil {
+			resp, err := client.Replicate(r.announce(), false)
+			if err != nil {
+				log.WithError(err).Warn("attach to upstream failed")
+				synced = false
+				r.setState(StateConnect)
+			} else if !synced && !r.recovered() {
+				wait = minDialBackoff
+			} else if !synced {
+				r.setState(StateSync)
+				if err = r.resync(client, resp.LastTxId); err != nil {
+					log.WithError(err).Warn("resync from upstream failed")
+				} else {
+					log.Info("resync from upstream success")
+					synced = true
+					r.setState(StateConnected)
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			if client.client != nil {
+				if _, err := client.Replicate(r.announce(), true); err != nil {
+					log.WithError(err).Warn("detach from upstream failed")
+				}
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resync replaces local data with the full data of upstream, local keys
+// written after lastTxId are kept since they may come from the pushes.
+// The changes are submitted as the pushes, so that they're logged,
+// ordered with the pushes and forwarded to the replicas of current node.
+func (r *Replicator) resync(client *EvolvestClient, lastTxId int64) error {
+	for db, st := range r.dbs {
+		data, err := client.Pull(db)
+		if err == ErrDbUnsupported || (db > 0 && status.Code(err) == codes.InvalidArgument) {
+			etlog.Log.WithField("db", db).Warn("database not served by upstream")
+			break
+		} else if err != nil {
+			return err
+		}
+		values := make(map[string]DataItem)
+		if err = json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+
+		now := utils.CurrentMillis()
+		for key, val := range values {
+			if val.Exp > 0 && val.Exp <= now {
+				continue
+			}
+			if err = submitItem(r.submit, db, key, val); err != nil {
+				return err
+			}
+		}
+
+		keys, err := st.Keys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, ok := values[key]; ok {
+				continue
+			}
+			val, err := st.Get(key)
+			if err != nil || val.Ver > lastTxId {
+				continue
+			}
+			// of the local version, so that a later write of it is kept
+			err = r.submit(&common.TxRequest{
+				TxId:   val.Ver,
+				Flag:   common.FlagSync,
+				Action: common.DEL,
+				Key:    key,
+				Db:     db,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return r.commit()
+}
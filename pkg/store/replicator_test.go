@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamPeer serves the data of database 0 with last tx id, and
+// records the replicas attaching and detaching
+type upstreamPeer struct {
+	evolvest.UnimplementedEvolvestServiceServer
+	mu       sync.Mutex
+	values   map[string]DataItem
+	lastTxId int64
+	attaches int
+	detaches int
+}
+
+func (p *upstreamPeer) Replicate(ctx context.Context, in *evolvest.ReplicateRequest) (*evolvest.ReplicateResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if in.Detach {
+		p.detaches++
+	} else {
+		p.attaches++
+	}
+	return &evolvest.ReplicateResponse{Ok: true, LastTxId: p.lastTxId}, nil
+}
+
+// Pull serves database 0 only, as the older nodes
+func (p *upstreamPeer) Pull(ctx context.Context, in *evolvest.PullRequest) (*evolvest.PullResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, err := json.Marshal(p.values)
+	if err != nil {
+		return nil, err
+	}
+	return &evolvest.PullResponse{Values: data}, nil
+}
+
+func (p *upstreamPeer) counts() (attaches, detaches int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.attaches, p.detaches
+}
+
+// waitFor polls cond until it's true or timeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicator_Replica(t *testing.T) {
+	interval := heartbeatInterval
+	heartbeatInterval = 50 * time.Millisecond
+	defer func() { heartbeatInterval = interval }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &upstreamPeer{
+		values:   map[string]DataItem{"a": {Val: []byte("1"), Ver: 90}},
+		lastTxId: 100,
+	}
+	srv := grpc.NewServer()
+	evolvest.RegisterEvolvestServiceServer(srv, peer)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conf := &config.Config{DataDir: t.TempDir(), ShutdownTimeout: 1, Replication: config.ReplicationConfig{
+		Role:      common.RoleReplica,
+		ReplicaOf: ln.Addr().String(),
+	}}
+	s := NewSyncer(conf, cluster.NewCluster(conf))
+	// deleted by upstream before its last tx, or pushed after it
+	s.Store.Set("stale", DataItem{Val: []byte("1"), Ver: 50})
+	s.Store.Set("pushed", DataItem{Val: []byte("1"), Ver: 200})
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	r := s.Replicator
+	if r.Synced() || !r.ReadOnly() {
+		t.Errorf("Synced() = %v, ReadOnly() = %v, want false, true before resync", r.Synced(), r.ReadOnly())
+	}
+	go s.Run(make(chan error, 16))
+
+	waitFor(t, "resync", r.Synced)
+	if role, upstream, state := r.Role(); role != common.RoleReplica || upstream != ln.Addr().String() || state != StateConnected {
+		t.Errorf("Role() = %s, %s, %s, want replica of upstream connected", role, upstream, state)
+	}
+	for key, want := range map[string]bool{"a": true, "stale": false, "pushed": true} {
+		if _, err := s.Store.Get(key); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", key, err == nil, want)
+		}
+	}
+	// logged, so that it's kept after restarting
+	data, err := ioutil.ReadFile(path.Join(conf.DataDir, common.FileTx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if req, err := ParseTx(line); err == nil {
+			logged[req.Key] = req.Action
+		}
+	}
+	if logged["a"] != common.SET || logged["stale"] != common.DEL || logged["pushed"] != "" {
+		t.Errorf("logged = %v, want set a and del stale", logged)
+	}
+
+	// attached again by the heartbeats, so that a restarted upstream
+	// knows the replica
+	waitFor(t, "heartbeats", func() bool {
+		attaches, _ := peer.counts()
+		return attaches >= 3
+	})
+	s.Shutdown()
+	waitFor(t, "detach", func() bool {
+		_, detaches := peer.counts()
+		return detaches == 1
+	})
+}
+
+func TestEvolvestClient_CloseTwice(t *testing.T) {
+	ec := NewEvolvestClient(&config.Config{}, "fake")
+	ec.Close()
+	ec.Close()
+}
@@ -5,43 +5,83 @@ import (
 	"fmt"
 	"github.com/edditen/etlog"
 	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/cluster"
 	"github.com/edditen/evolvest/pkg/common"
 	"github.com/edditen/evolvest/pkg/common/config"
 	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/compress"
+	"github.com/edditen/evolvest/pkg/metrics"
 	"github.com/edditen/evolvest/pkg/runnable"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Sender interface {
 	runnable.Runnable
+	// Send pushes request accepted by current node to peers and replicas
 	Send(req *common.TxRequest) error
+	// Forward pushes request synced from upstream to replicas
+	Forward(req *common.TxRequest) error
+	// AddReplica attaches a downstream replica by its sync address
+	AddReplica(addr string)
+	// RemoveReplica detaches a downstream replica
+	RemoveReplica(addr string)
+	// Replicas returns addresses of the attached replicas
+	Replicas() []string
+	// Peers returns clients of the peers
+	Peers() []*EvolvestClient
+	// Clients returns clients of the peers and replicas
+	Clients() []*EvolvestClient
+	// Full tells whether the queue of a peer or replica is full
+	Full() bool
 }
 
 type TxSender struct {
 	cfg      *config.Config
+	cluster  *cluster.Cluster
 	clients  []*EvolvestClient
+	mu       sync.RWMutex
+	replicas map[string]*EvolvestClient
 	shutdown chan interface{}
 }
 
-func NewTxSender(cfg *config.Config) *TxSender {
+func NewTxSender(cfg *config.Config, c *cluster.Cluster) *TxSender {
 	return &TxSender{
-		cfg:     cfg,
-		clients: make([]*EvolvestClient, 0),
+		cfg:      cfg,
+		cluster:  c,
+		clients:  make([]*EvolvestClient, 0),
+		replicas: make(map[string]*EvolvestClient),
 	}
 }
 
 func (ts *TxSender) Init() error {
 	log.Println("[Init] init txSender")
+	if ts.cluster.Enabled() {
+		// sharding mode, the peers are the other nodes of cluster
+		for _, node := range ts.cluster.Nodes() {
+			if node.Self {
+				continue
+			}
+			client := NewEvolvestClient(ts.cfg, node.SyncAddr())
+			client.node = node
+			client.StartClient()
+			ts.clients = append(ts.clients, client)
+		}
+		return nil
+	}
+
 	servAddrs := os.Getenv(common.EnvAddrs)
 	etlog.Log.WithField(common.EnvAddrs, servAddrs).Info("env")
 	if servAddrs != "" {
 		addrs := strings.Split(servAddrs, ",")
 		for _, addr := range addrs {
-			client := NewEvolvestClient(addr)
+			client := NewEvolvestClient(ts.cfg, addr)
 			client.StartClient()
 			ts.clients = append(ts.clients, client)
 		}
@@ -50,60 +90,317 @@ func (ts *TxSender) Init() error {
 }
 
 func (ts *TxSender) Send(req *common.TxRequest) error {
-	text := fmt.Sprintf("%d %s %s %s %s",
-		req.TxId, common.FlagSync, req.Action, req.Key, utils.Base64Encode(req.Val))
+	var target *cluster.Node
+	if req.Flag == common.FlagMigrated {
+		// the peers can't be told from the target without cluster
+		if !ts.cluster.Enabled() {
+			return ts.Forward(req)
+		}
+		target = ts.cluster.Migrating(cluster.KeySlot(req.Key))
+	}
 	for _, cli := range ts.clients {
-		if cli != nil {
-			cli.Push(text)
+		// only the replicas of the key's slot hold the data
+		if cli != nil && cli.node != target && ts.cluster.Holds(cli.node, req.Key) {
+			cli.Push(req)
 		}
 	}
+	return ts.Forward(req)
+}
+
+func (ts *TxSender) Forward(req *common.TxRequest) error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, cli := range ts.replicas {
+		cli.Push(req)
+	}
 	return nil
 }
 
+// FormatTx formats the request pushed to peers, which is parsed by ParseTx.
+// The database other than 0 follows the action, e.g. set@1, and the codec
+// of compressed value precedes the value, e.g. zstd:KLUv/QBY...
+func FormatTx(req *common.TxRequest) string {
+	return fmt.Sprintf("%d %s %s %s %s",
+		req.TxId, common.FlagSync, txAction(req), req.Key, txValue(req))
+}
+
+// NewTxRecord converts the request to the record streamed to peers
+func NewTxRecord(req *common.TxRequest) *evolvest.TxRecord {
+	return &evolvest.TxRecord{
+		TxId:   req.TxId,
+		Action: req.Action,
+		Db:     int32(req.Db),
+		Key:    req.Key,
+		Val:    req.Val,
+		Codec:  int32(req.Codec),
+	}
+}
+
+// ParseTxRecord converts the record streamed from peers, which is
+// validated the same as ParseTx
+func ParseTxRecord(rec *evolvest.TxRecord) (*common.TxRequest, error) {
+	if rec.TxId <= 0 || rec.Key == "" {
+		return nil, errors.New("missing required")
+	}
+	if rec.Db < 0 {
+		return nil, errors.New("db is wrong format")
+	}
+	req := &common.TxRequest{
+		TxId:   rec.TxId,
+		Flag:   common.FlagSync,
+		Action: rec.Action,
+		Key:    rec.Key,
+		Db:     int(rec.Db),
+	}
+	switch rec.Action {
+	case common.DEL, common.FLUSH:
+	case common.SET, common.EXPIRE, common.SWAPDB:
+		req.Val = rec.Val
+		if req.Val == nil {
+			req.Val = []byte{}
+		}
+		req.Codec = compress.Codec(rec.Codec)
+		if rec.Codec < 0 || req.Codec.String() == "unknown" {
+			return nil, errors.New("codec is wrong format")
+		}
+	default:
+		return nil, errors.New("cmd not support")
+	}
+	return req, nil
+}
+
+func txValue(req *common.TxRequest) string {
+	if req.Codec != compress.None {
+		return req.Codec.String() + ":" + utils.Base64Encode(req.Val)
+	}
+	return utils.Base64Encode(req.Val)
+}
+
+func txAction(req *common.TxRequest) string {
+	if req.Db != 0 {
+		return fmt.Sprintf("%s@%d", req.Action, req.Db)
+	}
+	return req.Action
+}
+
+func (ts *TxSender) AddReplica(addr string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.replicas[addr]; ok {
+		return
+	}
+	client := NewEvolvestClient(ts.cfg, addr)
+	if err := client.StartClient(); err != nil {
+		etlog.Log.WithError(err).WithField("addr", addr).Warn("attach replica failed")
+		return
+	}
+	ts.replicas[addr] = client
+	etlog.Log.WithField("addr", addr).Info("replica attached")
+}
+
+func (ts *TxSender) RemoveReplica(addr string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if client, ok := ts.replicas[addr]; ok {
+		client.Close()
+		delete(ts.replicas, addr)
+		etlog.Log.WithField("addr", addr).Info("replica detached")
+	}
+}
+
+func (ts *TxSender) Replicas() []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	addrs := make([]string, 0, len(ts.replicas))
+	for addr := range ts.replicas {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (ts *TxSender) Peers() []*EvolvestClient {
+	return ts.clients
+}
+
+func (ts *TxSender) Clients() []*EvolvestClient {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	clients := make([]*EvolvestClient, 0, len(ts.clients)+len(ts.replicas))
+	clients = append(clients, ts.clients...)
+	for _, cli := range ts.replicas {
+		clients = append(clients, cli)
+	}
+	return clients
+}
+
+func (ts *TxSender) Full() bool {
+	for _, cli := range ts.Clients() {
+		if cli.Full() {
+			return true
+		}
+	}
+	return false
+}
+
 func (ts *TxSender) Run(errC chan<- error) {
 	log.Println("[Run] run txSender")
 }
 
+// Shutdown waits for the queued pushes until the shutdown timeout,
+// and closes the clients
 func (ts *TxSender) Shutdown() {
+	deadline := time.Now().Add(ts.cfg.ShutdownDuration())
+	clients := append([]*EvolvestClient{}, ts.clients...)
+	ts.mu.RLock()
+	for _, cli := range ts.replicas {
+		clients = append(clients, cli)
+	}
+	ts.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, cli := range clients {
+		wg.Add(1)
+		go func(cli *EvolvestClient) {
+			defer wg.Done()
+			if left := cli.Drain(deadline); left > 0 {
+				metrics.ReplicationDropped.WithLabelValues(cli.addr).Add(float64(left))
+				etlog.Log.WithField("addr", cli.addr).WithField("left", left).
+					Warn("drain pushes timeout, abandon")
+			}
+			cli.Close()
+		}(cli)
+	}
+	wg.Wait()
+	log.Println("[Shutdown] shutdown txSender")
 }
 
 type EvolvestClient struct {
-	addr        string
-	client      evolvest.EvolvestServiceClient
-	reqC        chan string
-	sleepSecs   int
-	maxInterval int
+	cfg    *config.Config
+	addr   string
+	node   *cluster.Node
+	conn   *grpc.ClientConn
+	client evolvest.EvolvestServiceClient
+
+	// the ordered queue of pushes, see pipeline.go
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []pushItem
+	// down is set if the pushes fail longer than the peer timeout
+	down bool
+	// failing is the time the pushes started failing, zero if not
+	failing time.Time
+	closed  bool
+	// cur is the stream pushing to the peer, nil if not connected
+	cur *pushStream
+	// unary is set if the peer doesn't serve the stream
+	unary bool
+	// pending counts the requests not acknowledged yet
+	pending int64
+	// lastPushed is the last tx id acknowledged
+	lastPushed int64
+	shutdown   chan interface{}
+	closeOnce  sync.Once
 }
 
-func NewEvolvestClient(addr string) *EvolvestClient {
-	return &EvolvestClient{
-		addr:        addr,
-		reqC:        make(chan string, 100),
-		sleepSecs:   1,
-		maxInterval: 1024,
+func NewEvolvestClient(cfg *config.Config, addr string) *EvolvestClient {
+	ec := &EvolvestClient{
+		cfg:      cfg,
+		addr:     addr,
+		shutdown: make(chan interface{}),
 	}
+	ec.cond = sync.NewCond(&ec.mu)
+	return ec
 }
 
+// StartClient connects to remote and starts pushing requests
 func (ec *EvolvestClient) StartClient() error {
+	if err := ec.Dial(); err != nil {
+		// never pushed, drop the requests rather than refuse the writes
+		ec.mu.Lock()
+		ec.down = true
+		ec.mu.Unlock()
+		return err
+	}
+	ec.Process()
+	return nil
+}
+
+// Dial connects to remote without pushing
+func (ec *EvolvestClient) Dial() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	etlog.Log.WithField("addr", ec.addr).Info("connecting")
-	conn, err := grpc.DialContext(ctx, ec.addr, grpc.WithInsecure())
+	opts, err := dialOptions(ec.cfg)
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.DialContext(ctx, ec.addr, opts...)
 	if err != nil {
 		return err
 	}
+	ec.conn = conn
 	ec.client = evolvest.NewEvolvestServiceClient(conn)
-	ec.Process()
 	return nil
 }
 
-func (ec *EvolvestClient) Push(pushText string) {
-	ec.reqC <- pushText
+// dialOptions returns the credentials connecting to peers, which are
+// mutual TLS and the peer token if enabled
+func dialOptions(cfg *config.Config) ([]grpc.DialOption, error) {
+	opts := make([]grpc.DialOption, 0, 2)
+	if cfg.TLS.Sync {
+		conf, err := cfg.TLS.SyncClientConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "load sync tls error")
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(conf)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if cfg.Auth.SyncToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(NewTokenCredentials(cfg.Auth.SyncToken)))
+	}
+	return opts, nil
+}
+
+// TokenCredentials sends the bearer token with each call
+type TokenCredentials struct {
+	token string
+}
+
+func NewTokenCredentials(token string) *TokenCredentials {
+	return &TokenCredentials{token: token}
+}
+
+func (tc *TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + tc.token}, nil
+}
+
+// RequireTransportSecurity returns false, so that the token works
+// without tls in trusted networks
+func (tc *TokenCredentials) RequireTransportSecurity() bool {
+	return false
 }
 
-func (ec *EvolvestClient) Pull() ([]byte, error) {
+// Close stops pushing and closes the connection, it's safe to close
+// more than once
+func (ec *EvolvestClient) Close() {
+	ec.closeOnce.Do(func() {
+		ec.mu.Lock()
+		ec.closed = true
+		ec.cond.Broadcast()
+		ec.mu.Unlock()
+		close(ec.shutdown)
+		if ec.conn != nil {
+			ec.conn.Close()
+		}
+	})
+}
+
+// Pull returns the data of database db in json,
+// ErrDbUnsupported if the node only serves database 0
+func (ec *EvolvestClient) Pull(db int) ([]byte, error) {
 	resp, err := ec.CallGrpcWithTimeout(func(ctx context.Context) (interface{}, error) {
-		return ec.client.Pull(ctx, &evolvest.PullRequest{})
+		return ec.client.Pull(ctx, &evolvest.PullRequest{Db: int32(db)})
 	})
 	if err != nil {
 		return nil, err
@@ -113,82 +410,30 @@ func (ec *EvolvestClient) Pull() ([]byte, error) {
 	if !ok {
 		return nil, fmt.Errorf("type convert error")
 	}
+	if int(pullResp.Db) != db {
+		return nil, ErrDbUnsupported
+	}
 	return pullResp.Values, nil
 
 }
 
-func (ec *EvolvestClient) Process() {
-	go func() {
-		for {
-			items := ec.aggr(ec.reqC, 20, 50)
-			if len(items) == 0 {
-				time.Sleep(time.Second)
-				continue
-			}
-			req := &evolvest.PushRequest{
-				TxCmds: items,
-			}
-
-			resp, err := ec.CallGrpcWithTimeout(func(ctx context.Context) (interface{}, error) {
-				return ec.client.Push(ctx, req)
-			})
-
-			log := etlog.Log.WithField("commands", req.TxCmds)
-			if err != nil {
-				log = log.WithError(err)
-				if ec.retry(ec.reqC, req.TxCmds) {
-					log.Warn("push tx request to remote failed, reaches max retry times, abandon")
-				} else {
-					log.Info("push tx request to remote failed, retry")
-				}
-				continue
-
-			}
-			ec.resetRetryCount()
-			log.WithField("remote_addr", ec.addr).
-				WithField("response", resp).
-				Debug("push to remote success")
-		}
-	}()
-}
-
-func (ec *EvolvestClient) aggr(ch <-chan string, maxCount int, maxWaitMillis int64) []string {
-	items := make([]string, 0)
-	timeout := time.Duration(maxWaitMillis) * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	for i := 0; i < maxCount; i++ {
-		select {
-		case item := <-ch:
-			items = append(items, item)
-		case <-ctx.Done():
-			break
-		}
+// Replicate attaches current node as a replica of remote, or detaches from it
+func (ec *EvolvestClient) Replicate(addr string, detach bool) (*evolvest.ReplicateResponse, error) {
+	resp, err := ec.CallGrpcWithTimeout(func(ctx context.Context) (interface{}, error) {
+		return ec.client.Replicate(ctx, &evolvest.ReplicateRequest{
+			Addr:   addr,
+			Detach: detach,
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
-	return items
-
-}
 
-func (ec *EvolvestClient) retry(ch chan<- string, items []string) (reachLimit bool) {
-	if ec.sleepSecs > ec.maxInterval {
-		return true
+	replicateResp, ok := resp.(*evolvest.ReplicateResponse)
+	if !ok {
+		return nil, fmt.Errorf("type convert error")
 	}
-
-	go func() {
-		time.Sleep(time.Duration(ec.sleepSecs) * time.Second)
-		for _, item := range items {
-			ch <- item
-		}
-
-		ec.sleepSecs *= 2
-
-	}()
-	return false
-}
-
-func (ec *EvolvestClient) resetRetryCount() {
-	ec.sleepSecs = 1
+	return replicateResp, nil
 }
 
 func (ec *EvolvestClient) CallGrpcWithTimeout(fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"reflect"
+	"testing"
+)
+
+func TestTxSender_Migrated(t *testing.T) {
+	// n1 owns all slots replicated to n2 and n3, and migrates to n3
+	conf := &config.Config{Cluster: config.ClusterConfig{
+		Enabled:  true,
+		NodeId:   "n1",
+		Replicas: 2,
+		Nodes: []config.NodeConfig{
+			{Id: "n1", Host: "127.0.0.1", Port: "7001", Slots: []string{"0-16383"}},
+			{Id: "n2", Host: "127.0.0.1", Port: "7002"},
+			{Id: "n3", Host: "127.0.0.1", Port: "7003"},
+		},
+	}}
+	c := cluster.NewCluster(conf)
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSlotMigrating(cluster.KeySlot("a"), "n3"); err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTxSender(conf, c)
+	for _, id := range []string{"n2", "n3"} {
+		cli := NewEvolvestClient(conf, id)
+		cli.node = c.Node(id)
+		ts.clients = append(ts.clients, cli)
+	}
+
+	for i, req := range []*common.TxRequest{
+		{Flag: common.FlagReq, Action: common.SET, Key: "a", Val: []byte("1")},
+		// the target holds the newer copy
+		{Flag: common.FlagMigrated, Action: common.DEL, Key: "a"},
+	} {
+		req.TxId = int64(i + 1)
+		if err := ts.Send(req); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	want := map[string][]int64{"n2": {1, 2}, "n3": {1}}
+	for _, cli := range ts.clients {
+		got := make([]int64, 0)
+		for _, item := range cli.queue {
+			got = append(got, item.id)
+		}
+		if !reflect.DeepEqual(got, want[cli.addr]) {
+			t.Errorf("pushed to %s = %v, want %v", cli.addr, got, want[cli.addr])
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotFile is the content of snapshot, the tx segments with
+// sequence not greater than Seq are covered by Data. For a persistent
+// engine they're covered by its files, and Data is only written by backup.
+type snapshotFile struct {
+	Seq      int             `json:"seq"`
+	LastTxId int64           `json:"last_tx_id"`
+	Engine   string          `json:"engine,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	// Dbs are the data of the databases other than 0, if not empty
+	Dbs map[int]json.RawMessage `json:"dbs,omitempty"`
+}
+
+// Snapshot saves current data to snapshot file, and archives the tx file
+// as a segment which can be removed by Compact.
+func (s *Syncer) Snapshot() error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	_, err := s.snapshot(false)
+	return err
+}
+
+// snapshot writes the snapshot file, snapMu should be held. The data of
+// a persistent engine is flushed instead of serialized unless full.
+func (s *Syncer) snapshot(full bool) (*snapshotFile, error) {
+	s.applyMu.Lock()
+	var data []byte
+	var dbs map[int]json.RawMessage
+	var err error
+	engine := EngineMemory
+	for _, db := range s.dbs {
+		if p, ok := db.(Persistent); ok && err == nil {
+			engine = p.Engine()
+			err = errors.Wrap(p.Flush(), "flush data error")
+		}
+	}
+	if err == nil && (full || engine == EngineMemory) {
+		data, dbs, err = serializeAll(s.dbs)
+		err = errors.Wrap(err, "serialize data error")
+	}
+	if err != nil {
+		s.applyMu.Unlock()
+		return nil, err
+	}
+	lastTxId := s.LastTxId()
+	seq, err := s.appender.Rotate()
+	s.applyMu.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "rotate tx file error")
+	}
+
+	snap := &snapshotFile{
+		Seq:      seq,
+		LastTxId: lastTxId,
+		Engine:   engine,
+		Data:     data,
+		Dbs:      dbs,
+	}
+	content, err := json.Marshal(snap)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal snapshot error")
+	}
+
+	// the tx segments covered are compacted only after the snapshot is
+	// durable, so it's fsynced before and after renamed
+	if err = writeFileSync(path.Join(s.cfg.DataDir, common.FileSnapshot), content); err != nil {
+		return nil, errors.Wrap(err, "write snapshot error")
+	}
+	atomic.StoreInt64(&s.lastSnapshot, time.Now().Unix())
+	etlog.Log.WithField("seq", seq).WithField("last_tx_id", lastTxId).
+		Info("write snapshot success!")
+	return snap, nil
+}
+
+// LastSnapshot returns the unix time of the last snapshot, 0 if none
+func (s *Syncer) LastSnapshot() int64 {
+	return atomic.LoadInt64(&s.lastSnapshot)
+}
+
+// Compact removes the tx segments covered by snapshot
+func (s *Syncer) Compact() (removed int, err error) {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	snap, err := readSnapshot(s.cfg.DataDir)
+	if err != nil {
+		return 0, err
+	}
+	segments, err := TxSegments(s.cfg.DataDir)
+	if err != nil {
+		return 0, errors.Wrap(err, "list tx segments error")
+	}
+	for _, seq := range segments {
+		if seq > snap.Seq {
+			break
+		}
+		if err = os.Remove(path.Join(s.cfg.DataDir, SegmentName(seq))); err != nil {
+			return removed, errors.Wrap(err, "remove tx segment error")
+		}
+		removed++
+	}
+	etlog.Log.WithField("removed", removed).Info("compact tx segments success!")
+	return removed, nil
+}
+
+func readSnapshot(dataDir string) (*snapshotFile, error) {
+	snap := &snapshotFile{}
+	data, err := ioutil.ReadFile(path.Join(dataDir, common.FileSnapshot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snap, nil
+		}
+		return nil, errors.Wrap(err, "read snapshot error")
+	}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return nil, errors.Wrap(err, "unmarshal snapshot error")
+	}
+	return snap, nil
+}
+
+// Recover loads the snapshot, and replays the tx segments not covered
+// by snapshot and the current tx file.
+func (s *Syncer) Recover() error {
+	snap, err := readSnapshot(s.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	engine := EngineMemory
+	if p, ok := s.Store.(Persistent); ok {
+		engine = p.Engine()
+	}
+	if snap.Engine != "" && snap.Engine != EngineMemory && snap.Engine != engine && len(snap.Data) == 0 {
+		return fmt.Errorf("snapshot of engine %s can't be loaded by engine %s", snap.Engine, engine)
+	}
+	if snap.Seq > 0 || len(snap.Data) > 0 {
+		// the data of same persistent engine is recovered from its files
+		if len(snap.Data) > 0 && (engine == EngineMemory || snap.Engine != engine) {
+			if err = loadAll(s.dbs, snap.Data, snap.Dbs); err != nil {
+				return errors.Wrap(err, "load snapshot error")
+			}
+		}
+		s.setLastTxId(snap.LastTxId)
+		if fi, err := os.Stat(path.Join(s.cfg.DataDir, common.FileSnapshot)); err == nil {
+			atomic.StoreInt64(&s.lastSnapshot, fi.ModTime().Unix())
+		}
+	}
+
+	segments, err := TxSegments(s.cfg.DataDir)
+	if err != nil {
+		return errors.Wrap(err, "list tx segments error")
+	}
+	files := make([]string, 0, len(segments)+1)
+	for _, seq := range segments {
+		if seq > snap.Seq {
+			files = append(files, SegmentName(seq))
+		}
+	}
+	files = append(files, common.FileTx)
+
+	count := 0
+	for _, file := range files {
+		err = ReplayTxFile(path.Join(s.cfg.DataDir, file), func(req *common.TxRequest) {
+			s.setToStore(req)
+			count++
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "replay %s error", file)
+		}
+	}
+	etlog.Log.WithField("seq", snap.Seq).WithField("replayed", count).
+		Info("recover data success!")
+	return nil
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"testing"
+)
+
+// setKeys submits the sets of keys, or the deletes if val is empty,
+// and waits until they're applied
+func setKeys(t *testing.T, s *Syncer, val string, keys ...string) {
+	for _, key := range keys {
+		req := &common.TxRequest{
+			TxId:   utils.GenerateId(),
+			Flag:   common.FlagReq,
+			Action: common.SET,
+			Key:    key,
+			Val:    []byte(val),
+		}
+		if val == "" {
+			req.Action, req.Val = common.DEL, nil
+		}
+		if err := s.Submit(req); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	if err := s.WaitApplied(context.Background(), s.Queued()); err != nil {
+		t.Fatalf("WaitApplied() error = %v", err)
+	}
+}
+
+func TestSyncer_SnapshotRecover(t *testing.T) {
+	conf := &config.Config{
+		DataDir:         t.TempDir(),
+		ShutdownTimeout: 5,
+	}
+	s := startSyncer(t, conf)
+	defer s.Shutdown()
+	setKeys(t, s, "1", "a", "b", "c")
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	setKeys(t, s, "2", "b", "d")
+	setKeys(t, s, "", "c")
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	setKeys(t, s, "3", "d", "e")
+
+	want := map[string]string{"a": "1", "b": "2", "d": "3", "e": "3"}
+	recovered := func(t *testing.T) {
+		// recovered as a crash, without the final snapshot of shutdown
+		r := NewSyncer(conf, cluster.NewCluster(conf))
+		if err := r.Recover(); err != nil {
+			t.Fatalf("Recover() error = %v", err)
+		}
+		if r.Store.Len() != len(want) {
+			t.Errorf("Len() = %d, want %d", r.Store.Len(), len(want))
+		}
+		for key, val := range want {
+			if got, err := r.Store.Get(key); err != nil || string(got.Val) != val {
+				t.Errorf("%s = %q, %v, want %q", key, got.Val, err, val)
+			}
+		}
+		if r.LastTxId() == 0 {
+			t.Error("LastTxId() = 0, want recovered")
+		}
+	}
+
+	t.Run("segments", recovered)
+	removed, err := s.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Compact() = %d, want 2 segments removed", removed)
+	}
+	t.Run("compacted", recovered)
+}
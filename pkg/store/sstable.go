@@ -0,0 +1,510 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/compress"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+)
+
+// sstable file layout, all integers are little endian:
+//
+//	block...  records followed by crc32 of the records
+//	bloom     k, then the bits
+//	index     first key, offset and length of each block
+//	footer    index offset and length, bloom offset and length,
+//	          crc32 of bloom and index, magic
+//
+// a record is uvarint key length, key, flags, varint version,
+// varint expiry, uvarint value length and value. The flags hold the
+// deletion in bit 0 and the codec of value in the high 4 bits.
+const (
+	tableMagic      = 0x45564c53
+	tableFooterSize = 40
+	tableBlockSize  = 4096
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+	recordDeleted   = 1
+	// recordCodecShift is the shift of codec in flags
+	recordCodecShift = 4
+)
+
+// lsmEntry is a version of key, a tombstone if Deleted
+type lsmEntry struct {
+	DataItem
+	Deleted bool
+}
+
+// blockHandle locates a block of table
+type blockHandle struct {
+	firstKey string
+	off      int64
+	len      int64
+}
+
+type bloomFilter struct {
+	k    uint32
+	bits []byte
+}
+
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	n := (keys*bloomBitsPerKey + 7) / 8
+	if n < 8 {
+		n = 8
+	}
+	return &bloomFilter{k: bloomHashes, bits: make([]byte, n)}
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain returns false if key is definitely not in the table
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendRecord(b []byte, key string, e lsmEntry) []byte {
+	b = appendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	var flags byte
+	if e.Deleted {
+		flags |= recordDeleted
+	}
+	flags |= byte(e.Codec) << recordCodecShift
+	b = append(b, flags)
+	b = appendVarint(b, e.Ver)
+	b = appendVarint(b, e.Exp)
+	b = appendUvarint(b, uint64(len(e.Val)))
+	return append(b, e.Val...)
+}
+
+var errCorruptBlock = errors.New("corrupt sstable block")
+
+// decodeRecord decodes the record at the beginning of b,
+// returns the bytes consumed
+func decodeRecord(b []byte) (key string, e lsmEntry, n int, err error) {
+	readUvarint := func() uint64 {
+		v, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			err = errCorruptBlock
+			return 0
+		}
+		n += m
+		return v
+	}
+	readVarint := func() int64 {
+		v, m := binary.Varint(b[n:])
+		if m <= 0 {
+			err = errCorruptBlock
+			return 0
+		}
+		n += m
+		return v
+	}
+	readBytes := func(l uint64) []byte {
+		if err != nil || uint64(len(b)-n) < l {
+			err = errCorruptBlock
+			return nil
+		}
+		p := b[n : n+int(l)]
+		n += int(l)
+		return p
+	}
+
+	key = string(readBytes(readUvarint()))
+	flags := readBytes(1)
+	e.Ver = readVarint()
+	e.Exp = readVarint()
+	val := readBytes(readUvarint())
+	if err != nil {
+		return "", lsmEntry{}, 0, err
+	}
+	e.Deleted = flags[0]&recordDeleted != 0
+	e.Codec = compress.Codec(flags[0] >> recordCodecShift)
+	if !e.Deleted {
+		e.Val = append([]byte{}, val...)
+	}
+	return key, e, n, nil
+}
+
+// tableWriter writes the records in ascending order of keys to a table
+type tableWriter struct {
+	f        *os.File
+	w        *bufio.Writer
+	off      int64
+	block    []byte
+	firstKey string
+	index    []blockHandle
+	keys     []string
+}
+
+func newTableWriter(filename string) (*tableWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "create sstable error")
+	}
+	return &tableWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (t *tableWriter) add(key string, e lsmEntry) error {
+	if len(t.block) == 0 {
+		t.firstKey = key
+	}
+	t.block = appendRecord(t.block, key, e)
+	t.keys = append(t.keys, key)
+	if len(t.block) >= tableBlockSize {
+		return t.flushBlock()
+	}
+	return nil
+}
+
+func (t *tableWriter) flushBlock() error {
+	if len(t.block) == 0 {
+		return nil
+	}
+	t.block = appendUint32(t.block, crc32.ChecksumIEEE(t.block))
+	if _, err := t.w.Write(t.block); err != nil {
+		return err
+	}
+	t.index = append(t.index, blockHandle{firstKey: t.firstKey, off: t.off, len: int64(len(t.block))})
+	t.off += int64(len(t.block))
+	t.block = t.block[:0]
+	return nil
+}
+
+// finish writes the bloom, index and footer, and syncs the file
+func (t *tableWriter) finish() (err error) {
+	defer func() {
+		if e := t.f.Close(); err == nil {
+			err = e
+		}
+	}()
+	if err = t.flushBlock(); err != nil {
+		return err
+	}
+	bloom := newBloomFilter(len(t.keys))
+	for _, key := range t.keys {
+		bloom.add(key)
+	}
+	meta := appendUint32(nil, bloom.k)
+	meta = append(meta, bloom.bits...)
+	bloomLen := len(meta)
+	for _, h := range t.index {
+		meta = appendUvarint(meta, uint64(len(h.firstKey)))
+		meta = append(meta, h.firstKey...)
+		meta = appendUvarint(meta, uint64(h.off))
+		meta = appendUvarint(meta, uint64(h.len))
+	}
+	footer := make([]byte, 0, tableFooterSize)
+	footer = appendUint64(footer, uint64(t.off+int64(bloomLen)))
+	footer = appendUint64(footer, uint64(len(meta)-bloomLen))
+	footer = appendUint64(footer, uint64(t.off))
+	footer = appendUint64(footer, uint64(bloomLen))
+	footer = appendUint32(footer, crc32.ChecksumIEEE(meta))
+	footer = appendUint32(footer, tableMagic)
+	if _, err = t.w.Write(meta); err != nil {
+		return err
+	}
+	if _, err = t.w.Write(footer); err != nil {
+		return err
+	}
+	if err = t.w.Flush(); err != nil {
+		return err
+	}
+	return t.f.Sync()
+}
+
+// sstable is an immutable sorted table, the index and bloom filter
+// are kept in memory and the blocks are read through the cache
+type sstable struct {
+	id    uint64
+	level int
+	f     *os.File
+	size  int64
+	index []blockHandle
+	bloom *bloomFilter
+}
+
+func openTable(filename string, id uint64, level int) (*sstable, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "open sstable error")
+	}
+	t := &sstable{id: id, level: level, f: f}
+	if err = t.load(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "load sstable %s error", filename)
+	}
+	return t, nil
+}
+
+func (t *sstable) load() error {
+	fi, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = fi.Size()
+	if t.size < tableFooterSize {
+		return errors.New("sstable is truncated")
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err = t.f.ReadAt(footer, t.size-tableFooterSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(footer[36:]) != tableMagic {
+		return errors.New("bad sstable magic")
+	}
+	indexOff := int64(binary.LittleEndian.Uint64(footer[0:]))
+	indexLen := int64(binary.LittleEndian.Uint64(footer[8:]))
+	bloomOff := int64(binary.LittleEndian.Uint64(footer[16:]))
+	bloomLen := int64(binary.LittleEndian.Uint64(footer[24:]))
+	if bloomOff+bloomLen != indexOff || indexOff+indexLen != t.size-tableFooterSize || bloomLen < 4 {
+		return errors.New("bad sstable footer")
+	}
+	meta := make([]byte, bloomLen+indexLen)
+	if _, err = t.f.ReadAt(meta, bloomOff); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(meta) != binary.LittleEndian.Uint32(footer[32:]) {
+		return errors.New("sstable checksum mismatch")
+	}
+	t.bloom = &bloomFilter{k: binary.LittleEndian.Uint32(meta), bits: meta[4:bloomLen]}
+
+	index := meta[bloomLen:]
+	for len(index) > 0 {
+		var h blockHandle
+		fields := make([]uint64, 3)
+		for i := range fields {
+			v, n := binary.Uvarint(index)
+			if n <= 0 {
+				return errors.New("corrupt sstable index")
+			}
+			index = index[n:]
+			fields[i] = v
+			if i == 0 {
+				if uint64(len(index)) < v {
+					return errors.New("corrupt sstable index")
+				}
+				h.firstKey = string(index[:v])
+				index = index[v:]
+			}
+		}
+		h.off, h.len = int64(fields[1]), int64(fields[2])
+		t.index = append(t.index, h)
+	}
+	return nil
+}
+
+// readBlock reads the records of block i, with the checksum verified
+func (t *sstable) readBlock(i int) ([]byte, error) {
+	h := t.index[i]
+	b := make([]byte, h.len)
+	if _, err := t.f.ReadAt(b, h.off); err != nil {
+		return nil, errors.Wrap(err, "read sstable block error")
+	}
+	if len(b) < 4 {
+		return nil, errCorruptBlock
+	}
+	data := b[:len(b)-4]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return nil, fmt.Errorf("sstable %d block %d checksum mismatch", t.id, i)
+	}
+	return data, nil
+}
+
+// get looks up key in the block which may contain it
+func (t *sstable) get(key string, cache *blockCache) (lsmEntry, bool, error) {
+	if !t.bloom.mayContain(key) {
+		return lsmEntry{}, false, nil
+	}
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].firstKey > key }) - 1
+	if i < 0 {
+		return lsmEntry{}, false, nil
+	}
+	block, ok := cache.get(t.id, i)
+	if !ok {
+		var err error
+		if block, err = t.readBlock(i); err != nil {
+			return lsmEntry{}, false, err
+		}
+		cache.put(t.id, i, block)
+	}
+	for len(block) > 0 {
+		k, e, n, err := decodeRecord(block)
+		if err != nil {
+			return lsmEntry{}, false, err
+		}
+		if k == key {
+			return e, true, nil
+		} else if k > key {
+			break
+		}
+		block = block[n:]
+	}
+	return lsmEntry{}, false, nil
+}
+
+func (t *sstable) close() error {
+	return t.f.Close()
+}
+
+// tableIter iterates the records of table in order, bypassing the cache
+type tableIter struct {
+	t     *sstable
+	i     int
+	block []byte
+}
+
+func (it *tableIter) next() (string, lsmEntry, error) {
+	for len(it.block) == 0 {
+		if it.i >= len(it.t.index) {
+			return "", lsmEntry{}, io.EOF
+		}
+		block, err := it.t.readBlock(it.i)
+		if err != nil {
+			return "", lsmEntry{}, err
+		}
+		it.block = block
+		it.i++
+	}
+	key, e, n, err := decodeRecord(it.block)
+	if err != nil {
+		return "", lsmEntry{}, err
+	}
+	it.block = it.block[n:]
+	return key, e, nil
+}
+
+// memIter iterates a sorted copy of the memtable
+type memIter struct {
+	keys []string
+	mem  map[string]lsmEntry
+}
+
+func (it *memIter) next() (string, lsmEntry, error) {
+	if len(it.keys) == 0 {
+		return "", lsmEntry{}, io.EOF
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	return key, it.mem[key], nil
+}
+
+type entryIter interface {
+	next() (string, lsmEntry, error)
+}
+
+// mergeIter merges the iterators in order of keys,
+// the entry of the first iterator wins if the keys are same
+type mergeIter struct {
+	iters []entryIter
+	heads []*iterHead
+}
+
+type iterHead struct {
+	key string
+	e   lsmEntry
+}
+
+func newMergeIter(iters ...entryIter) (*mergeIter, error) {
+	m := &mergeIter{iters: iters, heads: make([]*iterHead, len(iters))}
+	for i := range iters {
+		if err := m.advance(i); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *mergeIter) advance(i int) error {
+	key, e, err := m.iters[i].next()
+	if err == io.EOF {
+		m.heads[i] = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	m.heads[i] = &iterHead{key: key, e: e}
+	return nil
+}
+
+func (m *mergeIter) next() (string, lsmEntry, error) {
+	min := -1
+	for i, h := range m.heads {
+		if h != nil && (min < 0 || h.key < m.heads[min].key) {
+			min = i
+		}
+	}
+	if min < 0 {
+		return "", lsmEntry{}, io.EOF
+	}
+	head := *m.heads[min]
+	// skip the older versions of the key
+	for i, h := range m.heads {
+		if h != nil && h.key == head.key {
+			if err := m.advance(i); err != nil {
+				return "", lsmEntry{}, err
+			}
+		}
+	}
+	return head.key, head.e, nil
+}
+
+// sortedKeys returns the keys of the memtable in order
+func sortedKeys(mem map[string]lsmEntry) []string {
+	keys := make([]string, 0, len(mem))
+	for key := range mem {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
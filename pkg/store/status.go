@@ -0,0 +1,289 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/edditen/evolvest/api/pb/evolvest"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DigestAll is the group of digest holding all keys if not in cluster mode
+const DigestAll = "*"
+
+// PeerStatus is the state of pushing to a peer or replica
+type PeerStatus struct {
+	Addr string `json:"addr"`
+	// Pending is count of requests not pushed yet
+	Pending int64 `json:"pending"`
+	// LastPushed is the last tx id pushed successfully
+	LastPushed int64 `json:"last_pushed"`
+	// LagSeconds is how long the oldest request not acknowledged has
+	// been queued
+	LagSeconds float64 `json:"lag_seconds"`
+	// Down is set once the pushes failed longer than the peer timeout
+	Down bool `json:"down,omitempty"`
+}
+
+// NodeStatus is the state of a node for comparing with the others
+type NodeStatus struct {
+	// Addr is the sync address
+	Addr     string `json:"addr"`
+	NodeId   string `json:"node_id"`
+	Role     string `json:"role"`
+	LastTxId int64  `json:"last_tx_id"`
+	Keys     int    `json:"keys"`
+	// Digests are hashes of the keys grouped by the owner node id of
+	// their slots in cluster mode, only the groups held by the node are
+	// included. All keys are in group DigestAll otherwise.
+	Digests map[string]string `json:"digests"`
+	Peers   []PeerStatus      `json:"peers"`
+	// Error is set if the node is not reachable
+	Error string `json:"error,omitempty"`
+}
+
+// Status returns the state of current node
+func (s *Syncer) Status() NodeStatus {
+	role, _, _ := s.Replicator.Role()
+	st := NodeStatus{
+		Addr:     s.cfg.Host + ":" + s.cfg.SyncPort,
+		NodeId:   strconv.Itoa(utils.ServId()),
+		Role:     role,
+		LastTxId: s.LastTxId(),
+		Keys:     s.Len(),
+		Digests:  s.digests(),
+		Peers:    make([]PeerStatus, 0),
+	}
+	if s.cluster.Enabled() {
+		st.Addr = s.cluster.Self().SyncAddr()
+		st.NodeId = s.cluster.Self().Id
+	}
+	for _, cli := range s.sender.Clients() {
+		st.Peers = append(st.Peers, cli.Status())
+	}
+	return st
+}
+
+// ReplicationLag returns the lag seconds of each peer and replica
+func (s *Syncer) ReplicationLag() map[string]float64 {
+	lags := make(map[string]float64)
+	for _, cli := range s.sender.Clients() {
+		lags[cli.addr] = cli.Lag().Seconds()
+	}
+	return lags
+}
+
+// ClusterStatus returns the states of current node and the others,
+// which are queried in parallel
+func (s *Syncer) ClusterStatus() []NodeStatus {
+	clients := s.sender.Clients()
+	statuses := make([]NodeStatus, len(clients)+1)
+	statuses[0] = s.Status()
+	var wg sync.WaitGroup
+	for i, cli := range clients {
+		wg.Add(1)
+		go func(i int, cli *EvolvestClient) {
+			defer wg.Done()
+			st, err := cli.NodeStatus()
+			if err != nil {
+				st = NodeStatus{Addr: cli.addr, Error: err.Error()}
+			}
+			statuses[i+1] = st
+		}(i, cli)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// digests hashes the items by group, the hash of each item is summed
+// so that the order of keys doesn't matter
+func (s *Syncer) digests() map[string]string {
+	sums := make(map[string]uint64)
+	group := func(key string) (string, bool) {
+		return DigestAll, true
+	}
+	if s.cluster.Enabled() {
+		self := s.cluster.Self()
+		held := make(map[*cluster.Node]bool)
+		for slot := 0; slot < cluster.SlotCount; slot++ {
+			for _, node := range s.cluster.Replicas(slot) {
+				if node == self {
+					held[s.cluster.Owner(slot)] = true
+				}
+			}
+		}
+		for owner := range held {
+			sums[owner.Id] = 0
+		}
+		group = func(key string) (string, bool) {
+			owner := s.cluster.Owner(cluster.KeySlot(key))
+			if owner == nil || !held[owner] {
+				return "", false
+			}
+			return owner.Id, true
+		}
+	} else {
+		sums[DigestAll] = 0
+	}
+
+	h := fnv.New64a()
+	ver := make([]byte, 8)
+	for i, db := range s.dbs {
+		db.Range(func(key string, val DataItem) bool {
+			g, ok := group(key)
+			if !ok {
+				return true
+			}
+			h.Reset()
+			// the digests of database 0 are kept as before
+			if i > 0 {
+				h.Write([]byte(strconv.Itoa(i) + "@"))
+			}
+			h.Write([]byte(key))
+			binary.BigEndian.PutUint64(ver, uint64(val.Ver))
+			h.Write(ver)
+			h.Write(val.Val)
+			sums[g] += h.Sum64()
+			return true
+		})
+	}
+
+	digests := make(map[string]string, len(sums))
+	for g, sum := range sums {
+		digests[g] = fmt.Sprintf("%016x", sum)
+	}
+	return digests
+}
+
+// Divergent returns the groups of digest differing from the majority of
+// the nodes holding them by node address, the owner wins the ties in
+// cluster mode
+func Divergent(statuses []NodeStatus) map[string][]string {
+	type vote struct {
+		count int
+		owner bool
+	}
+	votes := make(map[string]map[string]*vote)
+	for _, st := range statuses {
+		for g, digest := range st.Digests {
+			if votes[g] == nil {
+				votes[g] = make(map[string]*vote)
+			}
+			v := votes[g][digest]
+			if v == nil {
+				v = &vote{}
+				votes[g][digest] = v
+			}
+			v.count++
+			v.owner = v.owner || st.NodeId == g
+		}
+	}
+	majority := make(map[string]string, len(votes))
+	for g, byDigest := range votes {
+		digests := make([]string, 0, len(byDigest))
+		for digest := range byDigest {
+			digests = append(digests, digest)
+		}
+		sort.Strings(digests)
+		var best *vote
+		for _, digest := range digests {
+			v := byDigest[digest]
+			if best == nil || v.count > best.count || v.count == best.count && v.owner && !best.owner {
+				best = v
+				majority[g] = digest
+			}
+		}
+	}
+
+	divergent := make(map[string][]string)
+	for _, st := range statuses {
+		for g, digest := range st.Digests {
+			if digest != majority[g] {
+				divergent[st.Addr] = append(divergent[st.Addr], g)
+			}
+		}
+		sort.Strings(divergent[st.Addr])
+	}
+	for addr, groups := range divergent {
+		if len(groups) == 0 {
+			delete(divergent, addr)
+		}
+	}
+	return divergent
+}
+
+// KeyDiff is a key differing between two nodes, the version is 0 if the
+// key is missing in the node
+type KeyDiff struct {
+	Key  string
+	VerA int64
+	VerB int64
+}
+
+// DiffValues returns the keys missing in either side or having different
+// versions or values, sorted by key
+func DiffValues(a, b map[string]DataItem) []KeyDiff {
+	diffs := make([]KeyDiff, 0)
+	for key, va := range a {
+		vb, ok := b[key]
+		if !ok || va.Ver != vb.Ver || string(va.Val) != string(vb.Val) {
+			diffs = append(diffs, KeyDiff{Key: key, VerA: va.Ver, VerB: vb.Ver})
+		}
+	}
+	for key, vb := range b {
+		if _, ok := a[key]; !ok {
+			diffs = append(diffs, KeyDiff{Key: key, VerB: vb.Ver})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Key < diffs[j].Key
+	})
+	return diffs
+}
+
+// Status returns the state of pushing to the remote
+func (ec *EvolvestClient) Status() PeerStatus {
+	st := PeerStatus{
+		Addr:       ec.addr,
+		Pending:    atomic.LoadInt64(&ec.pending),
+		LastPushed: atomic.LoadInt64(&ec.lastPushed),
+	}
+	ec.mu.Lock()
+	st.Down = ec.down
+	ec.mu.Unlock()
+	st.LagSeconds = ec.Lag().Seconds()
+	return st
+}
+
+// NodeStatus queries the state of the remote node
+func (ec *EvolvestClient) NodeStatus() (NodeStatus, error) {
+	var st NodeStatus
+	if ec.client == nil {
+		return st, fmt.Errorf("not connected")
+	}
+	resp, err := ec.CallGrpcWithTimeout(func(ctx context.Context) (interface{}, error) {
+		return ec.client.Status(ctx, &evolvest.StatusRequest{})
+	})
+	if err != nil {
+		return st, err
+	}
+	statusResp, ok := resp.(*evolvest.StatusResponse)
+	if !ok {
+		return st, fmt.Errorf("type convert error")
+	}
+	var statuses []NodeStatus
+	if err = json.Unmarshal(statusResp.Statuses, &statuses); err != nil {
+		return st, err
+	}
+	if len(statuses) == 0 {
+		return st, fmt.Errorf("no status returned")
+	}
+	return statuses[0], nil
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDivergent(t *testing.T) {
+	node := func(addr, id string, digests map[string]string) NodeStatus {
+		return NodeStatus{Addr: addr, NodeId: id, Digests: digests}
+	}
+	tests := []struct {
+		name     string
+		statuses []NodeStatus
+		want     map[string][]string
+	}{
+		{"consistent", []NodeStatus{
+			node("a", "0", map[string]string{"*": "x"}),
+			node("b", "0", map[string]string{"*": "x"}),
+		}, map[string][]string{}},
+		{"minority", []NodeStatus{
+			node("a", "0", map[string]string{"*": "x"}),
+			node("b", "0", map[string]string{"*": "y"}),
+			node("c", "0", map[string]string{"*": "x"}),
+		}, map[string][]string{"b": {"*"}}},
+		{"owner wins tie", []NodeStatus{
+			node("a", "1", map[string]string{"1": "x", "2": "z"}),
+			node("b", "2", map[string]string{"1": "y", "2": "z"}),
+		}, map[string][]string{"b": {"1"}}},
+		{"unreachable ignored", []NodeStatus{
+			node("a", "0", map[string]string{"*": "x"}),
+			{Addr: "b", Error: "timeout"},
+		}, map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Divergent(tt.statuses); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Divergent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	a := map[string]DataItem{
+		"same":    {Val: []byte("1"), Ver: 1},
+		"older":   {Val: []byte("1"), Ver: 1},
+		"only-a":  {Val: []byte("1"), Ver: 3},
+		"changed": {Val: []byte("1"), Ver: 4},
+	}
+	b := map[string]DataItem{
+		"same":    {Val: []byte("1"), Ver: 1},
+		"older":   {Val: []byte("2"), Ver: 2},
+		"only-b":  {Val: []byte("1"), Ver: 5},
+		"changed": {Val: []byte("2"), Ver: 4},
+	}
+	want := []KeyDiff{
+		{Key: "changed", VerA: 4, VerB: 4},
+		{Key: "older", VerA: 1, VerB: 2},
+		{Key: "only-a", VerA: 3},
+		{Key: "only-b", VerB: 5},
+	}
+	if got := DiffValues(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffValues() = %v, want %v", got, want)
+	}
+}
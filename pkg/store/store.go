@@ -3,19 +3,32 @@ package store
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/edditen/etlog"
 	"github.com/edditen/evolvest/pkg/common"
 	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/compress"
 	"github.com/edditen/evolvest/pkg/runnable"
-	"io/ioutil"
 	"log"
-	"os"
-	"path"
+	"sync"
 )
 
 type DataItem struct {
 	Val []byte
 	Ver int64
+	// Exp is the unix time in milliseconds the item expires at, 0 if never
+	Exp int64 `json:",omitempty"`
+	// Codec tags how Val is compressed
+	Codec compress.Codec `json:",omitempty"`
+}
+
+// Value returns the original bytes of the value, decompressed if needed
+func (d DataItem) Value() ([]byte, error) {
+	return d.Codec.Decode(d.Val)
+}
+
+// Expired tells whether the item is expired at the unix millis now
+func (d DataItem) Expired(now int64) bool {
+	return d.Exp > 0 && d.Exp <= now
 }
 
 type Store interface {
@@ -26,25 +39,74 @@ type Store interface {
 	Get(key string) (val DataItem, err error)
 	// Del value of key, and return value
 	Del(key string, ver int64) (val DataItem, err error)
+	// Expire sets the expiring unix millis of key, 0 removes the expiry
+	Expire(key string, at int64, ver int64) (err error)
+	// Expired returns at most limit keys expired at the unix millis now
+	Expired(now int64, limit int) (keys []string)
 	// Keys return all keys
 	Keys() (keys []string, err error)
+	// Range calls fn with each item not expired until fn returns false,
+	// the store should not be changed in fn
+	Range(fn func(key string, val DataItem) bool)
+	// Len returns count of keys
+	Len() int
+	// Size returns estimated memory used by keys and values in bytes
+	Size() int64
+	// Sample returns the stats of at most n keys picked randomly,
+	// only the keys with expiry are picked if volatile
+	Sample(n int, volatile bool) []KeyStat
 	// Serialize current data
 	Serialize() (data []byte, err error)
 	// Load data to current state
 	Load(data []byte) (err error)
 }
 
+// entryOverhead is the estimated bytes used by map entry, string header,
+// slice header and version besides key and value themselves
+const entryOverhead = 64
+
+func entrySize(key string, val DataItem) int64 {
+	return int64(len(key) + len(val.Val) + entryOverhead)
+}
+
+// KeyStat is the stats of a key sampled for eviction
+type KeyStat struct {
+	Key  string
+	Size int64
+	Exp  int64
+	// Access is the unix millis of the last access
+	Access int64
+	// Freq is the logarithmic access counter decayed by time
+	Freq int32
+	// Db is the database of key, set by the syncer
+	Db int
+}
+
 type Storage struct {
 	cfg   *config.Config
+	mu    sync.RWMutex
 	Nodes map[string]DataItem `json:"nodes"`
+	// expires indexes the keys with expiry
+	expires map[string]int64
+	// keys and volatile index all keys and the ones with expiry, so that
+	// they're sampled uniformly
+	keys     *keyIndex
+	volatile *keyIndex
+	// stats records the access of keys for eviction
+	stats map[string]*accessStat
+	size  int64
 	w     *Watcher
 }
 
 func NewStorage(conf *config.Config) *Storage {
 	return &Storage{
-		cfg:   conf,
-		w:     NewWatcher(),
-		Nodes: make(map[string]DataItem, 17),
+		cfg:      conf,
+		w:        NewWatcher(),
+		Nodes:    make(map[string]DataItem, 17),
+		expires:  make(map[string]int64),
+		keys:     newKeyIndex(),
+		volatile: newKeyIndex(),
+		stats:    make(map[string]*accessStat),
 	}
 }
 
@@ -61,12 +123,21 @@ func (s *Storage) Shutdown() {
 }
 
 func (s *Storage) Set(key string, val DataItem) (oldVal DataItem, exist bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	oldVal, ok := s.Nodes[key]
 	if ok && val.Ver < oldVal.Ver {
 		// exist key, compare with the original one
 		return oldVal, true
 	}
 	s.Nodes[key] = val
+	s.keys.add(key)
+	s.index(key, val.Exp)
+	s.size += entrySize(key, val)
+	if ok {
+		s.size -= entrySize(key, oldVal)
+	}
+	s.touch(key, utils.CurrentMillis())
 
 	defer func() {
 		_ = s.w.Notify(common.SET, key, oldVal, val)
@@ -80,75 +151,189 @@ func (s *Storage) Set(key string, val DataItem) (oldVal DataItem, exist bool) {
 }
 
 func (s *Storage) Get(key string) (val DataItem, err error) {
-	if val, ok := s.Nodes[key]; ok {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := utils.CurrentMillis()
+	if val, ok := s.Nodes[key]; ok && !val.Expired(now) {
+		s.stats[key].touch(now)
 		return val, nil
 	}
 	return DataItem{}, fmt.Errorf("key %s not exists", key)
 }
 
 func (s *Storage) Del(key string, ver int64) (val DataItem, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if val, ok := s.Nodes[key]; ok {
 		if ver < val.Ver {
 			return DataItem{}, fmt.Errorf("ver %d is less than Store", ver)
 		}
 		delete(s.Nodes, key)
+		delete(s.expires, key)
+		delete(s.stats, key)
+		s.keys.remove(key)
+		s.volatile.remove(key)
+		s.size -= entrySize(key, val)
 		_ = s.w.Notify(common.DEL, key, val, DataItem{})
 		return val, nil
 	}
 	return DataItem{}, fmt.Errorf("key %s not exists", key)
 }
 
+func (s *Storage) Expire(key string, at int64, ver int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.Nodes[key]
+	if !ok {
+		return fmt.Errorf("key %s not exists", key)
+	}
+	if ver < val.Ver {
+		return fmt.Errorf("ver %d is less than Store", ver)
+	}
+	val.Exp = at
+	val.Ver = ver
+	s.Nodes[key] = val
+	s.index(key, at)
+	return nil
+}
+
+func (s *Storage) Expired(now int64, limit int) (keys []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, at := range s.expires {
+		if len(keys) >= limit {
+			break
+		}
+		if at <= now {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// touch records the access of key, the stats is created if not exists
+func (s *Storage) touch(key string, now int64) {
+	if st, ok := s.stats[key]; ok {
+		st.touch(now)
+		return
+	}
+	s.stats[key] = newAccessStat(now)
+}
+
+// index updates the expiry index of key
+func (s *Storage) index(key string, at int64) {
+	if at > 0 {
+		s.expires[key] = at
+		s.volatile.add(key)
+	} else {
+		delete(s.expires, key)
+		s.volatile.remove(key)
+	}
+}
+
 func (s *Storage) Keys() (keys []string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := utils.CurrentMillis()
 	keys = make([]string, 0, len(s.Nodes))
-	for k := range s.Nodes {
-		keys = append(keys, k)
+	for k, v := range s.Nodes {
+		if !v.Expired(now) {
+			keys = append(keys, k)
+		}
 	}
 	return keys, nil
 }
 
-func (s *Storage) Serialize() (data []byte, err error) {
-	data, err = json.Marshal(s)
-	return
+func (s *Storage) Range(fn func(key string, val DataItem) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := utils.CurrentMillis()
+	for k, v := range s.Nodes {
+		if !v.Expired(now) && !fn(k, v) {
+			return
+		}
+	}
 }
 
-func (s *Storage) Load(data []byte) (err error) {
-	err = json.Unmarshal(data, s)
-	return
+func (s *Storage) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Nodes)
 }
 
-func (s *Storage) Persistent() {
-	data, err := s.Serialize()
-	if err != nil {
-		etlog.Log.WithError(err).Warn("save data error")
-		return
-	}
+func (s *Storage) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
 
-	dataDir := s.cfg.DataDir
-	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
-		etlog.Log.WithError(err).Warn("mkdir error")
+func (s *Storage) Sample(n int, volatile bool) []KeyStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := utils.CurrentMillis()
+	index := s.keys
+	if volatile {
+		index = s.volatile
 	}
+	stats := make([]KeyStat, 0, n)
+	for i := 0; i < n; i++ {
+		key, found := index.random()
+		if !found {
+			break
+		}
+		val := s.Nodes[key]
+		st := s.stats[key]
+		stats = append(stats, KeyStat{
+			Key:    key,
+			Size:   entrySize(key, val),
+			Exp:    val.Exp,
+			Access: st.lastAccess(),
+			Freq:   st.freq(now),
+		})
+	}
+	return stats
+}
 
-	filename := path.Join(dataDir, common.FileSnapshot)
-	err = ioutil.WriteFile(filename, data, 0644)
-	if err != nil {
-		etlog.Log.WithError(err).Warn("write data to file error")
+// swap exchanges the data with other, the watchers are kept
+func (s *Storage) swap(other *Storage) {
+	if s == other {
 		return
 	}
-	etlog.Log.Info("write snapshot success!")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	s.Nodes, other.Nodes = other.Nodes, s.Nodes
+	s.expires, other.expires = other.expires, s.expires
+	s.keys, other.keys = other.keys, s.keys
+	s.volatile, other.volatile = other.volatile, s.volatile
+	s.stats, other.stats = other.stats, s.stats
+	s.size, other.size = other.size, s.size
 }
 
-func (s *Storage) Recover() {
-	filename := path.Join(s.cfg.DataDir, common.FileSnapshot)
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		etlog.Log.WithError(err).Warn("read data from file error")
-		return
+func (s *Storage) Serialize() (data []byte, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, err = json.Marshal(s)
+	return
+}
+
+func (s *Storage) Load(data []byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = json.Unmarshal(data, s); err != nil {
+		return err
 	}
-	err = s.Load(data)
-	if err != nil {
-		etlog.Log.WithError(err).Warn("load data to Store error")
-		return
+	s.size = 0
+	s.expires = make(map[string]int64)
+	s.keys, s.volatile = newKeyIndex(), newKeyIndex()
+	s.stats = make(map[string]*accessStat, len(s.Nodes))
+	now := utils.CurrentMillis()
+	for key, val := range s.Nodes {
+		s.size += entrySize(key, val)
+		s.keys.add(key)
+		s.index(key, val.Exp)
+		s.stats[key] = newAccessStat(now)
 	}
-
-	etlog.Log.Info("recover data from snapshot success!")
+	return nil
 }
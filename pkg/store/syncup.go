@@ -1,95 +1,375 @@
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/edditen/etlog"
+	"github.com/edditen/evolvest/pkg/cluster"
 	"github.com/edditen/evolvest/pkg/common"
 	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/compress"
+	"github.com/edditen/evolvest/pkg/metrics"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Syncer struct {
-	cfg      *config.Config
-	Store    Store
-	appender Appender
-	sender   Sender
-	reqC     chan *common.TxRequest
+	cfg     *config.Config
+	cluster *cluster.Cluster
+	// Store is the database 0
+	Store      Store
+	dbs        []Store
+	Replicator *Replicator
+	appender   Appender
+	sender     Sender
+	reqC       chan *common.TxRequest
+	// compressor is nil if compression is disabled
+	compressor *compress.Compressor
+	applyMu    sync.Mutex
+	// snapMu serializes snapshots, compactions and backups
+	snapMu    sync.Mutex
+	lastTxId  int64
+	recovered int32
+	// lastSnapshot is the unix time of the last successful snapshot
+	lastSnapshot int64
+	submitMu     sync.RWMutex
+	closed       bool
+	// queued and applied count the requests, the n-th queued is applied
+	// once applied reaches n. appliedC is closed after each batch.
+	seqMu    sync.Mutex
+	queued   int64
+	applied  int64
+	appliedC chan struct{}
+	// listeners are called with each applied request
+	listeners []func(req *common.TxRequest)
+	// evictC triggers the eviction, oom is set if no key can be evicted
+	evictC   chan struct{}
+	oom      int32
+	evicted  int64
 	shutdown chan interface{}
+	stopped  chan interface{}
 }
 
-func NewSyncer(conf *config.Config) *Syncer {
-	return &Syncer{
+// ErrShutdown is returned when submitting to a shutting down syncer
+var ErrShutdown = errors.New("syncer is shutting down")
+
+// ErrQueueFull is returned when the requests are submitted faster than applied
+var ErrQueueFull = errors.New("tx chan is full or off")
+
+// ErrBackpressure is returned to the writes while a peer is far behind
+var ErrBackpressure = errors.New("replication to peers is behind, retry later")
+
+func NewSyncer(conf *config.Config, c *cluster.Cluster) *Syncer {
+	dbs := newDatabases(conf)
+	s := &Syncer{
 		cfg:      conf,
-		Store:    NewStorage(conf),
+		cluster:  c,
+		Store:    dbs[0],
+		dbs:      dbs,
 		appender: NewTxAppender(conf),
-		sender:   NewTxSender(conf),
+		sender:   NewTxSender(conf, c),
 		reqC:     make(chan *common.TxRequest, 1000),
+		evictC:   make(chan struct{}, 1),
+		appliedC: make(chan struct{}),
 		shutdown: make(chan interface{}),
+		stopped:  make(chan interface{}),
 	}
+	s.Replicator = NewReplicator(conf, s.dbs, s.sender)
+	s.Replicator.submit = s.submitWait
+	s.Replicator.applied = s.LastTxId
+	s.Replicator.commit = func() error {
+		return s.WaitApplied(context.Background(), s.Queued())
+	}
+	s.Replicator.recovered = func() bool {
+		return atomic.LoadInt32(&s.recovered) == 1
+	}
+	return s
 }
 
 func (s *Syncer) Init() error {
 	log.Println("[Init] init syncer")
-	if err := s.Store.Init(); err != nil {
+	if err := validPolicy(s.cfg.MaxMemoryPolicy); err != nil {
+		return err
+	}
+	if err := validEngine(s.cfg.Engine); err != nil {
+		return err
+	}
+	switch s.cfg.AppendFsync {
+	case "", config.FsyncEverySec, config.FsyncAlways:
+	default:
+		return fmt.Errorf("unknown appendfsync %s", s.cfg.AppendFsync)
+	}
+	compressor, err := compress.NewCompressor(s.cfg.Compression.Codec, s.cfg.Compression.Threshold)
+	if err != nil {
 		return err
 	}
+	s.compressor = compressor
+	for _, db := range s.dbs {
+		if err := db.Init(); err != nil {
+			return err
+		}
+	}
 	if err := s.appender.Init(); err != nil {
 		return err
 	}
 	if err := s.sender.Init(); err != nil {
 		return err
 	}
+	if err := s.Replicator.Init(); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (s *Syncer) Run(errC chan<- error) {
 	log.Println("[Run] run syncer")
+	defer close(s.stopped)
 
-	go s.Store.Run(errC)
+	for _, db := range s.dbs {
+		go db.Run(errC)
+	}
 	go s.appender.Run(errC)
 	go s.sender.Run(errC)
+	go s.Replicator.Run(errC)
+
+	if err := s.Recover(); err != nil {
+		errC <- err
+		return
+	}
+	atomic.StoreInt32(&s.recovered, 1)
+	go s.expireLoop()
+	go s.evictLoop()
 
-	defer close(s.reqC)
 	for {
 		select {
 		case req := <-s.reqC:
-			s.setToStore(req)
-			s.appender.Append(req)
-			if req.Flag == common.FlagReq {
-				go s.sender.Send(req)
-			}
+			s.apply(s.batch(req))
 		case <-s.shutdown:
-			break
+			s.flush()
+			return
 		}
+	}
+}
 
+// batch drains the queued requests following req, up to the batch size
+func (s *Syncer) batch(req *common.TxRequest) []*common.TxRequest {
+	n := s.cfg.ApplyBatchSize()
+	reqs := make([]*common.TxRequest, 1, n)
+	reqs[0] = req
+	for len(reqs) < n {
+		select {
+		case req = <-s.reqC:
+			reqs = append(reqs, req)
+		default:
+			return reqs
+		}
 	}
+	return reqs
+}
 
+// flush applies the requests left in queue
+func (s *Syncer) flush() {
+	for {
+		select {
+		case req := <-s.reqC:
+			s.apply(s.batch(req))
+		default:
+			return
+		}
+	}
 }
 
+// Shutdown stops accepting requests and applies the queued ones, then
+// fsyncs and closes the tx file before taking a final snapshot, which
+// archives it, so that no acknowledged request is lost. The pushes to
+// peers are drained at last.
 func (s *Syncer) Shutdown() {
-	s.sender.Shutdown()
-	s.appender.Shutdown()
-	s.Store.Shutdown()
+	s.Replicator.Shutdown()
+
+	s.submitMu.Lock()
+	s.closed = true
+	s.submitMu.Unlock()
 	close(s.shutdown)
+
+	timeout := s.cfg.ShutdownDuration()
+	select {
+	case <-s.stopped:
+	case <-time.After(timeout):
+		etlog.Log.WithField("queue", s.QueueDepth()).Warn("flush tx queue timeout")
+	}
+	// the log is durable before the snapshot, so that a failed snapshot
+	// loses nothing
+	s.appender.Shutdown()
+	// do not overwrite the snapshot with partially recovered data
+	if atomic.LoadInt32(&s.recovered) == 1 {
+		if err := s.Snapshot(); err != nil {
+			etlog.Log.WithError(err).Warn("final snapshot failed")
+		}
+	}
+
+	s.sender.Shutdown()
+	for _, db := range s.dbs {
+		db.Shutdown()
+	}
 	log.Println("[Shutdown] shutdown syncer")
 }
 
 func (s *Syncer) Submit(req *common.TxRequest) error {
+	if req.Flag == common.FlagReq && req.Action == common.SET && req.Codec == compress.None {
+		// compressed by the caller rather than the apply loop
+		req.Val, req.Codec = s.compressor.Compress(req.Val)
+	}
+	s.submitMu.RLock()
+	defer s.submitMu.RUnlock()
+	if s.closed {
+		return ErrShutdown
+	}
+	// the writes synced from others are accepted, since they're
+	// queued for the chained replicas only
+	if req.Flag == common.FlagReq && s.sender.Full() {
+		return ErrBackpressure
+	}
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
 	select {
 	case s.reqC <- req:
+		s.queued++
 		return nil
 	default:
-		return errors.New("tx chan is full or off")
+		return ErrQueueFull
 	}
 }
 
-func (s *Syncer) setToStore(req *common.TxRequest) {
-	switch req.Action {
-	case common.SET:
-		s.Store.Set(req.Key, DataItem{
-			Val: req.Val,
-			Ver: req.TxId,
-		})
-	case common.DEL:
-		s.Store.Del(req.Key, req.TxId)
+// submitWait submits the request, waiting for the queue if it's full
+// or for the peers far behind
+func (s *Syncer) submitWait(req *common.TxRequest) error {
+	for {
+		err := s.Submit(req)
+		if err != ErrQueueFull && err != ErrBackpressure {
+			return err
+		}
+		time.Sleep(time.Millisecond)
 	}
 }
+
+// apply applies a batch of requests in order, logs them with a single
+// write, and then queues them for the peers in order
+func (s *Syncer) apply(reqs []*common.TxRequest) {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	for _, req := range reqs {
+		s.setToStore(req)
+	}
+	if err := s.appender.Append(reqs...); err != nil {
+		etlog.Log.WithError(err).WithField("count", len(reqs)).Warn("append tx failed")
+	}
+	metrics.ApplyBatchSize.Observe(float64(len(reqs)))
+	s.seqMu.Lock()
+	s.applied += int64(len(reqs))
+	close(s.appliedC)
+	s.appliedC = make(chan struct{})
+	s.seqMu.Unlock()
+	for _, req := range reqs {
+		for _, fn := range s.listeners {
+			fn(req)
+		}
+	}
+	// the pushes never block, Submit refuses the writes instead
+	// while a peer is far behind
+	for _, req := range reqs {
+		switch {
+		// current node is the only entry of the data from redis
+		case req.Flag == common.FlagReq || req.Flag == common.FlagMigrated || s.Replicator.FollowsRedis():
+			s.sender.Send(req)
+		default:
+			// chained replicas
+			s.sender.Forward(req)
+		}
+	}
+}
+
+// Queued returns the count of requests queued so far, the ones queued
+// before are applied once WaitApplied of it returns
+func (s *Syncer) Queued() int64 {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	return s.queued
+}
+
+// Pending returns the count of requests queued and not applied yet
+func (s *Syncer) Pending() int64 {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	return s.queued - s.applied
+}
+
+// WaitApplied waits until the first seq requests queued are applied
+// and logged
+func (s *Syncer) WaitApplied(ctx context.Context, seq int64) error {
+	stopped := false
+	for {
+		s.seqMu.Lock()
+		applied, appliedC := s.applied, s.appliedC
+		s.seqMu.Unlock()
+		if applied >= seq {
+			return nil
+		}
+		if stopped {
+			return ErrShutdown
+		}
+		select {
+		case <-appliedC:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			// the last batch may be applied just before stopping
+			stopped = true
+		}
+	}
+}
+
+// OnApply registers fn called with the applied requests in order,
+// fn should not block. It's not safe to register after running.
+func (s *Syncer) OnApply(fn func(req *common.TxRequest)) {
+	s.listeners = append(s.listeners, fn)
+}
+
+// QueueDepth returns count of requests waiting to be applied
+func (s *Syncer) QueueDepth() int {
+	return len(s.reqC)
+}
+
+// Ready tells whether the data is recovered, and synced from upstream
+// if current node is a replica
+func (s *Syncer) Ready() bool {
+	return atomic.LoadInt32(&s.recovered) == 1 && s.Replicator.Synced()
+}
+
+// LastTxId returns id of the last applied request
+func (s *Syncer) LastTxId() int64 {
+	return atomic.LoadInt64(&s.lastTxId)
+}
+
+func (s *Syncer) setLastTxId(txId int64) {
+	if txId > s.LastTxId() {
+		atomic.StoreInt64(&s.lastTxId, txId)
+	}
+}
+
+// Peers returns sync addresses of the peers
+func (s *Syncer) Peers() []string {
+	peers := s.sender.Peers()
+	addrs := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		addrs = append(addrs, peer.addr)
+	}
+	return addrs
+}
+
+func (s *Syncer) setToStore(req *common.TxRequest) {
+	s.setLastTxId(req.TxId)
+	applyTo(s.dbs, req)
+}
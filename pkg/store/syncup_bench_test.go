@@ -0,0 +1,85 @@
+package store
+
+import (
+	"fmt"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkSyncer_Set submits SETs from parallel clients, and reports
+// the throughput and the p99 latency from submitted to applied and
+// logged. The batch of 1 applies the requests one by one as before
+// the group commit.
+func BenchmarkSyncer_Set(b *testing.B) {
+	for _, fsync := range []string{config.FsyncEverySec, config.FsyncAlways} {
+		for _, batch := range []int{1, 16, 256} {
+			b.Run(fmt.Sprintf("fsync=%s/batch=%d", fsync, batch), func(b *testing.B) {
+				benchmarkSet(b, &config.Config{
+					DataDir:         b.TempDir(),
+					ShutdownTimeout: 5,
+					ApplyBatch:      batch,
+					AppendFsync:     fsync,
+				})
+			})
+		}
+	}
+}
+
+func benchmarkSet(b *testing.B, conf *config.Config) {
+	s := NewSyncer(conf, cluster.NewCluster(conf))
+	base := utils.GenerateId()
+	starts := make([]time.Time, b.N)
+	latencies := make([]time.Duration, 0, b.N)
+	done := make(chan struct{})
+	s.OnApply(func(req *common.TxRequest) {
+		latencies = append(latencies, time.Since(starts[req.TxId-base]))
+		if len(latencies) == b.N {
+			close(done)
+		}
+	})
+	if err := s.Init(); err != nil {
+		b.Fatal(err)
+	}
+	go s.Run(make(chan error, 1))
+	for !s.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	defer s.Shutdown()
+
+	val := make([]byte, 100)
+	var next int64 = -1
+	b.SetParallelism(8)
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&next, 1)
+			starts[i] = time.Now()
+			err := s.submitWait(&common.TxRequest{
+				TxId:   base + i,
+				Flag:   common.FlagReq,
+				Action: common.SET,
+				Key:    fmt.Sprintf("key-%d", i%10000),
+				Val:    val,
+			})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	<-done
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[len(latencies)*99/100]
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "ops/s")
+	b.ReportMetric(float64(p99.Microseconds()), "p99-us")
+}
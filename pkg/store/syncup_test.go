@@ -0,0 +1,264 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/edditen/evolvest/pkg/cluster"
+	"github.com/edditen/evolvest/pkg/common"
+	"github.com/edditen/evolvest/pkg/common/config"
+	"github.com/edditen/evolvest/pkg/common/utils"
+	"github.com/edditen/evolvest/pkg/compress"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startSyncer(t testing.TB, conf *config.Config) *Syncer {
+	return runSyncer(t, NewSyncer(conf, cluster.NewCluster(conf)))
+}
+
+// runSyncer inits and runs the syncer until it's ready
+func runSyncer(t testing.TB, s *Syncer) *Syncer {
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error, 1)
+	go s.Run(errC)
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Ready() {
+		select {
+		case err := <-errC:
+			t.Fatal(err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("syncer is not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s
+}
+
+func TestSyncer_Shutdown(t *testing.T) {
+	conf := &config.Config{
+		DataDir:         t.TempDir(),
+		ShutdownTimeout: 5,
+	}
+
+	// the requests are acknowledged once submitted,
+	// shutdown right away without waiting for them to be applied
+	s := startSyncer(t, conf)
+	const n = 500
+	for i := 0; i < n; i++ {
+		req := &common.TxRequest{
+			TxId:   utils.GenerateId(),
+			Flag:   common.FlagReq,
+			Action: common.SET,
+			Key:    fmt.Sprintf("key-%d", i),
+			Val:    []byte(fmt.Sprintf("val-%d", i)),
+		}
+		if i%10 == 9 {
+			req.Action = common.DEL
+			req.Key = fmt.Sprintf("key-%d", i-1)
+			req.Val = nil
+		}
+		if err := s.Submit(req); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	s.Shutdown()
+	// closed before the final snapshot, which archives it
+	if _, err := os.Stat(path.Join(conf.DataDir, common.FileTx)); !os.IsNotExist(err) {
+		t.Errorf("tx file after shutdown error = %v, want archived", err)
+	}
+
+	if err := s.Submit(&common.TxRequest{Action: common.SET, Key: "late"}); err != ErrShutdown {
+		t.Errorf("Submit() after shutdown error = %v, want %v", err, ErrShutdown)
+	}
+
+	s = startSyncer(t, conf)
+	defer s.Shutdown()
+	for i := 0; i < n; i++ {
+		if i%10 == 9 {
+			continue
+		}
+		key := fmt.Sprintf("key-%d", i)
+		val, err := s.Store.Get(key)
+		if i%10 == 8 {
+			if err == nil {
+				t.Errorf("%s deleted but got %q", key, val.Val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s lost after restart", key)
+		} else if want := fmt.Sprintf("val-%d", i); string(val.Val) != want {
+			t.Errorf("%s = %q, want %q", key, val.Val, want)
+		}
+	}
+}
+
+func TestSyncer_Expire(t *testing.T) {
+	conf := &config.Config{
+		DataDir:         t.TempDir(),
+		ShutdownTimeout: 5,
+	}
+	s := startSyncer(t, conf)
+	// increasing versions, so that none is discarded
+	txId := utils.GenerateId()
+	submit := func(action, key, val string) {
+		txId++
+		err := s.Submit(&common.TxRequest{
+			TxId:   txId,
+			Flag:   common.FlagReq,
+			Action: action,
+			Key:    key,
+			Val:    []byte(val),
+		})
+		if err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	now := utils.CurrentMillis()
+	submit(common.SET, "short", "1")
+	submit(common.EXPIRE, "short", fmt.Sprint(now+200))
+	submit(common.SET, "long", "1")
+	submit(common.EXPIRE, "long", fmt.Sprint(now+60000))
+	submit(common.SET, "persisted", "1")
+	submit(common.EXPIRE, "persisted", fmt.Sprint(now+200))
+	submit(common.EXPIRE, "persisted", "0")
+
+	time.Sleep(500 * time.Millisecond)
+	if _, err := s.Store.Get("short"); err == nil {
+		t.Error("short is not expired")
+	}
+	if val, err := s.Store.Get("long"); err != nil || val.Exp != now+60000 {
+		t.Errorf("long = %+v, %v, want expiring at %d", val, err, now+60000)
+	}
+	if val, err := s.Store.Get("persisted"); err != nil || val.Exp != 0 {
+		t.Errorf("persisted = %+v, %v, want no expiry", val, err)
+	}
+	if keys := s.Store.Expired(utils.CurrentMillis(), 10); len(keys) != 0 {
+		t.Errorf("Expired() = %v, want deleted", keys)
+	}
+	s.Shutdown()
+
+	// the expiry is recovered from the tx file
+	s = startSyncer(t, conf)
+	defer s.Shutdown()
+	if val, err := s.Store.Get("long"); err != nil || val.Exp != now+60000 {
+		t.Errorf("long after restart = %+v, %v", val, err)
+	}
+}
+
+func TestSyncer_Compression(t *testing.T) {
+	large := []byte(strings.Repeat(`{"id":1,"name":"evolvest"}`, 100))
+	gzipped, _ := compress.Gzip.Encode(large)
+	for _, engine := range []string{EngineMemory, EngineLSM} {
+		conf := &config.Config{
+			DataDir:         t.TempDir(),
+			Engine:          engine,
+			ShutdownTimeout: 5,
+			Compression:     config.CompressionConfig{Codec: "snappy"},
+		}
+		s := startSyncer(t, conf)
+		txId := utils.GenerateId()
+		reqs := []*common.TxRequest{
+			{Flag: common.FlagReq, Action: common.SET, Key: "large", Val: large},
+			{Flag: common.FlagReq, Action: common.SET, Key: "small", Val: []byte("1")},
+			// compressed by a peer with other settings
+			{Flag: common.FlagSync, Action: common.SET, Key: "peer", Val: gzipped, Codec: compress.Gzip},
+		}
+		for _, req := range reqs {
+			txId++
+			req.TxId = txId
+			if err := s.Submit(req); err != nil {
+				t.Fatalf("Submit() error = %v", err)
+			}
+		}
+		for s.LastTxId() != txId {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// flushes the lsm memtable to a table
+		if err := s.Snapshot(); err != nil {
+			t.Fatalf("Snapshot() error = %v", err)
+		}
+		s.Shutdown()
+
+		s = startSyncer(t, conf)
+		tests := []struct {
+			key   string
+			codec compress.Codec
+			want  []byte
+		}{
+			{"large", compress.Snappy, large},
+			{"small", compress.None, []byte("1")},
+			{"peer", compress.Gzip, large},
+		}
+		for _, tt := range tests {
+			val, err := s.Store.Get(tt.key)
+			if err != nil || val.Codec != tt.codec {
+				t.Errorf("%s Get(%s) = %v, %v, want codec %v", engine, tt.key, val.Codec, err, tt.codec)
+				continue
+			}
+			if b, err := val.Value(); err != nil || string(b) != string(tt.want) {
+				t.Errorf("%s Get(%s).Value() = %d bytes, %v", engine, tt.key, len(b), err)
+			}
+		}
+		s.Shutdown()
+	}
+}
+
+// recordSender records the requests sent to peers and forwarded to replicas
+type recordSender struct {
+	Sender
+	mu        sync.Mutex
+	sent      []string
+	forwarded []string
+}
+
+func (r *recordSender) Send(req *common.TxRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, req.Key)
+	return nil
+}
+
+func (r *recordSender) Forward(req *common.TxRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forwarded = append(r.forwarded, req.Key)
+	return nil
+}
+
+func TestSyncer_Flags(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir(), ShutdownTimeout: 5}
+	s := NewSyncer(conf, cluster.NewCluster(conf))
+	sender := &recordSender{Sender: s.sender}
+	s.sender = sender
+	runSyncer(t, s)
+	defer s.Shutdown()
+	for _, req := range []*common.TxRequest{
+		{Flag: common.FlagReq, Action: common.SET, Key: "req", Val: []byte("1")},
+		{Flag: common.FlagSync, Action: common.SET, Key: "sync", Val: []byte("1")},
+		{Flag: common.FlagMigrated, Action: common.DEL, Key: "migrated"},
+	} {
+		req.TxId = utils.GenerateId()
+		if err := s.Submit(req); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	if err := s.WaitApplied(context.Background(), s.Queued()); err != nil {
+		t.Fatal(err)
+	}
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	// the synced ones are not pushed to peers
+	if !reflect.DeepEqual(sender.sent, []string{"req", "migrated"}) || !reflect.DeepEqual(sender.forwarded, []string{"sync"}) {
+		t.Errorf("sent = %v, forwarded = %v, want [req migrated], [sync]", sender.sent, sender.forwarded)
+	}
+}